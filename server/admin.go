@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// promoteConfiguredAdmins grants site-wide admin to the usernames listed in ADMIN_USERS
+func promoteConfiguredAdmins() {
+	raw := getEnv("ADMIN_USERS", "")
+	if raw == "" {
+		return
+	}
+
+	var usernames []string
+	for _, name := range strings.Split(raw, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			usernames = append(usernames, name)
+		}
+	}
+
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, "UPDATE users SET is_admin = TRUE WHERE username = ANY($1) AND NOT is_admin", pq.Array(usernames))
+	if err != nil {
+		slog.Error("Failed to promote configured admins", "error", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		slog.Info("✅ Promoted configured site admins", "count", n)
+	}
+}
+
+func isSiteAdmin(userID int) bool {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	var isAdmin bool
+	err := db.QueryRowContext(ctx, "SELECT is_admin FROM users WHERE id = $1", userID).Scan(&isAdmin)
+	if err != nil {
+		slog.Error("Error checking admin status", "error", err)
+		return false
+	}
+	return isAdmin
+}
+
+// Admin middleware, must run after authMiddleware
+func adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := int(r.Context().Value("user_id").(float64))
+		if !isSiteAdmin(userID) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminUser is a row of the admin user list
+type AdminUser struct {
+	ID           int       `json:"id"`
+	Username     string    `json:"username"`
+	Email        string    `json:"email"`
+	IsAdmin      bool      `json:"is_admin"`
+	IsActive     bool      `json:"is_active"`
+	IsBot        bool      `json:"is_bot"`
+	Shadowbanned bool      `json:"shadowbanned"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// List users, optionally filtered by ?q= against username and email
+func handleAdminListUsers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, username, email, is_admin, is_active, is_bot, is_shadowbanned, created_at
+		FROM users
+		WHERE id != 1
+			AND ($1 = '' OR username ILIKE '%' || $1 || '%' OR email ILIKE '%' || $1 || '%')
+		ORDER BY id ASC
+		LIMIT $2 OFFSET $3
+	`, q, limit, offset)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list users", "error", err)
+		http.Error(w, "Failed to list users", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []AdminUser{}
+	for rows.Next() {
+		var u AdminUser
+		if err := rows.Scan(&u.ID, &u.Username, &u.Email, &u.IsAdmin, &u.IsActive, &u.IsBot, &u.Shadowbanned, &u.CreatedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning user", "error", err)
+			continue
+		}
+		users = append(users, u)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+func setUserActive(w http.ResponseWriter, r *http.Request, active bool) {
+	vars := mux.Vars(r)
+	targetID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if targetID == 1 {
+		http.Error(w, "Cannot change the System account", http.StatusBadRequest)
+		return
+	}
+	if targetID == userID && !active {
+		http.Error(w, "Cannot deactivate your own account", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, "UPDATE users SET is_active = $1 WHERE id = $2", active, targetID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update user status", "error", err)
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "User active status changed by admin", "target_user_id", targetID, "active", active)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Deactivate an account so it can no longer log in or use the API
+func handleAdminDeactivateUser(w http.ResponseWriter, r *http.Request) {
+	setUserActive(w, r, false)
+}
+
+// Reactivate a previously deactivated account
+func handleAdminReactivateUser(w http.ResponseWriter, r *http.Request) {
+	setUserActive(w, r, true)
+}
+
+func setUserShadowbanned(w http.ResponseWriter, r *http.Request, shadowbanned bool) {
+	vars := mux.Vars(r)
+	targetID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if targetID == 1 {
+		http.Error(w, "Cannot change the System account", http.StatusBadRequest)
+		return
+	}
+	if targetID == userID && shadowbanned {
+		http.Error(w, "Cannot shadowban your own account", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, "UPDATE users SET is_shadowbanned = $1 WHERE id = $2", shadowbanned, targetID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update shadowban", "error", err)
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "User shadowban changed by admin", "target_user_id", targetID, "shadowbanned", shadowbanned)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Shadowban a user: their messages are still saved and echoed back to them, but nobody else
+// receives them or sees them in history, and they raise no notifications or webhooks
+func handleAdminShadowbanUser(w http.ResponseWriter, r *http.Request) {
+	setUserShadowbanned(w, r, true)
+}
+
+// Lift a shadowban. Messages sent while it was in place stay hidden.
+func handleAdminUnshadowbanUser(w http.ResponseWriter, r *http.Request) {
+	setUserShadowbanned(w, r, false)
+}
+
+// Delete any room regardless of membership
+func handleAdminDeleteRoom(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, "DELETE FROM rooms WHERE id = $1", roomID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete room", "error", err)
+		http.Error(w, "Failed to delete room", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	roomManager.CloseRoomHub(roomID)
+	memberships.invalidateRoom(roomID)
+	slog.InfoContext(r.Context(), "Room deleted by site admin")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// AdminStats are the server-wide figures for the admin dashboard. Connection counts are for this
+// instance; the rest come from the database.
+type AdminStats struct {
+	Users              int            `json:"users"`
+	ActiveUsers        int            `json:"active_users"` // Accounts not deactivated
+	DailyActiveUsers   int            `json:"daily_active_users"`
+	MonthlyActiveUsers int            `json:"monthly_active_users"`
+	Rooms              int            `json:"rooms"`
+	Messages           int            `json:"messages"`
+	MessagesPerDay     []DailyCount   `json:"messages_per_day"` // The last statsDays days, oldest first
+	BusiestRooms       []RoomActivity `json:"busiest_rooms"`    // By messages over the last 7 days
+	ActiveHubs         int            `json:"active_hubs"`
+	Connections        int            `json:"connections"`
+	OnlineUsers        int            `json:"online_users"`
+	ConnectedSubs      int            `json:"connected_subscriptions"`
+	DroppedSends       int64          `json:"dropped_sends"` // Messages discarded for slow clients
+	SlowClosed         int64          `json:"slow_client_disconnects"`
+}
+
+type DailyCount struct {
+	Date  string `json:"date"` // YYYY-MM-DD
+	Count int    `json:"count"`
+}
+
+type RoomActivity struct {
+	RoomID   int    `json:"room_id"`
+	Name     string `json:"name"`
+	Messages int    `json:"messages"`
+}
+
+const (
+	statsDays         = 30
+	statsBusiestRooms = 10
+)
+
+// Server-wide counters for the admin dashboard
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	var stats AdminStats
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	// A user is active on a day they sent a message, were connected, or are connected now
+	err := readDB().QueryRowContext(ctx, `
+		WITH activity AS (
+			SELECT sender_id AS user_id, MAX(created_at) AS at
+			FROM messages WHERE created_at > NOW() - INTERVAL '30 days' GROUP BY sender_id
+			UNION ALL
+			SELECT id, last_seen_at FROM users WHERE last_seen_at > NOW() - INTERVAL '30 days'
+			UNION ALL
+			SELECT unnest($1::int[]), NOW()
+		)
+		SELECT
+			(SELECT COUNT(*) FROM users WHERE id != 1),
+			(SELECT COUNT(*) FROM users WHERE id != 1 AND is_active),
+			(SELECT COUNT(DISTINCT a.user_id) FROM activity a JOIN users u ON u.id = a.user_id
+			 WHERE a.at > NOW() - INTERVAL '1 day' AND u.id != 1 AND NOT u.is_bot),
+			(SELECT COUNT(DISTINCT a.user_id) FROM activity a JOIN users u ON u.id = a.user_id
+			 WHERE u.id != 1 AND NOT u.is_bot),
+			(SELECT COUNT(*) FROM rooms),
+			(SELECT COUNT(*) FROM messages)
+	`, pq.Array(roomManager.OnlineUsers())).Scan(&stats.Users, &stats.ActiveUsers, &stats.DailyActiveUsers,
+		&stats.MonthlyActiveUsers, &stats.Rooms, &stats.Messages)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get stats", "error", err)
+		http.Error(w, "Failed to get stats", http.StatusInternalServerError)
+		return
+	}
+
+	if stats.MessagesPerDay, err = messagesPerDay(ctx); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get messages per day", "error", err)
+		http.Error(w, "Failed to get stats", http.StatusInternalServerError)
+		return
+	}
+	if stats.BusiestRooms, err = busiestRooms(ctx); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get busiest rooms", "error", err)
+		http.Error(w, "Failed to get stats", http.StatusInternalServerError)
+		return
+	}
+
+	roomManager.mu.RLock()
+	stats.ActiveHubs = len(roomManager.Rooms)
+	stats.Connections = len(roomManager.Clients)
+	stats.OnlineUsers = len(roomManager.Users)
+	for _, hub := range roomManager.Rooms {
+		hub.mu.RLock()
+		stats.ConnectedSubs += len(hub.Clients)
+		hub.mu.RUnlock()
+	}
+	roomManager.mu.RUnlock()
+	stats.DroppedSends = slowClientStats.Dropped.Load()
+	stats.SlowClosed = slowClientStats.Disconnected.Load()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// messagesPerDay counts messages for each of the last statsDays days, by the database's clock,
+// including days without any
+func messagesPerDay(ctx context.Context) ([]DailyCount, error) {
+	rows, err := readDB().QueryContext(ctx, `
+		SELECT to_char(d, 'YYYY-MM-DD'), COUNT(m.id)
+		FROM generate_series(CURRENT_DATE - ($1::int - 1), CURRENT_DATE, INTERVAL '1 day') d
+		LEFT JOIN messages m ON m.created_at >= d AND m.created_at < d + INTERVAL '1 day'
+		GROUP BY d
+		ORDER BY d
+	`, statsDays)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := make([]DailyCount, 0, statsDays)
+	for rows.Next() {
+		var day DailyCount
+		if err := rows.Scan(&day.Date, &day.Count); err != nil {
+			return nil, err
+		}
+		days = append(days, day)
+	}
+	return days, rows.Err()
+}
+
+func busiestRooms(ctx context.Context) ([]RoomActivity, error) {
+	rows, err := readDB().QueryContext(ctx, `
+		SELECT r.id, r.name, COUNT(*)
+		FROM messages m
+		JOIN rooms r ON r.id = m.room_id
+		WHERE m.created_at > NOW() - INTERVAL '7 days'
+		GROUP BY r.id, r.name
+		ORDER BY COUNT(*) DESC, r.id
+		LIMIT $1
+	`, statsBusiestRooms)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := []RoomActivity{}
+	for rows.Next() {
+		var room RoomActivity
+		if err := rows.Scan(&room.RoomID, &room.Name, &room.Messages); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
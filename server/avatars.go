@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Generated avatars stand in for users and rooms without an uploaded image. The same seed always
+// gives the same picture: a symmetric 5x5 identicon, or with ?text= the text's initial on a
+// background in the seed's colour.
+const (
+	defaultGeneratedAvatarSize = 128
+	minGeneratedAvatarSize     = 16
+	maxGeneratedAvatarSize     = 512
+	maxAvatarSeedLength        = 200
+	maxCachedAvatars           = 2048
+)
+
+// generatedAvatarURL is where the avatar for seed is served
+func generatedAvatarURL(seed string) string {
+	return "/api/avatars/" + url.PathEscape(seed) + ".png"
+}
+
+// userAvatarURL is the generated avatar of a user; users can't upload images
+func userAvatarURL(userID int) string {
+	return generatedAvatarURL(fmt.Sprintf("user-%d", userID))
+}
+
+// avatarCache holds rendered PNGs; rendering is cheap but not free, and clients ask for the same
+// few avatars constantly. It is emptied when full rather than tracking use.
+var avatarCache = struct {
+	mu     sync.Mutex
+	images map[string][]byte
+}{images: make(map[string][]byte)}
+
+var (
+	avatarFontOnce sync.Once
+	avatarFont     *opentype.Font
+)
+
+// Render a generated avatar (public, so it works in <img> tags). ?size= is the width and height
+// in pixels, 128 by default.
+func handleGetGeneratedAvatar(w http.ResponseWriter, r *http.Request) {
+	seed := mux.Vars(r)["seed"]
+	if seed == "" || len(seed) > maxAvatarSeedLength {
+		http.Error(w, "Invalid seed", http.StatusBadRequest)
+		return
+	}
+
+	size := defaultGeneratedAvatarSize
+	if v := r.URL.Query().Get("size"); v != "" {
+		var err error
+		size, err = strconv.Atoi(v)
+		if err != nil || size < minGeneratedAvatarSize || size > maxGeneratedAvatarSize {
+			http.Error(w, "size must be between 16 and 512", http.StatusBadRequest)
+			return
+		}
+	}
+
+	initial := ""
+	if text := sanitizeLine(r.URL.Query().Get("text")); text != "" {
+		initial = avatarInitial(text)
+	}
+
+	key := fmt.Sprintf("%d\x00%s\x00%s", size, initial, seed)
+	sum := sha256.Sum256([]byte(key))
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("Cache-Control", "public, max-age=604800")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	avatarCache.mu.Lock()
+	data, ok := avatarCache.images[key]
+	avatarCache.mu.Unlock()
+	if !ok {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, renderAvatar(seed, initial, size)); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to encode avatar", "error", err)
+			http.Error(w, "Failed to render avatar", http.StatusInternalServerError)
+			return
+		}
+		data = buf.Bytes()
+
+		avatarCache.mu.Lock()
+		if len(avatarCache.images) >= maxCachedAvatars {
+			clear(avatarCache.images)
+		}
+		avatarCache.images[key] = data
+		avatarCache.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// renderAvatar draws the initial when the font has it, and the identicon otherwise
+func renderAvatar(seed, initial string, size int) image.Image {
+	hash := sha256.Sum256([]byte(seed))
+	fg := avatarColor(hash)
+	if initial != "" {
+		if img := renderInitialAvatar(initial, fg, size); img != nil {
+			return img
+		}
+	}
+	return renderIdenticon(hash, fg, size)
+}
+
+// avatarColor picks a mid-tone colour from the hash, so white text and a light background both
+// stand out against it
+func avatarColor(hash [32]byte) color.RGBA {
+	hue := float64(uint16(hash[0])<<8|uint16(hash[1])) / 65536 * 360
+	return hslToRGB(hue, 0.55, 0.5)
+}
+
+func hslToRGB(h, s, l float64) color.RGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return color.RGBA{uint8((r + m) * 255), uint8((g + m) * 255), uint8((b + m) * 255), 255}
+}
+
+// renderIdenticon fills a 5x5 grid mirrored around its middle column, one hash bit per cell
+func renderIdenticon(hash [32]byte, fg color.RGBA, size int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{240, 240, 240, 255}}, image.Point{}, draw.Src)
+
+	const cells = 5
+	padding := size / 10
+	cell := (size - 2*padding) / cells
+	offset := (size - cell*cells) / 2
+	for row := 0; row < cells; row++ {
+		for col := 0; col < (cells+1)/2; col++ {
+			bit := row*3 + col
+			if hash[2+bit/8]>>(bit%8)&1 == 0 {
+				continue
+			}
+			for _, c := range []int{col, cells - 1 - col} {
+				rect := image.Rect(offset+c*cell, offset+row*cell, offset+(c+1)*cell, offset+(row+1)*cell)
+				draw.Draw(img, rect, &image.Uniform{fg}, image.Point{}, draw.Src)
+			}
+		}
+	}
+	return img
+}
+
+// renderInitialAvatar centres the initial in white on bg, or returns nil if the font lacks it
+func renderInitialAvatar(initial string, bg color.RGBA, size int) image.Image {
+	avatarFontOnce.Do(func() {
+		f, err := opentype.Parse(goregular.TTF)
+		if err != nil {
+			slog.Error("Failed to parse avatar font", "error", err)
+			return
+		}
+		avatarFont = f
+	})
+	if avatarFont == nil {
+		return nil
+	}
+
+	face, err := opentype.NewFace(avatarFont, &opentype.FaceOptions{Size: float64(size) / 2, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil
+	}
+	defer face.Close()
+	for _, r := range initial {
+		if _, ok := face.GlyphAdvance(r); !ok {
+			return nil
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{bg}, image.Point{}, draw.Src)
+
+	d := &font.Drawer{Dst: img, Src: image.White, Face: face}
+	bounds, _ := d.BoundString(initial)
+	width := bounds.Max.X - bounds.Min.X
+	height := bounds.Max.Y - bounds.Min.Y
+	center := fixed.I(size / 2)
+	d.Dot = fixed.Point26_6{
+		X: center - width/2 - bounds.Min.X,
+		Y: center - height/2 - bounds.Min.Y,
+	}
+	d.DrawString(initial)
+	return img
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RoomBan keeps a user out of a room until an admin lifts it
+type RoomBan struct {
+	UserID       int       `json:"user_id"`
+	Username     string    `json:"username"`
+	BannedBy     int       `json:"banned_by"`
+	BannedByName string    `json:"banned_by_name"`
+	Reason       string    `json:"reason"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func isUserBanned(userID, roomID int) bool {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	var banned bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM room_bans WHERE room_id = $1 AND user_id = $2)", roomID, userID).Scan(&banned)
+	if err != nil {
+		slog.Error("DB error checking ban", "user_id", userID, "room_id", roomID, "error", err)
+		return false
+	}
+	return banned
+}
+
+// Ban a user from a room, removing their membership and any pending invite or join request (admin only)
+func handleBanUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		UserID int    `json:"user_id"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.Reason = sanitizeLine(req.Reason)
+	if len(req.Reason) > 500 {
+		http.Error(w, "Reason must be at most 500 characters", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermBanMembers, "Only admins can ban users"); !ok {
+		return
+	}
+
+	if req.UserID <= 1 || req.UserID == userID {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var bannedName string
+	if err := db.QueryRowContext(ctx, "SELECT username FROM users WHERE id = $1", req.UserID).Scan(&bannedName); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var ban RoomBan
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO room_bans (room_id, user_id, banned_by, reason) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (room_id, user_id) DO UPDATE SET banned_by = EXCLUDED.banned_by, reason = EXCLUDED.reason
+		RETURNING user_id, banned_by, reason, created_at
+	`, roomID, req.UserID, userID, req.Reason).Scan(&ban.UserID, &ban.BannedBy, &ban.Reason, &ban.CreatedAt)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to ban user", "error", err)
+		http.Error(w, "Failed to ban user", http.StatusInternalServerError)
+		return
+	}
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM room_members WHERE room_id = $1 AND user_id = $2", roomID, req.UserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to remove banned member", "error", err)
+		http.Error(w, "Failed to ban user", http.StatusInternalServerError)
+		return
+	}
+	wasMember, _ := result.RowsAffected()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM room_invites WHERE room_id = $1 AND invitee_id = $2 AND status = 'pending'", roomID, req.UserID); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to cancel invite for banned user", "error", err)
+		http.Error(w, "Failed to ban user", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM room_join_requests WHERE room_id = $1 AND user_id = $2 AND status = 'pending'", roomID, req.UserID); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to cancel join request for banned user", "error", err)
+		http.Error(w, "Failed to ban user", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Server error during commit", http.StatusInternalServerError)
+		return
+	}
+	memberships.invalidate(roomID, req.UserID)
+
+	if wasMember > 0 {
+		announceMemberGone(roomID, "memberRemoved", &MemberEvent{UserID: req.UserID, Username: bannedName, RemovedBy: userID},
+			newSystemEvent(EventMemberBanned, userID, req.UserID, "actor", username, "target", bannedName))
+	}
+
+	slog.InfoContext(r.Context(), "User banned from room", "banned_user_id", req.UserID)
+
+	ban.Username = bannedName
+	ban.BannedByName = username
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ban)
+}
+
+// Lift a ban so the user can join again (admin only)
+func handleUnbanUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	bannedID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermBanMembers, "Only admins can unban users"); !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, "DELETE FROM room_bans WHERE room_id = $1 AND user_id = $2", roomID, bannedID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to unban user", "error", err)
+		http.Error(w, "Failed to unban user", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		http.Error(w, "User is not banned from this room", http.StatusNotFound)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "User unbanned from room", "banned_user_id", bannedID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// List a room's bans (admin only)
+func handleGetRoomBans(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermBanMembers, "Only admins can view bans"); !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT b.user_id, u.username, COALESCE(b.banned_by, 0), COALESCE(bu.username, ''), b.reason, b.created_at
+		FROM room_bans b
+		JOIN users u ON u.id = b.user_id
+		LEFT JOIN users bu ON bu.id = b.banned_by
+		WHERE b.room_id = $1
+		ORDER BY b.created_at DESC
+	`, roomID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get room bans", "error", err)
+		http.Error(w, "Failed to get room bans", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	bans := []RoomBan{}
+	for rows.Next() {
+		var b RoomBan
+		if err := rows.Scan(&b.UserID, &b.Username, &b.BannedBy, &b.BannedByName, &b.Reason, &b.CreatedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning ban", "error", err)
+			continue
+		}
+		bans = append(bans, b)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bans)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const apiKeyPrefix = "chb_"
+
+// generateAPIKey returns a new random API key. Only its hash is ever stored.
+func generateAPIKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + hex.EncodeToString(buf), nil
+}
+
+func hashAPIKey(key string) string {
+	return hashPassword(key)
+}
+
+// lookupAPIKey resolves an API key to the bot user that owns it
+func lookupAPIKey(key string) (int, string, error) {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	var userID int
+	var username string
+	err := db.QueryRowContext(ctx, `
+		UPDATE api_keys ak SET last_used_at = CURRENT_TIMESTAMP
+		FROM users u
+		WHERE ak.user_id = u.id AND ak.key_hash = $1 AND u.is_active
+		RETURNING u.id, u.username
+	`, hashAPIKey(key)).Scan(&userID, &username)
+	return userID, username, err
+}
+
+// Create a bot user and issue its API key
+func handleCreateBot(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.Name = sanitizeLine(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Bot name is required", http.StatusBadRequest)
+		return
+	}
+	// The name is its account's username, so it follows the same rules as people's
+	if reason := usernames.check(req.Name); reason != "" {
+		http.Error(w, reason, http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	apiKey, err := generateAPIKey()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to generate API key", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Bots never log in with a password, so the hash is a placeholder like the System account
+	var botID int
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO users (username, email, password_hash, is_bot) VALUES ($1, $2, $3, TRUE) RETURNING id",
+		req.Name, fmt.Sprintf("%s@bots.chathub.io", req.Name), "BOT_ACCOUNT_HASH",
+	).Scan(&botID)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			http.Error(w, "Username already taken", http.StatusConflict)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to create bot user", "error", err)
+		http.Error(w, "Failed to create bot", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO api_keys (user_id, key_hash, created_by) VALUES ($1, $2, $3)",
+		botID, hashAPIKey(apiKey), userID,
+	)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to store API key", "error", err)
+		http.Error(w, "Failed to create bot", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Server error during commit", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Bot created", "bot_name", req.Name, "bot_id", botID)
+
+	// The plain key is only returned once; it cannot be recovered later
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":       botID,
+		"username": req.Name,
+		"api_key":  apiKey,
+	})
+}
+
+// Post a message to a room over REST, used by bots and other integrations
+func handlePostRoomMessage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Content       string `json:"content"`
+		AttachmentIDs []int  `json:"attachment_ids"`
+		ReplyToID     int    `json:"reply_to_id"`
+		GIFID         string `json:"gif_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	idempotencyKey, ok := requestIdempotencyKey(w, r)
+	if !ok {
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	savedMsg, err := postUserMessage(&OutgoingMessage{
+		RoomID:         roomID,
+		SenderID:       userID,
+		Sender:         username,
+		Content:        req.Content,
+		AttachmentIDs:  req.AttachmentIDs,
+		ReplyToID:      req.ReplyToID,
+		GIFID:          req.GIFID,
+		IdempotencyKey: idempotencyKey,
+	})
+	var verr *ValidationError
+	if errors.Is(err, errNotRoomMember) {
+		http.Error(w, "Not authorized", http.StatusForbidden)
+		return
+	} else if errors.As(err, &verr) {
+		http.Error(w, verr.Message, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save message", "error", err)
+		http.Error(w, "Failed to send message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if savedMsg.replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(savedMsg)
+}
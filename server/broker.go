@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+)
+
+// Broker fans room broadcasts out to every server instance. Each RoomHub publishes what it is
+// given and delivers what its subscription receives, including its own messages, so clients
+// connected to different instances see the same stream.
+type Broker interface {
+	Publish(roomID int, msg *WSMessage) error
+	// Subscribe calls handler for each message published to the room until unsubscribe is called
+	Subscribe(roomID int, handler func(*WSMessage)) (unsubscribe func(), err error)
+	// Ping reports whether the broker is reachable, for the readiness probe
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+var broker Broker = newMemoryBroker()
+
+// initBroker selects the backend from BROKER ("memory", "redis" or "nats")
+func initBroker() error {
+	switch driver := getEnv("BROKER", "memory"); driver {
+	case "memory":
+		broker = newMemoryBroker()
+	case "redis":
+		b, err := newRedisBroker(getEnv("REDIS_URL", "redis://localhost:6379/0"))
+		if err != nil {
+			return err
+		}
+		broker = b
+	case "nats":
+		b, err := newNATSBroker(getEnv("NATS_URL", nats.DefaultURL))
+		if err != nil {
+			return err
+		}
+		broker = b
+	default:
+		return fmt.Errorf("unknown BROKER %q", driver)
+	}
+	return nil
+}
+
+func encodeBrokerMessage(msg *WSMessage) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func decodeBrokerMessage(data []byte) (*WSMessage, error) {
+	var msg WSMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	// room_id is shared by the envelope and the embedded message; JSON only fills the envelope's
+	if msg.Message != nil {
+		msg.Message.RoomID = msg.RoomID
+	}
+	return &msg, nil
+}
+
+// --- In Memory ---
+
+// memoryBroker delivers within the process, for single-instance deployments
+type memoryBroker struct {
+	mu     sync.RWMutex
+	nextID int
+	subs   map[int]map[int]func(*WSMessage) // roomID -> subscription ID -> handler
+}
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{subs: make(map[int]map[int]func(*WSMessage))}
+}
+
+func (b *memoryBroker) Publish(roomID int, msg *WSMessage) error {
+	b.mu.RLock()
+	handlers := make([]func(*WSMessage), 0, len(b.subs[roomID]))
+	for _, handler := range b.subs[roomID] {
+		handlers = append(handlers, handler)
+	}
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(msg)
+	}
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(roomID int, handler func(*WSMessage)) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	id := b.nextID
+	if b.subs[roomID] == nil {
+		b.subs[roomID] = make(map[int]func(*WSMessage))
+	}
+	b.subs[roomID][id] = handler
+
+	return func() {
+		b.mu.Lock()
+		delete(b.subs[roomID], id)
+		if len(b.subs[roomID]) == 0 {
+			delete(b.subs, roomID)
+		}
+		b.mu.Unlock()
+	}, nil
+}
+
+func (b *memoryBroker) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (b *memoryBroker) Close() error {
+	return nil
+}
+
+// --- Redis ---
+
+type redisBroker struct {
+	client *redis.Client
+}
+
+func newRedisBroker(url string) (*redisBroker, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parse REDIS_URL: %w", err)
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, fmt.Errorf("connect to redis: %w", err)
+	}
+	return &redisBroker{client: client}, nil
+}
+
+func redisRoomChannel(roomID int) string {
+	return "chathub:room:" + strconv.Itoa(roomID)
+}
+
+func (b *redisBroker) Publish(roomID int, msg *WSMessage) error {
+	data, err := encodeBrokerMessage(msg)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(context.Background(), redisRoomChannel(roomID), data).Err()
+}
+
+func (b *redisBroker) Subscribe(roomID int, handler func(*WSMessage)) (func(), error) {
+	ctx := context.Background()
+	pubsub := b.client.Subscribe(ctx, redisRoomChannel(roomID))
+	// Wait for the confirmation so nothing published right after Subscribe returns is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	go func() {
+		for m := range pubsub.Channel() {
+			msg, err := decodeBrokerMessage([]byte(m.Payload))
+			if err != nil {
+				slog.Error("Failed to decode broker message", "room_id", roomID, "error", err)
+				continue
+			}
+			handler(msg)
+		}
+	}()
+
+	return func() { pubsub.Close() }, nil
+}
+
+func (b *redisBroker) Ping(ctx context.Context) error {
+	return b.client.Ping(ctx).Err()
+}
+
+func (b *redisBroker) Close() error {
+	return b.client.Close()
+}
+
+// --- NATS ---
+
+type natsBroker struct {
+	conn *nats.Conn
+}
+
+func newNATSBroker(url string) (*natsBroker, error) {
+	conn, err := nats.Connect(url, nats.Name("chathub"))
+	if err != nil {
+		return nil, fmt.Errorf("connect to nats: %w", err)
+	}
+	return &natsBroker{conn: conn}, nil
+}
+
+func natsRoomSubject(roomID int) string {
+	return "chathub.room." + strconv.Itoa(roomID)
+}
+
+func (b *natsBroker) Publish(roomID int, msg *WSMessage) error {
+	data, err := encodeBrokerMessage(msg)
+	if err != nil {
+		return err
+	}
+	return b.conn.Publish(natsRoomSubject(roomID), data)
+}
+
+func (b *natsBroker) Subscribe(roomID int, handler func(*WSMessage)) (func(), error) {
+	sub, err := b.conn.Subscribe(natsRoomSubject(roomID), func(m *nats.Msg) {
+		msg, err := decodeBrokerMessage(m.Data)
+		if err != nil {
+			slog.Error("Failed to decode broker message", "room_id", roomID, "error", err)
+			return
+		}
+		handler(msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() { sub.Unsubscribe() }, nil
+}
+
+func (b *natsBroker) Ping(ctx context.Context) error {
+	if status := b.conn.Status(); status != nats.CONNECTED {
+		return fmt.Errorf("nats connection is %s", status)
+	}
+	return nil
+}
+
+func (b *natsBroker) Close() error {
+	b.conn.Drain()
+	return nil
+}
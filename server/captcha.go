@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// captchaVerifier checks the token a CAPTCHA widget gave the client
+type captchaVerifier interface {
+	Name() string
+	SiteKey() string
+	Verify(ctx context.Context, token, remoteIP string) (bool, error)
+}
+
+// captcha is set by initCaptcha when CAPTCHA_PROVIDER is configured; registration then requires
+// a captcha_token
+var captcha captchaVerifier
+
+var captchaClient = &http.Client{Timeout: 5 * time.Second}
+
+// Endpoints of the providers' siteverify APIs, which all take the same form and answer alike
+var captchaVerifyURLs = map[string]string{
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+	"recaptcha": "https://www.google.com/recaptcha/api/siteverify",
+	"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+// initCaptcha selects the provider from CAPTCHA_PROVIDER ("hcaptcha", "recaptcha" or "turnstile"),
+// with CAPTCHA_SECRET for verifying and CAPTCHA_SITE_KEY for the widget. RECAPTCHA_MIN_SCORE (0.5)
+// is the lowest reCAPTCHA v3 score accepted.
+func initCaptcha() error {
+	provider := getEnv("CAPTCHA_PROVIDER", "")
+	if provider == "" {
+		return nil
+	}
+	verifyURL, ok := captchaVerifyURLs[provider]
+	if !ok {
+		return fmt.Errorf("unknown CAPTCHA_PROVIDER %q", provider)
+	}
+	secret := getEnv("CAPTCHA_SECRET", "")
+	if secret == "" {
+		return errors.New("CAPTCHA_SECRET is required")
+	}
+	v := &siteVerifier{name: provider, url: verifyURL, secret: secret, siteKey: getEnv("CAPTCHA_SITE_KEY", "")}
+	if provider == "recaptcha" {
+		score, err := strconv.ParseFloat(getEnv("RECAPTCHA_MIN_SCORE", "0.5"), 64)
+		if err != nil {
+			return fmt.Errorf("invalid RECAPTCHA_MIN_SCORE: %w", err)
+		}
+		v.minScore = score
+	}
+	captcha = v
+	return nil
+}
+
+// siteVerifier verifies tokens with a siteverify API
+type siteVerifier struct {
+	name     string
+	url      string
+	secret   string
+	siteKey  string
+	minScore float64 // reCAPTCHA v3 only; v2 and the other providers send no score
+}
+
+func (v *siteVerifier) Name() string    { return v.name }
+func (v *siteVerifier) SiteKey() string { return v.siteKey }
+
+func (v *siteVerifier) Verify(ctx context.Context, token, remoteIP string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	form := url.Values{"secret": {v.secret}, "response": {token}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := captchaClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s returned %s", v.name, resp.Status)
+	}
+
+	var result struct {
+		Success bool     `json:"success"`
+		Score   *float64 `json:"score"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	if result.Score != nil && *result.Score < v.minScore {
+		return false, nil
+	}
+	return result.Success, nil
+}
+
+// Get what the registration form needs to render the CAPTCHA widget
+func handleGetCaptchaConfig(w http.ResponseWriter, r *http.Request) {
+	if captcha == nil {
+		http.Error(w, "CAPTCHA is not configured", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"provider": captcha.Name(), "site_key": captcha.SiteKey()})
+}
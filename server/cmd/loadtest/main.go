@@ -0,0 +1,320 @@
+// Command loadtest simulates many clients chatting in many rooms against a running server and
+// reports broadcast latency and how many deliveries were dropped, for comparing hub designs.
+//
+//	go run ./cmd/loadtest -url http://localhost:8080 -clients 500 -rooms 50 -rate 0.5 -duration 1m
+//
+// Every client registers its own account, joins one of the rooms and sends at the given rate.
+// Latency is measured from a client sending a message to each other member receiving it. The
+// server limits each connection to WS_MESSAGE_RATE messages per second, so raise it on the
+// server for rates above that; rejected sends are reported separately from drops.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	baseURL  = flag.String("url", "http://localhost:8080", "Server address")
+	clients  = flag.Int("clients", 100, "Concurrent clients")
+	rooms    = flag.Int("rooms", 10, "Rooms the clients are spread over")
+	rate     = flag.Float64("rate", 1, "Messages per second each client sends")
+	duration = flag.Duration("duration", 30*time.Second, "How long clients send for")
+	drain    = flag.Duration("drain", 5*time.Second, "How long to wait for deliveries after sending stops")
+	setup    = flag.Int("setup-concurrency", 20, "Clients registered and connected at once")
+)
+
+// frame is the part of the server's WebSocket envelope the load test uses
+type frame struct {
+	Type        string `json:"type"`
+	RoomID      int    `json:"room_id,omitempty"`
+	Content     string `json:"content,omitempty"`
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	Message     *struct {
+		SenderID int    `json:"sender_id"`
+		Text     string `json:"text"`
+	} `json:"message,omitempty"`
+}
+
+type client struct {
+	index  int
+	userID int
+	token  string
+	roomID int
+	conn   *websocket.Conn
+	writes sync.Mutex
+}
+
+// stats collects what every client saw; messages are keyed by their client_msg_id
+type stats struct {
+	mu        sync.Mutex
+	sent      map[string]time.Time
+	roomOf    map[string]int
+	received  map[string]int
+	latencies []time.Duration
+
+	rejected     atomic.Int64
+	disconnected atomic.Int64
+}
+
+const messagePrefix = "loadtest "
+
+func main() {
+	flag.Parse()
+	log.SetFlags(0)
+	if *clients < *rooms || *rooms < 1 {
+		log.Fatal("Need at least one room and as many clients as rooms")
+	}
+
+	run := time.Now().UnixNano() % 1e9
+	all := make([]*client, *clients)
+	for i := range all {
+		all[i] = &client{index: i}
+	}
+
+	log.Printf("Registering %d clients", *clients)
+	if err := forEach(all, func(c *client) error { return c.register(run) }); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Creating %d rooms", *rooms)
+	roomIDs := make([]int, *rooms)
+	for j := range roomIDs {
+		id, err := all[j].createRoom(fmt.Sprintf("loadtest-%d-%d", run, j))
+		if err != nil {
+			log.Fatal(err)
+		}
+		roomIDs[j] = id
+	}
+	members := make(map[int]int)
+	if err := forEach(all, func(c *client) error {
+		c.roomID = roomIDs[c.index%*rooms]
+		if c.index < *rooms {
+			return nil // Created it
+		}
+		return c.join()
+	}); err != nil {
+		log.Fatal(err)
+	}
+	for _, c := range all {
+		members[c.roomID]++
+	}
+
+	s := &stats{
+		sent:     make(map[string]time.Time),
+		roomOf:   make(map[string]int),
+		received: make(map[string]int),
+	}
+	log.Printf("Connecting %d clients", *clients)
+	if err := forEach(all, func(c *client) error { return c.connect(s) }); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Sending for %s", *duration)
+	var wg sync.WaitGroup
+	stop := time.Now().Add(*duration)
+	for _, c := range all {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.sendUntil(stop, s)
+		}()
+	}
+	wg.Wait()
+	time.Sleep(*drain)
+	for _, c := range all {
+		c.conn.Close()
+	}
+
+	s.report(os.Stdout, members)
+}
+
+// forEach runs fn for every client, -setup-concurrency at a time, stopping at the first error
+func forEach(all []*client, fn func(*client) error) error {
+	sem := make(chan struct{}, *setup)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var first error
+	for _, c := range all {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			if err := fn(c); err != nil {
+				once.Do(func() { first = err })
+			}
+		}()
+	}
+	wg.Wait()
+	return first
+}
+
+func (c *client) do(method, path string, body, out any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, *baseURL+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: status %d", method, path, resp.StatusCode)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+func (c *client) register(run int64) error {
+	name := fmt.Sprintf("lt%d-%d", run, c.index)
+	var resp struct {
+		Token  string `json:"token"`
+		UserID int    `json:"user_id"`
+	}
+	err := c.do("POST", "/api/register", map[string]string{
+		"username": name, "email": name + "@loadtest.invalid", "password": "loadtest",
+	}, &resp)
+	c.token, c.userID = resp.Token, resp.UserID
+	return err
+}
+
+func (c *client) createRoom(name string) (int, error) {
+	var room struct {
+		ID int `json:"id"`
+	}
+	err := c.do("POST", "/api/rooms", map[string]any{"name": name}, &room)
+	return room.ID, err
+}
+
+func (c *client) join() error {
+	return c.do("POST", fmt.Sprintf("/api/rooms/%d/join", c.roomID), nil, nil)
+}
+
+func (c *client) connect(s *stats) error {
+	wsURL := strings.Replace(*baseURL, "http", "ws", 1) + "/ws?token=" + url.QueryEscape(c.token)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		return fmt.Errorf("client %d: %w", c.index, err)
+	}
+	c.conn = conn
+	if err := c.write(frame{Type: "joinRoom", RoomID: c.roomID}); err != nil {
+		return err
+	}
+	go c.read(s)
+	return nil
+}
+
+func (c *client) write(f frame) error {
+	c.writes.Lock()
+	defer c.writes.Unlock()
+	return c.conn.WriteJSON(f)
+}
+
+func (c *client) read(s *stats) {
+	for {
+		var f frame
+		if err := c.conn.ReadJSON(&f); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) && !strings.Contains(err.Error(), "use of closed") {
+				s.disconnected.Add(1)
+			}
+			return
+		}
+		now := time.Now()
+		switch {
+		case f.Type == "roomMessage" && f.Message != nil && f.Message.SenderID != c.userID:
+			key, ok := strings.CutPrefix(f.Message.Text, messagePrefix)
+			if !ok {
+				continue
+			}
+			s.mu.Lock()
+			if sentAt, ok := s.sent[key]; ok {
+				s.received[key]++
+				s.latencies = append(s.latencies, now.Sub(sentAt))
+			}
+			s.mu.Unlock()
+		case f.Type == "error" && f.ClientMsgID != "":
+			// Rate limited or refused: not a drop, since it was never broadcast
+			s.mu.Lock()
+			delete(s.sent, f.ClientMsgID)
+			s.mu.Unlock()
+			s.rejected.Add(1)
+		}
+	}
+}
+
+func (c *client) sendUntil(stop time.Time, s *stats) {
+	interval := time.Duration(float64(time.Second) / *rate)
+	// Stagger the clients so they don't all send on the same tick
+	time.Sleep(time.Duration(c.index) * interval / time.Duration(*clients))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for seq := 0; time.Now().Before(stop); seq++ {
+		key := fmt.Sprintf("c%d-%d", c.index, seq)
+		s.mu.Lock()
+		s.sent[key] = time.Now()
+		s.roomOf[key] = c.roomID
+		s.mu.Unlock()
+		if err := c.write(frame{Type: "sendMessage", RoomID: c.roomID, Content: messagePrefix + key, ClientMsgID: key}); err != nil {
+			s.mu.Lock()
+			delete(s.sent, key)
+			s.mu.Unlock()
+			return
+		}
+		<-ticker.C
+	}
+}
+
+func (s *stats) report(w *os.File, members map[int]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expected, delivered int
+	for key := range s.sent {
+		expected += members[s.roomOf[key]] - 1 // Everyone but the sender
+		delivered += s.received[key]
+	}
+	dropped := expected - delivered
+	dropRate := 0.0
+	if expected > 0 {
+		dropRate = float64(dropped) / float64(expected) * 100
+	}
+
+	fmt.Fprintf(w, "\n%d clients in %d rooms, %.2f msg/s each for %s\n", *clients, *rooms, *rate, *duration)
+	fmt.Fprintf(w, "messages:    %d sent, %d rejected by the server\n", len(s.sent), s.rejected.Load())
+	fmt.Fprintf(w, "deliveries:  %d of %d, %d dropped (%.2f%%)\n", delivered, expected, dropped, dropRate)
+	fmt.Fprintf(w, "disconnects: %d\n", s.disconnected.Load())
+	if len(s.latencies) == 0 {
+		return
+	}
+	slices.Sort(s.latencies)
+	pct := func(p float64) time.Duration {
+		return s.latencies[min(len(s.latencies)-1, int(p*float64(len(s.latencies))))]
+	}
+	fmt.Fprintf(w, "latency:     p50 %s, p90 %s, p99 %s, max %s\n",
+		pct(0.50).Round(time.Microsecond), pct(0.90).Round(time.Microsecond),
+		pct(0.99).Round(time.Microsecond), s.latencies[len(s.latencies)-1].Round(time.Microsecond))
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ContactRequest is a friend request between two users, stored in contacts
+type ContactRequest struct {
+	ID        int       `json:"id"`
+	FromID    int       `json:"from_id"`
+	FromName  string    `json:"from_name"`
+	ToID      int       `json:"to_id"`
+	ToName    string    `json:"to_name"`
+	Status    string    `json:"status"` // "pending", "accepted" or "declined"
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Contact is an accepted friend, with the direct message room if there is one
+type Contact struct {
+	UserID       int        `json:"user_id"`
+	Username     string     `json:"username"`
+	Avatar       string     `json:"avatar"`
+	AvatarURL    string     `json:"avatarUrl"`
+	Online       bool       `json:"online"`
+	Status       UserStatus `json:"status"`
+	DirectRoomID int        `json:"direct_room_id,omitempty"`
+	Since        time.Time  `json:"since"`
+}
+
+// Send a friend request by user_id or username. If the other user already asked, this accepts it.
+func handleSendContactRequest(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID   int    `json:"user_id"`
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var target ContactRequest
+	err := db.QueryRowContext(ctx, `
+		SELECT id, username FROM users
+		WHERE (id = $1 OR ($1 = 0 AND username = $2)) AND is_active AND NOT is_bot AND id != 1
+	`, req.UserID, sanitizeLine(req.Username)).Scan(&target.ToID, &target.ToName)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "DB error finding contact", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if target.ToID == userID {
+		http.Error(w, "You can't add yourself as a contact", http.StatusBadRequest)
+		return
+	}
+
+	var existing ContactRequest
+	err = db.QueryRowContext(ctx, `
+		SELECT id, requester_id, status FROM contacts
+		WHERE (requester_id = $1 AND addressee_id = $2) OR (requester_id = $2 AND addressee_id = $1)
+	`, userID, target.ToID).Scan(&existing.ID, &existing.FromID, &existing.Status)
+	if err != nil && err != sql.ErrNoRows {
+		slog.ErrorContext(r.Context(), "DB error checking contact", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case err == nil && existing.Status == "accepted":
+		http.Error(w, "Already in your contacts", http.StatusConflict)
+		return
+	case err == nil && existing.Status == "pending" && existing.FromID == userID:
+		http.Error(w, "Request already sent", http.StatusConflict)
+		return
+	case err == nil && existing.Status == "pending":
+		// They asked first
+		acceptContactRequest(w, r, existing.ID, userID)
+		return
+	}
+
+	// A declined request can be sent again, by either side
+	contact := ContactRequest{FromID: userID, FromName: username, ToID: target.ToID, ToName: target.ToName, Status: "pending"}
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO contacts (requester_id, addressee_id) VALUES ($1, $2)
+		ON CONFLICT (LEAST(requester_id, addressee_id), GREATEST(requester_id, addressee_id)) DO UPDATE
+		SET requester_id = EXCLUDED.requester_id, addressee_id = EXCLUDED.addressee_id, status = 'pending',
+		    created_at = CURRENT_TIMESTAMP, responded_at = NULL
+		RETURNING id, created_at
+	`, userID, target.ToID).Scan(&contact.ID, &contact.CreatedAt)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create contact request", "error", err)
+		http.Error(w, "Failed to send request", http.StatusInternalServerError)
+		return
+	}
+
+	roomManager.SendToUser(target.ToID, &WSMessage{Type: "contactRequestCreated", ContactRequest: &contact})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(contact)
+}
+
+// List the user's pending friend requests, received and sent
+func handleGetContactRequests(w http.ResponseWriter, r *http.Request) {
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.id, c.requester_id, f.username, c.addressee_id, t.username, c.status, c.created_at
+		FROM contacts c
+		JOIN users f ON f.id = c.requester_id
+		JOIN users t ON t.id = c.addressee_id
+		WHERE (c.requester_id = $1 OR c.addressee_id = $1) AND c.status = 'pending'
+		ORDER BY c.created_at DESC
+	`, userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get contact requests", "error", err)
+		http.Error(w, "Failed to get requests", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	requests := struct {
+		Incoming []ContactRequest `json:"incoming"`
+		Outgoing []ContactRequest `json:"outgoing"`
+	}{Incoming: []ContactRequest{}, Outgoing: []ContactRequest{}}
+	for rows.Next() {
+		var c ContactRequest
+		if err := rows.Scan(&c.ID, &c.FromID, &c.FromName, &c.ToID, &c.ToName, &c.Status, &c.CreatedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning contact request", "error", err)
+			continue
+		}
+		if c.ToID == userID {
+			requests.Incoming = append(requests.Incoming, c)
+		} else {
+			requests.Outgoing = append(requests.Outgoing, c)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
+
+// Accept a friend request sent to the current user
+func handleAcceptContactRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	requestID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid request ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	acceptContactRequest(w, r, requestID, userID)
+}
+
+// acceptContactRequest accepts a pending request addressed to userID, tells the requester, and
+// writes the new contact as the response
+func acceptContactRequest(w http.ResponseWriter, r *http.Request, requestID, userID int) {
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var c ContactRequest
+	var since time.Time
+	err := db.QueryRowContext(ctx, `
+		UPDATE contacts SET status = 'accepted', responded_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND addressee_id = $2 AND status = 'pending'
+		RETURNING id, requester_id, addressee_id, created_at, responded_at
+	`, requestID, userID).Scan(&c.ID, &c.FromID, &c.ToID, &c.CreatedAt, &since)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Request not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to accept contact request", "error", err)
+		http.Error(w, "Failed to accept request", http.StatusInternalServerError)
+		return
+	}
+	c.Status = "accepted"
+
+	err = db.QueryRowContext(ctx, "SELECT (SELECT username FROM users WHERE id = $1), (SELECT username FROM users WHERE id = $2)",
+		c.FromID, c.ToID).Scan(&c.FromName, &c.ToName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load contact names", "error", err)
+	}
+	roomManager.SendToUser(c.FromID, &WSMessage{Type: "contactRequestAccepted", ContactRequest: &c})
+
+	contact := Contact{UserID: c.FromID, Username: c.FromName, Online: roomManager.IsOnline(c.FromID), Since: since}
+	if contact.Username != "" {
+		contact.Avatar = avatarInitial(contact.Username)
+	}
+	contact.AvatarURL = userAvatarURL(contact.UserID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(contact)
+}
+
+// Decline a friend request sent to the current user. The requester isn't told.
+func handleDeclineContactRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	requestID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid request ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `
+		UPDATE contacts SET status = 'declined', responded_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND addressee_id = $2 AND status = 'pending'
+	`, requestID, userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to decline contact request", "error", err)
+		http.Error(w, "Failed to decline request", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Request not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// List the user's contacts with their online status, alphabetically
+func handleGetContacts(w http.ResponseWriter, r *http.Request) {
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT u.id, u.username, u.status, u.status_emoji, u.status_text, COALESCE(c.responded_at, c.created_at), COALESCE(dm.id, 0)
+		FROM contacts c
+		JOIN users u ON u.id = CASE WHEN c.requester_id = $1 THEN c.addressee_id ELSE c.requester_id END
+		LEFT JOIN LATERAL (
+			SELECT r.id FROM rooms r
+			JOIN room_members a ON a.room_id = r.id AND a.user_id = $1
+			JOIN room_members b ON b.room_id = r.id AND b.user_id = u.id
+			WHERE r.is_direct
+			LIMIT 1
+		) dm ON TRUE
+		WHERE (c.requester_id = $1 OR c.addressee_id = $1) AND c.status = 'accepted' AND u.is_active
+	`, userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get contacts", "error", err)
+		http.Error(w, "Failed to get contacts", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	contacts := []Contact{}
+	for rows.Next() {
+		var c Contact
+		if err := rows.Scan(&c.UserID, &c.Username, &c.Status.State, &c.Status.Emoji, &c.Status.Text, &c.Since, &c.DirectRoomID); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning contact", "error", err)
+			continue
+		}
+		c.Avatar = avatarInitial(c.Username)
+		c.AvatarURL = userAvatarURL(c.UserID)
+		c.Online = roomManager.IsOnline(c.UserID)
+		contacts = append(contacts, c)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return strings.ToLower(contacts[i].Username) < strings.ToLower(contacts[j].Username)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(contacts)
+}
+
+// Remove a contact, or withdraw a pending request to them. Their direct messages are kept.
+func handleRemoveContact(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	contactID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `
+		DELETE FROM contacts
+		WHERE ((requester_id = $1 AND addressee_id = $2) OR (requester_id = $2 AND addressee_id = $1 AND status = 'accepted'))
+			AND status != 'declined'
+	`, userID, contactID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to remove contact", "error", err)
+		http.Error(w, "Failed to remove contact", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Contact not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Open the direct message room with a contact, creating it on first use (201)
+func handleOpenDirectRoom(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	contactID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var contactName string
+	err = db.QueryRowContext(ctx, `
+		SELECT u.username FROM contacts c
+		JOIN users u ON u.id = $2 AND u.is_active
+		WHERE ((c.requester_id = $1 AND c.addressee_id = $2) OR (c.requester_id = $2 AND c.addressee_id = $1))
+			AND c.status = 'accepted'
+	`, userID, contactID).Scan(&contactName)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Not in your contacts", http.StatusForbidden)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "DB error checking contact", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	room, created, err := openDirectRoom(ctx, userID, username, contactID, contactName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to open direct room", "error", err)
+		http.Error(w, "Failed to open conversation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		roomManager.subscribeUser(room.ID, userID)
+		roomManager.subscribeUser(room.ID, contactID)
+		roomManager.SendToUser(contactID, &WSMessage{Type: "directRoomCreated", RoomID: room.ID})
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(room)
+}
+
+// openDirectRoom returns the direct room of two users, creating it if they have none. Creation
+// takes an advisory lock on the pair, so two users opening it at once end up in the same room.
+func openDirectRoom(ctx context.Context, userID int, username string, otherID int, otherName string) (*Room, bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	low, high := min(userID, otherID), max(userID, otherID)
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1, $2)", low, high); err != nil {
+		return nil, false, err
+	}
+
+	room := &Room{IsPrivate: true, IsDirect: true, Members: 2}
+	err = tx.QueryRowContext(ctx, `
+		SELECT r.id, r.name, r.created_by, r.created_at FROM rooms r
+		JOIN room_members a ON a.room_id = r.id AND a.user_id = $1
+		JOIN room_members b ON b.room_id = r.id AND b.user_id = $2
+		WHERE r.is_direct
+		LIMIT 1
+	`, userID, otherID).Scan(&room.ID, &room.Name, &room.CreatedBy, &room.CreatedAt)
+	if err == nil {
+		room.Avatar = avatarInitial(otherName)
+		return room, false, nil
+	} else if err != sql.ErrNoRows {
+		return nil, false, err
+	}
+
+	// Named after both users; clients show the other one
+	room.Name = username + ", " + otherName
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO rooms (name, description, created_by, is_private, is_direct) VALUES ($1, '', $2, TRUE, TRUE) RETURNING id, created_by, created_at",
+		room.Name, userID,
+	).Scan(&room.ID, &room.CreatedBy, &room.CreatedAt)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO room_members (room_id, user_id, role) VALUES ($1, $2, $4), ($1, $3, $4)",
+		room.ID, userID, otherID, RoleMember,
+	); err != nil {
+		return nil, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	memberships.invalidate(room.ID, userID)
+	memberships.invalidate(room.ID, otherID)
+
+	room.Avatar = avatarInitial(otherName)
+	room.LastMessage = "No messages yet."
+	return room, true, nil
+}
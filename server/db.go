@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// configurePool sizes the connection pool from DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS,
+// DB_CONN_MAX_LIFETIME_SECONDS and DB_CONN_MAX_IDLE_SECONDS
+func configurePool(db *sql.DB) {
+	db.SetMaxOpenConns(envInt("DB_MAX_OPEN_CONNS", 25))
+	db.SetMaxIdleConns(envInt("DB_MAX_IDLE_CONNS", 10))
+	db.SetConnMaxLifetime(time.Duration(envInt("DB_CONN_MAX_LIFETIME_SECONDS", 1800)) * time.Second)
+	db.SetConnMaxIdleTime(time.Duration(envInt("DB_CONN_MAX_IDLE_SECONDS", 300)) * time.Second)
+}
+
+// dbQueryTimeout bounds the queries of one operation (DB_QUERY_TIMEOUT_MS), so a slow database
+// fails requests instead of piling up goroutines waiting on it
+func dbQueryTimeout() time.Duration {
+	return time.Duration(envInt("DB_QUERY_TIMEOUT_MS", 5000)) * time.Millisecond
+}
+
+// dbContext derives the context an operation's queries run under
+func dbContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, dbQueryTimeout())
+}
+
+// replica is a read-only copy of the database, used by readDB while its health check passes
+type replica struct {
+	addr    string
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+var (
+	replicas    []*replica
+	nextReplica atomic.Uint64
+)
+
+// initReplicas opens DB_REPLICA_HOSTS, a comma-separated list of host or host:port entries.
+// Replicas start out unhealthy and join the rotation once their first health check passes.
+func initReplicas() {
+	for _, addr := range strings.Split(getEnv("DB_REPLICA_HOSTS", ""), ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			host, port = addr, getEnv("DB_PORT", "5432")
+		}
+		conn, err := openDB(dbConnString(host, port))
+		if err != nil {
+			slog.Error("Failed to open read replica", "replica", addr, "error", err)
+			continue
+		}
+		configurePool(conn)
+		replicas = append(replicas, &replica{addr: addr, db: conn})
+	}
+
+	if len(replicas) > 0 {
+		checkReplicas()
+		go func() {
+			for range time.Tick(time.Duration(envInt("DB_REPLICA_CHECK_SECONDS", 5)) * time.Second) {
+				checkReplicas()
+			}
+		}()
+	}
+}
+
+func checkReplicas() {
+	for _, rep := range replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err := rep.db.PingContext(ctx)
+		cancel()
+
+		if healthy := err == nil; rep.healthy.Swap(healthy) != healthy {
+			if healthy {
+				slog.Info("Read replica is available", "replica", rep.addr)
+			} else {
+				slog.Warn("Read replica is unavailable, falling back to the primary", "replica", rep.addr, "error", err)
+			}
+		}
+	}
+}
+
+// readDB returns a healthy replica, round robin, or the primary when there is none. Replicas lag
+// the primary slightly, so only use it for reads that tolerate that, like lists and history.
+func readDB() *sql.DB {
+	n := uint64(len(replicas))
+	start := nextReplica.Add(1)
+	for i := uint64(0); i < n; i++ {
+		if rep := replicas[(start+i)%n]; rep.healthy.Load() {
+			return rep.db
+		}
+	}
+	return db
+}
+
+func closeReplicas() {
+	for _, rep := range replicas {
+		rep.db.Close()
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var startedAt = time.Now()
+
+// registerPprof exposes the profiler. With PPROF_ADDR set it gets its own listener, meant to be
+// bound to localhost or a private network; with PPROF_ENABLED=true it is served under
+// /api/admin/debug/pprof/ behind site admin auth. Otherwise it stays off.
+func registerPprof(admin *mux.Router) {
+	if addr := getEnv("PPROF_ADDR", ""); addr != "" {
+		// Importing net/http/pprof registers its handlers on http.DefaultServeMux, which the
+		// main API no longer uses, so that mux is only reachable through this listener
+		go func() {
+			slog.Info("pprof listening", "addr", addr)
+			if err := http.ListenAndServe(addr, http.DefaultServeMux); err != nil {
+				slog.Error("pprof listener stopped", "error", err)
+			}
+		}()
+	}
+
+	if getEnv("PPROF_ENABLED", "") != "true" {
+		return
+	}
+	debug := admin.PathPrefix("/debug/pprof").Subrouter()
+	debug.HandleFunc("/cmdline", pprof.Cmdline)
+	debug.HandleFunc("/profile", pprof.Profile)
+	debug.HandleFunc("/symbol", pprof.Symbol)
+	debug.HandleFunc("/trace", pprof.Trace)
+	debug.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// pprof.Index looks up named profiles (heap, goroutine, ...) by the path after /debug/pprof/
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, "/api/admin")
+		pprof.Index(w, r)
+	})
+}
+
+// Runtime diagnostics for live troubleshooting: goroutines, memory and per-hub client counts
+func handleAdminDebug(w http.ResponseWriter, r *http.Request) {
+	type hubInfo struct {
+		RoomID  int   `json:"room_id"`
+		Clients int   `json:"clients"`
+		Seq     int64 `json:"seq"`
+	}
+	var info struct {
+		Goroutines  int       `json:"goroutines"`
+		Uptime      string    `json:"uptime"`
+		HeapAlloc   uint64    `json:"heap_alloc_bytes"`
+		HeapObjects uint64    `json:"heap_objects"`
+		NumGC       uint32    `json:"num_gc"`
+		Connections int       `json:"connections"`
+		OnlineUsers int       `json:"online_users"`
+		HubCount    int       `json:"hub_count"`
+		Hubs        []hubInfo `json:"hubs"`
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	info.Goroutines = runtime.NumGoroutine()
+	info.Uptime = time.Since(startedAt).Round(time.Second).String()
+	info.HeapAlloc = mem.HeapAlloc
+	info.HeapObjects = mem.HeapObjects
+	info.NumGC = mem.NumGC
+
+	info.Hubs = []hubInfo{}
+	roomManager.mu.RLock()
+	info.Connections = len(roomManager.Clients)
+	info.OnlineUsers = len(roomManager.Users)
+	info.HubCount = len(roomManager.Rooms)
+	for roomID, hub := range roomManager.Rooms {
+		hub.mu.RLock()
+		info.Hubs = append(info.Hubs, hubInfo{RoomID: roomID, Clients: len(hub.Clients), Seq: hub.Seq})
+		hub.mu.RUnlock()
+	}
+	roomManager.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// MessageRevision is a version of a message that an edit replaced
+type MessageRevision struct {
+	ID         int       `json:"id"`
+	MessageID  int       `json:"message_id"`
+	Text       string    `json:"text"`
+	HTML       string    `json:"html,omitempty"`
+	EditedBy   int       `json:"edited_by"`
+	ReplacedAt time.Time `json:"replaced_at"` // When the edit that replaced this version was made
+}
+
+// Edit the text of one of your messages. The version it replaces is kept in message_revisions,
+// and the room receives "messageEdited".
+func handleEditMessage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	msgID, err := strconv.Atoi(vars["msgId"])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if !isUserInRoom(userID, roomID) {
+		http.Error(w, "Not authorized", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Locked until the edit commits, so concurrent edits each keep the version they replaced
+	var senderID int
+	var kind, oldContent, oldHTML string
+	var deleted bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT sender_id, kind, content, COALESCE(content_html, ''), deleted_at IS NOT NULL
+		FROM messages WHERE id = $1 AND room_id = $2
+		FOR UPDATE
+	`, msgID, roomID).Scan(&senderID, &kind, &oldContent, &oldHTML, &deleted)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "DB error fetching message", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if senderID != userID {
+		http.Error(w, "Only the sender can edit this message", http.StatusForbidden)
+		return
+	}
+	if deleted {
+		http.Error(w, "Message is deleted", http.StatusConflict)
+		return
+	}
+	if kind != "text" {
+		http.Error(w, "Only text messages can be edited", http.StatusBadRequest)
+		return
+	}
+
+	// Edits go through the same checks as sending, so they can't be used to get around them
+	content, flagged, err := checkMessageEdit(roomID, userID, req.Content)
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		http.Error(w, verr.Message, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to check message edit", "error", err)
+		http.Error(w, "Failed to edit message", http.StatusInternalServerError)
+		return
+	}
+	if content == oldContent {
+		http.Error(w, "Message is unchanged", http.StatusBadRequest)
+		return
+	}
+
+	var contentHTML string
+	if markdownEnabled() {
+		contentHTML = renderMarkdown(content)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO message_revisions (message_id, content, content_html, edited_by) VALUES ($1, $2, NULLIF($3, ''), $4)",
+		msgID, oldContent, oldHTML, userID,
+	)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save message revision", "error", err)
+		http.Error(w, "Failed to edit message", http.StatusInternalServerError)
+		return
+	}
+
+	edited := Message{ID: msgID, RoomID: roomID, SenderID: senderID, Kind: kind, Text: content, HTML: contentHTML}
+	var editedAt time.Time
+	err = tx.QueryRowContext(ctx, `
+		UPDATE messages
+		SET content = $1, content_html = NULLIF($2, ''), edited_at = CURRENT_TIMESTAMP,
+		    flagged_at = CASE WHEN $3 THEN CURRENT_TIMESTAMP ELSE flagged_at END
+		WHERE id = $4
+		RETURNING edited_at, created_at, shadowbanned
+	`, content, contentHTML, flagged, msgID).Scan(&editedAt, &edited.Timestamp, &edited.shadowbanned)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to edit message", "error", err)
+		http.Error(w, "Failed to edit message", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Server error during commit", http.StatusInternalServerError)
+		return
+	}
+
+	edited.EditedAt = &editedAt
+	edited.Sender = r.Context().Value("username").(string)
+	edited.Avatar = avatarInitial(edited.Sender)
+
+	roomManager.BroadcastToRoom(roomID, &WSMessage{Type: "messageEdited", RoomID: roomID, Message: &edited})
+	slog.InfoContext(r.Context(), "Message edited", "message_id", msgID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(edited)
+}
+
+// checkMessageEdit validates new text for a message and runs it through moderation, returning the
+// text to save and whether it should be flagged
+func checkMessageEdit(roomID, userID int, content string) (string, bool, error) {
+	content = sanitizeText(content)
+	if err := validateMessageContent(content, nil, ""); err != nil {
+		return "", false, err
+	}
+	if !hasRoomPermission(roomID, roomRole(roomID, userID), PermSendMessages) {
+		return "", false, errRoomReadonly
+	}
+	if err := checkNotArchived(roomID); err != nil {
+		return "", false, err
+	}
+	if err := checkNotMuted(roomID, userID); err != nil {
+		return "", false, err
+	}
+	return moderateContent(roomID, content)
+}
+
+// Get the earlier versions of a message, oldest first (members of its room)
+func handleGetMessageHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	msgID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	// Deleted messages keep their history for the database, not for members; shadowbanned ones
+	// are only their sender's to see
+	var roomID int
+	err = db.QueryRowContext(ctx, `
+		SELECT room_id FROM messages
+		WHERE id = $1 AND deleted_at IS NULL AND (NOT shadowbanned OR sender_id = $2)
+	`, msgID, userID).Scan(&roomID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "DB error fetching message", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !isUserInRoom(userID, roomID) {
+		http.Error(w, "Not authorized", http.StatusForbidden)
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, message_id, content, COALESCE(content_html, ''), COALESCE(edited_by, 0), created_at
+		FROM message_revisions
+		WHERE message_id = $1
+		ORDER BY id ASC
+	`, msgID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get message history", "error", err)
+		http.Error(w, "Failed to get message history", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	revisions := []MessageRevision{}
+	for rows.Next() {
+		var rev MessageRevision
+		if err := rows.Scan(&rev.ID, &rev.MessageID, &rev.Text, &rev.HTML, &rev.EditedBy, &rev.ReplacedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning message revision", "error", err)
+			continue
+		}
+		revisions = append(revisions, rev)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// mailer sends plain-text email through SMTP_ADDR (host:port), authenticating with SMTP_USERNAME
+// and SMTP_PASSWORD when set
+type mailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// emailNotifier is set when SMTP_ADDR is configured
+var emailNotifier *emailDigestNotifier
+
+func newMailer() *mailer {
+	addr := getEnv("SMTP_ADDR", "")
+	if addr == "" {
+		return nil
+	}
+	m := &mailer{addr: addr, from: getEnv("MAIL_FROM", "ChatHub <noreply@chathub.io>")}
+	if username := getEnv("SMTP_USERNAME", ""); username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", username, getEnv("SMTP_PASSWORD", ""), host)
+	}
+	return m
+}
+
+func (m *mailer) Send(to, subject, body string) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	// net/smtp wants the bare address for the envelope
+	from := m.from
+	if i := strings.LastIndex(from, "<"); i >= 0 {
+		from = strings.TrimSuffix(from[i+1:], ">")
+	}
+	return smtp.SendMail(m.addr, m.auth, from, []string{to}, []byte(msg.String()))
+}
+
+// --- Digests ---
+
+// emailDigestNotifier collects mentions and direct messages for users who are offline. Once a
+// user has been offline for EMAIL_DIGEST_DELAY_MINUTES, those still unread are emailed to them
+// as one summary.
+type emailDigestNotifier struct {
+	mailer *mailer
+	delay  time.Duration
+}
+
+func newEmailDigestNotifier() *emailDigestNotifier {
+	m := newMailer()
+	if m == nil {
+		return nil
+	}
+	emailNotifier = &emailDigestNotifier{
+		mailer: m,
+		delay:  time.Duration(envInt("EMAIL_DIGEST_DELAY_MINUTES", 15)) * time.Minute,
+	}
+	return emailNotifier
+}
+
+// Notify records mentions and direct messages for the user's next digest, unless they opted out
+// of email; digests never cover every message of a room. During Do Not Disturb it is still
+// recorded, and sendDue holds the digest until the window ends.
+func (e *emailDigestNotifier) Notify(ctx context.Context, n *Notification) {
+	if n.Reason == ReasonMessage || !n.Email {
+		return
+	}
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO email_notifications (user_id, room_id, message_id, reason) VALUES ($1, $2, $3, $4)
+	`, n.UserID, n.RoomID, n.Message.ID, n.Reason)
+	if err != nil {
+		slog.Error("Failed to record email notification", "user_id", n.UserID, "error", err)
+	}
+}
+
+// digestItem is one unread message of a digest
+type digestItem struct {
+	roomName string
+	sender   string
+	text     string
+}
+
+// run sends the digests that are due every minute. Due entries are deleted as they
+// are read, so instances sharing the database never send the same digest twice.
+func (e *emailDigestNotifier) run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := e.sendDue(); err != nil {
+			slog.Error("Failed to send email digests", "error", err)
+		}
+	}
+}
+
+func (e *emailDigestNotifier) sendDue() error {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	// Entries are kept for users who are still connected here, were seen within the delay, or are in
+	// their Do Not Disturb window, and dropped once read, deleted, or opted out of
+	cutoff := time.Now().Add(-e.delay)
+	rows, err := db.QueryContext(ctx, `
+		WITH due AS (
+			DELETE FROM email_notifications en
+			USING users u
+			WHERE u.id = en.user_id AND en.user_id IN (
+				SELECT user_id FROM email_notifications GROUP BY user_id HAVING MIN(created_at) < $1
+			) AND (u.last_seen_at IS NULL OR u.last_seen_at < $1) AND NOT (en.user_id = ANY($2))
+			  AND NOT EXISTS (SELECT 1 FROM notification_preferences np WHERE np.user_id = en.user_id AND `+dndActiveSQL+`)
+			RETURNING en.user_id, en.room_id, en.message_id, en.reason
+		)
+		SELECT d.user_id, u.username, u.email, r.name, su.username, m.content
+		FROM due d
+		JOIN users u ON u.id = d.user_id AND u.is_active
+		JOIN room_members rm ON rm.room_id = d.room_id AND rm.user_id = d.user_id
+		JOIN messages m ON m.id = d.message_id AND m.id > rm.last_read_message_id AND m.deleted_at IS NULL
+		JOIN rooms r ON r.id = d.room_id
+		JOIN users su ON su.id = m.sender_id
+		WHERE NOT EXISTS (SELECT 1 FROM notification_preferences WHERE user_id = d.user_id AND NOT email_enabled)
+		ORDER BY d.user_id, d.room_id, m.id
+	`, cutoff, pq.Array(roomManager.OnlineUsers()))
+	if err != nil {
+		return err
+	}
+
+	type digest struct {
+		userID          int
+		username, email string
+		items           []digestItem
+	}
+	var digests []*digest
+	for rows.Next() {
+		d := &digest{}
+		var item digestItem
+		if err := rows.Scan(&d.userID, &d.username, &d.email, &item.roomName, &item.sender, &item.text); err != nil {
+			rows.Close()
+			return err
+		}
+		if len(digests) == 0 || digests[len(digests)-1].userID != d.userID {
+			digests = append(digests, d)
+		}
+		last := digests[len(digests)-1]
+		last.items = append(last.items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	cancel()
+
+	for _, d := range digests {
+		subject, body := digestEmail(d.username, d.items)
+		if err := e.mailer.Send(d.email, subject, body); err != nil {
+			slog.Warn("Failed to send email digest", "user_id", d.userID, "error", err)
+		}
+	}
+	return nil
+}
+
+// digestEmail renders a digest; items come grouped by room, oldest first
+func digestEmail(username string, items []digestItem) (subject, body string) {
+	subject = fmt.Sprintf("You have %d unread messages on ChatHub", len(items))
+	if len(items) == 1 {
+		subject = "You have an unread message on ChatHub"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hi %s,\n\nWhile you were away:\n", username)
+	room := ""
+	for _, item := range items {
+		if item.roomName != room {
+			room = item.roomName
+			fmt.Fprintf(&b, "\n%s\n", room)
+		}
+		text := quoteSnippet(item.text)
+		if text == "" {
+			text = "(attachment)"
+		}
+		fmt.Fprintf(&b, "  %s: %s\n", item.sender, text)
+	}
+	b.WriteString("\nYou can turn these emails off in your notification settings.\n")
+	return subject, b.String()
+}
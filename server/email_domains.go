@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"golang.org/x/net/idna"
+)
+
+var (
+	errInvalidEmail       = errors.New("invalid email address")
+	errEmailDomainBlocked = errors.New("email domain not allowed")
+)
+
+// defaultBlockedEmailDomains fills the blocklist the first time the server starts; after that
+// admins own the list and removed entries stay removed
+var defaultBlockedEmailDomains = []string{
+	"10minutemail.com", "33mail.com", "dispostable.com", "emailondeck.com", "fakeinbox.com",
+	"getnada.com", "guerrillamail.com", "guerrillamail.net", "maildrop.cc", "mailinator.com",
+	"mailnesia.com", "mintemail.com", "mohmal.com", "mytemp.email", "sharklasers.com",
+	"spamgourmet.com", "temp-mail.org", "tempail.com", "tempmail.com", "tempr.email",
+	"throwawaymail.com", "trashmail.com", "yopmail.com",
+}
+
+// normalizeEmail checks the address is a bare addr-spec with a real-looking domain, and returns it
+// with the domain lowercased
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if len(email) > 254 {
+		return "", errInvalidEmail
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", errInvalidEmail
+	}
+	at := strings.LastIndex(email, "@")
+	local, domain := email[:at], strings.ToLower(email[at+1:])
+	if len(local) > 64 || !validEmailDomain(domain) {
+		return "", errInvalidEmail
+	}
+	return local + "@" + domain, nil
+}
+
+// validEmailDomain accepts host names with at least two labels and a non-numeric top-level label
+func validEmailDomain(domain string) bool {
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return false
+	}
+	labels := strings.Split(ascii, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	return strings.ContainsFunc(labels[len(labels)-1], func(r rune) bool { return r < '0' || r > '9' })
+}
+
+// normalizeEmailDomain lowercases a domain as admins enter it, tolerating a leading "@"
+func normalizeEmailDomain(domain string) (string, bool) {
+	domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "@")
+	return domain, len(domain) <= 255 && validEmailDomain(domain)
+}
+
+// emailDomainList caches the blocklist so registration doesn't query it every time. Changes
+// made through another instance are picked up once the cache is a minute old.
+type emailDomainList struct {
+	mu       sync.RWMutex
+	domains  map[string]bool // nil until loaded
+	loadedAt time.Time
+}
+
+var blockedEmailDomains = &emailDomainList{}
+
+func (l *emailDomainList) load(ctx context.Context) (map[string]bool, error) {
+	l.mu.RLock()
+	domains, loadedAt := l.domains, l.loadedAt
+	l.mu.RUnlock()
+	if domains != nil && time.Since(loadedAt) < time.Minute {
+		return domains, nil
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT domain FROM blocked_email_domains")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	domains = make(map[string]bool)
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return nil, err
+		}
+		domains[domain] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	l.domains, l.loadedAt = domains, time.Now()
+	l.mu.Unlock()
+	return domains, nil
+}
+
+// invalidate drops the cached list so it is reloaded on the next registration
+func (l *emailDomainList) invalidate() {
+	l.mu.Lock()
+	l.domains = nil
+	l.mu.Unlock()
+}
+
+// checkEmailDomain refuses addresses at a blocked domain or any of its subdomains
+func checkEmailDomain(ctx context.Context, email string) error {
+	// Only Postgres has the blocklist
+	if _, ok := store.(*postgresStore); !ok {
+		return nil
+	}
+	domains, err := blockedEmailDomains.load(ctx)
+	if err != nil {
+		return err
+	}
+	domain := email[strings.LastIndex(email, "@")+1:]
+	for {
+		if domains[domain] {
+			return errEmailDomainBlocked
+		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			return nil
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// seedBlockedEmailDomains adds the default blocklist once per database
+func seedBlockedEmailDomains() error {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	var key string
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO server_settings (key, value) VALUES ('email_domains_seeded', 'true')
+		ON CONFLICT (key) DO NOTHING RETURNING key
+	`).Scan(&key)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx,
+		"INSERT INTO blocked_email_domains (domain) SELECT unnest($1::text[]) ON CONFLICT DO NOTHING",
+		pq.Array(defaultBlockedEmailDomains),
+	)
+	return err
+}
+
+// --- Admin API ---
+
+// BlockedEmailDomain is a domain that can't be used to register
+type BlockedEmailDomain struct {
+	Domain    string    `json:"domain"`
+	CreatedBy *int      `json:"created_by"` // nil for the defaults
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// List the blocked email domains
+func handleAdminListEmailDomains(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT domain, created_by, created_at FROM blocked_email_domains ORDER BY domain")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list blocked email domains", "error", err)
+		http.Error(w, "Failed to list blocked email domains", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	domains := []BlockedEmailDomain{}
+	for rows.Next() {
+		var d BlockedEmailDomain
+		var createdBy sql.NullInt64
+		if err := rows.Scan(&d.Domain, &createdBy, &d.CreatedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning blocked email domain", "error", err)
+			continue
+		}
+		if createdBy.Valid {
+			id := int(createdBy.Int64)
+			d.CreatedBy = &id
+		}
+		domains = append(domains, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(domains)
+}
+
+// Block one or more email domains; domains already on the list are ignored
+func handleAdminAddEmailDomains(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Domains []string `json:"domains"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(req.Domains) == 0 || len(req.Domains) > 1000 {
+		http.Error(w, "Between 1 and 1000 domains are required", http.StatusBadRequest)
+		return
+	}
+	for i, domain := range req.Domains {
+		normalized, ok := normalizeEmailDomain(domain)
+		if !ok {
+			http.Error(w, "Invalid domain: "+domain, http.StatusBadRequest)
+			return
+		}
+		req.Domains[i] = normalized
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx,
+		"INSERT INTO blocked_email_domains (domain, created_by) SELECT unnest($1::text[]), $2 ON CONFLICT DO NOTHING",
+		pq.Array(req.Domains), userID,
+	)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to block email domains", "error", err)
+		http.Error(w, "Failed to block email domains", http.StatusInternalServerError)
+		return
+	}
+	added, _ := res.RowsAffected()
+
+	blockedEmailDomains.invalidate()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]int64{"added": added})
+}
+
+// Unblock an email domain
+func handleAdminDeleteEmailDomain(w http.ResponseWriter, r *http.Request) {
+	domain, _ := normalizeEmailDomain(mux.Vars(r)["domain"])
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, "DELETE FROM blocked_email_domains WHERE domain = $1", domain)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to unblock email domain", "error", err)
+		http.Error(w, "Failed to unblock email domain", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Domain not found", http.StatusNotFound)
+		return
+	}
+
+	blockedEmailDomains.invalidate()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
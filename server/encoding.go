@@ -0,0 +1,137 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Frame encodings, negotiated through the WebSocket subprotocol at connect time
+const (
+	EncodingJSON    = "json"
+	EncodingMsgpack = "msgpack"
+)
+
+// wsSubprotocols are offered during the upgrade. Browsers that ask for none get JSON;
+// high-traffic clients can ask for "chathub.msgpack" to get binary MessagePack frames.
+var wsSubprotocols = []string{"chathub.json", "chathub.msgpack"}
+
+func encodingForSubprotocol(subprotocol string) string {
+	if subprotocol == "chathub.msgpack" {
+		return EncodingMsgpack
+	}
+	return EncodingJSON
+}
+
+// frameField is one key of a flattened WSMessage, located by its reflect index path
+type frameField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// frameFields lists WSMessage's keys as encoding/json produces them: the embedded *Message is
+// inlined and envelope fields win over message fields with the same name (room_id).
+// MessagePack can't inline an embedded pointer, so msgpack frames are built from this list.
+var frameFields = buildFrameFields()
+
+func buildFrameFields() []frameField {
+	var fields []frameField
+	seen := make(map[string]bool)
+
+	var collect func(t reflect.Type, prefix []int, embedded *[]int)
+	collect = func(t reflect.Type, prefix []int, embedded *[]int) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			index := append(append([]int{}, prefix...), i)
+			if f.Anonymous && f.Type.Kind() == reflect.Ptr && f.Type.Elem().Kind() == reflect.Struct {
+				*embedded = index
+				continue
+			}
+			tag := f.Tag.Get("json")
+			if tag == "-" || !f.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if name == "" {
+				name = f.Name
+			}
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			fields = append(fields, frameField{name: name, index: index, omitEmpty: strings.Contains(opts, "omitempty")})
+		}
+	}
+
+	var embedded []int
+	envelope := reflect.TypeOf(WSMessage{})
+	collect(envelope, nil, &embedded)
+	if embedded != nil {
+		var none []int
+		collect(envelope.FieldByIndex(embedded).Type.Elem(), embedded, &none)
+	}
+	return fields
+}
+
+func isEmptyFrameValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return v.IsZero()
+}
+
+// flattenFrame turns a WSMessage into the same key/value shape as its JSON encoding
+func flattenFrame(msg *WSMessage) map[string]interface{} {
+	v := reflect.ValueOf(msg).Elem()
+	frame := make(map[string]interface{}, 8)
+	for _, f := range frameFields {
+		fv, err := v.FieldByIndexErr(f.index)
+		if err != nil {
+			continue // Nil embedded *Message
+		}
+		if f.omitEmpty && isEmptyFrameValue(fv) {
+			continue
+		}
+		frame[f.name] = fv.Interface()
+	}
+	return frame
+}
+
+// readMessage decodes the next frame in the connection's encoding. MessagePack frames reuse the
+// json struct tags, so both encodings carry the same field names.
+func (c *Client) readMessage(msg *WSMessage) error {
+	if c.Encoding != EncodingMsgpack {
+		return c.Conn.ReadJSON(msg)
+	}
+	_, r, err := c.Conn.NextReader()
+	if err != nil {
+		return err
+	}
+	dec := msgpack.NewDecoder(r)
+	dec.SetCustomStructTag("json")
+	return dec.Decode(msg)
+}
+
+func (c *Client) writeMessage(msg *WSMessage) error {
+	msg = localizeFrame(msg, c.Locale)
+	if c.Encoding != EncodingMsgpack {
+		return c.Conn.WriteJSON(msg)
+	}
+	w, err := c.Conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	enc := msgpack.NewEncoder(w)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(flattenFrame(msg)); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// GIF is a GIF from the configured provider, attached to messages of kind "gif". IDs are those
+// returned by GET /api/gifs/search.
+type GIF struct {
+	ID         string `json:"id"`
+	Provider   string `json:"provider"`
+	Title      string `json:"title,omitempty"`
+	URL        string `json:"url"`
+	PreviewURL string `json:"preview_url"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+}
+
+const (
+	defaultGIFSearchLimit = 24
+	maxGIFSearchLimit     = 50
+)
+
+var errUnknownGIF = &ValidationError{Code: CodeInvalidGIF, Message: "The GIF does not exist or GIFs are not enabled"}
+
+// gifProvider searches a GIF service. next is an opaque cursor for the following page, empty on
+// the last one.
+type gifProvider interface {
+	Name() string
+	Search(ctx context.Context, query string, limit int, cursor string) (gifs []GIF, next string, err error)
+	Get(ctx context.Context, id string) (*GIF, error)
+}
+
+// gifs is set by initGIFs when GIF_PROVIDER is configured
+var gifs gifProvider
+
+var gifClient = &http.Client{Timeout: 5 * time.Second}
+
+// initGIFs selects the provider from GIF_PROVIDER ("giphy" or "tenor"), with its key in
+// GIF_API_KEY. The key never leaves the server.
+func initGIFs() error {
+	driver := getEnv("GIF_PROVIDER", "")
+	if driver == "" {
+		return nil
+	}
+	key := getEnv("GIF_API_KEY", "")
+	if key == "" {
+		return errors.New("GIF_API_KEY is required")
+	}
+	switch driver {
+	case "giphy":
+		gifs = &giphyProvider{key: key, rating: getEnv("GIF_RATING", "pg-13")}
+	case "tenor":
+		gifs = &tenorProvider{key: key, contentFilter: getEnv("GIF_CONTENT_FILTER", "medium")}
+	default:
+		return fmt.Errorf("unknown GIF_PROVIDER %q", driver)
+	}
+	return nil
+}
+
+// gifCache keeps recent search results so sending a GIF picked from them needs no provider call
+var gifCache = struct {
+	mu      sync.Mutex
+	entries map[string]gifCacheEntry
+}{entries: make(map[string]gifCacheEntry)}
+
+type gifCacheEntry struct {
+	gif     GIF
+	expires time.Time
+}
+
+const (
+	gifCacheTTL     = time.Hour
+	gifCacheMaxSize = 10000
+)
+
+func cacheGIFs(results []GIF) {
+	gifCache.mu.Lock()
+	defer gifCache.mu.Unlock()
+	if len(gifCache.entries)+len(results) > gifCacheMaxSize {
+		gifCache.entries = make(map[string]gifCacheEntry)
+	}
+	expires := time.Now().Add(gifCacheTTL)
+	for _, g := range results {
+		gifCache.entries[g.ID] = gifCacheEntry{gif: g, expires: expires}
+	}
+}
+
+// resolveGIF looks up a GIF a client wants to send, so messages only carry provider media
+func resolveGIF(id string) (*GIF, error) {
+	if gifs == nil || id == "" || len(id) > 128 {
+		return nil, errUnknownGIF
+	}
+	gifCache.mu.Lock()
+	entry, ok := gifCache.entries[id]
+	gifCache.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return &entry.gif, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gifClient.Timeout)
+	defer cancel()
+	gif, err := gifs.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if gif == nil {
+		return nil, errUnknownGIF
+	}
+	cacheGIFs([]GIF{*gif})
+	return gif, nil
+}
+
+// getJSON fetches a provider URL into v, sending header with the request
+func getJSON(ctx context.Context, endpoint string, header http.Header, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return withoutURL(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := gifClient.Do(req)
+	if err != nil {
+		return withoutURL(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("provider responded %d", resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(v)
+}
+
+// withoutURL drops the URL a *url.Error quotes, since Giphy's carries the API key, so the error
+// can be logged
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s request: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+// --- Giphy ---
+
+type giphyProvider struct {
+	key    string
+	rating string
+}
+
+type giphyGIF struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Images map[string]struct {
+		URL    string `json:"url"`
+		Width  string `json:"width"`
+		Height string `json:"height"`
+	} `json:"images"`
+}
+
+func (g giphyGIF) toGIF() GIF {
+	full, preview := g.Images["fixed_height"], g.Images["fixed_height_small"]
+	width, _ := strconv.Atoi(full.Width)
+	height, _ := strconv.Atoi(full.Height)
+	if preview.URL == "" {
+		preview = full
+	}
+	return GIF{ID: "giphy:" + g.ID, Provider: "giphy", Title: g.Title, URL: full.URL, PreviewURL: preview.URL, Width: width, Height: height}
+}
+
+func (p *giphyProvider) Name() string { return "giphy" }
+
+func (p *giphyProvider) Search(ctx context.Context, query string, limit int, cursor string) ([]GIF, string, error) {
+	offset, _ := strconv.Atoi(cursor)
+	params := url.Values{
+		"api_key": {p.key},
+		"q":       {query},
+		"limit":   {strconv.Itoa(limit)},
+		"offset":  {strconv.Itoa(offset)},
+		"rating":  {p.rating},
+	}
+	var resp struct {
+		Data       []giphyGIF `json:"data"`
+		Pagination struct {
+			TotalCount int `json:"total_count"`
+			Count      int `json:"count"`
+			Offset     int `json:"offset"`
+		} `json:"pagination"`
+	}
+	if err := getJSON(ctx, "https://api.giphy.com/v1/gifs/search?"+params.Encode(), nil, &resp); err != nil {
+		return nil, "", err
+	}
+	results := make([]GIF, 0, len(resp.Data))
+	for _, g := range resp.Data {
+		results = append(results, g.toGIF())
+	}
+	next := ""
+	if end := resp.Pagination.Offset + resp.Pagination.Count; resp.Pagination.Count > 0 && end < resp.Pagination.TotalCount {
+		next = strconv.Itoa(end)
+	}
+	return results, next, nil
+}
+
+func (p *giphyProvider) Get(ctx context.Context, id string) (*GIF, error) {
+	giphyID, ok := strings.CutPrefix(id, "giphy:")
+	if !ok {
+		return nil, nil
+	}
+	var resp struct {
+		Data giphyGIF `json:"data"`
+	}
+	// Giphy only takes the key as a query parameter
+	if err := getJSON(ctx, "https://api.giphy.com/v1/gifs/"+url.PathEscape(giphyID)+"?api_key="+url.QueryEscape(p.key), nil, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Data.ID == "" {
+		return nil, nil
+	}
+	g := resp.Data.toGIF()
+	return &g, nil
+}
+
+// --- Tenor ---
+
+type tenorProvider struct {
+	key           string
+	contentFilter string
+}
+
+type tenorGIF struct {
+	ID           string `json:"id"`
+	Title        string `json:"content_description"`
+	MediaFormats map[string]struct {
+		URL  string `json:"url"`
+		Dims []int  `json:"dims"`
+	} `json:"media_formats"`
+}
+
+func (t tenorGIF) toGIF() GIF {
+	full, preview := t.MediaFormats["gif"], t.MediaFormats["tinygif"]
+	if preview.URL == "" {
+		preview = full
+	}
+	g := GIF{ID: "tenor:" + t.ID, Provider: "tenor", Title: t.Title, URL: full.URL, PreviewURL: preview.URL}
+	if len(full.Dims) == 2 {
+		g.Width, g.Height = full.Dims[0], full.Dims[1]
+	}
+	return g
+}
+
+func (p *tenorProvider) Name() string { return "tenor" }
+
+func (p *tenorProvider) params() url.Values {
+	return url.Values{
+		"client_key":    {"chathub"},
+		"media_filter":  {"gif,tinygif"},
+		"contentfilter": {p.contentFilter},
+	}
+}
+
+// header carries the key, which Google APIs accept in X-Goog-Api-Key, so it stays out of URLs
+func (p *tenorProvider) header() http.Header {
+	return http.Header{"X-Goog-Api-Key": {p.key}}
+}
+
+func (p *tenorProvider) Search(ctx context.Context, query string, limit int, cursor string) ([]GIF, string, error) {
+	params := p.params()
+	params.Set("q", query)
+	params.Set("limit", strconv.Itoa(limit))
+	if cursor != "" {
+		params.Set("pos", cursor)
+	}
+	var resp struct {
+		Results []tenorGIF `json:"results"`
+		Next    string     `json:"next"`
+	}
+	if err := getJSON(ctx, "https://tenor.googleapis.com/v2/search?"+params.Encode(), p.header(), &resp); err != nil {
+		return nil, "", err
+	}
+	results := make([]GIF, 0, len(resp.Results))
+	for _, t := range resp.Results {
+		results = append(results, t.toGIF())
+	}
+	next := resp.Next
+	if len(resp.Results) < limit || next == "0" {
+		next = ""
+	}
+	return results, next, nil
+}
+
+func (p *tenorProvider) Get(ctx context.Context, id string) (*GIF, error) {
+	tenorID, ok := strings.CutPrefix(id, "tenor:")
+	if !ok {
+		return nil, nil
+	}
+	params := p.params()
+	params.Set("ids", tenorID)
+	var resp struct {
+		Results []tenorGIF `json:"results"`
+	}
+	if err := getJSON(ctx, "https://tenor.googleapis.com/v2/posts?"+params.Encode(), p.header(), &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Results) == 0 {
+		return nil, nil
+	}
+	g := resp.Results[0].toGIF()
+	return &g, nil
+}
+
+// --- Messages ---
+
+// insertMessageGIF stores the GIF of a message of kind "gif"
+func insertMessageGIF(ctx context.Context, tx *sql.Tx, messageID int, g *GIF) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO message_gifs (message_id, provider, gif_id, title, url, preview_url, width, height)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, messageID, g.Provider, g.ID, g.Title, g.URL, g.PreviewURL, g.Width, g.Height)
+	return err
+}
+
+// attachGIFs fills in the GIF for every GIF message in a page of history
+func attachGIFs(messages []Message) {
+	var ids []int64
+	for _, m := range messages {
+		if m.Kind == "gif" && !m.Deleted {
+			ids = append(ids, int64(m.ID))
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT message_id, provider, gif_id, title, url, preview_url, width, height
+		FROM message_gifs WHERE message_id = ANY($1)
+	`, pq.Array(ids))
+	if err != nil {
+		slog.Error("Failed to load GIFs", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	byMessage := make(map[int]*GIF)
+	for rows.Next() {
+		var msgID int
+		var g GIF
+		if err := rows.Scan(&msgID, &g.Provider, &g.ID, &g.Title, &g.URL, &g.PreviewURL, &g.Width, &g.Height); err != nil {
+			slog.Error("Error scanning GIF", "error", err)
+			continue
+		}
+		byMessage[msgID] = &g
+	}
+	for i := range messages {
+		if g, ok := byMessage[messages[i].ID]; ok && !messages[i].Deleted {
+			messages[i].GIF = g
+		}
+	}
+}
+
+// Search the GIF provider. Send a result with its id as gif_id in "sendMessage" (or POST
+// /api/rooms/{id}/messages); content is then an optional caption.
+func handleSearchGIFs(w http.ResponseWriter, r *http.Request) {
+	if gifs == nil {
+		http.Error(w, "GIF search is not configured", http.StatusNotFound)
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	limit := defaultGIFSearchLimit
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = min(l, maxGIFSearchLimit)
+	}
+
+	results, next, err := gifs.Search(r.Context(), query, limit, r.URL.Query().Get("next"))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to search GIFs", "provider", gifs.Name(), "error", err)
+		http.Error(w, "GIF search failed", http.StatusBadGateway)
+		return
+	}
+	cacheGIFs(results)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"results": results, "next": next})
+}
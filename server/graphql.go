@@ -0,0 +1,836 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+const graphQLSchema = `
+schema {
+	query: Query
+	subscription: Subscription
+}
+
+scalar Time
+
+type Query {
+	me: User!
+	# The user's rooms, most recently active first, as GET /api/rooms
+	rooms(limit: Int, offset: Int, updatedSince: Time): [Room!]!
+	# Null unless the user is a member
+	room(id: ID!): Room
+}
+
+type Subscription {
+	# The room's broadcasts, as delivered over /ws
+	roomEvents(roomId: ID!): RoomEvent!
+}
+
+type User {
+	id: ID!
+	username: String!
+}
+
+type Room {
+	id: ID!
+	name: String!
+	description: String!
+	isPrivate: Boolean!
+	createdAt: Time!
+	memberCount: Int!
+	unread: Int!
+	unreadMentions: Int!
+	lastMessage: String!
+	lastMessageAt: Time
+	avatarUrl: String
+	slowModeSeconds: Int!
+	# Pages forward with first/after, otherwise backward from the latest with last/before (default last 50)
+	messages(first: Int, after: String, last: Int, before: String): MessageConnection!
+	members: [Member!]!
+}
+
+type Member {
+	user: User!
+	role: String!
+	joinedAt: Time!
+	online: Boolean!
+	muted: Boolean!
+	mutedUntil: Time
+}
+
+type MessageConnection {
+	edges: [MessageEdge!]!
+	pageInfo: PageInfo!
+}
+
+type MessageEdge {
+	cursor: String!
+	node: Message!
+}
+
+type PageInfo {
+	hasNextPage: Boolean!
+	hasPreviousPage: Boolean!
+	startCursor: String
+	endCursor: String
+}
+
+type Message {
+	id: ID!
+	roomId: ID!
+	sender: User!
+	kind: String!
+	text: String!
+	html: String
+	timestamp: Time!
+	deleted: Boolean!
+	replyTo: QuotedMessage
+	reactions: [Reaction!]!
+	attachments: [Attachment!]!
+	poll: Poll
+	# Set for kind "system"
+	systemEvent: SystemEvent
+}
+
+type SystemEvent {
+	# e.g. "member.joined" or "member.role_granted"
+	type: String!
+	actor: User!
+	target: User
+}
+
+type QuotedMessage {
+	id: ID!
+	sender: User!
+	text: String!
+	deleted: Boolean!
+}
+
+type Reaction {
+	emoji: String!
+	count: Int!
+	userIds: [ID!]!
+}
+
+type Attachment {
+	id: ID!
+	filename: String!
+	contentType: String!
+	size: Float!
+	url: String!
+	thumbnailUrl: String
+}
+
+type Poll {
+	id: ID!
+	question: String!
+	totalVotes: Int!
+	options: [PollOption!]!
+}
+
+type PollOption {
+	id: ID!
+	text: String!
+	votes: Int!
+}
+
+type RoomEvent {
+	# The /ws event type, e.g. roomMessage or reactionAdded
+	type: String!
+	roomId: ID!
+	seq: Float!
+	# Set for roomMessage
+	message: Message
+	# The whole event as sent over /ws, JSON-encoded
+	payload: String!
+}
+`
+
+// Page size of Room.messages when neither first nor last is given, and the most either may ask for
+const (
+	defaultGraphQLPage = 50
+	maxGraphQLPage     = 100
+)
+
+var graphQLSchemaOnce = sync.OnceValue(func() *graphql.Schema {
+	return graphql.MustParseSchema(graphQLSchema, &graphQLResolver{},
+		graphql.MaxDepth(envInt("GRAPHQL_MAX_DEPTH", 10)),
+		graphql.MaxQueryLength(envInt("GRAPHQL_MAX_QUERY_BYTES", 16<<10)),
+	)
+})
+
+// graphQLHandler serves /graphql: queries as POST (or GET with ?query=) behind authMiddleware,
+// and queries and subscriptions over a WebSocket speaking graphql-transport-ws, authenticated
+// with ?token= like /ws
+func graphQLHandler() http.Handler {
+	schema := graphQLSchemaOnce()
+	queries := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req graphQLRequest
+		if r.Method == http.MethodGet {
+			req.Query = r.URL.Query().Get("query")
+			req.OperationName = r.URL.Query().Get("operationName")
+			if vars := r.URL.Query().Get("variables"); vars != "" {
+				if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+					http.Error(w, "Invalid variables", http.StatusBadRequest)
+					return
+				}
+			}
+		} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		resp := schema.Exec(r.Context(), req.Query, req.OperationName, req.Variables)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if websocket.IsWebSocketUpgrade(r) {
+			serveGraphQLSocket(w, r, schema)
+			return
+		}
+		queries.ServeHTTP(w, r)
+	})
+}
+
+type graphQLRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// --- graphql-transport-ws ---
+
+// graphQLSocketMessage is a frame of the graphql-transport-ws protocol
+type graphQLSocketMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Close codes defined by graphql-transport-ws
+const (
+	gqlCloseBadRequest         = 4400
+	gqlCloseUnauthorized       = 4401
+	gqlCloseSubscriberExists   = 4409
+	gqlCloseTooManyInitRequest = 4429
+)
+
+func serveGraphQLSocket(w http.ResponseWriter, r *http.Request, schema *graphql.Schema) {
+	if roomManager.isShuttingDown() {
+		http.Error(w, "Server is restarting", http.StatusServiceUnavailable)
+		return
+	}
+
+	claims, err := parseJWT(r.URL.Query().Get("token"))
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if !isUserActive(int(claims["user_id"].(float64))) {
+		http.Error(w, "Account has been deactivated", http.StatusForbidden)
+		return
+	}
+	if !isSessionActive(claims, clientIP(r)) {
+		http.Error(w, "Signed out on this device", http.StatusUnauthorized)
+		return
+	}
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin:  func(r *http.Request) bool { return true },
+		Subprotocols: []string{"graphql-transport-ws"},
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GraphQL WebSocket upgrade error", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// Detached from the request, which the server considers finished once the connection is hijacked
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = context.WithValue(ctx, "user_id", claims["user_id"].(float64))
+	ctx = context.WithValue(ctx, "username", claims["username"].(string))
+	ctx, untrack := trackSessionStream(ctx, tokenSessionID(claims))
+	defer untrack()
+
+	out := make(chan graphQLSocketMessage, 64)
+	go writeGraphQLSocket(ctx, conn, out)
+	send := func(msg graphQLSocketMessage) {
+		select {
+		case out <- msg:
+		case <-ctx.Done():
+		}
+	}
+	closeWith := func(code int, reason string) {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	}
+	// Signing the session out ends its subscriptions and the socket, which unblocks the read below
+	go func() {
+		<-ctx.Done()
+		if context.Cause(ctx) == errSessionSignedOut {
+			closeWith(gqlCloseUnauthorized, "Signed out on this device")
+			conn.Close()
+		}
+	}()
+
+	conn.SetReadLimit(maxFrameBytes())
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	var mu sync.Mutex
+	operations := make(map[string]context.CancelFunc)
+	initialized := false
+
+	for {
+		var msg graphQLSocketMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+
+		switch msg.Type {
+		case "connection_init":
+			if initialized {
+				closeWith(gqlCloseTooManyInitRequest, "Too many initialisation requests")
+				return
+			}
+			initialized = true
+			send(graphQLSocketMessage{Type: "connection_ack"})
+
+		case "ping":
+			send(graphQLSocketMessage{Type: "pong"})
+
+		case "pong":
+
+		case "subscribe":
+			if !initialized {
+				closeWith(gqlCloseUnauthorized, "Unauthorized")
+				return
+			}
+			var req graphQLRequest
+			if msg.ID == "" || json.Unmarshal(msg.Payload, &req) != nil {
+				closeWith(gqlCloseBadRequest, "Invalid subscribe message")
+				return
+			}
+			mu.Lock()
+			if _, exists := operations[msg.ID]; exists {
+				mu.Unlock()
+				closeWith(gqlCloseSubscriberExists, "Subscriber for "+msg.ID+" already exists")
+				return
+			}
+			opCtx, stop := context.WithCancel(ctx)
+			operations[msg.ID] = stop
+			mu.Unlock()
+
+			go func(id string) {
+				defer func() {
+					mu.Lock()
+					delete(operations, id)
+					mu.Unlock()
+					stop()
+				}()
+				results, err := schema.Subscribe(opCtx, req.Query, req.OperationName, req.Variables)
+				if err != nil {
+					payload, _ := json.Marshal([]map[string]string{{"message": err.Error()}})
+					send(graphQLSocketMessage{ID: id, Type: "error", Payload: payload})
+					return
+				}
+				for result := range results {
+					payload, err := json.Marshal(result)
+					if err != nil {
+						slog.Error("Failed to encode GraphQL result", "error", err)
+						continue
+					}
+					send(graphQLSocketMessage{ID: id, Type: "next", Payload: payload})
+				}
+				// A client-initiated complete needs no reply
+				if opCtx.Err() == nil {
+					send(graphQLSocketMessage{ID: id, Type: "complete"})
+				}
+			}(msg.ID)
+
+		case "complete":
+			mu.Lock()
+			if stop, ok := operations[msg.ID]; ok {
+				stop()
+			}
+			mu.Unlock()
+
+		default:
+			closeWith(gqlCloseBadRequest, "Unknown message type "+strconv.Quote(msg.Type))
+			return
+		}
+	}
+}
+
+// writeGraphQLSocket is the connection's only writer, sending frames and keepalive pings until ctx ends
+func writeGraphQLSocket(ctx context.Context, conn *websocket.Conn, out <-chan graphQLSocketMessage) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-out:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteJSON(msg); err != nil {
+				conn.Close()
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				conn.Close()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// --- Resolvers ---
+
+type graphQLResolver struct{}
+
+func graphQLUser(ctx context.Context) (int, string) {
+	return int(ctx.Value("user_id").(float64)), ctx.Value("username").(string)
+}
+
+func graphQLID(n int) graphql.ID {
+	return graphql.ID(strconv.Itoa(n))
+}
+
+func parseGraphQLID(id graphql.ID) (int, error) {
+	n, err := strconv.Atoi(string(id))
+	if err != nil {
+		return 0, errors.New("invalid ID " + strconv.Quote(string(id)))
+	}
+	return n, nil
+}
+
+func (*graphQLResolver) Me(ctx context.Context) *userResolver {
+	userID, username := graphQLUser(ctx)
+	return &userResolver{id: userID, username: username}
+}
+
+func (*graphQLResolver) Rooms(ctx context.Context, args struct {
+	Limit        *int32
+	Offset       *int32
+	UpdatedSince *graphql.Time
+}) ([]*roomResolver, error) {
+	userID, username := graphQLUser(ctx)
+	var opts roomListOptions
+	if args.Limit != nil {
+		opts.Limit = int(*args.Limit)
+	}
+	if args.Offset != nil && *args.Offset > 0 {
+		opts.Offset = int(*args.Offset)
+	}
+	if args.UpdatedSince != nil {
+		opts.UpdatedSince = &args.UpdatedSince.Time
+	}
+
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	rooms, _, err := store.ListRooms(dbCtx, userID, username, opts)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get rooms", "error", err)
+		return nil, errors.New("failed to get rooms")
+	}
+	resolvers := make([]*roomResolver, len(rooms))
+	for i := range rooms {
+		resolvers[i] = &roomResolver{room: rooms[i]}
+	}
+	return resolvers, nil
+}
+
+func (*graphQLResolver) Room(ctx context.Context, args struct{ ID graphql.ID }) (*roomResolver, error) {
+	roomID, err := parseGraphQLID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	userID, username := graphQLUser(ctx)
+
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	rooms, _, err := store.ListRooms(dbCtx, userID, username, roomListOptions{RoomID: roomID})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get room", "room_id", roomID, "error", err)
+		return nil, errors.New("failed to get room")
+	}
+	if len(rooms) == 0 {
+		return nil, nil
+	}
+	return &roomResolver{room: rooms[0]}, nil
+}
+
+// RoomEvents relays the room's hub broadcasts until the subscription ends
+func (*graphQLResolver) RoomEvents(ctx context.Context, args struct{ RoomID graphql.ID }) (<-chan *roomEventResolver, error) {
+	roomID, err := parseGraphQLID(args.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	userID, username := graphQLUser(ctx)
+	if !isUserInRoom(userID, roomID) {
+		return nil, errNotRoomMember
+	}
+
+	broadcasts := roomManager.WatchRoom(ctx, roomID, userID, username)
+	events := make(chan *roomEventResolver)
+	go func() {
+		defer close(events)
+		for msg := range broadcasts {
+			select {
+			case events <- &roomEventResolver{msg: msg}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+type userResolver struct {
+	id       int
+	username string
+}
+
+func (u *userResolver) ID() graphql.ID   { return graphQLID(u.id) }
+func (u *userResolver) Username() string { return u.username }
+
+type roomResolver struct {
+	room Room
+}
+
+func (r *roomResolver) ID() graphql.ID          { return graphQLID(r.room.ID) }
+func (r *roomResolver) Name() string            { return r.room.Name }
+func (r *roomResolver) Description() string     { return r.room.Description }
+func (r *roomResolver) IsPrivate() bool         { return r.room.IsPrivate }
+func (r *roomResolver) CreatedAt() graphql.Time { return graphql.Time{Time: r.room.CreatedAt} }
+func (r *roomResolver) MemberCount() int32      { return int32(r.room.Members) }
+func (r *roomResolver) Unread() int32           { return int32(r.room.Unread) }
+func (r *roomResolver) UnreadMentions() int32   { return int32(r.room.UnreadMentions) }
+func (r *roomResolver) LastMessage() string     { return r.room.LastMessage }
+func (r *roomResolver) AvatarURL() *string      { return optionalString(r.room.AvatarURL) }
+func (r *roomResolver) SlowModeSeconds() int32  { return int32(r.room.SlowModeSeconds) }
+
+func (r *roomResolver) LastMessageAt() *graphql.Time {
+	if r.room.LastMessageAt == nil {
+		return nil
+	}
+	return &graphql.Time{Time: *r.room.LastMessageAt}
+}
+
+func (r *roomResolver) Messages(ctx context.Context, args struct {
+	First  *int32
+	After  *string
+	Last   *int32
+	Before *string
+}) (*messageConnectionResolver, error) {
+	var afterID, beforeID int
+	var err error
+	if args.After != nil {
+		if afterID, err = decodeMessageCursor(*args.After); err != nil {
+			return nil, err
+		}
+	}
+	if args.Before != nil {
+		if beforeID, err = decodeMessageCursor(*args.Before); err != nil {
+			return nil, err
+		}
+	}
+	if afterID > 0 && beforeID > 0 {
+		return nil, errors.New("after and before can't be combined")
+	}
+
+	forward := args.After != nil || (args.First != nil && args.Last == nil && args.Before == nil)
+	cursor, limit := beforeID, defaultGraphQLPage
+	if forward {
+		cursor = afterID
+		if args.First != nil {
+			limit = int(*args.First)
+		}
+	} else if args.Last != nil {
+		limit = int(*args.Last)
+	}
+	if limit < 1 || limit > maxGraphQLPage {
+		return nil, errors.New("page size must be between 1 and " + strconv.Itoa(maxGraphQLPage))
+	}
+
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	userID, _ := graphQLUser(ctx)
+	messages, more, err := store.MessagePage(dbCtx, r.room.ID, userID, cursor, forward, limit)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to fetch messages", "room_id", r.room.ID, "error", err)
+		return nil, errors.New("failed to fetch messages")
+	}
+
+	conn := &messageConnectionResolver{messages: messages}
+	if forward {
+		conn.hasNext = more
+		conn.hasPrevious = args.After != nil
+	} else {
+		conn.hasPrevious = more
+		conn.hasNext = args.Before != nil
+	}
+	return conn, nil
+}
+
+func (r *roomResolver) Members(ctx context.Context) ([]*memberResolver, error) {
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	members, err := store.RoomMembers(dbCtx, r.room.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get room members", "room_id", r.room.ID, "error", err)
+		return nil, errors.New("failed to get room members")
+	}
+	resolvers := make([]*memberResolver, len(members))
+	for i := range members {
+		resolvers[i] = &memberResolver{member: members[i]}
+	}
+	return resolvers, nil
+}
+
+type memberResolver struct {
+	member RoomMember
+}
+
+func (m *memberResolver) User() *userResolver {
+	return &userResolver{id: m.member.ID, username: m.member.Username}
+}
+func (m *memberResolver) Role() string           { return m.member.Role }
+func (m *memberResolver) JoinedAt() graphql.Time { return graphql.Time{Time: m.member.JoinedAt} }
+func (m *memberResolver) Online() bool           { return m.member.Online }
+func (m *memberResolver) Muted() bool            { return m.member.Muted }
+func (m *memberResolver) MutedUntil() *graphql.Time {
+	if m.member.MutedUntil == nil {
+		return nil
+	}
+	return &graphql.Time{Time: *m.member.MutedUntil}
+}
+
+// Message cursors are opaque to clients but just wrap the message ID
+func encodeMessageCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("message:" + strconv.Itoa(id)))
+}
+
+func decodeMessageCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		if id, ok := strings.CutPrefix(string(raw), "message:"); ok {
+			if n, err := strconv.Atoi(id); err == nil && n > 0 {
+				return n, nil
+			}
+		}
+	}
+	return 0, errors.New("invalid cursor")
+}
+
+type messageConnectionResolver struct {
+	messages             []Message
+	hasNext, hasPrevious bool
+}
+
+func (c *messageConnectionResolver) Edges() []*messageEdgeResolver {
+	edges := make([]*messageEdgeResolver, len(c.messages))
+	for i := range c.messages {
+		edges[i] = &messageEdgeResolver{message: &c.messages[i]}
+	}
+	return edges
+}
+
+func (c *messageConnectionResolver) PageInfo() *pageInfoResolver {
+	info := &pageInfoResolver{hasNext: c.hasNext, hasPrevious: c.hasPrevious}
+	if len(c.messages) > 0 {
+		start := encodeMessageCursor(c.messages[0].ID)
+		end := encodeMessageCursor(c.messages[len(c.messages)-1].ID)
+		info.start, info.end = &start, &end
+	}
+	return info
+}
+
+type messageEdgeResolver struct {
+	message *Message
+}
+
+func (e *messageEdgeResolver) Cursor() string         { return encodeMessageCursor(e.message.ID) }
+func (e *messageEdgeResolver) Node() *messageResolver { return &messageResolver{msg: e.message} }
+
+type pageInfoResolver struct {
+	hasNext, hasPrevious bool
+	start, end           *string
+}
+
+func (p *pageInfoResolver) HasNextPage() bool     { return p.hasNext }
+func (p *pageInfoResolver) HasPreviousPage() bool { return p.hasPrevious }
+func (p *pageInfoResolver) StartCursor() *string  { return p.start }
+func (p *pageInfoResolver) EndCursor() *string    { return p.end }
+
+type messageResolver struct {
+	msg *Message
+}
+
+func (m *messageResolver) ID() graphql.ID     { return graphQLID(m.msg.ID) }
+func (m *messageResolver) RoomID() graphql.ID { return graphQLID(m.msg.RoomID) }
+func (m *messageResolver) Sender() *userResolver {
+	return &userResolver{id: m.msg.SenderID, username: m.msg.Sender}
+}
+func (m *messageResolver) Kind() string            { return m.msg.Kind }
+func (m *messageResolver) Text() string            { return m.msg.Text }
+func (m *messageResolver) HTML() *string           { return optionalString(m.msg.HTML) }
+func (m *messageResolver) Timestamp() graphql.Time { return graphql.Time{Time: m.msg.Timestamp} }
+func (m *messageResolver) Deleted() bool           { return m.msg.Deleted }
+
+func (m *messageResolver) ReplyTo() *quotedMessageResolver {
+	if m.msg.ReplyTo == nil {
+		return nil
+	}
+	return &quotedMessageResolver{quote: m.msg.ReplyTo}
+}
+
+func (m *messageResolver) Reactions() []*reactionResolver {
+	resolvers := make([]*reactionResolver, len(m.msg.Reactions))
+	for i := range m.msg.Reactions {
+		resolvers[i] = &reactionResolver{reaction: &m.msg.Reactions[i]}
+	}
+	return resolvers
+}
+
+func (m *messageResolver) Attachments() []*attachmentResolver {
+	resolvers := make([]*attachmentResolver, len(m.msg.Attachments))
+	for i := range m.msg.Attachments {
+		resolvers[i] = &attachmentResolver{attachment: &m.msg.Attachments[i]}
+	}
+	return resolvers
+}
+
+func (m *messageResolver) Poll() *pollResolver {
+	if m.msg.Poll == nil {
+		return nil
+	}
+	return &pollResolver{poll: m.msg.Poll}
+}
+
+func (m *messageResolver) SystemEvent() *systemEventResolver {
+	if m.msg.SystemEvent == nil {
+		return nil
+	}
+	return &systemEventResolver{event: m.msg.SystemEvent}
+}
+
+type systemEventResolver struct {
+	event *SystemEvent
+}
+
+func (e *systemEventResolver) Type() string { return e.event.Type }
+func (e *systemEventResolver) Actor() *userResolver {
+	return &userResolver{id: e.event.ActorID, username: e.event.Params["actor"]}
+}
+func (e *systemEventResolver) Target() *userResolver {
+	if e.event.TargetID == 0 {
+		return nil
+	}
+	return &userResolver{id: e.event.TargetID, username: e.event.Params["target"]}
+}
+
+type quotedMessageResolver struct {
+	quote *QuotedMessage
+}
+
+func (q *quotedMessageResolver) ID() graphql.ID { return graphQLID(q.quote.ID) }
+func (q *quotedMessageResolver) Sender() *userResolver {
+	return &userResolver{id: q.quote.SenderID, username: q.quote.Sender}
+}
+func (q *quotedMessageResolver) Text() string  { return q.quote.Text }
+func (q *quotedMessageResolver) Deleted() bool { return q.quote.Deleted }
+
+type reactionResolver struct {
+	reaction *ReactionSummary
+}
+
+func (r *reactionResolver) Emoji() string { return r.reaction.Emoji }
+func (r *reactionResolver) Count() int32  { return int32(r.reaction.Count) }
+func (r *reactionResolver) UserIDs() []graphql.ID {
+	ids := make([]graphql.ID, len(r.reaction.UserIDs))
+	for i, id := range r.reaction.UserIDs {
+		ids[i] = graphQLID(id)
+	}
+	return ids
+}
+
+type attachmentResolver struct {
+	attachment *Attachment
+}
+
+func (a *attachmentResolver) ID() graphql.ID        { return graphQLID(a.attachment.ID) }
+func (a *attachmentResolver) Filename() string      { return a.attachment.Filename }
+func (a *attachmentResolver) ContentType() string   { return a.attachment.ContentType }
+func (a *attachmentResolver) Size() float64         { return float64(a.attachment.Size) }
+func (a *attachmentResolver) URL() string           { return a.attachment.URL }
+func (a *attachmentResolver) ThumbnailURL() *string { return optionalString(a.attachment.ThumbnailURL) }
+
+type pollResolver struct {
+	poll *Poll
+}
+
+func (p *pollResolver) ID() graphql.ID    { return graphQLID(p.poll.ID) }
+func (p *pollResolver) Question() string  { return p.poll.Question }
+func (p *pollResolver) TotalVotes() int32 { return int32(p.poll.TotalVotes) }
+func (p *pollResolver) Options() []*pollOptionResolver {
+	resolvers := make([]*pollOptionResolver, len(p.poll.Options))
+	for i := range p.poll.Options {
+		resolvers[i] = &pollOptionResolver{option: &p.poll.Options[i]}
+	}
+	return resolvers
+}
+
+type pollOptionResolver struct {
+	option *PollOption
+}
+
+func (o *pollOptionResolver) ID() graphql.ID { return graphQLID(o.option.ID) }
+func (o *pollOptionResolver) Text() string   { return o.option.Text }
+func (o *pollOptionResolver) Votes() int32   { return int32(o.option.Votes) }
+
+type roomEventResolver struct {
+	msg *WSMessage
+}
+
+func (e *roomEventResolver) Type() string       { return e.msg.Type }
+func (e *roomEventResolver) RoomID() graphql.ID { return graphQLID(e.msg.RoomID) }
+func (e *roomEventResolver) Seq() float64       { return float64(e.msg.Seq) }
+
+func (e *roomEventResolver) Message() *messageResolver {
+	if e.msg.Type != "roomMessage" || e.msg.Message == nil {
+		return nil
+	}
+	return &messageResolver{msg: e.msg.Message}
+}
+
+func (e *roomEventResolver) Payload() (string, error) {
+	data, err := json.Marshal(e.msg)
+	return string(data), err
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,291 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=module=chatapp --go-grpc_out=. --go-grpc_opt=module=chatapp proto/chathub.proto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"chatapp/chatpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer is set when GRPC_ADDR is configured
+var grpcServer *grpc.Server
+
+// startGRPC serves ChatService on GRPC_ADDR (e.g. ":9090"), for internal services and bots.
+// It is off unless the address is set.
+func startGRPC() error {
+	addr := getEnv("GRPC_ADDR", "")
+	if addr == "" {
+		return nil
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	grpcServer = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(grpcRecoverUnary, grpcAuthUnary),
+		grpc.ChainStreamInterceptor(grpcRecoverStream, grpcAuthStream),
+	)
+	chatpb.RegisterChatServiceServer(grpcServer, &chatService{})
+
+	go func() {
+		slog.Info("gRPC server running", "addr", addr)
+		if err := grpcServer.Serve(lis); err != nil {
+			slog.Error("gRPC server stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// stopGRPC lets in-flight calls finish for up to timeout, then cancels the rest; streams only end
+// when cancelled, so they are cut off at the deadline
+func stopGRPC(timeout time.Duration) {
+	if grpcServer == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		grpcServer.Stop()
+	}
+}
+
+// --- Auth ---
+
+// peerIP is the address a gRPC call came from, recorded on the caller's session
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// grpcAuthenticate accepts the same credentials as authMiddleware, from "authorization" or
+// "x-api-key" metadata, and puts the user in the context under the same keys
+func grpcAuthenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	var userID int
+	var username, sessionID string
+	if apiKey := first("x-api-key"); apiKey != "" {
+		var err error
+		if userID, username, err = lookupAPIKey(apiKey); err != nil {
+			return nil, status.Error(codes.Unauthenticated, "Invalid API key")
+		}
+	} else {
+		token := strings.TrimPrefix(first("authorization"), "Bearer ")
+		if token == "" {
+			return nil, status.Error(codes.Unauthenticated, "Missing authorization token")
+		}
+		claims, err := parseJWT(token)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, "Invalid token")
+		}
+		userID, username = int(claims["user_id"].(float64)), claims["username"].(string)
+		if !isUserActive(userID) {
+			return nil, status.Error(codes.PermissionDenied, "Account has been deactivated")
+		}
+		if !isSessionActive(claims, peerIP(ctx)) {
+			return nil, status.Error(codes.Unauthenticated, "Signed out on this device")
+		}
+		sessionID = tokenSessionID(claims)
+	}
+
+	ctx = context.WithValue(ctx, "user_id", float64(userID))
+	ctx = context.WithValue(ctx, "username", username)
+	ctx = context.WithValue(ctx, "session_id", sessionID)
+	return ctx, nil
+}
+
+func grpcAuthUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := grpcAuthenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcAuthStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := grpcAuthenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authedStream carries the authenticated context into stream handlers
+type authedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authedStream) Context() context.Context { return s.ctx }
+
+// The gRPC equivalents of recoverPanics, so one bad call can't take the server down
+func grpcRecoverUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			slog.ErrorContext(ctx, "Panic in gRPC call", "method", info.FullMethod, "panic", p)
+			err = status.Error(codes.Internal, "Internal server error")
+		}
+	}()
+	return handler(ctx, req)
+}
+
+func grpcRecoverStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			slog.ErrorContext(ss.Context(), "Panic in gRPC stream", "method", info.FullMethod, "panic", p)
+			err = status.Error(codes.Internal, "Internal server error")
+		}
+	}()
+	return handler(srv, ss)
+}
+
+// --- ChatService ---
+
+type chatService struct {
+	chatpb.UnimplementedChatServiceServer
+}
+
+func (*chatService) SendMessage(ctx context.Context, req *chatpb.SendMessageRequest) (*chatpb.Message, error) {
+	userID, username := int(ctx.Value("user_id").(float64)), ctx.Value("username").(string)
+	attachmentIDs := make([]int, len(req.AttachmentIds))
+	for i, id := range req.AttachmentIds {
+		attachmentIDs[i] = int(id)
+	}
+
+	saved, err := postUserMessage(&OutgoingMessage{
+		RoomID:        int(req.RoomId),
+		SenderID:      userID,
+		Sender:        username,
+		Content:       req.Content,
+		AttachmentIDs: attachmentIDs,
+		ReplyToID:     int(req.ReplyToId),
+	})
+	var verr *ValidationError
+	if errors.Is(err, errNotRoomMember) {
+		return nil, status.Error(codes.PermissionDenied, "Not authorized")
+	} else if errors.As(err, &verr) {
+		return nil, status.Error(codes.InvalidArgument, verr.Message)
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Failed to save message", "room_id", req.RoomId, "error", err)
+		return nil, status.Error(codes.Internal, "Failed to send message")
+	}
+	return messageToProto(saved), nil
+}
+
+func (*chatService) StreamRoomMessages(req *chatpb.StreamRoomMessagesRequest, stream grpc.ServerStreamingServer[chatpb.RoomEvent]) error {
+	ctx, untrack := trackSessionStream(stream.Context(), stream.Context().Value("session_id").(string))
+	defer untrack()
+	userID, username := int(ctx.Value("user_id").(float64)), ctx.Value("username").(string)
+	roomID := int(req.RoomId)
+	if !isUserInRoom(userID, roomID) {
+		return status.Error(codes.PermissionDenied, "Not authorized")
+	}
+
+	for msg := range roomManager.WatchRoom(ctx, roomID, userID, username) {
+		if msg.Type != "roomMessage" && !req.AllEvents {
+			continue
+		}
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to encode room event", "room_id", roomID, "error", err)
+			continue
+		}
+		event := &chatpb.RoomEvent{Type: msg.Type, RoomId: int64(msg.RoomID), Seq: msg.Seq, Payload: payload}
+		if msg.Type == "roomMessage" && msg.Message != nil {
+			event.Message = messageToProto(msg.Message)
+		}
+		if err := stream.Send(event); err != nil {
+			return err
+		}
+	}
+	if context.Cause(ctx) == errSessionSignedOut {
+		return status.Error(codes.Unauthenticated, "Signed out on this device")
+	}
+	return ctx.Err()
+}
+
+func (*chatService) ListRooms(ctx context.Context, req *chatpb.ListRoomsRequest) (*chatpb.ListRoomsResponse, error) {
+	userID, username := int(ctx.Value("user_id").(float64)), ctx.Value("username").(string)
+	opts := roomListOptions{Limit: int(req.Limit), Offset: max(int(req.Offset), 0)}
+	if req.UpdatedSince != nil {
+		t := req.UpdatedSince.AsTime()
+		opts.UpdatedSince = &t
+	}
+
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	rooms, syncedAt, err := store.ListRooms(dbCtx, userID, username, opts)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get rooms", "error", err)
+		return nil, status.Error(codes.Internal, "Failed to get rooms")
+	}
+
+	resp := &chatpb.ListRoomsResponse{Rooms: make([]*chatpb.Room, len(rooms)), SyncedAt: timestamppb.New(syncedAt)}
+	for i, room := range rooms {
+		resp.Rooms[i] = &chatpb.Room{
+			Id:              int64(room.ID),
+			Name:            room.Name,
+			Description:     room.Description,
+			IsPrivate:       room.IsPrivate,
+			CreatedAt:       timestamppb.New(room.CreatedAt),
+			MemberCount:     int32(room.Members),
+			Unread:          int32(room.Unread),
+			LastMessage:     room.LastMessage,
+			LastSenderId:    int64(room.LastSenderID),
+			AvatarUrl:       room.AvatarURL,
+			SlowModeSeconds: int32(room.SlowModeSeconds),
+		}
+	}
+	return resp, nil
+}
+
+func messageToProto(m *Message) *chatpb.Message {
+	pm := &chatpb.Message{
+		Id:        int64(m.ID),
+		RoomId:    int64(m.RoomID),
+		SenderId:  int64(m.SenderID),
+		Sender:    m.Sender,
+		Kind:      m.Kind,
+		Text:      m.Text,
+		Html:      m.HTML,
+		Timestamp: timestamppb.New(m.Timestamp),
+		Deleted:   m.Deleted,
+	}
+	if m.ReplyTo != nil {
+		pm.ReplyToId = int64(m.ReplyTo.ID)
+	}
+	return pm
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const readinessTimeout = 2 * time.Second
+
+// Liveness probe: the process is up and serving HTTP
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// Readiness probe: the database and broker are reachable and the server isn't shutting down.
+// Responds 503 with the failing checks so load balancers stop routing here.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := map[string]string{"database": "ok", "broker": "ok", "server": "ok"}
+	ready := true
+	if err := db.PingContext(ctx); err != nil {
+		checks["database"] = err.Error()
+		ready = false
+	}
+	if err := broker.Ping(ctx); err != nil {
+		checks["broker"] = err.Error()
+		ready = false
+	}
+	if roomManager.isShuttingDown() {
+		checks["server"] = "shutting down"
+		ready = false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		slog.WarnContext(r.Context(), "Readiness check failed", "checks", checks)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"ready": ready, "checks": checks})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// hubIdleTimeout is how long a hub may have no clients before it is shut down
+func hubIdleTimeout() time.Duration {
+	return time.Duration(envInt("WS_HUB_IDLE_SECONDS", 300)) * time.Second
+}
+
+// BroadcastToRoom queues a message on the room's hub. If the hub shuts down before taking it,
+// the message goes to the hub that replaces it.
+func (m *RoomManager) BroadcastToRoom(roomID int, msg *WSMessage) {
+	if msg.Message != nil && msg.Message.shadowbanned {
+		// Echoed to the sender alone, so nothing looks amiss to them
+		m.SendToUser(msg.Message.SenderID, msg)
+		return
+	}
+	notifyWebhooksOfBroadcast(roomID, msg)
+	queueNotifications(msg)
+	for {
+		hub := m.GetOrCreateRoomHub(roomID)
+		select {
+		case hub.Broadcast <- msg:
+			return
+		case <-hub.done:
+		}
+	}
+}
+
+// SubscribeToRoom registers the client with the room's hub, starting one if needed
+func (m *RoomManager) SubscribeToRoom(roomID int, client *Client) {
+	for {
+		hub := m.GetOrCreateRoomHub(roomID)
+		select {
+		case hub.Register <- client:
+			return
+		case <-hub.done:
+		}
+	}
+}
+
+// UnsubscribeFromRoom stops the client receiving the room's broadcasts
+func (m *RoomManager) UnsubscribeFromRoom(roomID int, client *Client) {
+	m.mu.RLock()
+	hub, ok := m.Rooms[roomID]
+	m.mu.RUnlock()
+	if ok {
+		select {
+		case hub.Unregister <- client:
+		case <-hub.done:
+		}
+	}
+}
+
+// WatchRoom registers with the room's hub on behalf of a non-WebSocket consumer (GraphQL, gRPC)
+// and returns its broadcasts until ctx ends. The watcher isn't a connection of the manager, so it
+// doesn't count towards presence; removal from the room stops the events, as for /ws.
+func (m *RoomManager) WatchRoom(ctx context.Context, roomID, userID int, username string) <-chan *WSMessage {
+	watcher := &Client{
+		ID:       userID,
+		Username: username,
+		Avatar:   avatarInitial(username),
+		Send:     make(chan *WSMessage, 256),
+		Manager:  m,
+	}
+	m.SubscribeToRoom(roomID, watcher)
+
+	events := make(chan *WSMessage)
+	go func() {
+		defer close(events)
+		defer m.UnsubscribeFromRoom(roomID, watcher)
+		for {
+			select {
+			case msg := <-watcher.Send:
+				select {
+				case events <- msg:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// CloseRoomHub stops the room's hub and its broker subscription, e.g. when the room is deleted.
+// Connected clients simply stop receiving the room's events.
+func (m *RoomManager) CloseRoomHub(roomID int) {
+	m.mu.Lock()
+	hub, ok := m.Rooms[roomID]
+	if ok {
+		delete(m.Rooms, roomID)
+	}
+	m.mu.Unlock()
+
+	if ok {
+		hub.close()
+	}
+}
+
+// CloseAllHubs stops every hub, at shutdown
+func (m *RoomManager) CloseAllHubs() {
+	m.mu.Lock()
+	hubs := m.Rooms
+	m.Rooms = make(map[int]*RoomHub)
+	m.mu.Unlock()
+
+	for _, hub := range hubs {
+		hub.close()
+	}
+}
+
+func (h *RoomHub) close() {
+	close(h.done)
+	if h.unsubscribe != nil {
+		h.unsubscribe()
+	}
+}
+
+// flushToBroker publishes broadcasts that were queued when the hub shut down, since clients
+// on other instances may still be listening
+func (h *RoomHub) flushToBroker() {
+	for {
+		select {
+		case message := <-h.Broadcast:
+			if h.unsubscribe == nil {
+				continue
+			}
+			if err := broker.Publish(h.RoomID, message); err != nil {
+				slog.Error("Failed to publish while stopping hub", "room_id", h.RoomID, "error", err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// reapIdleHubs shuts down hubs that have had no clients for hubIdleTimeout, so rooms nobody is
+// watching don't keep goroutines and broker subscriptions alive
+func (m *RoomManager) reapIdleHubs() {
+	interval := hubIdleTimeout() / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		var idle []*RoomHub
+
+		m.mu.Lock()
+		for roomID, hub := range m.Rooms {
+			hub.mu.RLock()
+			empty := len(hub.Clients) == 0
+			hub.mu.RUnlock()
+
+			switch {
+			case !empty:
+				hub.idleSince = time.Time{}
+			case hub.idleSince.IsZero():
+				hub.idleSince = now
+			case now.Sub(hub.idleSince) >= hubIdleTimeout():
+				delete(m.Rooms, roomID)
+				idle = append(idle, hub)
+			}
+		}
+		m.mu.Unlock()
+
+		for _, hub := range idle {
+			hub.close()
+		}
+		if len(idle) > 0 {
+			slog.Info("Stopped idle room hubs", "count", len(idle))
+		}
+	}
+}
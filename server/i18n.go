@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+// SystemEvent is what a system message (kind "system") says, stored with it so each reader gets
+// it in their own language and bots can act on it. The message's text is the English rendering,
+// for clients that don't localize.
+type SystemEvent struct {
+	Type     string            `json:"type"`                // The action, e.g. "member.joined"
+	ActorID  int               `json:"actor_id"`            // Who did it
+	TargetID int               `json:"target_id,omitempty"` // Who it was done to, for events with a target
+	Params   map[string]string `json:"params"`              // Usernames, counts, and "at" as an RFC 3339 time
+}
+
+// System event types
+const (
+	EventRoomCreated          = "room.created"           // actor, at
+	EventMemberJoined         = "member.joined"          // actor, at
+	EventMemberLeft           = "member.left"            // actor, at
+	EventMemberRemoved        = "member.removed"         // actor, target, at
+	EventMemberBanned         = "member.banned"          // actor, target
+	EventMemberMuted          = "member.muted"           // actor, target, and minutes for a timed mute
+	EventMemberUnmuted        = "member.unmuted"         // actor, target
+	EventRoleGranted          = "member.role_granted"    // actor, target, role
+	EventRoleRevoked          = "member.role_revoked"    // actor, target, role (the one taken away)
+	EventOwnershipTransferred = "room.owner_transferred" // actor, target
+	EventSlowModeChanged      = "room.slow_mode"         // actor, and seconds when turned on
+	EventRoomInactive         = "room.inactive"          // days, action (archive or delete), at (when it happens)
+	EventRoomArchived         = "room.archived"          // at
+	EventRoomUnarchived       = "room.unarchived"        // actor
+)
+
+const defaultLocale = "en"
+
+// systemMessageCatalog holds each locale's templates, keyed by event type and, where the wording
+// depends on a parameter, a variant after a colon. {name} is replaced by the parameter.
+var systemMessageCatalog = map[string]map[string]string{
+	"en": {
+		EventRoomCreated:                  "{actor} created this room at {at}.",
+		EventMemberJoined:                 "{actor} joined this room at {at}.",
+		EventMemberLeft:                   "{actor} left this room at {at}.",
+		EventMemberRemoved:                "{actor} removed {target} from this room at {at}.",
+		EventMemberBanned:                 "{actor} banned {target} from this room.",
+		EventMemberMuted:                  "{actor} muted {target}.",
+		EventMemberMuted + ":timed":       "{actor} muted {target} for {minutes} minutes.",
+		EventMemberUnmuted:                "{actor} unmuted {target}.",
+		EventRoleGranted + ":admin":       "{actor} made {target} an admin.",
+		EventRoleGranted + ":moderator":   "{actor} made {target} a moderator.",
+		EventRoleRevoked + ":admin":       "{actor} removed {target} as admin.",
+		EventRoleRevoked + ":moderator":   "{actor} removed {target} as moderator.",
+		EventOwnershipTransferred:         "{actor} transferred ownership of this room to {target}.",
+		EventSlowModeChanged:              "{actor} turned off slow mode.",
+		EventSlowModeChanged + ":enabled": "{actor} turned on slow mode: one message every {seconds} seconds.",
+		EventRoomInactive + ":archive":    "No one has posted here for {days} days. This room will be archived at {at} unless someone sends a message.",
+		EventRoomInactive + ":delete":     "No one has posted here for {days} days. This room will be deleted at {at} unless someone sends a message.",
+		EventRoomArchived:                 "This room was archived at {at} for inactivity.",
+		EventRoomUnarchived:               "{actor} unarchived this room.",
+	},
+	"es": {
+		EventRoomCreated:                  "{actor} creó esta sala a las {at}.",
+		EventMemberJoined:                 "{actor} se unió a esta sala a las {at}.",
+		EventMemberLeft:                   "{actor} salió de esta sala a las {at}.",
+		EventMemberRemoved:                "{actor} expulsó a {target} de esta sala a las {at}.",
+		EventMemberBanned:                 "{actor} vetó a {target} en esta sala.",
+		EventMemberMuted:                  "{actor} silenció a {target}.",
+		EventMemberMuted + ":timed":       "{actor} silenció a {target} durante {minutes} minutos.",
+		EventMemberUnmuted:                "{actor} quitó el silencio a {target}.",
+		EventRoleGranted + ":admin":       "{actor} hizo administrador a {target}.",
+		EventRoleGranted + ":moderator":   "{actor} hizo moderador a {target}.",
+		EventRoleRevoked + ":admin":       "{actor} quitó a {target} como administrador.",
+		EventRoleRevoked + ":moderator":   "{actor} quitó a {target} como moderador.",
+		EventOwnershipTransferred:         "{actor} transfirió la propiedad de esta sala a {target}.",
+		EventSlowModeChanged:              "{actor} desactivó el modo lento.",
+		EventSlowModeChanged + ":enabled": "{actor} activó el modo lento: un mensaje cada {seconds} segundos.",
+		EventRoomInactive + ":archive":    "Nadie ha escrito aquí en {days} días. Esta sala se archivará a las {at} si nadie envía un mensaje.",
+		EventRoomInactive + ":delete":     "Nadie ha escrito aquí en {days} días. Esta sala se eliminará a las {at} si nadie envía un mensaje.",
+		EventRoomArchived:                 "Esta sala se archivó a las {at} por inactividad.",
+		EventRoomUnarchived:               "{actor} desarchivó esta sala.",
+	},
+	"fr": {
+		EventRoomCreated:                  "{actor} a créé ce salon à {at}.",
+		EventMemberJoined:                 "{actor} a rejoint ce salon à {at}.",
+		EventMemberLeft:                   "{actor} a quitté ce salon à {at}.",
+		EventMemberRemoved:                "{actor} a retiré {target} de ce salon à {at}.",
+		EventMemberBanned:                 "{actor} a banni {target} de ce salon.",
+		EventMemberMuted:                  "{actor} a rendu {target} muet.",
+		EventMemberMuted + ":timed":       "{actor} a rendu {target} muet pendant {minutes} minutes.",
+		EventMemberUnmuted:                "{actor} a rendu la parole à {target}.",
+		EventRoleGranted + ":admin":       "{actor} a nommé {target} administrateur.",
+		EventRoleGranted + ":moderator":   "{actor} a nommé {target} modérateur.",
+		EventRoleRevoked + ":admin":       "{actor} a retiré à {target} le rôle d'administrateur.",
+		EventRoleRevoked + ":moderator":   "{actor} a retiré à {target} le rôle de modérateur.",
+		EventOwnershipTransferred:         "{actor} a transféré la propriété de ce salon à {target}.",
+		EventSlowModeChanged:              "{actor} a désactivé le mode lent.",
+		EventSlowModeChanged + ":enabled": "{actor} a activé le mode lent : un message toutes les {seconds} secondes.",
+		EventRoomInactive + ":archive":    "Personne n'a écrit ici depuis {days} jours. Ce salon sera archivé à {at} si personne n'envoie de message.",
+		EventRoomInactive + ":delete":     "Personne n'a écrit ici depuis {days} jours. Ce salon sera supprimé à {at} si personne n'envoie de message.",
+		EventRoomArchived:                 "Ce salon a été archivé à {at} pour inactivité.",
+		EventRoomUnarchived:               "{actor} a désarchivé ce salon.",
+	},
+	"de": {
+		EventRoomCreated:                  "{actor} hat diesen Raum um {at} erstellt.",
+		EventMemberJoined:                 "{actor} ist diesem Raum um {at} beigetreten.",
+		EventMemberLeft:                   "{actor} hat diesen Raum um {at} verlassen.",
+		EventMemberRemoved:                "{actor} hat {target} um {at} aus diesem Raum entfernt.",
+		EventMemberBanned:                 "{actor} hat {target} aus diesem Raum verbannt.",
+		EventMemberMuted:                  "{actor} hat {target} stummgeschaltet.",
+		EventMemberMuted + ":timed":       "{actor} hat {target} für {minutes} Minuten stummgeschaltet.",
+		EventMemberUnmuted:                "{actor} hat die Stummschaltung von {target} aufgehoben.",
+		EventRoleGranted + ":admin":       "{actor} hat {target} zum Admin gemacht.",
+		EventRoleGranted + ":moderator":   "{actor} hat {target} zum Moderator gemacht.",
+		EventRoleRevoked + ":admin":       "{actor} hat {target} die Admin-Rolle entzogen.",
+		EventRoleRevoked + ":moderator":   "{actor} hat {target} die Moderator-Rolle entzogen.",
+		EventOwnershipTransferred:         "{actor} hat die Leitung dieses Raums an {target} übertragen.",
+		EventSlowModeChanged:              "{actor} hat den langsamen Modus ausgeschaltet.",
+		EventSlowModeChanged + ":enabled": "{actor} hat den langsamen Modus eingeschaltet: eine Nachricht alle {seconds} Sekunden.",
+		EventRoomInactive + ":archive":    "Seit {days} Tagen hat hier niemand geschrieben. Dieser Raum wird um {at} archiviert, wenn niemand eine Nachricht sendet.",
+		EventRoomInactive + ":delete":     "Seit {days} Tagen hat hier niemand geschrieben. Dieser Raum wird um {at} gelöscht, wenn niemand eine Nachricht sendet.",
+		EventRoomArchived:                 "Dieser Raum wurde um {at} wegen Inaktivität archiviert.",
+		EventRoomUnarchived:               "{actor} hat die Archivierung dieses Raums aufgehoben.",
+	},
+}
+
+// systemMessageTimeFormats formats the {at} parameter in each locale, in the server's time zone
+var systemMessageTimeFormats = map[string]string{
+	"en": SystemMessageTimeFormat,
+	"es": "15:04 del 2/1/2006",
+	"fr": "15:04 le 02/01/2006",
+	"de": "15:04 Uhr am 02.01.2006",
+}
+
+var localeMatcher = language.NewMatcher([]language.Tag{language.English, language.Spanish, language.French, language.German})
+
+// requestLocale picks the locale for a request from ?locale= or else Accept-Language
+func requestLocale(r *http.Request) string {
+	tags, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if v := r.URL.Query().Get("locale"); v != "" {
+		if tag, err := language.Parse(v); err == nil {
+			tags = append([]language.Tag{tag}, tags...)
+		}
+	}
+	if len(tags) == 0 {
+		return defaultLocale
+	}
+	_, i, confidence := localeMatcher.Match(tags...)
+	if confidence == language.No {
+		return defaultLocale
+	}
+	return []string{"en", "es", "fr", "de"}[i]
+}
+
+// newSystemEvent builds an event from alternating parameter names and values; targetID is 0 for
+// events without a target
+func newSystemEvent(eventType string, actorID, targetID int, params ...string) *SystemEvent {
+	e := &SystemEvent{Type: eventType, ActorID: actorID, TargetID: targetID, Params: make(map[string]string, len(params)/2)}
+	for i := 0; i+1 < len(params); i += 2 {
+		e.Params[params[i]] = params[i+1]
+	}
+	return e
+}
+
+// eventTime formats t for the "at" parameter
+func eventTime(t time.Time) string {
+	return t.Format(time.RFC3339)
+}
+
+// variant selects the template of an event whose wording depends on a parameter
+func (e *SystemEvent) variant() string {
+	switch e.Type {
+	case EventMemberMuted:
+		if e.Params["minutes"] != "" {
+			return ":timed"
+		}
+	case EventRoleGranted, EventRoleRevoked:
+		return ":" + e.Params["role"]
+	case EventSlowModeChanged:
+		if e.Params["seconds"] != "" {
+			return ":enabled"
+		}
+	case EventRoomInactive:
+		return ":" + e.Params["action"]
+	}
+	return ""
+}
+
+// Render returns the event's text in locale, falling back to English for unknown locales and to
+// "" for event types neither knows
+func (e *SystemEvent) Render(locale string) string {
+	catalog, ok := systemMessageCatalog[locale]
+	if !ok {
+		locale, catalog = defaultLocale, systemMessageCatalog[defaultLocale]
+	}
+	key := e.Type + e.variant()
+	template, ok := catalog[key]
+	if !ok {
+		if template, ok = systemMessageCatalog[defaultLocale][key]; !ok {
+			return ""
+		}
+	}
+
+	replacements := make([]string, 0, len(e.Params)*2)
+	for name, value := range e.Params {
+		if name == "at" {
+			if t, err := time.Parse(time.RFC3339, value); err == nil {
+				value = t.Local().Format(systemMessageTimeFormats[locale])
+			}
+		}
+		replacements = append(replacements, "{"+name+"}", value)
+	}
+	return strings.NewReplacer(replacements...).Replace(template)
+}
+
+// encodeSystemEvent is the event as stored in messages.system_event
+func encodeSystemEvent(e *SystemEvent) any {
+	if e == nil {
+		return nil
+	}
+	data, _ := json.Marshal(e)
+	return string(data)
+}
+
+// decodeSystemEvent reads messages.system_event, which is NULL for messages from people
+func decodeSystemEvent(data []byte) *SystemEvent {
+	if len(data) == 0 {
+		return nil
+	}
+	var e SystemEvent
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil
+	}
+	return &e
+}
+
+// migrateSystemMessageKind gives the System user's messages from before kind "system" existed that
+// kind, once. They keep their text and have no system_event.
+func migrateSystemMessageKind() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var key string
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO server_settings (key, value) VALUES ('system_message_kind_migrated', 'true')
+		ON CONFLICT (key) DO NOTHING RETURNING key
+	`).Scan(&key)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE messages SET kind = 'system' WHERE sender_id = 1 AND kind = 'text'"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// localizeMessages renders system messages in locale; other messages are left alone
+func localizeMessages(messages []Message, locale string) {
+	if locale == defaultLocale {
+		return
+	}
+	for i := range messages {
+		if e := messages[i].SystemEvent; e != nil {
+			if text := e.Render(locale); text != "" {
+				messages[i].Text = text
+			}
+		}
+	}
+}
+
+// localizeFrame returns msg with its system message rendered in locale, copying rather than
+// changing what other connections share
+func localizeFrame(msg *WSMessage, locale string) *WSMessage {
+	if locale == defaultLocale || msg.Message == nil || msg.Message.SystemEvent == nil {
+		return msg
+	}
+	text := msg.Message.SystemEvent.Render(locale)
+	if text == "" {
+		return msg
+	}
+	frame := *msg
+	m := *msg.Message
+	m.Text = text
+	frame.Message = &m
+	return &frame
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Idempotency keys let clients retry sending a message (client_msg_id over /ws, the
+// Idempotency-Key header over REST) or creating a room without doing it twice. Keys are per user
+// and per kind of request, and remembered for IDEMPOTENCY_KEY_HOURS.
+const (
+	IdempotencyMessage = "message"
+	IdempotencyRoom    = "room"
+
+	maxIdempotencyKeyLength = 64
+)
+
+var (
+	errIdempotencyKeyUsed       = errors.New("idempotency key already used")
+	errIdempotencyKeyInProgress = errors.New("a request with this idempotency key is still in progress")
+)
+
+// idempotencyKeyHours is how long a key is remembered (IDEMPOTENCY_KEY_HOURS)
+func idempotencyKeyHours() int {
+	return envInt("IDEMPOTENCY_KEY_HOURS", 24)
+}
+
+// idempotencyKeysKept reports whether keys are remembered. Only Postgres keeps them; elsewhere a
+// retry is carried out again.
+func idempotencyKeysKept() bool {
+	_, ok := store.(*postgresStore)
+	return ok
+}
+
+// requestIdempotencyKey reads the Idempotency-Key header, writing a 400 if it is too long
+func requestIdempotencyKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > maxIdempotencyKeyLength {
+		http.Error(w, "Idempotency-Key must be at most 64 characters", http.StatusBadRequest)
+		return "", false
+	}
+	if !idempotencyKeysKept() {
+		return "", true
+	}
+	return key, true
+}
+
+// idempotentResource returns what the first request with the key created. It is 0 if the key is
+// unused or forgotten; errIdempotencyKeyInProgress if that request hasn't finished.
+func idempotentResource(ctx context.Context, userID int, scope, key string) (int, error) {
+	var resourceID sql.NullInt64
+	err := db.QueryRowContext(ctx, `
+		SELECT resource_id FROM idempotency_keys
+		WHERE user_id = $1 AND scope = $2 AND key = $3 AND created_at > NOW() - $4 * INTERVAL '1 hour'
+	`, userID, scope, key, idempotencyKeyHours()).Scan(&resourceID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if !resourceID.Valid {
+		return 0, errIdempotencyKeyInProgress
+	}
+	return int(resourceID.Int64), nil
+}
+
+// sqlExecer is a *sql.DB or *sql.Tx
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// claimIdempotencyKey records the key for resourceID, or with resourceID 0 reserves it until
+// completeIdempotencyKey. A forgotten key is reused. It returns errIdempotencyKeyUsed if another
+// request holds the key.
+func claimIdempotencyKey(ctx context.Context, q sqlExecer, userID int, scope, key string, resourceID int) error {
+	res, err := q.ExecContext(ctx, `
+		INSERT INTO idempotency_keys (user_id, scope, key, resource_id) VALUES ($1, $2, $3, NULLIF($4, 0))
+		ON CONFLICT (user_id, scope, key) DO UPDATE SET resource_id = EXCLUDED.resource_id, created_at = CURRENT_TIMESTAMP
+		WHERE idempotency_keys.created_at <= NOW() - $5 * INTERVAL '1 hour'
+	`, userID, scope, key, resourceID, idempotencyKeyHours())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errIdempotencyKeyUsed
+	}
+	return nil
+}
+
+// completeIdempotencyKey points a reserved key at what its request created
+func completeIdempotencyKey(ctx context.Context, userID int, scope, key string, resourceID int) error {
+	_, err := db.ExecContext(ctx,
+		"UPDATE idempotency_keys SET resource_id = $4 WHERE user_id = $1 AND scope = $2 AND key = $3",
+		userID, scope, key, resourceID,
+	)
+	return err
+}
+
+// releaseIdempotencyKey drops a reservation whose request failed, so a retry can try again
+func releaseIdempotencyKey(userID int, scope, key string) {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+	if _, err := db.ExecContext(ctx,
+		"DELETE FROM idempotency_keys WHERE user_id = $1 AND scope = $2 AND key = $3 AND resource_id IS NULL",
+		userID, scope, key,
+	); err != nil {
+		slog.Error("Failed to release idempotency key", "user_id", userID, "scope", scope, "error", err)
+	}
+}
+
+// idempotentMessage loads the message a sender already sent with the key, or nil if there is
+// none. It is marked replayed so callers ack it without broadcasting it again.
+func idempotentMessage(senderID int, key string) (*Message, error) {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	msgID, err := idempotentResource(ctx, senderID, IdempotencyMessage, key)
+	if err != nil || msgID == 0 {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, messageSelect+" WHERE m.id = $1", msgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := scanMessages(rows)
+	if len(messages) == 0 {
+		return nil, nil // Deleted since, along with its room
+	}
+	messages[0].replayed = true
+	return &messages[0], nil
+}
+
+// replayCreatedRoom answers a retried POST /api/rooms with the room the first request created
+func replayCreatedRoom(w http.ResponseWriter, r *http.Request, userID int, key string) {
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	roomID, err := idempotentResource(ctx, userID, IdempotencyRoom, key)
+	if errors.Is(err, errIdempotencyKeyInProgress) || (err == nil && roomID == 0) {
+		http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to look up idempotency key", "error", err)
+		http.Error(w, "Failed to create room", http.StatusInternalServerError)
+		return
+	}
+
+	var room Room
+	err = db.QueryRowContext(ctx, `
+		SELECT r.id, r.name, COALESCE(r.description, ''), r.created_by, r.created_at, r.is_private,
+			(SELECT COUNT(*) FROM room_members WHERE room_id = r.id)
+		FROM rooms r WHERE r.id = $1
+	`, roomID).Scan(&room.ID, &room.Name, &room.Description, &room.CreatedBy, &room.CreatedAt, &room.IsPrivate, &room.Members)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Room not found", http.StatusNotFound) // Deleted since it was created
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load room", "room_id", roomID, "error", err)
+		http.Error(w, "Failed to create room", http.StatusInternalServerError)
+		return
+	}
+	room.LastMessage = fmt.Sprintf("You created this room at %s.", room.CreatedAt.Format(SystemMessageTimeFormat))
+	room.LastMessageTime = room.CreatedAt.Format(LastMessageTimeFormat)
+	room.LastMessageAt = &room.CreatedAt
+	room.Avatar = avatarInitial(room.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(room)
+}
+
+// pruneIdempotencyKeys deletes forgotten keys every hour
+func pruneIdempotencyKeys() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := dbContext(context.Background())
+		_, err := db.ExecContext(ctx,
+			"DELETE FROM idempotency_keys WHERE created_at <= NOW() - $1 * INTERVAL '1 hour'",
+			idempotencyKeyHours(),
+		)
+		cancel()
+		if err != nil {
+			slog.Error("Failed to prune idempotency keys", "error", err)
+		}
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const incomingWebhookTokenPrefix = "chh_"
+
+// maxIncomingWebhookBytes caps the request body of POST /api/hooks/{token}
+const maxIncomingWebhookBytes = 64 << 10
+
+// IncomingWebhook posts into its room as its own bot account, named after the hook. The token is
+// only returned when the hook is created.
+type IncomingWebhook struct {
+	ID         int        `json:"id"`
+	RoomID     int        `json:"room_id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Token      string     `json:"token,omitempty"`
+	URL        string     `json:"url,omitempty"` // Path to POST to, with the token
+	CreatedBy  int        `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// slackPayload is the subset of Slack's incoming webhook payload that is understood: the text,
+// plus the text of any legacy attachments, which monitoring tools often put the detail in
+type slackPayload struct {
+	Text        string `json:"text"`
+	Attachments []struct {
+		Fallback string `json:"fallback"`
+		Pretext  string `json:"pretext"`
+		Text     string `json:"text"`
+	} `json:"attachments"`
+}
+
+func (p *slackPayload) content() string {
+	parts := []string{}
+	if text := sanitizeText(slackToMarkdown(p.Text)); text != "" {
+		parts = append(parts, text)
+	}
+	for _, a := range p.Attachments {
+		text := sanitizeText(slackToMarkdown(strings.Join([]string{a.Pretext, a.Text}, "\n")))
+		if text == "" {
+			text = sanitizeText(slackToMarkdown(a.Fallback))
+		}
+		if text != "" {
+			parts = append(parts, text)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+var (
+	slackToken    = regexp.MustCompile(`<[^<>\s][^<>]*>|&(?:lt|gt|amp);`)
+	slackEntities = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+)
+
+// slackToMarkdown rewrites Slack's markup in text for the message pipeline: <url|label> and <url>
+// become markdown links, and <@user>, <#channel> and <!here> style mentions become plain text,
+// using their label where Slack sends one. The &lt;, &gt; and &amp; Slack escapes are decoded.
+func slackToMarkdown(text string) string {
+	return slackToken.ReplaceAllStringFunc(text, func(m string) string {
+		if m[0] == '&' {
+			return slackEntities.Replace(m)
+		}
+		target, label, _ := strings.Cut(slackEntities.Replace(m[1:len(m)-1]), "|")
+		switch target[0] {
+		case '@', '#':
+			if label != "" {
+				return target[:1] + strings.TrimPrefix(label, target[:1])
+			}
+			return target
+		case '!':
+			if label != "" {
+				return label
+			}
+			name, _, _ := strings.Cut(target[1:], "^")
+			return "@" + name
+		}
+		if label == "" {
+			label = target
+		}
+		if strings.ContainsAny(label, "[]") || strings.ContainsAny(target, "() ") {
+			return label + " (" + target + ")"
+		}
+		return "[" + label + "](" + target + ")"
+	})
+}
+
+// readSlackPayload accepts a JSON body or, like Slack, a form with the JSON in its "payload" field
+func readSlackPayload(r *http.Request) (*slackPayload, error) {
+	var p slackPayload
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		return &p, json.Unmarshal([]byte(r.PostForm.Get("payload")), &p)
+	}
+	return &p, json.NewDecoder(r.Body).Decode(&p)
+}
+
+// Post a Slack-style payload into the hook's room. Errors use Slack's plain-text codes so
+// existing integrations can report them.
+func handleIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxIncomingWebhookBytes)
+	payload, err := readSlackPayload(r)
+	if err != nil {
+		http.Error(w, "invalid_payload", http.StatusBadRequest)
+		return
+	}
+	content := payload.content()
+	if content == "" {
+		http.Error(w, "no_text", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var roomID, userID int
+	var username string
+	err = db.QueryRowContext(ctx, `
+		UPDATE incoming_webhooks iw SET last_used_at = CURRENT_TIMESTAMP
+		FROM users u
+		WHERE u.id = iw.user_id AND iw.token_hash = $1 AND u.is_active
+		RETURNING iw.room_id, iw.user_id, u.username
+	`, hashAPIKey(token)).Scan(&roomID, &userID, &username)
+	if err == sql.ErrNoRows {
+		http.Error(w, "no_service", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to look up incoming webhook", "error", err)
+		http.Error(w, "server_error", http.StatusInternalServerError)
+		return
+	}
+	cancel()
+
+	_, err = postUserMessage(&OutgoingMessage{RoomID: roomID, SenderID: userID, Sender: username, Content: content})
+	var verr *ValidationError
+	if errors.Is(err, errNotRoomMember) {
+		http.Error(w, "channel_not_found", http.StatusNotFound)
+		return
+	} else if errors.As(err, &verr) {
+		http.Error(w, verr.Message, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to post incoming webhook message", "room_id", roomID, "error", err)
+		http.Error(w, "server_error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok"))
+}
+
+// List the room's incoming webhooks (members who may manage the room)
+func handleGetIncomingWebhooks(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermManageRoom, "You don't have permission to manage webhooks"); !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT iw.id, iw.room_id, iw.user_id, u.username, COALESCE(iw.created_by, 0), iw.created_at, iw.last_used_at
+		FROM incoming_webhooks iw
+		JOIN users u ON u.id = iw.user_id
+		WHERE iw.room_id = $1
+		ORDER BY iw.id
+	`, roomID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get incoming webhooks", "error", err)
+		http.Error(w, "Failed to get webhooks", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	hooks := []IncomingWebhook{}
+	for rows.Next() {
+		var hook IncomingWebhook
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&hook.ID, &hook.RoomID, &hook.UserID, &hook.Name, &hook.CreatedBy, &hook.CreatedAt, &lastUsed); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning incoming webhook", "error", err)
+			continue
+		}
+		if lastUsed.Valid {
+			hook.LastUsedAt = &lastUsed.Time
+		}
+		hooks = append(hooks, hook)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+// Create an incoming webhook, with a bot account of the given name that joins the room
+func handleCreateIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.Name = sanitizeLine(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Webhook name is required", http.StatusBadRequest)
+		return
+	}
+	// Messages show the name as the poster's username
+	if reason := usernames.check(req.Name); reason != "" {
+		http.Error(w, reason, http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermManageRoom, "You don't have permission to manage webhooks"); !ok {
+		return
+	}
+
+	token, err := generateAPIKey()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to generate webhook token", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	token = incomingWebhookTokenPrefix + strings.TrimPrefix(token, apiKeyPrefix)
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	hook := IncomingWebhook{RoomID: roomID, Name: req.Name, Token: token, URL: "/api/hooks/" + token, CreatedBy: userID}
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO users (username, email, password_hash, is_bot) VALUES ($1, $2, $3, TRUE) RETURNING id",
+		req.Name, fmt.Sprintf("%s@hooks.chathub.io", req.Name), "BOT_ACCOUNT_HASH",
+	).Scan(&hook.UserID)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			http.Error(w, "Username already taken", http.StatusConflict)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to create webhook user", "error", err)
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO incoming_webhooks (room_id, user_id, token_hash, created_by)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, roomID, hook.UserID, hashAPIKey(token), userID).Scan(&hook.ID, &hook.CreatedAt)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create incoming webhook", "error", err)
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Server error during commit", http.StatusInternalServerError)
+		return
+	}
+
+	if err := addRoomMember(roomID, hook.UserID, hook.Name, time.Now()); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to add webhook user to room", "error", err)
+		// Deleting the account removes the hook with it
+		db.ExecContext(context.Background(), "DELETE FROM users WHERE id = $1", hook.UserID)
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Incoming webhook created", "webhook_id", hook.ID, "webhook_user_id", hook.UserID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+// Rename the identity an incoming webhook posts as
+func handleUpdateIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	hookID, err := strconv.Atoi(vars["hookId"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.Name = sanitizeLine(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Webhook name is required", http.StatusBadRequest)
+		return
+	}
+	if reason := usernames.check(req.Name); reason != "" {
+		http.Error(w, reason, http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermManageRoom, "You don't have permission to manage webhooks"); !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `
+		UPDATE users u SET username = $3, email = $4
+		FROM incoming_webhooks iw
+		WHERE iw.user_id = u.id AND iw.id = $1 AND iw.room_id = $2
+	`, hookID, roomID, req.Name, fmt.Sprintf("%s@hooks.chathub.io", req.Name))
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			http.Error(w, "Username already taken", http.StatusConflict)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to rename incoming webhook", "error", err)
+		http.Error(w, "Failed to update webhook", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Delete an incoming webhook. Its account is deactivated and leaves the room, but keeps its
+// name on messages it already posted.
+func handleDeleteIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	hookID, err := strconv.Atoi(vars["hookId"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermManageRoom, "You don't have permission to manage webhooks"); !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var hookUserID int
+	err = tx.QueryRowContext(ctx,
+		"DELETE FROM incoming_webhooks WHERE id = $1 AND room_id = $2 RETURNING user_id",
+		hookID, roomID,
+	).Scan(&hookUserID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete incoming webhook", "error", err)
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET is_active = FALSE WHERE id = $1", hookUserID); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to deactivate webhook user", "error", err)
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM room_members WHERE room_id = $1 AND user_id = $2", roomID, hookUserID); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to remove webhook user from room", "error", err)
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Server error during commit", http.StatusInternalServerError)
+		return
+	}
+	memberships.invalidate(roomID, hookUserID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestSlackPayloadContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload slackPayload
+		want    string
+	}{
+		{"plain text", slackPayload{Text: "Deploy finished"}, "Deploy finished"},
+		{"labelled link", slackPayload{Text: "<https://ci.example.com/build/1|Build #1> failed for <@U123>"}, "[Build #1](https://ci.example.com/build/1) failed for @U123"},
+		{"bare link", slackPayload{Text: "See <https://example.com/a?b=1&amp;c=2>"}, "See [https://example.com/a?b=1&c=2](https://example.com/a?b=1&c=2)"},
+		{"link with brackets in its label", slackPayload{Text: "<https://example.com|[prod] down>"}, "[prod] down (https://example.com)"},
+		{"user with name", slackPayload{Text: "ping <@U123|alice>"}, "ping @alice"},
+		{"channel", slackPayload{Text: "in <#C42|deploys> and <#C43>"}, "in #deploys and #C43"},
+		{"broadcasts", slackPayload{Text: "<!here> and <!channel>"}, "@here and @channel"},
+		{"group with label", slackPayload{Text: "<!subteam^S1|@oncall> look"}, "@oncall look"},
+		{"escapes", slackPayload{Text: "a &lt; b &amp;&amp; c &gt; d"}, "a < b && c > d"},
+		{"escaped escape", slackPayload{Text: "&amp;lt;"}, "&lt;"},
+		{"attachments", slackPayload{Text: "Alert", Attachments: []struct {
+			Fallback string `json:"fallback"`
+			Pretext  string `json:"pretext"`
+			Text     string `json:"text"`
+		}{
+			{Pretext: "CPU high", Text: "<https://grafana.example.com/d/1|Dashboard>"},
+			{Fallback: "Disk <!here>"},
+		}}, "Alert\n\nCPU high\n[Dashboard](https://grafana.example.com/d/1)\n\nDisk @here"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.payload.content(); got != tt.want {
+				t.Errorf("content() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+//go:build integration
+
+package integration
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type check struct {
+	name string
+	run  func(e *env) error
+}
+
+var checks = []check{
+	{"message broadcast to room members", checkBroadcast},
+	{"read receipts", checkReadReceipts},
+	{"non-members are refused", checkNonMemberRefused},
+	{"members can't delete the room", checkMemberCantDeleteRoom},
+}
+
+// roomWithMembers registers the owner and others, and has the others join the owner's new room
+func roomWithMembers(e *env, names ...string) (int, []*user, error) {
+	users := make([]*user, len(names))
+	for i, name := range names {
+		u, err := e.register(name)
+		if err != nil {
+			return 0, nil, err
+		}
+		users[i] = u
+	}
+	roomID, err := users[0].createRoom("integration")
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, u := range users[1:] {
+		if err := u.expect(http.StatusOK, "POST", "/api/rooms/"+strconv.Itoa(roomID)+"/join", nil, nil); err != nil {
+			return 0, nil, err
+		}
+	}
+	return roomID, users, nil
+}
+
+func checkBroadcast(e *env) error {
+	roomID, users, err := roomWithMembers(e, "alice", "bob")
+	if err != nil {
+		return err
+	}
+	alice, bob := users[0], users[1]
+
+	aliceWS, err := alice.connect()
+	if err != nil {
+		return err
+	}
+	defer aliceWS.close()
+	bobWS, err := bob.connect()
+	if err != nil {
+		return err
+	}
+	defer bobWS.close()
+	for _, ws := range []*socket{aliceWS, bobWS} {
+		if err := ws.send(frame{Type: "joinRoom", RoomID: roomID}); err != nil {
+			return err
+		}
+	}
+
+	if err := aliceWS.send(frame{Type: "sendMessage", RoomID: roomID, Content: "hello bob", ClientMsgID: "m1"}); err != nil {
+		return err
+	}
+	ack, err := aliceWS.await("messageAck", func(f frame) bool { return f.Type == "messageAck" && f.ClientMsgID == "m1" })
+	if err != nil {
+		return err
+	}
+	got, err := bobWS.await("roomMessage", func(f frame) bool {
+		return f.Type == "roomMessage" && f.Message != nil && f.Message.SenderID == alice.id
+	})
+	if err != nil {
+		return err
+	}
+	if got.Message.Text != "hello bob" || got.Message.ID != ack.Message.ID {
+		return fmt.Errorf("bob got message %d %q, want %d %q", got.Message.ID, got.Message.Text, ack.Message.ID, "hello bob")
+	}
+
+	var history []struct {
+		ID int `json:"id"`
+	}
+	if err := bob.expect(http.StatusOK, "GET", "/api/rooms/"+strconv.Itoa(roomID)+"/messages", nil, &history); err != nil {
+		return err
+	}
+	if len(history) == 0 || history[len(history)-1].ID != ack.Message.ID {
+		return fmt.Errorf("message %d is not the latest in the history", ack.Message.ID)
+	}
+	return nil
+}
+
+func checkReadReceipts(e *env) error {
+	roomID, users, err := roomWithMembers(e, "alice", "bob")
+	if err != nil {
+		return err
+	}
+	alice, bob := users[0], users[1]
+	room := "/api/rooms/" + strconv.Itoa(roomID)
+
+	var msg struct {
+		ID int `json:"id"`
+	}
+	if err := alice.expect(http.StatusCreated, "POST", room+"/messages", map[string]string{"content": "read me"}, &msg); err != nil {
+		return err
+	}
+
+	aliceWS, err := alice.connect()
+	if err != nil {
+		return err
+	}
+	defer aliceWS.close()
+	if err := aliceWS.send(frame{Type: "joinRoom", RoomID: roomID}); err != nil {
+		return err
+	}
+
+	if err := bob.expect(http.StatusOK, "POST", room+"/read", nil, nil); err != nil {
+		return err
+	}
+	receipt, err := aliceWS.await("messagesRead", func(f frame) bool {
+		return f.Type == "messagesRead" && f.Receipt != nil && f.Receipt.UserID == bob.id
+	})
+	if err != nil {
+		return err
+	}
+	if receipt.Receipt.LastReadMessageID < msg.ID {
+		return fmt.Errorf("receipt up to message %d, want at least %d", receipt.Receipt.LastReadMessageID, msg.ID)
+	}
+
+	var reads []struct {
+		UserID int `json:"user_id"`
+	}
+	if err := alice.expect(http.StatusOK, "GET", room+"/messages/"+strconv.Itoa(msg.ID)+"/reads", nil, &reads); err != nil {
+		return err
+	}
+	for _, r := range reads {
+		if r.UserID == bob.id {
+			return nil
+		}
+	}
+	return fmt.Errorf("bob is not among the readers of message %d", msg.ID)
+}
+
+func checkNonMemberRefused(e *env) error {
+	roomID, users, err := roomWithMembers(e, "alice")
+	if err != nil {
+		return err
+	}
+	mallory, err := e.register("mallory")
+	if err != nil {
+		return err
+	}
+	room := "/api/rooms/" + strconv.Itoa(roomID)
+
+	if err := mallory.expect(http.StatusForbidden, "GET", room+"/messages", nil, nil); err != nil {
+		return err
+	}
+	if err := mallory.expect(http.StatusForbidden, "GET", room+"/members", nil, nil); err != nil {
+		return err
+	}
+
+	ws, err := mallory.connect()
+	if err != nil {
+		return err
+	}
+	defer ws.close()
+	if err := ws.send(frame{Type: "sendMessage", RoomID: roomID, Content: "let me in", ClientMsgID: "m1"}); err != nil {
+		return err
+	}
+	f, err := ws.await("error", func(f frame) bool { return f.Type == "error" && f.ClientMsgID == "m1" })
+	if err != nil {
+		return err
+	}
+	if f.Error == nil || f.Error.Code != "not_authorized" {
+		return fmt.Errorf("error frame %+v, want code not_authorized", f.Error)
+	}
+
+	var history []struct {
+		SenderID int `json:"sender_id"`
+	}
+	if err := users[0].expect(http.StatusOK, "GET", room+"/messages", nil, &history); err != nil {
+		return err
+	}
+	for _, m := range history {
+		if m.SenderID == mallory.id {
+			return fmt.Errorf("a non-member's message was saved")
+		}
+	}
+	return nil
+}
+
+func checkMemberCantDeleteRoom(e *env) error {
+	roomID, users, err := roomWithMembers(e, "alice", "bob")
+	if err != nil {
+		return err
+	}
+	room := "/api/rooms/" + strconv.Itoa(roomID)
+	if err := users[1].expect(http.StatusForbidden, "DELETE", room, nil, nil); err != nil {
+		return err
+	}
+	return users[0].expect(http.StatusOK, "GET", room+"/members", nil, nil)
+}
@@ -0,0 +1,309 @@
+//go:build integration
+
+// Package integration runs end-to-end checks against a real server: it starts Postgres in Docker,
+// builds and boots the server against it, then drives the API and WebSocket the way clients do.
+// It needs the docker CLI and a running daemon.
+//
+//	cd server && go test -tags integration ./...
+package integration
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	_ "github.com/lib/pq"
+)
+
+var (
+	image    = flag.String("postgres", "16-alpine", "Tag of the postgres image")
+	frameTTL = flag.Duration("wait", 5*time.Second, "How long to wait for an expected WebSocket event")
+)
+
+func TestServer(t *testing.T) {
+	dbPort := startPostgres(t)
+	base := startServer(t, dbPort)
+	for _, c := range checks {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.run(&env{base: base}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// startPostgres runs a throwaway Postgres container, removed when the test ends, and returns its
+// host port once it accepts connections
+func startPostgres(t *testing.T) string {
+	t.Helper()
+	out, err := exec.Command("docker", "run", "-d", "--rm", "-p", "127.0.0.1::5432",
+		"-e", "POSTGRES_PASSWORD=password", "-e", "POSTGRES_DB=chathubdb", "postgres:"+*image).Output()
+	if err != nil {
+		t.Fatalf("Failed to start Postgres (is Docker running?): %v", err)
+	}
+	container := strings.TrimSpace(string(out))
+	t.Cleanup(func() { exec.Command("docker", "rm", "-f", container).Run() })
+
+	out, err = exec.Command("docker", "port", container, "5432/tcp").Output()
+	if err != nil {
+		t.Fatalf("Failed to find the Postgres port: %v", err)
+	}
+	addr := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	dbPort := addr[strings.LastIndex(addr, ":")+1:]
+
+	deadline := time.Now().Add(60 * time.Second)
+	for {
+		err = pingPostgres(dbPort)
+		if err == nil {
+			return dbPort
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Postgres did not come up: %v", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func pingPostgres(port string) error {
+	conn, err := sql.Open("postgres", fmt.Sprintf("host=localhost port=%s user=postgres password=password dbname=chathubdb sslmode=disable", port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Ping()
+}
+
+// startServer builds the server package and boots it against Postgres, returning its base URL. Its
+// log is shown with -v.
+func startServer(t *testing.T, dbPort string) string {
+	t.Helper()
+	tmp := t.TempDir()
+
+	bin := filepath.Join(tmp, "chathub")
+	build := exec.Command("go", "build", "-o", bin, ".")
+	build.Dir = ".."
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to build the server: %v\n%s", err, out)
+	}
+
+	port, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := exec.Command(bin)
+	server.Dir = tmp
+	server.Env = append(os.Environ(),
+		"PORT="+strconv.Itoa(port), "DB_HOST=localhost", "DB_PORT="+dbPort,
+		"DB_USER=postgres", "DB_PASSWORD=password", "DB_NAME=chathubdb", "DB_DRIVER=postgres",
+		"JWT_SECRET=integration", "SERVE_FRONTEND=false", "UPLOAD_DIR="+filepath.Join(tmp, "uploads"),
+	)
+	if testing.Verbose() {
+		server.Stdout, server.Stderr = os.Stdout, os.Stderr
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start the server: %v", err)
+	}
+	t.Cleanup(func() {
+		server.Process.Signal(os.Interrupt)
+		server.Wait()
+	})
+
+	base := "http://localhost:" + strconv.Itoa(port)
+	if err := waitReady(base); err != nil {
+		t.Fatal(err)
+	}
+	return base
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func waitReady(base string) error {
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if resp, err := http.Get(base + "/readyz"); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return errors.New("server did not become ready")
+}
+
+// --- Clients ---
+
+// env is what a check works against; every check registers its own users and rooms
+type env struct {
+	base string
+}
+
+type user struct {
+	env   *env
+	id    int
+	name  string
+	token string
+}
+
+// register creates a user with a name unique to this run
+func (e *env) register(name string) (*user, error) {
+	name = fmt.Sprintf("%s%d", name, time.Now().UnixNano()%1e9)
+	var resp struct {
+		Token  string `json:"token"`
+		UserID int    `json:"user_id"`
+	}
+	body := map[string]string{"username": name, "email": name + "@example.com", "password": "secret"}
+	if status, err := e.do("POST", "/api/register", "", body, &resp); err != nil {
+		return nil, err
+	} else if status != http.StatusOK {
+		return nil, fmt.Errorf("register %s: status %d", name, status)
+	}
+	return &user{env: e, id: resp.UserID, name: name, token: resp.Token}, nil
+}
+
+func (e *env) do(method, path, token string, body, out any) (int, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, e.base+path, r)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("%s %s: %w", method, path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func (u *user) do(method, path string, body, out any) (int, error) {
+	return u.env.do(method, path, u.token, body, out)
+}
+
+// expect fails unless the request succeeds with the given status
+func (u *user) expect(status int, method, path string, body, out any) error {
+	got, err := u.do(method, path, body, out)
+	if err != nil {
+		return err
+	}
+	if got != status {
+		return fmt.Errorf("%s %s as %s: status %d, want %d", method, path, u.name, got, status)
+	}
+	return nil
+}
+
+func (u *user) createRoom(name string) (int, error) {
+	var room struct {
+		ID int `json:"id"`
+	}
+	err := u.expect(http.StatusCreated, "POST", "/api/rooms", map[string]any{"name": name}, &room)
+	return room.ID, err
+}
+
+// frame is the part of the server's WebSocket envelope the checks look at
+type frame struct {
+	Type        string `json:"type"`
+	RoomID      int    `json:"room_id"`
+	Content     string `json:"content,omitempty"`
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	Message     *struct {
+		ID       int    `json:"id"`
+		SenderID int    `json:"sender_id"`
+		Text     string `json:"text"`
+	} `json:"message,omitempty"`
+	Receipt *struct {
+		UserID            int `json:"user_id"`
+		LastReadMessageID int `json:"last_read_message_id"`
+	} `json:"receipt,omitempty"`
+	Error *struct {
+		Code string `json:"code"`
+	} `json:"error,omitempty"`
+}
+
+type socket struct {
+	conn   *websocket.Conn
+	frames chan frame
+}
+
+func (u *user) connect() (*socket, error) {
+	wsURL := "ws" + u.env.base[len("http"):] + "/ws?token=" + url.QueryEscape(u.token)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("connect %s: %w", u.name, err)
+	}
+	s := &socket{conn: conn, frames: make(chan frame, 256)}
+	go func() {
+		defer close(s.frames)
+		for {
+			var f frame
+			if err := conn.ReadJSON(&f); err != nil {
+				return
+			}
+			s.frames <- f
+		}
+	}()
+	return s, nil
+}
+
+func (s *socket) send(f frame) error {
+	return s.conn.WriteJSON(f)
+}
+
+// await returns the first frame that matches, skipping others, or fails after -wait
+func (s *socket) await(what string, match func(frame) bool) (frame, error) {
+	timeout := time.After(*frameTTL)
+	for {
+		select {
+		case f, ok := <-s.frames:
+			if !ok {
+				return frame{}, fmt.Errorf("connection closed waiting for %s", what)
+			}
+			if match(f) {
+				return f, nil
+			}
+		case <-timeout:
+			return frame{}, fmt.Errorf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func (s *socket) close() {
+	s.conn.Close()
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RoomInvite is a pending invitation for a user to join a room
+type RoomInvite struct {
+	ID          int       `json:"id"`
+	RoomID      int       `json:"room_id"`
+	RoomName    string    `json:"room_name"`
+	InviterID   int       `json:"inviter_id"`
+	InviterName string    `json:"inviter_name"`
+	InviteeID   int       `json:"invitee_id"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Invite a user, by ID or username, to a room; members can invite unless the room's permissions
+// say otherwise. The invitee is told over the WebSocket and can accept or decline.
+func handleCreateInvite(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		UserID   int    `json:"user_id"`
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.Username = sanitizeLine(req.Username)
+	if req.UserID == 0 && req.Username == "" {
+		http.Error(w, "user_id or username is required", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermInvite, "You don't have permission to invite to this room"); !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	if req.UserID == 0 {
+		err = db.QueryRowContext(ctx, "SELECT id FROM users WHERE username = $1", req.Username).Scan(&req.UserID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "DB error looking up invitee", "error", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if req.UserID <= 1 || req.UserID == userID {
+		http.Error(w, "Invalid invitee", http.StatusBadRequest)
+		return
+	}
+
+	var inviteeExists bool
+	err = db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE id = $1 AND is_active)", req.UserID).Scan(&inviteeExists)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DB error checking invitee", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if !inviteeExists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if isUserInRoom(req.UserID, roomID) {
+		http.Error(w, "User is already a member of this room", http.StatusConflict)
+		return
+	}
+
+	if isUserBanned(req.UserID, roomID) {
+		http.Error(w, "User is banned from this room", http.StatusForbidden)
+		return
+	}
+
+	var roomName string
+	db.QueryRowContext(ctx, "SELECT name FROM rooms WHERE id = $1", roomID).Scan(&roomName)
+
+	invite, err := inviteUser(ctx, roomID, roomName, userID, r.Context().Value("username").(string), req.UserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create invite", "error", err)
+		http.Error(w, "Failed to create invite", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "User invited to room", "invitee_id", req.UserID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invite)
+}
+
+// inviteUser records a pending invite to the room and tells the invitee. Re-inviting someone who
+// declined earlier puts the invite back to pending.
+func inviteUser(ctx context.Context, roomID int, roomName string, inviterID int, inviterName string, inviteeID int) (*RoomInvite, error) {
+	invite := RoomInvite{RoomName: roomName, InviterName: inviterName}
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO room_invites (room_id, inviter_id, invitee_id) VALUES ($1, $2, $3)
+		ON CONFLICT (room_id, invitee_id) DO UPDATE
+			SET inviter_id = EXCLUDED.inviter_id, status = 'pending', created_at = CURRENT_TIMESTAMP, responded_at = NULL
+		RETURNING id, room_id, inviter_id, invitee_id, status, created_at
+	`, roomID, inviterID, inviteeID).Scan(&invite.ID, &invite.RoomID, &invite.InviterID, &invite.InviteeID, &invite.Status, &invite.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	roomManager.SendToUser(inviteeID, &WSMessage{Type: "roomInvited", RoomID: roomID, Invite: &invite})
+	return &invite, nil
+}
+
+// maxBulkMembers bounds the entries of one bulk import
+const maxBulkMembers = 200
+
+// BulkMemberResult reports what a bulk import did with one entry
+type BulkMemberResult struct {
+	Entry  string `json:"entry"`
+	Status string `json:"status"` // "added", "invited", "already_member", "banned", "not_found", "invalid" or "failed"
+	UserID int    `json:"user_id,omitempty"`
+	// Without SMTP nothing emails an invited address its token, so it is returned to be passed on
+	InviteToken string `json:"invite_token,omitempty"`
+}
+
+// Add users to a room in bulk (admins). Entries are usernames or email addresses: existing users
+// join the room straight away, and unknown addresses are emailed an invite token to redeem once
+// they have an account.
+func handleBulkAddMembers(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Members []string `json:"members"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(req.Members) == 0 {
+		http.Error(w, "members is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Members) > maxBulkMembers {
+		http.Error(w, fmt.Sprintf("At most %d members per request", maxBulkMembers), http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	if roomRole(roomID, userID) != RoleAdmin {
+		http.Error(w, "Only admins can add members in bulk", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var roomName string
+	if err := db.QueryRowContext(ctx, "SELECT name FROM rooms WHERE id = $1", roomID).Scan(&roomName); err != nil {
+		slog.ErrorContext(r.Context(), "DB error fetching room", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]BulkMemberResult, 0, len(req.Members))
+	seen := make(map[string]bool)
+	for _, entry := range req.Members {
+		entry = sanitizeLine(entry)
+		if entry == "" || seen[strings.ToLower(entry)] {
+			continue
+		}
+		seen[strings.ToLower(entry)] = true
+		results = append(results, bulkAddMember(r.Context(), roomID, roomName, userID, username, entry))
+	}
+
+	slog.InfoContext(r.Context(), "Bulk member import", "room_id", roomID, "entries", len(results))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// bulkAddMember adds the user named by entry, a username or email address, to the room, or
+// invites the address if nobody has registered with it yet
+func bulkAddMember(ctx context.Context, roomID int, roomName string, inviterID int, inviterName, entry string) BulkMemberResult {
+	result := BulkMemberResult{Entry: entry}
+	isEmail := strings.Contains(entry, "@")
+	if isEmail {
+		if addr, err := mail.ParseAddress(entry); err != nil || addr.Address != entry {
+			result.Status = "invalid"
+			return result
+		}
+	}
+
+	query := "SELECT id, username FROM users WHERE username = $1 AND is_active AND id <> 1"
+	if isEmail {
+		query = "SELECT id, username FROM users WHERE LOWER(email) = LOWER($1) AND is_active AND id <> 1"
+	}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	var memberID int
+	var memberName string
+	err := db.QueryRowContext(dbCtx, query, entry).Scan(&memberID, &memberName)
+
+	if err == sql.ErrNoRows && isEmail {
+		token, err := inviteEmail(ctx, roomID, roomName, inviterID, inviterName, entry)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to invite email", "room_id", roomID, "error", err)
+			result.Status = "failed"
+			return result
+		}
+		result.Status = "invited"
+		if emailNotifier == nil {
+			result.InviteToken = token
+		}
+		return result
+	} else if err == sql.ErrNoRows {
+		result.Status = "not_found"
+		return result
+	} else if err != nil {
+		slog.ErrorContext(ctx, "DB error looking up bulk member", "error", err)
+		result.Status = "failed"
+		return result
+	}
+
+	result.UserID = memberID
+	switch {
+	case isUserInRoom(memberID, roomID):
+		result.Status = "already_member"
+	case isUserBanned(memberID, roomID):
+		result.Status = "banned"
+	default:
+		if err := addRoomMember(roomID, memberID, memberName, time.Now()); err != nil {
+			slog.ErrorContext(ctx, "Failed to add bulk member", "room_id", roomID, "user_id", memberID, "error", err)
+			result.Status = "failed"
+			return result
+		}
+		result.Status = "added"
+	}
+	return result
+}
+
+// inviteEmail records an invite for an address nobody has registered with and returns its token,
+// emailing the token when SMTP is configured. Only the token's hash is stored. Inviting the same
+// address again replaces the token.
+func inviteEmail(ctx context.Context, roomID int, roomName string, inviterID int, inviterName, email string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+
+	_, err := db.ExecContext(dbCtx, `
+		INSERT INTO room_email_invites (room_id, inviter_id, email, token_hash) VALUES ($1, $2, LOWER($3), $4)
+		ON CONFLICT (room_id, email) DO UPDATE
+			SET inviter_id = EXCLUDED.inviter_id, token_hash = EXCLUDED.token_hash, created_at = CURRENT_TIMESTAMP
+	`, roomID, inviterID, email, hashAPIKey(token))
+	if err != nil {
+		return "", err
+	}
+
+	if emailNotifier != nil {
+		go func() {
+			subject := fmt.Sprintf("%s invited you to %s on ChatHub", inviterName, roomName)
+			body := fmt.Sprintf("Hi,\n\n%s invited you to join %s on ChatHub.\n\nSign up or sign in, then redeem this invite code to join:\n\n%s\n\nThe code works once.\n", inviterName, roomName, token)
+			if err := emailNotifier.mailer.Send(email, subject, body); err != nil {
+				slog.Warn("Failed to send invite email", "room_id", roomID, "error", err)
+			}
+		}()
+	}
+	return token, nil
+}
+
+// Redeem an emailed invite token and join its room. A token works once, for whichever account
+// redeems it, so having the email is what counts rather than the address an account signed up with.
+func handleRedeemEmailInvite(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.Token = strings.TrimSpace(req.Token)
+	if req.Token == "" {
+		http.Error(w, "token is required", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var roomID int
+	err := db.QueryRowContext(ctx,
+		"DELETE FROM room_email_invites WHERE token_hash = $1 RETURNING room_id",
+		hashAPIKey(req.Token),
+	).Scan(&roomID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "DB error redeeming email invite", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Email invite redeemed", "room_id", roomID, "user_id", userID)
+
+	joinRoom(w, roomID, userID, username, true)
+}
+
+// List the current user's pending invites
+func handleGetMyInvites(w http.ResponseWriter, r *http.Request) {
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT i.id, i.room_id, r.name, COALESCE(i.inviter_id, 0), COALESCE(u.username, ''), i.invitee_id, i.status, i.created_at
+		FROM room_invites i
+		JOIN rooms r ON r.id = i.room_id
+		LEFT JOIN users u ON u.id = i.inviter_id
+		WHERE i.invitee_id = $1 AND i.status = 'pending'
+		ORDER BY i.created_at DESC
+	`, userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get invites", "error", err)
+		http.Error(w, "Failed to get invites", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	invites := []RoomInvite{}
+	for rows.Next() {
+		var i RoomInvite
+		if err := rows.Scan(&i.ID, &i.RoomID, &i.RoomName, &i.InviterID, &i.InviterName, &i.InviteeID, &i.Status, &i.CreatedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning invite", "error", err)
+			continue
+		}
+		invites = append(invites, i)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invites)
+}
+
+// loadPendingInvite returns the invite's room if it is pending and addressed to the user
+func loadPendingInvite(w http.ResponseWriter, r *http.Request) (inviteID, roomID int, ok bool) {
+	vars := mux.Vars(r)
+	inviteID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid invite ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	err = db.QueryRowContext(ctx,
+		"SELECT room_id FROM room_invites WHERE id = $1 AND invitee_id = $2 AND status = 'pending'",
+		inviteID, userID,
+	).Scan(&roomID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "DB error fetching invite", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	return inviteID, roomID, true
+}
+
+// Accept an invite and join the room
+func handleAcceptInvite(w http.ResponseWriter, r *http.Request) {
+	inviteID, roomID, ok := loadPendingInvite(w, r)
+	if !ok {
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	if !joinRoom(w, roomID, userID, username, true) {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx,
+		"UPDATE room_invites SET status = 'accepted', responded_at = CURRENT_TIMESTAMP WHERE id = $1",
+		inviteID,
+	); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to mark invite accepted", "invite_id", inviteID, "error", err)
+	}
+}
+
+// Decline an invite
+func handleDeclineInvite(w http.ResponseWriter, r *http.Request) {
+	inviteID, _, ok := loadPendingInvite(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	_, err := db.ExecContext(ctx,
+		"UPDATE room_invites SET status = 'declined', responded_at = CURRENT_TIMESTAMP WHERE id = $1",
+		inviteID,
+	)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to decline invite", "error", err)
+		http.Error(w, "Failed to decline invite", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
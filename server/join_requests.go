@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// JoinRequest is a user asking to join a private room, pending until an admin approves or denies it
+type JoinRequest struct {
+	ID        int       `json:"id"`
+	RoomID    int       `json:"room_id"`
+	RoomName  string    `json:"room_name"`
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// notifyRoomAdmins sends an event to the open connections of everyone who can approve join requests
+func notifyRoomAdmins(roomID int, msg *WSMessage) {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT user_id FROM room_members WHERE room_id = $1 AND role = $2", roomID, RoleAdmin)
+	if err != nil {
+		slog.Error("Failed to load room admins", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var adminID int
+		if err := rows.Scan(&adminID); err != nil {
+			slog.Error("Error scanning room admin", "error", err)
+			continue
+		}
+		roomManager.SendToUser(adminID, msg)
+	}
+}
+
+// createJoinRequest files (or re-files, after a denial) a request to join a private room
+// and responds with 202 Accepted
+func createJoinRequest(w http.ResponseWriter, roomID, userID int, username string) {
+	req := JoinRequest{UserID: userID, Username: username}
+
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO room_join_requests (room_id, user_id) VALUES ($1, $2)
+		ON CONFLICT (room_id, user_id) DO UPDATE
+			SET status = 'pending', created_at = CASE WHEN room_join_requests.status = 'pending' THEN room_join_requests.created_at ELSE CURRENT_TIMESTAMP END,
+				responded_by = NULL, responded_at = NULL
+		RETURNING id, room_id, status, created_at
+	`, roomID, userID).Scan(&req.ID, &req.RoomID, &req.Status, &req.CreatedAt)
+	if err != nil {
+		slog.Error("Failed to create join request", "error", err)
+		http.Error(w, "Failed to request to join", http.StatusInternalServerError)
+		return
+	}
+	db.QueryRowContext(ctx, "SELECT name FROM rooms WHERE id = $1", roomID).Scan(&req.RoomName)
+
+	notifyRoomAdmins(roomID, &WSMessage{Type: "joinRequestCreated", RoomID: roomID, JoinRequest: &req})
+
+	slog.Info("User requested to join private room", "user_id", userID, "room_id", roomID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(req)
+}
+
+// List a room's pending join requests (admin only)
+func handleGetJoinRequests(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermApproveJoins, "Only admins can view join requests"); !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT jr.id, jr.room_id, r.name, jr.user_id, u.username, jr.status, jr.created_at
+		FROM room_join_requests jr
+		JOIN rooms r ON r.id = jr.room_id
+		JOIN users u ON u.id = jr.user_id
+		WHERE jr.room_id = $1 AND jr.status = 'pending'
+		ORDER BY jr.created_at ASC
+	`, roomID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get join requests", "error", err)
+		http.Error(w, "Failed to get join requests", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	requests := []JoinRequest{}
+	for rows.Next() {
+		var jr JoinRequest
+		if err := rows.Scan(&jr.ID, &jr.RoomID, &jr.RoomName, &jr.UserID, &jr.Username, &jr.Status, &jr.CreatedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning join request", "error", err)
+			continue
+		}
+		requests = append(requests, jr)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
+
+// resolveJoinRequest loads a pending request after checking the caller may approve it
+func resolveJoinRequest(w http.ResponseWriter, r *http.Request) (*JoinRequest, bool) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	requestID, err := strconv.Atoi(vars["requestId"])
+	if err != nil {
+		http.Error(w, "Invalid request ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermApproveJoins, "Only admins can review join requests"); !ok {
+		return nil, false
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var jr JoinRequest
+	err = db.QueryRowContext(ctx, `
+		SELECT jr.id, jr.room_id, r.name, jr.user_id, u.username, jr.status, jr.created_at
+		FROM room_join_requests jr
+		JOIN rooms r ON r.id = jr.room_id
+		JOIN users u ON u.id = jr.user_id
+		WHERE jr.id = $1 AND jr.room_id = $2 AND jr.status = 'pending'
+	`, requestID, roomID).Scan(&jr.ID, &jr.RoomID, &jr.RoomName, &jr.UserID, &jr.Username, &jr.Status, &jr.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Join request not found", http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "DB error fetching join request", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return &jr, true
+}
+
+// claimJoinRequest records the decision if the request is still pending, answering 409 when
+// another admin got to it first
+func claimJoinRequest(w http.ResponseWriter, jr *JoinRequest, status string, responderID int) bool {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx,
+		"UPDATE room_join_requests SET status = $1, responded_by = $2, responded_at = CURRENT_TIMESTAMP WHERE id = $3 AND status = 'pending'",
+		status, responderID, jr.ID,
+	)
+	if err != nil {
+		slog.Error("Failed to update join request", "error", err)
+		http.Error(w, "Failed to update join request", http.StatusInternalServerError)
+		return false
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Join request was already resolved", http.StatusConflict)
+		return false
+	}
+	jr.Status = status
+	return true
+}
+
+// finishJoinRequest tells the requester and the room's admins about the decision
+func finishJoinRequest(w http.ResponseWriter, jr *JoinRequest, responderID int) {
+	event := &WSMessage{Type: "joinRequestResolved", RoomID: jr.RoomID, JoinRequest: jr}
+	roomManager.SendToUser(jr.UserID, event)
+	notifyRoomAdmins(jr.RoomID, event)
+
+	slog.Info("Join request resolved", "join_request_id", jr.ID, "room_id", jr.RoomID, "status", jr.Status, "responder_id", responderID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jr)
+}
+
+// Approve a join request, adding the requester to the room (admin only)
+func handleApproveJoinRequest(w http.ResponseWriter, r *http.Request) {
+	jr, ok := resolveJoinRequest(w, r)
+	if !ok {
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if isUserBanned(jr.UserID, jr.RoomID) {
+		http.Error(w, "User is banned from this room", http.StatusForbidden)
+		return
+	}
+
+	// Claimed before adding the member, so a concurrent deny can't leave them in the room
+	if !claimJoinRequest(w, jr, "approved", userID) {
+		return
+	}
+
+	// The requester may have joined through an invite in the meantime
+	if !isUserInRoom(jr.UserID, jr.RoomID) {
+		if err := addRoomMember(jr.RoomID, jr.UserID, jr.Username, time.Now()); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to add approved member", "error", err)
+			reopenJoinRequest(r.Context(), jr.ID)
+			http.Error(w, "Failed to add member", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	finishJoinRequest(w, jr, userID)
+}
+
+// reopenJoinRequest puts a request back to pending after approving it failed, so it can be retried
+func reopenJoinRequest(ctx context.Context, requestID int) {
+	dbCtx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	_, err := db.ExecContext(dbCtx,
+		"UPDATE room_join_requests SET status = 'pending', responded_by = NULL, responded_at = NULL WHERE id = $1",
+		requestID,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to reopen join request", "join_request_id", requestID, "error", err)
+	}
+}
+
+// Deny a join request (admin only)
+func handleDenyJoinRequest(w http.ResponseWriter, r *http.Request) {
+	jr, ok := resolveJoinRequest(w, r)
+	if !ok {
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if !claimJoinRequest(w, jr, "denied", userID) {
+		return
+	}
+	finishJoinRequest(w, jr, userID)
+}
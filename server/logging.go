@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// initLogging installs the default slog logger. LOG_FORMAT is "text" (default) or "json";
+// LOG_LEVEL is debug, info (default), warn or error.
+func initLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info"))); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if strings.EqualFold(getEnv("LOG_FORMAT", "text"), "json") {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(&contextHandler{handler}))
+}
+
+// contextHandler adds the request's IDs to records logged with a context (slog.InfoContext etc.),
+// so handlers don't have to repeat them on every call
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id, ok := ctx.Value("request_id").(string); ok {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	if userID, ok := ctx.Value("user_id").(float64); ok {
+		rec.AddAttrs(slog.Int("user_id", int(userID)))
+	}
+	if roomID, ok := ctx.Value("room_id").(int); ok {
+		rec.AddAttrs(slog.Int("room_id", roomID))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
+
+// withRoomLogField puts the {id} of /rooms/{id}/... routes in the request context for contextHandler
+func withRoomLogField(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil && strings.Contains(tmpl, "/rooms/{id}") {
+				if roomID, err := strconv.Atoi(mux.Vars(r)["id"]); err == nil {
+					r = r.WithContext(context.WithValue(r.Context(), "room_id", roomID))
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logger tags a connection's log records with its user
+func (c *Client) logger() *slog.Logger {
+	return slog.With("user_id", c.ID, "username", c.Username)
+}
+
+// fatal logs err and exits, for startup failures
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
@@ -6,19 +6,21 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
-	"github.com/lib/pq"
 )
 
 var db *sql.DB
@@ -27,6 +29,12 @@ var jwtKey []byte
 
 const SystemMessageTimeFormat = "3:04 PM on Jan 2, 2006"
 
+// LastMessageTimeFormat is the legacy Room.LastMessageTime; clients should format LastMessageAt
+const LastMessageTimeFormat = "3:04 PM"
+
+// DeletedMessagePlaceholder replaces the content of soft-deleted messages in history
+const DeletedMessagePlaceholder = "This message was deleted"
+
 // --- Struct Definitions ---
 
 type User struct {
@@ -44,11 +52,20 @@ type Room struct {
 	CreatedAt   time.Time `json:"created_at"`
 	LastMessage     string `json:"lastMessage"`
 	LastSenderID    int    `json:"lastSenderId"`
-	LastMessageTime string `json:"lastMessageTime"`
+	LastMessageTime string `json:"lastMessageTime"` // Deprecated: server-formatted LastMessageAt, kept for older clients
+	LastMessageAt   *time.Time `json:"lastMessageAt,omitempty"` // The last message, or the room's creation when it has none
 	Unread          int    `json:"unread"`
+	UnreadMentions  int    `json:"unreadMentions"` // Unread messages that @mention the user, counted within Unread
 	IsPrivate       bool   `json:"isPrivate"`
+	IsDirect        bool   `json:"isDirect,omitempty"` // A contact's direct message room
 	Members         int    `json:"members"`
 	Avatar          string `json:"avatar"`
+	AvatarURL       string `json:"avatarUrl,omitempty"` // Uploaded or generated image; Avatar stays the initial
+	NotifyLevel     string `json:"notificationLevel,omitempty"`
+	MutedUntil      *time.Time `json:"mutedUntil,omitempty"` // The user muted the room for a while; it acts as level none until then
+	ArchivedAt      *time.Time `json:"archivedAt,omitempty"` // Archived for inactivity: read-only until an admin unarchives it
+	CleanupAt       *time.Time `json:"cleanupAt,omitempty"`  // Flagged inactive: archived or deleted then unless someone posts
+	SlowModeSeconds int    `json:"slowModeSeconds"`
 }
 
 // Message represents a chat message
@@ -58,9 +75,22 @@ type Message struct {
 	SenderID  int       `json:"sender_id"`
 	Sender    string    `json:"sender"`  
 	Avatar    string    `json:"avatar"`
+	Kind      string    `json:"kind"` // "text", "poll", "gif" or "system" (from the System user, see SystemEvent)
 	Text      string    `json:"text"`
+	HTML      string    `json:"html,omitempty"` // Sanitized rendering of Text when markdown is enabled
 	Timestamp time.Time `json:"timestamp"`
 	Read      bool      `json:"read"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"` // Last edit; earlier versions are at GET /api/messages/{id}/history
+	Reactions []ReactionSummary `json:"reactions,omitempty"`
+	Attachments []Attachment    `json:"attachments,omitempty"`
+	Poll      *Poll     `json:"poll,omitempty"`
+	GIF       *GIF      `json:"gif,omitempty"`
+	ReplyTo   *QuotedMessage `json:"reply_to,omitempty"`
+	SystemEvent *SystemEvent `json:"system_event,omitempty"` // What a System message says; Text is it rendered for the reader
+
+	shadowbanned bool // Sent by a shadowbanned user: only they see it
+	replayed     bool // Sent before with the same idempotency key, so already broadcast
 }
 
 // WSMessage is the envelope for WebSocket communication
@@ -68,7 +98,27 @@ type WSMessage struct {
 	Type     string `json:"type"` // "joinRoom", "sendMessage", "roomMessage", "error"
 	RoomID   int    `json:"room_id,omitempty"`
 	Content  string `json:"content,omitempty"` // For "sendMessage"
+	AttachmentIDs []int `json:"attachment_ids,omitempty"` // For "sendMessage"
+	GIFID    string `json:"gif_id,omitempty"` // For "sendMessage", a result of GET /api/gifs/search
+	Options  []string `json:"options,omitempty"` // For "createPoll", with the question in Content
+	ClientMsgID string `json:"client_msg_id,omitempty"` // Client-generated temp ID, echoed in "messageAck" and "error"
+	ReplyToID int `json:"reply_to_id,omitempty"` // For "sendMessage", the message being quoted
+	LastSeen map[int]int `json:"last_seen,omitempty"` // For "resume", room ID -> last message ID the client has
+	HasMore  bool `json:"has_more,omitempty"` // For "resumed", more messages were missed than were replayed
+	RoomIDs  []int `json:"room_ids,omitempty"` // For "roomsSynced", every room the connection is subscribed to
+	Version  int `json:"version,omitempty"` // For "hello", the protocol version offered or agreed
+	Features []string `json:"features,omitempty"` // For "hello", the features offered or agreed
+	Seq      int64 `json:"seq,omitempty"` // Per-room sequence on broadcasts; for "fetchSince", the last one the client has
 	*Message        // For "roomMessage"
+	Reaction *ReactionEvent `json:"reaction,omitempty"` // For "reactionAdded", "reactionRemoved"
+	Presence *PresenceEvent `json:"presence,omitempty"` // For "userOnline", "userOffline"
+	Receipt  *ReadReceipt   `json:"receipt,omitempty"`  // For "messagesRead"
+	JoinRequest *JoinRequest `json:"join_request,omitempty"` // For "joinRequestCreated", "joinRequestResolved"
+	Member   *MemberEvent   `json:"member,omitempty"`   // For "memberJoined", "memberLeft", "memberRemoved"
+	ContactRequest *ContactRequest `json:"contact_request,omitempty"` // For "contactRequestCreated", "contactRequestAccepted"
+	Invite   *RoomInvite    `json:"invite,omitempty"`   // For "roomInvited"
+	SignOut  *SessionSignOut `json:"sign_out,omitempty"` // For "sessionSignedOut", passed between instances over the broker
+	Error    *ValidationError `json:"error,omitempty"`  // For "error"
 }
 
 // Client represents a connected WebSocket client
@@ -79,6 +129,15 @@ type Client struct {
 	Conn     *websocket.Conn
 	Send     chan *WSMessage
 	Manager  *RoomManager
+	Protocol int             // Negotiated with "hello"; 0 until then
+	Features map[string]bool // Negotiated with "hello"; nil for clients that skipped it
+	mu       sync.RWMutex    // Guards Protocol and Features
+	Encoding string          // EncodingJSON or EncodingMsgpack, fixed at connect time
+	Locale   string          // System messages are rendered in this, fixed at connect time
+	SessionID string         // The session of the token it connected with, "" if it has none
+	shutdown chan struct{}   // Closed when the server is stopping
+	drops    atomic.Int64    // Messages dropped because Send was full, for the disconnect_after_drops policy
+	releaseSlot func()       // Frees the connection's place in the per-user and per-IP connection limits
 }
 
 // RoomHub manages clients for a single room
@@ -89,15 +148,25 @@ type RoomHub struct {
 	Register   chan *Client
 	Unregister chan *Client
 	Manager    *RoomManager
+	deliver    chan *WSMessage // Messages from the broker, to fan out to Clients
+	unsubscribe func()        // Ends the broker subscription; nil if subscribing failed
+	done       chan struct{} // Closed when the hub is shut down; senders select on it
+	idleSince  time.Time     // When the hub was first seen without clients; guarded by Manager.mu
+	Seq        int64        // Last sequence number broadcast to the room
+	history    []*WSMessage // Recent broadcasts, for "fetchSince"
 	mu         sync.RWMutex
 }
 
 // RoomManager manages all RoomHubs
 type RoomManager struct {
 	Rooms      map[int]*RoomHub
+	Clients    map[*Client]bool
+	Users      map[int]map[*Client]bool // userID -> their open connections; online while there is one
 	Register   chan *Client
 	Unregister chan *Client
 	mu         sync.RWMutex
+	shuttingDown bool           // Set by Shutdown; no new clients are accepted
+	writers      sync.WaitGroup // Running writePumps, so Shutdown can wait for them to flush
 }
 
 // --- Environment & DB Init ---
@@ -117,26 +186,34 @@ func getEnv(key, def string) string {
 
 func initDB() {
 	loadEnv()
-	connStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		getEnv("DB_HOST", "localhost"),
-		getEnv("DB_PORT", "5432"),
-		getEnv("DB_USER", "postgres"),
-		getEnv("DB_PASSWORD", "password"),
-		getEnv("DB_NAME", "chathubdb"),
-	)
+	connStr := dbConnString(getEnv("DB_HOST", "localhost"), getEnv("DB_PORT", "5432"))
 
 	var err error
-	db, err = sql.Open("postgres", connStr)
+	db, err = openDB(connStr)
 	if err != nil {
-		log.Fatal("Failed to connect to database:", err)
+		fatal("Failed to connect to database", err)
 	}
+	configurePool(db)
 	if err = db.Ping(); err != nil {
-		log.Fatal("Database ping failed:", err)
+		fatal("Database ping failed", err)
 	}
 
 	createTables()
-	log.Println("✅ Database connected successfully")
+	slog.Info("✅ Database connected successfully")
+
+	initReplicas()
+}
+
+// dbConnString builds the connection string for a server; replicas share the primary's credentials
+func dbConnString(host, port string) string {
+	return fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		host,
+		port,
+		getEnv("DB_USER", "postgres"),
+		getEnv("DB_PASSWORD", "password"),
+		getEnv("DB_NAME", "chathubdb"),
+	)
 }
 
 func createTables() {
@@ -161,7 +238,7 @@ func createTables() {
         id SERIAL PRIMARY KEY,
         room_id INT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
         user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-        role VARCHAR(50) DEFAULT 'member', -- 'admin', 'member'
+        role VARCHAR(50) DEFAULT 'member', -- 'admin', 'moderator', 'member'
         joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
         UNIQUE(room_id, user_id)
     );
@@ -174,19 +251,369 @@ func createTables() {
     );
     CREATE INDEX IF NOT EXISTS idx_messages_room_id_created_at ON messages(room_id, created_at);
 
-    CREATE TABLE IF NOT EXISTS message_reads (
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT FALSE;
+    CREATE TABLE IF NOT EXISTS api_keys (
+        id SERIAL PRIMARY KEY,
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        key_hash VARCHAR(64) UNIQUE NOT NULL,
+        created_by INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        last_used_at TIMESTAMP
+    );
+
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS is_active BOOLEAN NOT NULL DEFAULT TRUE;
+
+    ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+    ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_by INT REFERENCES users(id) ON DELETE SET NULL;
+
+    CREATE TABLE IF NOT EXISTS room_invites (
+        id SERIAL PRIMARY KEY,
+        room_id INT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+        inviter_id INT REFERENCES users(id) ON DELETE SET NULL,
+        invitee_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        status VARCHAR(20) NOT NULL DEFAULT 'pending', -- 'pending', 'accepted', 'declined'
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        responded_at TIMESTAMP,
+        UNIQUE(room_id, invitee_id)
+    );
+    CREATE INDEX IF NOT EXISTS idx_room_invites_invitee ON room_invites(invitee_id, status);
+
+    CREATE TABLE IF NOT EXISTS message_reactions (
         id SERIAL PRIMARY KEY,
         message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
         user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-        read_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-        UNIQUE(message_id, user_id)
+        emoji VARCHAR(32) NOT NULL,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE(message_id, user_id, emoji)
+    );
+    CREATE INDEX IF NOT EXISTS idx_message_reactions_message ON message_reactions(message_id);
+
+    CREATE TABLE IF NOT EXISTS attachments (
+        id SERIAL PRIMARY KEY,
+        uploader_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        message_id INT REFERENCES messages(id) ON DELETE CASCADE,
+        storage_key TEXT NOT NULL,
+        filename VARCHAR(255) NOT NULL,
+        content_type VARCHAR(255) NOT NULL,
+        size_bytes BIGINT NOT NULL,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS idx_attachments_message ON attachments(message_id);
+    ALTER TABLE attachments ADD COLUMN IF NOT EXISTS thumbnail_key TEXT;
+
+    ALTER TABLE messages ADD COLUMN IF NOT EXISTS content_html TEXT;
+
+    CREATE TABLE IF NOT EXISTS moderation_words (
+        id SERIAL PRIMARY KEY,
+        room_id INT REFERENCES rooms(id) ON DELETE CASCADE, -- NULL for the global list
+        word VARCHAR(100) NOT NULL,
+        action VARCHAR(20) NOT NULL DEFAULT 'mask', -- 'reject', 'mask', 'flag'
+        created_by INT REFERENCES users(id) ON DELETE SET NULL,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE UNIQUE INDEX IF NOT EXISTS idx_moderation_words_room_word ON moderation_words(COALESCE(room_id, 0), word);
+    ALTER TABLE messages ADD COLUMN IF NOT EXISTS flagged_at TIMESTAMP;
+
+    ALTER TABLE messages ADD COLUMN IF NOT EXISTS kind VARCHAR(20) NOT NULL DEFAULT 'text'; -- 'text', 'poll', 'gif', 'system'
+    CREATE TABLE IF NOT EXISTS polls (
+        id SERIAL PRIMARY KEY,
+        message_id INT UNIQUE NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+        room_id INT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+        question TEXT NOT NULL,
+        created_by INT REFERENCES users(id) ON DELETE SET NULL,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE TABLE IF NOT EXISTS poll_options (
+        id SERIAL PRIMARY KEY,
+        poll_id INT NOT NULL REFERENCES polls(id) ON DELETE CASCADE,
+        position INT NOT NULL,
+        text VARCHAR(200) NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS poll_votes (
+        id SERIAL PRIMARY KEY,
+        poll_id INT NOT NULL REFERENCES polls(id) ON DELETE CASCADE,
+        option_id INT NOT NULL REFERENCES poll_options(id) ON DELETE CASCADE,
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        voted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE(poll_id, user_id)
     );
-    CREATE INDEX IF NOT EXISTS idx_message_reads_user_message ON message_reads(user_id, message_id);
-    CREATE INDEX IF NOT EXISTS idx_message_reads_message ON message_reads(message_id);
+    CREATE INDEX IF NOT EXISTS idx_poll_votes_option ON poll_votes(option_id);
+
+    ALTER TABLE messages ADD COLUMN IF NOT EXISTS reply_to_id INT REFERENCES messages(id) ON DELETE SET NULL;
+
+    ALTER TABLE rooms ADD COLUMN IF NOT EXISTS avatar_key TEXT;
+    ALTER TABLE rooms ADD COLUMN IF NOT EXISTS slow_mode_seconds INT NOT NULL DEFAULT 0;
+
+    -- A member is muted while muted_at is set and muted_until is NULL (indefinite) or in the future
+    ALTER TABLE room_members ADD COLUMN IF NOT EXISTS muted_at TIMESTAMP;
+    ALTER TABLE room_members ADD COLUMN IF NOT EXISTS muted_until TIMESTAMP;
+    ALTER TABLE room_members ADD COLUMN IF NOT EXISTS notify_level VARCHAR(20) NOT NULL DEFAULT 'all'; -- 'all', 'mentions', 'none'
+
+    CREATE TABLE IF NOT EXISTS room_bans (
+        id SERIAL PRIMARY KEY,
+        room_id INT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        banned_by INT REFERENCES users(id) ON DELETE SET NULL,
+        reason TEXT NOT NULL DEFAULT '',
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE(room_id, user_id)
+    );
+
+    CREATE TABLE IF NOT EXISTS room_role_permissions (
+        room_id INT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+        role VARCHAR(50) NOT NULL,
+        permission VARCHAR(50) NOT NULL,
+        allowed BOOLEAN NOT NULL,
+        PRIMARY KEY (room_id, role, permission)
+    );
+
+    CREATE TABLE IF NOT EXISTS room_join_requests (
+        id SERIAL PRIMARY KEY,
+        room_id INT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        status VARCHAR(20) NOT NULL DEFAULT 'pending', -- 'pending', 'approved', 'denied'
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        responded_by INT REFERENCES users(id) ON DELETE SET NULL,
+        responded_at TIMESTAMP,
+        UNIQUE(room_id, user_id)
+    );
+
+    -- Each member has read everything up to last_read_message_id. This replaces message_reads,
+    -- which stored a row per message per reader; existing data is folded into the pointers once.
+    ALTER TABLE room_members ADD COLUMN IF NOT EXISTS last_read_message_id INT NOT NULL DEFAULT 0;
+    ALTER TABLE room_members ADD COLUMN IF NOT EXISTS last_read_at TIMESTAMP;
+    CREATE INDEX IF NOT EXISTS idx_messages_room_id_id ON messages(room_id, id);
+    DO $$
+    BEGIN
+        IF to_regclass('message_reads') IS NOT NULL THEN
+            UPDATE room_members rm
+            SET last_read_message_id = r.last_id, last_read_at = r.read_at
+            FROM (
+                SELECT m.room_id, mr.user_id, MAX(mr.message_id) AS last_id, MAX(mr.read_at) AS read_at
+                FROM message_reads mr
+                JOIN messages m ON m.id = mr.message_id
+                GROUP BY m.room_id, mr.user_id
+            ) r
+            WHERE rm.room_id = r.room_id AND rm.user_id = r.user_id AND rm.last_read_message_id < r.last_id;
+            DROP TABLE message_reads;
+        END IF;
+    END
+    $$;
+
+    CREATE TABLE IF NOT EXISTS room_webhooks (
+        id SERIAL PRIMARY KEY,
+        room_id INT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+        url TEXT NOT NULL,
+        secret TEXT NOT NULL,
+        events TEXT[] NOT NULL,
+        created_by INT REFERENCES users(id) ON DELETE SET NULL,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS idx_room_webhooks_room_id ON room_webhooks(room_id);
+
+    CREATE TABLE IF NOT EXISTS webhook_deliveries (
+        id BIGSERIAL PRIMARY KEY,
+        webhook_id INT NOT NULL REFERENCES room_webhooks(id) ON DELETE CASCADE,
+        event VARCHAR(50) NOT NULL,
+        payload JSONB NOT NULL,
+        status VARCHAR(20) NOT NULL DEFAULT 'pending', -- 'pending', 'succeeded', 'failed'
+        attempts INT NOT NULL DEFAULT 0,
+        response_status INT,
+        last_error TEXT,
+        next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        delivered_at TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+    CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id, id);
+
+    CREATE TABLE IF NOT EXISTS incoming_webhooks (
+        id SERIAL PRIMARY KEY,
+        room_id INT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- the bot account it posts as
+        token_hash VARCHAR(64) NOT NULL UNIQUE,
+        created_by INT REFERENCES users(id) ON DELETE SET NULL,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        last_used_at TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS idx_incoming_webhooks_room_id ON incoming_webhooks(room_id);
+
+    CREATE TABLE IF NOT EXISTS push_subscriptions (
+        id SERIAL PRIMARY KEY,
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        endpoint TEXT NOT NULL UNIQUE,
+        p256dh TEXT NOT NULL,
+        auth TEXT NOT NULL,
+        user_agent TEXT,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS idx_push_subscriptions_user_id ON push_subscriptions(user_id);
+
+    CREATE TABLE IF NOT EXISTS device_tokens (
+        id SERIAL PRIMARY KEY,
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        platform VARCHAR(10) NOT NULL, -- 'fcm', 'apns'
+        token TEXT NOT NULL UNIQUE,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS idx_device_tokens_user_id ON device_tokens(user_id);
+
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP; -- When the user's last connection closed
+    CREATE TABLE IF NOT EXISTS notification_preferences (
+        user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+        email_enabled BOOLEAN NOT NULL DEFAULT TRUE,
+        updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE TABLE IF NOT EXISTS email_notifications (
+        id BIGSERIAL PRIMARY KEY,
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        room_id INT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+        message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+        reason VARCHAR(20) NOT NULL, -- 'mention', 'direct'
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS idx_email_notifications_user_id ON email_notifications(user_id, created_at);
+
+    CREATE TABLE IF NOT EXISTS message_gifs (
+        message_id INT PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+        provider VARCHAR(20) NOT NULL, -- 'giphy', 'tenor'
+        gif_id TEXT NOT NULL,
+        title TEXT NOT NULL DEFAULT '',
+        url TEXT NOT NULL,
+        preview_url TEXT NOT NULL,
+        width INT NOT NULL DEFAULT 0,
+        height INT NOT NULL DEFAULT 0
+    );
+
+    ALTER TABLE rooms ADD COLUMN IF NOT EXISTS is_direct BOOLEAN NOT NULL DEFAULT FALSE; -- A contact's direct message room
+    CREATE TABLE IF NOT EXISTS contacts (
+        id SERIAL PRIMARY KEY,
+        requester_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        addressee_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        status VARCHAR(20) NOT NULL DEFAULT 'pending', -- 'pending', 'accepted', 'declined'
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        responded_at TIMESTAMP
+    );
+    CREATE UNIQUE INDEX IF NOT EXISTS idx_contacts_pair ON contacts(LEAST(requester_id, addressee_id), GREATEST(requester_id, addressee_id));
+    CREATE INDEX IF NOT EXISTS idx_contacts_addressee_id ON contacts(addressee_id);
+
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'available'; -- 'available', 'busy', 'away'
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS status_emoji VARCHAR(64) NOT NULL DEFAULT '';
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS status_text VARCHAR(255) NOT NULL DEFAULT '';
+
+    ALTER TABLE notification_preferences ADD COLUMN IF NOT EXISTS dnd_start TIME;
+    ALTER TABLE notification_preferences ADD COLUMN IF NOT EXISTS dnd_end TIME;
+    ALTER TABLE notification_preferences ADD COLUMN IF NOT EXISTS dnd_timezone VARCHAR(64);
+
+    ALTER TABLE notification_preferences ADD COLUMN IF NOT EXISTS push_enabled BOOLEAN NOT NULL DEFAULT TRUE;
+    ALTER TABLE notification_preferences ADD COLUMN IF NOT EXISTS mentions_enabled BOOLEAN NOT NULL DEFAULT TRUE;
+    ALTER TABLE notification_preferences ADD COLUMN IF NOT EXISTS direct_enabled BOOLEAN NOT NULL DEFAULT TRUE;
+    ALTER TABLE notification_preferences ADD COLUMN IF NOT EXISTS all_messages_enabled BOOLEAN NOT NULL DEFAULT TRUE;
+
+    CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at);
+
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS is_shadowbanned BOOLEAN NOT NULL DEFAULT FALSE;
+    ALTER TABLE messages ADD COLUMN IF NOT EXISTS shadowbanned BOOLEAN NOT NULL DEFAULT FALSE;
+
+    CREATE TABLE IF NOT EXISTS room_email_invites (
+        id SERIAL PRIMARY KEY,
+        room_id INT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+        inviter_id INT REFERENCES users(id) ON DELETE SET NULL,
+        email VARCHAR(255) NOT NULL, -- Lowercased; one invite per address and room
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE(room_id, email)
+    );
+
+    ALTER TABLE rooms ADD COLUMN IF NOT EXISTS join_code VARCHAR(32) UNIQUE; -- e.g. BLUE-FOX-OWL-4217, created on first use
+
+    ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP;
+    CREATE TABLE IF NOT EXISTS message_revisions (
+        id SERIAL PRIMARY KEY,
+        message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+        content TEXT NOT NULL, -- The version an edit replaced
+        content_html TEXT,
+        edited_by INT REFERENCES users(id) ON DELETE SET NULL,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS idx_message_revisions_message ON message_revisions(message_id, id);
+
+    CREATE TABLE IF NOT EXISTS server_settings (
+        key VARCHAR(64) PRIMARY KEY, -- e.g. 'rate_limits'
+        value JSONB NOT NULL,
+        updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+
+    CREATE TABLE IF NOT EXISTS blocked_email_domains (
+        domain VARCHAR(255) PRIMARY KEY, -- Lowercased; subdomains are blocked too
+        created_by INT REFERENCES users(id) ON DELETE SET NULL, -- NULL for the defaults
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+
+    ALTER TABLE messages ADD COLUMN IF NOT EXISTS system_event JSONB; -- For System messages, see SystemEvent
+
+    CREATE TABLE IF NOT EXISTS idempotency_keys (
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        scope VARCHAR(20) NOT NULL, -- 'message' or 'room'
+        key VARCHAR(64) NOT NULL,
+        resource_id INT, -- The message or room created; NULL while a room is being created
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (user_id, scope, key)
+    );
+
+    CREATE TABLE IF NOT EXISTS notifications (
+        id BIGSERIAL PRIMARY KEY,
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        room_id INT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+        message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+        reason VARCHAR(20) NOT NULL, -- 'mention', 'direct'
+        read_at TIMESTAMP, -- Marked read; reading the room past the message counts too
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS idx_notifications_user_id ON notifications(user_id, id);
+
+    CREATE TABLE IF NOT EXISTS sessions (
+        id VARCHAR(32) PRIMARY KEY, -- The token's session_id claim
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        user_agent VARCHAR(255) NOT NULL DEFAULT '',
+        ip VARCHAR(45) NOT NULL DEFAULT '', -- Of the latest request or connection
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+
+    ALTER TABLE room_members ADD COLUMN IF NOT EXISTS notifications_muted_until TIMESTAMPTZ; -- The member's own mute of the room, see roomMutedSQL
+    -- It was TIMESTAMP at first, which dropped the offset of the time the client sent
+    DO $$
+    BEGIN
+        IF (SELECT data_type FROM information_schema.columns
+            WHERE table_name = 'room_members' AND column_name = 'notifications_muted_until') = 'timestamp without time zone' THEN
+            ALTER TABLE room_members ALTER COLUMN notifications_muted_until TYPE TIMESTAMPTZ USING notifications_muted_until AT TIME ZONE 'UTC';
+        END IF;
+    END
+    $$;
+
+    ALTER TABLE rooms ADD COLUMN IF NOT EXISTS inactive_since TIMESTAMP; -- Flagged by the inactive room cleanup, see roomCleanupPolicy
+    ALTER TABLE rooms ADD COLUMN IF NOT EXISTS archived_at TIMESTAMP; -- Read-only until unarchived
+
+    -- When a message last changed (sent, edited or deleted), for room lists with updated_since
+    CREATE INDEX IF NOT EXISTS idx_messages_room_id_changed_at ON messages(room_id, (GREATEST(created_at, edited_at, deleted_at)));
+
+    -- Email invites are redeemed with the token they were sent rather than claimed by whoever
+    -- registers the address; invites from before tokens can't be redeemed
+    ALTER TABLE room_email_invites ADD COLUMN IF NOT EXISTS token_hash VARCHAR(64) UNIQUE;
+    DELETE FROM room_email_invites WHERE token_hash IS NULL;
+    DROP INDEX IF EXISTS idx_room_email_invites_email;
     `
 
 	if _, err := db.Exec(schema); err != nil {
-		log.Fatal("Failed to create tables:", err)
+		fatal("Failed to create tables", err)
+	}
+
+	// Usernames are unique regardless of case. Databases that already hold names differing only
+	// in case can't have the index, and rely on CreateUser's check alone.
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username_lower ON users(LOWER(username))"); err != nil {
+		slog.Warn("Could not create the case-insensitive username index", "error", err)
 	}
 
 	// --- Create System User ---
@@ -194,7 +621,7 @@ func createTables() {
 	var systemUserExists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = 1)").Scan(&systemUserExists)
 	if err != nil {
-		log.Fatal("Failed to check for System user:", err)
+		fatal("Failed to check for System user", err)
 	}
 
 	if !systemUserExists {
@@ -204,18 +631,27 @@ func createTables() {
 		VALUES (1, 'System', 'system@chathub.io', 'SYSTEM_ACCOUNT_HASH');
 		`
 		if _, err := db.Exec(systemUserSQL); err != nil {
-			log.Fatal("Failed to create System user:", err)
+			fatal("Failed to create System user", err)
 		}
 
 		// Adjust sequence to start at 2 (only on first creation)
 		if _, err := db.Exec("SELECT setval('users_id_seq', 1, true)"); err != nil {
-			log.Fatal("Failed to update users sequence value:", err)
+			fatal("Failed to update users sequence value", err)
 		}
 
-		log.Println("✅ System user (ID 1) created and sequence initialized.")
+		slog.Info("✅ System user (ID 1) created and sequence initialized")
 	} else {
-		log.Println("✅ System user (ID 1) already exists.")
+		slog.Info("✅ System user (ID 1) already exists")
+	}
+
+	if err := seedBlockedEmailDomains(); err != nil {
+		fatal("Failed to seed blocked email domains", err)
+	}
+	if err := migrateSystemMessageKind(); err != nil {
+		fatal("Failed to mark system messages", err)
 	}
+
+	promoteConfiguredAdmins()
 }
 
 // --- Hub & Manager Logic ---
@@ -223,6 +659,8 @@ func createTables() {
 func NewRoomManager() *RoomManager {
 	return &RoomManager{
 		Rooms:      make(map[int]*RoomHub),
+		Clients:    make(map[*Client]bool),
+		Users:      make(map[int]map[*Client]bool),
 		Register:   make(chan *Client),
 		Unregister: make(chan *Client),
 	}
@@ -233,19 +671,52 @@ func (m *RoomManager) Run() {
 	for {
 		select {
 		case client := <-m.Register:
-			log.Printf("Client %s connected", client.Username)
+			client.logger().Info("Client connected")
+			m.mu.Lock()
+			// Upgraded while Shutdown was snapshotting clients, close it straight away
+			if m.shuttingDown {
+				m.mu.Unlock()
+				close(client.shutdown)
+				continue
+			}
+			m.Clients[client] = true
+			if m.Users[client.ID] == nil {
+				m.Users[client.ID] = make(map[*Client]bool)
+			}
+			m.Users[client.ID][client] = true
+			cameOnline := len(m.Users[client.ID]) == 1
+			m.mu.Unlock()
+
+			if cameOnline {
+				go m.broadcastPresence(client, true)
+			}
 		case client := <-m.Unregister:
-			log.Printf("Client %s disconnected", client.Username)
 			m.mu.Lock()
+			// A client can be unregistered more than once (read error + slow send), only handle the first
+			if _, ok := m.Clients[client]; !ok {
+				m.mu.Unlock()
+				continue
+			}
+			client.logger().Info("Client disconnected")
+			delete(m.Clients, client)
 			for _, hub := range m.Rooms {
 				hub.mu.Lock()
-				if _, ok := hub.Clients[client]; ok {
-					delete(hub.Clients, client)
-					close(client.Send)
-				}
+				delete(hub.Clients, client)
 				hub.mu.Unlock()
 			}
+			close(client.Send)
+
+			delete(m.Users[client.ID], client)
+			wentOffline := len(m.Users[client.ID]) == 0
+			if wentOffline {
+				delete(m.Users, client.ID)
+			}
 			m.mu.Unlock()
+
+			if wentOffline {
+				go m.broadcastPresence(client, false)
+				go recordLastSeen(client.ID)
+			}
 		}
 	}
 }
@@ -265,39 +736,80 @@ func (m *RoomManager) GetOrCreateRoomHub(roomID int) *RoomHub {
 		Register:   make(chan *Client),
 		Unregister: make(chan *Client),
 		Manager:    m,
+		deliver:    make(chan *WSMessage, 256),
+		done:       make(chan struct{}),
+		idleSince:  time.Now(),
+	}
+	unsubscribe, err := broker.Subscribe(roomID, func(msg *WSMessage) {
+		select {
+		case hub.deliver <- msg:
+		case <-hub.done:
+		}
+	})
+	if err != nil {
+		slog.Error("Failed to subscribe room to the broker, delivering locally only", "room_id", roomID, "error", err)
+	} else {
+		hub.unsubscribe = unsubscribe
 	}
 	m.Rooms[roomID] = hub
 
 	go hub.Run()
+	go hub.publish()
 	return hub
 }
 
+// publish hands the hub's broadcasts to the broker in order. It runs apart from Run so the
+// in-memory broker, which delivers synchronously, can't block the hub on itself.
+func (h *RoomHub) publish() {
+	for {
+		var message *WSMessage
+		select {
+		case message = <-h.Broadcast:
+		case <-h.done:
+			h.flushToBroker()
+			return
+		}
+		if h.unsubscribe != nil {
+			err := broker.Publish(h.RoomID, message)
+			if err == nil {
+				continue
+			}
+			slog.Error("Failed to publish to the broker, delivering locally only", "room_id", h.RoomID, "error", err)
+		}
+		select {
+		case h.deliver <- message:
+		case <-h.done:
+		}
+	}
+}
+
 func (h *RoomHub) Run() {
-	log.Printf("Starting hub for room %d", h.RoomID)
+	slog.Debug("Starting hub", "room_id", h.RoomID)
 	for {
 		select {
+		case <-h.done:
+			slog.Debug("Stopping hub", "room_id", h.RoomID)
+			return
+
 		case client := <-h.Register:
 			h.mu.Lock()
 			h.Clients[client] = true
-			log.Printf("Client %s joined room %d. Total clients in room: %d", client.Username, h.RoomID, len(h.Clients))
+			client.logger().Debug("Client registered with hub", "room_id", h.RoomID, "room_clients", len(h.Clients))
 			h.mu.Unlock()
 
 		case client := <-h.Unregister:
 			h.mu.Lock()
 			if _, ok := h.Clients[client]; ok {
 				delete(h.Clients, client)
-				log.Printf("Client %s left room %d. Total clients in room: %d", client.Username, h.RoomID, len(h.Clients))
+				client.logger().Debug("Client unregistered from hub", "room_id", h.RoomID, "room_clients", len(h.Clients))
 			}
 			h.mu.Unlock()
 
-		case message := <-h.Broadcast:
+		case message := <-h.deliver:
+			message = h.stamp(message)
 			h.mu.RLock()
 			for client := range h.Clients {
-				select {
-				case client.Send <- message:
-				default:
-					go func(c *Client) { h.Manager.Unregister <- c }(client)
-				}
+				client.enqueue(message)
 			}
 			h.mu.RUnlock()
 		}
@@ -306,14 +818,69 @@ func (h *RoomHub) Run() {
 
 // --- WebSocket Client Logic ---
 
+const (
+	// Time allowed to write a message to the peer
+	writeWait = 10 * time.Second
+	// Time allowed to read the next pong from the peer; a silent connection is reaped after this
+	pongWait = 60 * time.Second
+	// Send pings at this period, which must be less than pongWait
+	pingPeriod = (pongWait * 9) / 10
+)
+
+// sendError reports a problem with a client's request, echoing its client_msg_id so
+// optimistic sends can be marked failed. Content carries the text for older clients.
+func (c *Client) sendError(req *WSMessage, code, message string) {
+	c.sendValidationError(req, &ValidationError{Code: code, Message: message})
+}
+
+func (c *Client) sendValidationError(req *WSMessage, verr *ValidationError) {
+	c.Send <- errorFrame(req, verr)
+}
+
+func errorFrame(req *WSMessage, verr *ValidationError) *WSMessage {
+	return &WSMessage{Type: "error", RoomID: req.RoomID, ClientMsgID: req.ClientMsgID, Content: verr.Message, Error: verr}
+}
+
+// sendAck confirms to the sender that a message was persisted, mapping its temp ID to the real one
+func (c *Client) sendAck(req *WSMessage, saved *Message) {
+	if req.ClientMsgID == "" {
+		return
+	}
+	c.Send <- ackFrame(req, saved)
+}
+
+func ackFrame(req *WSMessage, saved *Message) *WSMessage {
+	return &WSMessage{Type: "messageAck", RoomID: saved.RoomID, ClientMsgID: req.ClientMsgID, Message: saved}
+}
+
 func (c *Client) readPump() {
-	defer func() { c.Manager.Unregister <- c; c.Conn.Close() }()
+	defer func() {
+		c.Manager.Unregister <- c
+		c.Conn.Close()
+		if c.releaseSlot != nil {
+			c.releaseSlot()
+		}
+	}()
+	defer c.recoverClientPanic()
+
+	c.Conn.SetReadLimit(maxFrameBytes())
+	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	c.subscribeAll()
+
+	limiter := newTokenBucket(wsMessageRate(), wsMessageBurst())
 
 	for {
 		var msg WSMessage
-		if err := c.Conn.ReadJSON(&msg); err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
+		if err := c.readMessage(&msg); err != nil {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				c.logger().Warn("Frame over the size limit, closing connection", "limit_bytes", maxFrameBytes())
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				c.logger().Error("Unexpected WebSocket close", "error", err)
 			}
 			break
 		}
@@ -324,60 +891,192 @@ func (c *Client) readPump() {
 			Avatar:   c.Avatar,
 		}
 
+		if len(msg.ClientMsgID) > 64 {
+			msg.ClientMsgID = ""
+			c.sendError(&msg, CodeInvalidMessage, "client_msg_id must be at most 64 characters")
+			continue
+		}
+
+		if msg.Type == "sendMessage" || msg.Type == "createPoll" {
+			// Picks up limits changed by an admin since the connection opened
+			limiter.setRate(float64(wsMessageRate()), float64(wsMessageBurst()))
+			if !limiter.allow(time.Now()) {
+				if limiter.rejected >= wsFloodLimit() {
+					c.logger().Warn("Client kept flooding after being rate limited, closing connection")
+					c.Conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"),
+						time.Now().Add(writeWait))
+					break
+				}
+				c.sendValidationError(&msg, limiter.rateLimitError())
+				continue
+			}
+		}
+
 		switch msg.Type {
 		case "joinRoom":
 			if !isUserInRoom(c.ID, msg.RoomID) {
-				log.Printf("Auth error: User %d tried to join room %d", c.ID, msg.RoomID)
-				c.Send <- &WSMessage{Type: "error", Content: "Not authorized for this room"}
+				c.logger().Warn("Auth error: tried to join a room they are not in", "room_id", msg.RoomID)
+				c.sendError(&msg, CodeNotAuthorized, "Not authorized for this room")
 				continue
 			}
-			hub := c.Manager.GetOrCreateRoomHub(msg.RoomID)
-			hub.Register <- c
-			log.Printf("Client %s joined room %d", c.Username, msg.RoomID)
+			c.Manager.SubscribeToRoom(msg.RoomID, c)
+			c.logger().Debug("Client joined room", "room_id", msg.RoomID)
+
+		case "leaveRoom":
+			// Only stops this connection's subscription; membership and other rooms are untouched
+			c.Manager.UnsubscribeFromRoom(msg.RoomID, c)
+			c.logger().Debug("Client left room", "room_id", msg.RoomID)
+
+		case "hello":
+			c.hello(&msg)
+
+		case "resume":
+			c.resume(&msg)
+
+		case "syncRooms":
+			c.subscribeAll()
+
+		case "fetchSince":
+			c.fetchSince(&msg)
 
 		case "sendMessage":
-			if msg.Content == "" || msg.RoomID == 0 {
-				log.Println("Invalid message from client")
+			ctx, span := c.startWSSpan(&msg)
+			endSpan(span, c.sendMessage(ctx, &msg))
+
+		case "createPoll":
+			if msg.RoomID == 0 {
+				c.sendError(&msg, CodeInvalidMessage, "room_id is required")
 				continue
 			}
-			
 			if !isUserInRoom(c.ID, msg.RoomID) {
-				log.Printf("Auth error: User %d tried to send to room %d", c.ID, msg.RoomID)
-				c.Send <- &WSMessage{Type: "error", Content: "Not authorized to send to this room"}
+				c.sendError(&msg, CodeNotAuthorized, "Not authorized to send to this room")
 				continue
 			}
 
-			var savedMsg Message
-			err := db.QueryRow(
-				"INSERT INTO messages (room_id, sender_id, content) VALUES ($1, $2, $3) RETURNING id, room_id, sender_id, content, created_at",
-				msg.RoomID, c.ID, msg.Content,
-			).Scan(&savedMsg.ID, &savedMsg.RoomID, &savedMsg.SenderID, &savedMsg.Text, &savedMsg.Timestamp)
-
-			if err != nil {
-				log.Println("Failed to save message:", err)
+			savedMsg, err := createPollMessage(msg.RoomID, c.ID, c.Username, msg.Content, msg.Options)
+			var verr *ValidationError
+			if errors.As(err, &verr) {
+				c.sendValidationError(&msg, verr)
+				continue
+			} else if err != nil {
+				slog.Error("Failed to create poll", "error", err)
+				c.sendError(&msg, CodeInternal, "Failed to create poll")
 				continue
 			}
 
-			savedMsg.Sender = c.Username
-			savedMsg.Avatar = c.Avatar
-			savedMsg.Read = false 
-
-			hub := c.Manager.GetOrCreateRoomHub(msg.RoomID)
-			hub.Broadcast <- &WSMessage{
+			c.sendAck(&msg, savedMsg)
+			c.Manager.BroadcastToRoom(msg.RoomID, &WSMessage{
 				Type:    "roomMessage",
-				RoomID:   savedMsg.RoomID, 
-				Message: &savedMsg,
-			}
+				RoomID:  savedMsg.RoomID,
+				Message: savedMsg,
+			})
+
+		default:
+			c.sendError(&msg, CodeUnknownType, fmt.Sprintf("Unknown message type %q", msg.Type))
 		}
 	}
 }
 
+// sendMessage runs a "sendMessage" frame through validation, persistence and the room broadcast.
+// The returned error is only for tracing; the client has already been told about it.
+func (c *Client) sendMessage(ctx context.Context, msg *WSMessage) error {
+	if msg.RoomID == 0 {
+		c.sendError(msg, CodeInvalidMessage, "room_id is required")
+		return errors.New("missing room_id")
+	}
+	if err := validateMessageContent(msg.Content, msg.AttachmentIDs, msg.GIFID); err != nil {
+		c.sendValidationError(msg, err.(*ValidationError))
+		return err
+	}
+
+	if !isUserInRoom(c.ID, msg.RoomID) {
+		c.logger().Warn("Auth error: tried to send to a room they are not in", "room_id", msg.RoomID)
+		c.sendError(msg, CodeNotAuthorized, "Not authorized to send to this room")
+		return errors.New("not a member of the room")
+	}
+
+	// The ack and broadcast happen once the persister has written the message, so the readPump
+	// can move on to the next frame meanwhile
+	err := queueUserMessage(&OutgoingMessage{
+		RoomID:         msg.RoomID,
+		SenderID:       c.ID,
+		Sender:         c.Username,
+		Content:        msg.Content,
+		AttachmentIDs:  msg.AttachmentIDs,
+		ReplyToID:      msg.ReplyToID,
+		GIFID:          msg.GIFID,
+		IdempotencyKey: msg.ClientMsgID,
+	}, func(savedMsg *Message, err error) {
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			c.sendIfConnected(errorFrame(msg, verr))
+			return
+		} else if err != nil {
+			c.logger().Error("Failed to save message", "room_id", msg.RoomID, "error", err)
+			c.sendIfConnected(errorFrame(msg, &ValidationError{Code: CodeInternal, Message: "Failed to send message"}))
+			return
+		}
+
+		if msg.ClientMsgID != "" {
+			c.sendIfConnected(ackFrame(msg, savedMsg))
+		}
+		if savedMsg.replayed {
+			return
+		}
+		_, span := tracer.Start(ctx, "broadcast")
+		c.Manager.BroadcastToRoom(msg.RoomID, &WSMessage{
+			Type:    "roomMessage",
+			RoomID:  savedMsg.RoomID,
+			Message: savedMsg,
+		})
+		span.End()
+	})
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		c.sendValidationError(msg, verr)
+		return err
+	} else if err != nil {
+		slog.Error("Failed to save message", "error", err)
+		c.sendError(msg, CodeInternal, "Failed to send message")
+		return err
+	}
+	return nil
+}
+
 func (c *Client) writePump() {
-	defer c.Conn.Close()
-	for msg := range c.Send {
-		if err := c.Conn.WriteJSON(msg); err != nil {
-			log.Println("WebSocket write error:", err)
-			break
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Conn.Close()
+		c.Manager.writers.Done()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.Send:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The manager closed the channel
+				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			c.Conn.EnableWriteCompression(c.supports(FeatureCompression))
+			if err := c.writeMessage(msg); err != nil {
+				slog.Error("WebSocket write error", "error", err)
+				return
+			}
+
+		case <-c.shutdown:
+			c.closeForShutdown()
+			return
+
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.logger().Info("Ping failed, closing connection", "error", err)
+				return
+			}
 		}
 	}
 }
@@ -399,12 +1098,20 @@ func verifyPassword(password, hash string) bool {
 	return hashPassword(password) == hash
 }
 
-func generateJWT(userID int, username string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+// tokenLifetime is how long a token from login or registration stays valid
+const tokenLifetime = 24 * time.Hour
+
+// generateJWT issues a token for the user, naming its session (see startSession) unless that is ""
+func generateJWT(userID int, username, sessionID string) (string, error) {
+	claims := jwt.MapClaims{
 		"user_id":  userID,
 		"username": username,
-		"exp":      time.Now().Add(24 * time.Hour).Unix(),
-	})
+		"exp":      time.Now().Add(tokenLifetime).Unix(),
+	}
+	if sessionID != "" {
+		claims["session_id"] = sessionID
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(jwtKey)
 }
 
@@ -425,6 +1132,20 @@ func parseJWT(tokenString string) (jwt.MapClaims, error) {
 // Auth middleware to get user claims
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Bot accounts authenticate with an API key instead of a JWT
+		if apiKey := r.Header.Get("X-Api-Key"); apiKey != "" {
+			userID, username, err := lookupAPIKey(apiKey)
+			if err != nil {
+				http.Error(w, "Invalid API key", http.StatusUnauthorized)
+				return
+			}
+			ctx := r.Context()
+			ctx = context.WithValue(ctx, "user_id", float64(userID))
+			ctx = context.WithValue(ctx, "username", username)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
 			http.Error(w, "Missing authorization token", http.StatusUnauthorized)
@@ -442,70 +1163,137 @@ func authMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		if !isUserActive(int(claims["user_id"].(float64))) {
+			http.Error(w, "Account has been deactivated", http.StatusForbidden)
+			return
+		}
+		if !isSessionActive(claims, clientIP(r)) {
+			http.Error(w, "Signed out on this device", http.StatusUnauthorized)
+			return
+		}
+
 		ctx := r.Context()
 		ctx = context.WithValue(ctx, "user_id", claims["user_id"].(float64))
 		ctx = context.WithValue(ctx, "username", claims["username"].(string))
+		ctx = context.WithValue(ctx, "session_id", tokenSessionID(claims))
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+func isUserActive(userID int) bool {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	active, err := store.IsUserActive(ctx, userID)
+	if err != nil {
+		slog.Error("Error checking user status", "error", err)
+		return false
+	}
+	return active
+}
+
 func isUserInRoom(userID, roomID int) bool {
-	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM room_members WHERE user_id = $1 AND room_id = $2)", userID, roomID).Scan(&exists)
+	return isMemberIn(store, userID, roomID)
+}
+
+// isMemberIn checks membership in s, through the membership cache
+func isMemberIn(s Store, userID, roomID int) bool {
+	member, ok, gen := memberships.get(roomID, userID)
+	if ok {
+		return member
+	}
+
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	exists, err := s.IsRoomMember(ctx, roomID, userID)
 	if err != nil {
-		log.Printf("Error checking room membership: %v", err)
+		slog.Error("Error checking room membership", "error", err)
 		return false
 	}
+	memberships.set(roomID, userID, exists, gen)
 	return exists
 }
 
 // --- HTTP Handlers ---
 
-func handleRegister(w http.ResponseWriter, r *http.Request) {
+func (h *coreHandlers) handleRegister(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Username string `json:"username"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Username     string `json:"username"`
+		Email        string `json:"email"`
+		Password     string `json:"password"`
+		CaptchaToken string `json:"captcha_token"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	req.Username = sanitizeLine(req.Username)
 
 	// Validate input
 	if req.Username == "" || req.Email == "" || req.Password == "" {
 		http.Error(w, "Username, email, and password are required", http.StatusBadRequest)
 		return
 	}
+	if reason := usernames.check(req.Username); reason != "" {
+		http.Error(w, reason, http.StatusBadRequest)
+		return
+	}
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+	req.Email = email
+
+	if captcha != nil {
+		ok, err := captcha.Verify(r.Context(), req.CaptchaToken, clientIP(r))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "CAPTCHA verification error", "provider", captcha.Name(), "error", err)
+			http.Error(w, "Could not verify CAPTCHA. Please try again.", http.StatusServiceUnavailable)
+			return
+		}
+		if !ok {
+			http.Error(w, "CAPTCHA verification failed", http.StatusBadRequest)
+			return
+		}
+	}
 
 	hashed := hashPassword(req.Password)
-	var userID int
-	err := db.QueryRow(
-		"INSERT INTO users (username, email, password_hash) VALUES ($1, $2, $3) RETURNING id",
-		req.Username, req.Email, hashed,
-	).Scan(&userID)
 
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	if err := checkEmailDomain(ctx, req.Email); err == errEmailDomainBlocked {
+		http.Error(w, "Email addresses from this domain can't be used to register", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to check email domain", "error", err)
+		http.Error(w, "Registration failed. Please try again.", http.StatusInternalServerError)
+		return
+	}
+
+	userID, err := h.store.CreateUser(ctx, req.Username, req.Email, hashed)
 	if err != nil {
-		// Check if it's a PostgreSQL unique constraint violation
-		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
-			// 23505 is the PostgreSQL error code for unique_violation
-			if pqErr.Constraint == "users_username_key" {
-				http.Error(w, "Username already taken", http.StatusConflict)
-				return
-			} else if pqErr.Constraint == "users_email_key" {
-				http.Error(w, "Email already registered", http.StatusConflict)
-				return
-			}
-			http.Error(w, "User already exists", http.StatusConflict)
+		if err == errUsernameTaken {
+			http.Error(w, "Username already taken", http.StatusConflict)
+			return
+		} else if err == errEmailTaken {
+			http.Error(w, "Email already registered", http.StatusConflict)
 			return
 		}
 		// Other database errors
-		log.Printf("Registration error: %v", err)
+		slog.ErrorContext(r.Context(), "Registration error", "error", err)
 		http.Error(w, "Registration failed. Please try again.", http.StatusInternalServerError)
 		return
 	}
 
-	token, _ := generateJWT(userID, req.Username)
+	// The account exists by now, so a token without a session beats failing the registration
+	sessionID, err := startSession(ctx, userID, r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to start session", "error", err)
+	}
+	token, _ := generateJWT(userID, req.Username, sessionID)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"token":    token,
@@ -514,7 +1302,7 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func handleLogin(w http.ResponseWriter, r *http.Request) {
+func (h *coreHandlers) handleLogin(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
@@ -523,73 +1311,76 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	req.Username = sanitizeLine(req.Username)
 
-	var userID int
-	var hash string
-	err := db.QueryRow(
-		"SELECT id, password_hash FROM users WHERE username = $1",
-		req.Username,
-	).Scan(&userID, &hash)
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
 
-	if err != nil || !verifyPassword(req.Password, hash) {
+	creds, err := h.store.UserCredentials(ctx, req.Username)
+	if err != nil || !verifyPassword(req.Password, creds.PasswordHash) {
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	token, _ := generateJWT(userID, req.Username)
+	if !creds.Active {
+		http.Error(w, "Account has been deactivated", http.StatusForbidden)
+		return
+	}
+
+	sessionID, err := startSession(ctx, creds.ID, r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to start session", "error", err)
+		http.Error(w, "Login failed. Please try again.", http.StatusInternalServerError)
+		return
+	}
+	token, _ := generateJWT(creds.ID, req.Username, sessionID)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"token":    token,
-		"user_id":  userID,
+		"user_id":  creds.ID,
 		"username": req.Username,
 	})
 }
 
 // Create a new room
-func handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+func (h *coreHandlers) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Name        string `json:"name"`
 		Description string `json:"description"`
+		IsPrivate   bool   `json:"is_private"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	req.Name, req.Description = sanitizeLine(req.Name), sanitizeText(req.Description)
 	if req.Name == "" {
 		http.Error(w, "Room name is required", http.StatusBadRequest)
 		return
 	}
-
-	userID := int(r.Context().Value("user_id").(float64))
-
-	tx, err := db.Begin()
-	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
+	idempotencyKey, ok := requestIdempotencyKey(w, r)
+	if !ok {
 		return
 	}
-	defer tx.Rollback() 
 
-	var roomID int
-	var createdAt time.Time
-	err = tx.QueryRow(
-		"INSERT INTO rooms (name, description, created_by) VALUES ($1, $2, $3) RETURNING id, created_at",
-		req.Name, req.Description, userID,
-	).Scan(&roomID, &createdAt)
+	userID := int(r.Context().Value("user_id").(float64))
 
-	if err != nil {
-		log.Println("Failed to create room:", err)
-		http.Error(w, "Failed to create room", http.StatusInternalServerError)
-		return
-	}
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
 
-	_, err = tx.Exec(
-		"INSERT INTO room_members (room_id, user_id, role) VALUES ($1, $2, $3)",
-		roomID, userID, "admin",
-	)
-	if err != nil {
-		log.Println("Failed to add room member:", err)
-		http.Error(w, "Failed to create room", http.StatusInternalServerError)
-		return
+	// The key is reserved before the room is created, so a retry racing the first request waits
+	// for it instead of creating a second room
+	keyed := idempotencyKey != ""
+	if keyed {
+		err := claimIdempotencyKey(ctx, db, userID, IdempotencyRoom, idempotencyKey, 0)
+		if errors.Is(err, errIdempotencyKeyUsed) {
+			replayCreatedRoom(w, r, userID, idempotencyKey)
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to claim idempotency key", "error", err)
+			http.Error(w, "Failed to create room", http.StatusInternalServerError)
+			return
+		}
 	}
 
 	currentTime := time.Now()
@@ -597,50 +1388,43 @@ func handleCreateRoom(w http.ResponseWriter, r *http.Request) {
 
 	username := r.Context().Value("username").(string)
 
-	systemMessageContent := fmt.Sprintf("%s created this room at %s.", username, formattedTime)
-
-	var savedMsg Message
-	err = tx.QueryRow(
-		"INSERT INTO messages (room_id, sender_id, content) VALUES ($1, $2, $3) RETURNING id, room_id, sender_id, content, created_at",
-		roomID, 1, systemMessageContent,
-	).Scan(&savedMsg.ID, &savedMsg.RoomID, &savedMsg.SenderID, &savedMsg.Text, &savedMsg.Timestamp)
-
-	if err != nil {
-		log.Printf("Failed to add creation system message: %v", err)
-		http.Error(w, "Room created, but system message failed", http.StatusInternalServerError)
-		return
-	}
-
-	if err := tx.Commit(); err != nil {
-		http.Error(w, "Server error during commit", http.StatusInternalServerError)
-		return
-	}
-
-	hub := roomManager.GetOrCreateRoomHub(roomID)
-	savedMsg.Sender = "System"
-	savedMsg.Avatar = "S"
-	savedMsg.Read = false
-
-	hub.Broadcast <- &WSMessage{
-		Type:    "roomMessage",
-		RoomID:   savedMsg.RoomID, 
-		Message: &savedMsg,
-	}
+	createdEvent := newSystemEvent(EventRoomCreated, userID, 0, "actor", username, "at", eventTime(currentTime))
 
 	newRoom := Room{
-		ID:          roomID,
 		Name:        req.Name,
 		Description: req.Description,
 		CreatedBy:   userID,
-		CreatedAt:   createdAt,
 		LastMessage: fmt.Sprintf("You created this room at %s.", formattedTime),
-		LastMessageTime: currentTime.Format("3:04 PM"),
+		LastMessageTime: currentTime.Format(LastMessageTimeFormat),
+		LastMessageAt: &currentTime,
 		Unread: 0,
-		IsPrivate: false,
+		IsPrivate: req.IsPrivate,
 		Members: 1,
-		Avatar: string(req.Name[0]),
+		Avatar: avatarInitial(req.Name),
+	}
+	savedMsg, err := h.store.CreateRoom(ctx, &newRoom, createdEvent)
+	if err != nil {
+		if keyed {
+			releaseIdempotencyKey(userID, IdempotencyRoom, idempotencyKey)
+		}
+		slog.ErrorContext(r.Context(), "Failed to create room", "error", err)
+		http.Error(w, "Failed to create room", http.StatusInternalServerError)
+		return
+	}
+	if keyed {
+		// Left reserved on failure: retries get a 409 until the key is forgotten, rather than a second room
+		if err := completeIdempotencyKey(ctx, userID, IdempotencyRoom, idempotencyKey, newRoom.ID); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to record idempotency key", "room_id", newRoom.ID, "error", err)
+		}
 	}
 
+	roomManager.subscribeUser(newRoom.ID, userID)
+	roomManager.BroadcastToRoom(newRoom.ID, &WSMessage{
+		Type:    "roomMessage",
+		RoomID:   savedMsg.RoomID, 
+		Message: savedMsg,
+	})
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(newRoom)
@@ -658,184 +1442,171 @@ func handleJoinRoom(w http.ResponseWriter, r *http.Request) {
 	userID := int(r.Context().Value("user_id").(float64))
 	username := r.Context().Value("username").(string)
 
+	joinRoom(w, roomID, userID, username, false)
+}
+
+// joinRoom adds the user to a room, posts the "joined" system message and writes the room as
+// the response. Private rooms can only be joined when invited is true (e.g. accepting an invite);
+// otherwise a join request is filed for the room's admins.
+func joinRoom(w http.ResponseWriter, roomID, userID int, username string, invited bool) bool {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
 	var room Room
 	var membersCount int
-	err = db.QueryRow(`
-		SELECT r.id, r.name, r.description, r.created_by, r.created_at,
+	var avatarKey string
+	err := db.QueryRowContext(ctx, `
+		SELECT r.id, r.name, r.description, r.created_by, r.created_at, r.is_private, COALESCE(r.avatar_key, ''), r.slow_mode_seconds,
 			(SELECT COUNT(*) FROM room_members rm WHERE rm.room_id = r.id) as members_count
 		FROM rooms r WHERE r.id = $1
-	`, roomID).Scan(&room.ID, &room.Name, &room.Description, &room.CreatedBy, &room.CreatedAt, &membersCount)
+	`, roomID).Scan(&room.ID, &room.Name, &room.Description, &room.CreatedBy, &room.CreatedAt, &room.IsPrivate, &avatarKey, &room.SlowModeSeconds, &membersCount)
 
 	if err == sql.ErrNoRows {
 		http.Error(w, "Room not found", http.StatusNotFound)
-		return
+		return false
 	} else if err != nil {
-		log.Printf("DB error fetching room details: %v", err)
+		slog.Error("DB error fetching room details", "error", err)
 		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+		return false
 	}
 
 	if isUserInRoom(userID, roomID) {
 		http.Error(w, "Already a member of this room", http.StatusConflict)
-		return
+		return false
 	}
 
-	tx, err := db.Begin()
+	if isUserBanned(userID, roomID) {
+		http.Error(w, "You are banned from this room", http.StatusForbidden)
+		return false
+	}
+
+	if room.IsPrivate && !invited {
+		createJoinRequest(w, roomID, userID, username)
+		return false
+	}
+
+	currentTime := time.Now()
+	formattedTime := currentTime.Format(SystemMessageTimeFormat)
+
+	if err := addRoomMember(roomID, userID, username, currentTime); err != nil {
+		slog.Error("Failed to add room member", "error", err)
+		http.Error(w, "Failed to join room", http.StatusInternalServerError)
+		return false
+	}
+
+	room.Members = membersCount + 1 
+	room.Avatar = avatarInitial(room.Name)
+	room.AvatarURL = roomAvatarURL(room.ID, avatarKey)
+	room.LastMessage = fmt.Sprintf("You joined this room at %s.", formattedTime)
+	room.LastMessageTime = currentTime.Format(LastMessageTimeFormat)
+	room.LastMessageAt = &currentTime
+	room.Unread = 0
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(room)
+	return true
+}
+
+// addRoomMember inserts the membership and the "joined" system message in one transaction,
+// then broadcasts the message to the room
+func addRoomMember(roomID, userID int, username string, joinedAt time.Time) error {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+		return err
 	}
 	defer tx.Rollback()
 
-	_, err = tx.Exec(
-		"INSERT INTO room_members (room_id, user_id, role) VALUES ($1, $2, $3)",
-		roomID, userID, "member",
-	)
+	member := &MemberEvent{UserID: userID, Username: username, Avatar: avatarInitial(username), Role: RoleMember}
+	var memberJoinedAt time.Time
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO room_members (room_id, user_id, role) VALUES ($1, $2, $3) RETURNING joined_at",
+		roomID, userID, member.Role,
+	).Scan(&memberJoinedAt)
 	if err != nil {
-		log.Printf("Failed to add room member: %v", err)
-		http.Error(w, "Failed to join room", http.StatusInternalServerError)
-		return
+		return err
 	}
+	member.JoinedAt = &memberJoinedAt
 
-	currentTime := time.Now()
-	formattedTime := currentTime.Format(SystemMessageTimeFormat)
-	systemMessageContent := fmt.Sprintf("%s joined this room at %s.", username, formattedTime)
+	joinedEvent := newSystemEvent(EventMemberJoined, userID, 0, "actor", username, "at", eventTime(joinedAt))
 
 	var savedMsg Message
-	err = tx.QueryRow(
-		"INSERT INTO messages (room_id, sender_id, content) VALUES ($1, $2, $3) RETURNING id, room_id, sender_id, content, created_at",
-		roomID, 1, systemMessageContent,
-	).Scan(&savedMsg.ID, &savedMsg.RoomID, &savedMsg.SenderID, &savedMsg.Text, &savedMsg.Timestamp)
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO messages (room_id, sender_id, kind, content, system_event) VALUES ($1, $2, 'system', $3, $4) RETURNING id, room_id, sender_id, kind, content, created_at",
+		roomID, 1, joinedEvent.Render(defaultLocale), encodeSystemEvent(joinedEvent),
+	).Scan(&savedMsg.ID, &savedMsg.RoomID, &savedMsg.SenderID, &savedMsg.Kind, &savedMsg.Text, &savedMsg.Timestamp)
 	if err != nil {
-		log.Printf("Failed to add system message: %v", err)
-		http.Error(w, "Failed to join room (message fail)", http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	if err := tx.Commit(); err != nil {
-		http.Error(w, "Server error during commit", http.StatusInternalServerError)
-		return
+		return err
 	}
-
-	hub := roomManager.GetOrCreateRoomHub(roomID)
+	memberships.invalidate(roomID, userID)
+	roomManager.subscribeUser(roomID, userID)
 
 	savedMsg.Sender = "System"
 	savedMsg.Avatar = "S" 
+	savedMsg.SystemEvent = joinedEvent
 	savedMsg.Read = false
 
-	hub.Broadcast <- &WSMessage{
+	roomManager.BroadcastToRoom(roomID, &WSMessage{
 		Type:     "roomMessage",
 		RoomID:   savedMsg.RoomID,
 		Message:  &savedMsg,
-	}
-	log.Printf("Broadcasted system message to room %d: %s", roomID, savedMsg.Text)
-
-	room.Members = membersCount + 1 
-	room.Avatar = string(room.Name[0])
-	room.LastMessage = fmt.Sprintf("You joined this room at %s.", formattedTime)
-	room.LastMessageTime = currentTime.Format("3:04 PM")
-	room.Unread = 0
-	room.IsPrivate = false
+	})
+	slog.Debug("Broadcasted system message", "room_id", roomID, "text", savedMsg.Text)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(room)
+	// Lets open member lists add the newcomer without re-fetching
+	roomManager.BroadcastToRoom(roomID, &WSMessage{Type: "memberJoined", RoomID: roomID, Member: member})
+	return nil
 }
 
-// Get all rooms for the current user
-func handleGetRooms(w http.ResponseWriter, r *http.Request) {
+// Get all rooms for the current user, most recently active first.
+// Supports ?limit= and ?offset=, and ?updated_since= (the X-Synced-At of a previous response) to
+// fetch only rooms with messages sent, edited or deleted, reads or joins since then. It looks back
+// roomSyncWindow further, so a room may come back that hasn't changed. Rooms the user left or was
+// removed from are not reported by updated_since; clients learn about those over the WebSocket.
+func (h *coreHandlers) handleGetRooms(w http.ResponseWriter, r *http.Request) {
     userID := int(r.Context().Value("user_id").(float64))
-    rooms := []Room{}
-
-    rows, err := db.Query(`
-        SELECT
-            r.id, r.name, r.description, r.created_by, r.created_at, r.is_private,
-            (SELECT COUNT(*) FROM room_members WHERE room_id = r.id) AS members_count,
-            lm.content,
-            lm.created_at,
-			lm.sender_id,
-            -- Calculate unread count: messages not sent by user and not in message_reads
-            (
-                SELECT COUNT(*)
-                FROM messages m
-                WHERE m.room_id = r.id
-                    AND m.sender_id != $1  -- Exclude own messages
-                    AND NOT EXISTS (
-                        SELECT 1 FROM message_reads mr
-                        WHERE mr.message_id = m.id AND mr.user_id = $1
-                    )
-            ) AS unread_count
-        FROM rooms r
-        JOIN room_members rm ON rm.room_id = r.id
-        LEFT JOIN (
-            -- Subquery to find the single latest message (lm = Latest Message)
-			SELECT DISTINCT ON (room_id) id, room_id, content, created_at, sender_id
-            FROM messages
-            ORDER BY room_id, created_at DESC
-        ) lm ON lm.room_id = r.id
-        WHERE rm.user_id = $1
-        ORDER BY lm.created_at DESC NULLS LAST -- Order by latest activity
-    `, userID)
+    username := r.Context().Value("username").(string)
 
-    if err != nil {
-        log.Println("Failed to get rooms:", err)
-        http.Error(w, "Failed to get rooms", http.StatusInternalServerError)
-        return
+    params := r.URL.Query()
+    var opts roomListOptions
+    if n, err := strconv.Atoi(params.Get("limit")); err == nil && n > 0 {
+        opts.Limit = n
     }
-    defer rows.Close()
-
-    for rows.Next() {
-        var room Room
-        var membersCount int
-        var unreadCount int
-        
-        var lastMessage sql.NullString
-        var lastMessageTime sql.NullTime
-		var lastSenderID sql.NullInt64
-        
-        if err := rows.Scan(
-            &room.ID, &room.Name, &room.Description, &room.CreatedBy, &room.CreatedAt, &room.IsPrivate,
-            &membersCount,
-            &lastMessage,
-            &lastMessageTime,
-			&lastSenderID,
-            &unreadCount, 
-        ); err != nil {
-            log.Println("Error scanning room:", err)
-            continue
-        }
-        
-        room.Members = membersCount
-        room.Unread = unreadCount
-
-        if lastMessage.Valid {
-            room.LastMessage = lastMessage.String
-        } else {
-            room.LastMessage = "No messages yet." 
-        }
-
-        if lastMessageTime.Valid {
-            room.LastMessageTime = lastMessageTime.Time.Format("3:04 PM")
-        } else {
-            room.LastMessageTime = room.CreatedAt.Format("3:04 PM") 
+    if n, err := strconv.Atoi(params.Get("offset")); err == nil && n > 0 {
+        opts.Offset = n
+    }
+    if s := params.Get("updated_since"); s != "" {
+        t, err := time.Parse(time.RFC3339, s)
+        if err != nil {
+            http.Error(w, "updated_since must be an RFC 3339 timestamp", http.StatusBadRequest)
+            return
         }
+        opts.UpdatedSince = &t
+    }
 
-		if lastSenderID.Valid {
-    		room.LastSenderID = int(lastSenderID.Int64)
-		} else {
-    		room.LastSenderID = 0 // Default to 0 or another non-system ID if no messages
-		}
+    ctx, cancel := dbContext(r.Context())
+    defer cancel()
 
-        room.Avatar = string(room.Name[0])
-        
-        rooms = append(rooms, room)
+    rooms, syncedAt, err := h.store.ListRooms(ctx, userID, username, opts)
+    if err != nil {
+        slog.ErrorContext(r.Context(), "Failed to get rooms", "error", err)
+        http.Error(w, "Failed to get rooms", http.StatusInternalServerError)
+        return
     }
 
     w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("X-Synced-At", syncedAt.Format(time.RFC3339Nano))
     json.NewEncoder(w).Encode(rooms)
 }
 
 // Get messages for a specific room
-func handleGetRoomMessages(w http.ResponseWriter, r *http.Request) {
+func (h *coreHandlers) handleGetRoomMessages(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	roomID, err := strconv.Atoi(vars["id"])
 	if err != nil {
@@ -845,44 +1616,30 @@ func handleGetRoomMessages(w http.ResponseWriter, r *http.Request) {
 
 	userID := int(r.Context().Value("user_id").(float64))
 
-	if !isUserInRoom(userID, roomID) {
+	if !isMemberIn(h.store, userID, roomID) {
 		http.Error(w, "Not authorized", http.StatusForbidden)
 		return
 	}
 
-	rows, err := db.Query(
-		`SELECT m.id, m.room_id, m.sender_id, u.username, m.content, m.created_at
-         FROM messages m
-         JOIN users u ON m.sender_id = u.id
-         WHERE m.room_id = $1
-         ORDER BY m.created_at ASC
-         LIMIT 100`,
-		roomID,
-	)
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	messages, _, err := h.store.MessagePage(ctx, roomID, userID, 0, true, 100)
 	if err != nil {
 		http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var messages []Message
-	for rows.Next() {
-		var m Message
-		if err := rows.Scan(&m.ID, &m.RoomID, &m.SenderID, &m.Sender, &m.Text, &m.Timestamp); err != nil {
-			log.Println("Error scanning message:", err)
-			continue
-		}
-		m.Avatar = string(m.Sender[0])
-		m.Read = true
-		messages = append(messages, m)
+	for i := range messages {
+		messages[i].Read = true
 	}
+	localizeMessages(messages, requestLocale(r))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(messages)
 }
 
 // Mark all messages in a room as read for the current user
-func handleMarkRoomAsRead(w http.ResponseWriter, r *http.Request) {
+func (h *coreHandlers) handleMarkRoomAsRead(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	roomID, err := strconv.Atoi(vars["id"])
 	if err != nil {
@@ -892,47 +1649,55 @@ func handleMarkRoomAsRead(w http.ResponseWriter, r *http.Request) {
 
 	userID := int(r.Context().Value("user_id").(float64))
 
-	if !isUserInRoom(userID, roomID) {
+	if !isMemberIn(h.store, userID, roomID) {
 		http.Error(w, "Not authorized", http.StatusForbidden)
 		return
 	}
 
-	result, err := db.Exec(`
-		INSERT INTO message_reads (message_id, user_id)
-		SELECT m.id, $1
-		FROM messages m
-		WHERE m.room_id = $2
-			AND m.sender_id != $1  -- Don't mark own messages
-			AND NOT EXISTS (
-				SELECT 1 FROM message_reads mr
-				WHERE mr.message_id = m.id AND mr.user_id = $1
-			)
-		ON CONFLICT (message_id, user_id) DO NOTHING
-	`, userID, roomID)
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
 
+	lastReadID, advanced, err := h.store.MarkRoomRead(ctx, roomID, userID)
 	if err != nil {
-		log.Printf("Failed to mark messages as read: %v", err)
+		slog.ErrorContext(r.Context(), "Failed to mark messages as read", "error", err)
 		http.Error(w, "Failed to mark messages as read", http.StatusInternalServerError)
 		return
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-
-	if rowsAffected > 0 {
-		hub := roomManager.GetOrCreateRoomHub(roomID)
-		hub.Broadcast <- &WSMessage{
+	if advanced {
+		username := r.Context().Value("username").(string)
+		roomManager.BroadcastToRoom(roomID, &WSMessage{
 			Type:   "messagesRead",
 			RoomID: roomID,
-		}
-		log.Printf("User %d marked %d messages as read in room %d", userID, rowsAffected, roomID)
+			Receipt: &ReadReceipt{
+				UserID:            userID,
+				Username:          username,
+				LastReadMessageID: lastReadID,
+			},
+		})
+		slog.DebugContext(r.Context(), "Messages marked as read", "last_read_message_id", lastReadID)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
 }
 
+// RoomMember is an entry of a room's member list
+type RoomMember struct {
+	ID         int        `json:"id"`
+	Username   string     `json:"username"`
+	Email      string     `json:"email"`
+	Avatar     string     `json:"avatar"`
+	Role       string     `json:"role"`
+	JoinedAt   time.Time  `json:"joined_at"`
+	Online     bool       `json:"online"`
+	Muted      bool       `json:"muted"`
+	MutedUntil *time.Time `json:"muted_until,omitempty"`
+	Status     UserStatus `json:"status"`
+}
+
 // Get all members of a specific room
-func handleGetRoomMembers(w http.ResponseWriter, r *http.Request) {
+func (h *coreHandlers) handleGetRoomMembers(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	roomID, err := strconv.Atoi(vars["id"])
 	if err != nil {
@@ -942,56 +1707,26 @@ func handleGetRoomMembers(w http.ResponseWriter, r *http.Request) {
 
 	userID := int(r.Context().Value("user_id").(float64))
 
-	if !isUserInRoom(userID, roomID) {
+	if !isMemberIn(h.store, userID, roomID) {
 		http.Error(w, "Not authorized", http.StatusForbidden)
 		return
 	}
 
-	rows, err := db.Query(`
-		SELECT u.id, u.username, u.email, rm.role, rm.joined_at
-		FROM room_members rm
-		JOIN users u ON rm.user_id = u.id
-		WHERE rm.room_id = $1
-		ORDER BY
-			CASE rm.role
-				WHEN 'admin' THEN 1
-				ELSE 2
-			END,
-			rm.joined_at ASC
-	`, roomID)
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
 
+	members, err := h.store.RoomMembers(ctx, roomID)
 	if err != nil {
-		log.Printf("Failed to get room members: %v", err)
+		slog.ErrorContext(r.Context(), "Failed to get room members", "error", err)
 		http.Error(w, "Failed to get room members", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	type RoomMember struct {
-		ID       int       `json:"id"`
-		Username string    `json:"username"`
-		Email    string    `json:"email"`
-		Avatar   string    `json:"avatar"`
-		Role     string    `json:"role"`
-		JoinedAt time.Time `json:"joined_at"`
-	}
-
-	var members []RoomMember
-	for rows.Next() {
-		var m RoomMember
-		if err := rows.Scan(&m.ID, &m.Username, &m.Email, &m.Role, &m.JoinedAt); err != nil {
-			log.Printf("Error scanning member: %v", err)
-			continue
-		}
-		m.Avatar = string(m.Username[0])
-		members = append(members, m)
-	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(members)
 }
 
-// Remove a member from a room (admin only)
+// Remove a member from a room (admins, or moderators removing plain members)
 func handleRemoveMember(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	roomID, err := strconv.Atoi(vars["id"])
@@ -1008,10 +1743,8 @@ func handleRemoveMember(w http.ResponseWriter, r *http.Request) {
 
 	userID := int(r.Context().Value("user_id").(float64))
 
-	var role string
-	err = db.QueryRow("SELECT role FROM room_members WHERE room_id = $1 AND user_id = $2", roomID, userID).Scan(&role)
-	if err != nil || role != "admin" {
-		http.Error(w, "Only admins can remove members", http.StatusForbidden)
+	role, ok := requireRoomPermission(w, roomID, userID, PermKick, "You don't have permission to remove members")
+	if !ok {
 		return
 	}
 
@@ -1020,18 +1753,33 @@ func handleRemoveMember(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := db.Exec("DELETE FROM room_members WHERE room_id = $1 AND user_id = $2", roomID, memberID)
-	if err != nil {
-		log.Printf("Failed to remove member: %v", err)
-		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+	if memberRole := roomRole(roomID, memberID); memberRole != "" && !outranks(role, memberRole) {
+		http.Error(w, "You can only remove members with a lower role", http.StatusForbidden)
 		return
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var memberName string
+	err = db.QueryRowContext(ctx, `
+		DELETE FROM room_members rm USING users u
+		WHERE rm.room_id = $1 AND rm.user_id = $2 AND u.id = rm.user_id
+		RETURNING u.username
+	`, roomID, memberID).Scan(&memberName)
+	if err == sql.ErrNoRows {
 		http.Error(w, "Member not found in room", http.StatusNotFound)
 		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to remove member", "error", err)
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
 	}
+	memberships.invalidate(roomID, memberID)
+
+	username := r.Context().Value("username").(string)
+	announceMemberGone(roomID, "memberRemoved", &MemberEvent{UserID: memberID, Username: memberName, RemovedBy: userID},
+		newSystemEvent(EventMemberRemoved, userID, memberID, "actor", username, "target", memberName, "at", eventTime(time.Now())))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
@@ -1048,21 +1796,23 @@ func handleDeleteRoom(w http.ResponseWriter, r *http.Request) {
 
 	userID := int(r.Context().Value("user_id").(float64))
 
-	var role string
-	err = db.QueryRow("SELECT role FROM room_members WHERE room_id = $1 AND user_id = $2", roomID, userID).Scan(&role)
-	if err != nil || role != "admin" {
-		http.Error(w, "Only admins can delete rooms", http.StatusForbidden)
+	if _, ok := requireRoomPermission(w, roomID, userID, PermDeleteRoom, "Only admins can delete rooms"); !ok {
 		return
 	}
 
-	_, err = db.Exec("DELETE FROM rooms WHERE id = $1", roomID)
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	_, err = db.ExecContext(ctx, "DELETE FROM rooms WHERE id = $1", roomID)
 	if err != nil {
-		log.Printf("Failed to delete room: %v", err)
+		slog.ErrorContext(r.Context(), "Failed to delete room", "error", err)
 		http.Error(w, "Failed to delete room", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Room %d deleted by user %d", roomID, userID)
+	roomManager.CloseRoomHub(roomID)
+	memberships.invalidateRoom(roomID)
+	slog.InfoContext(r.Context(), "Room deleted")
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
@@ -1079,55 +1829,95 @@ func handleLeaveRoom(w http.ResponseWriter, r *http.Request) {
 
 	userID := int(r.Context().Value("user_id").(float64))
 
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
 	var adminCount int
-	err = db.QueryRow("SELECT COUNT(*) FROM room_members WHERE room_id = $1 AND role = 'admin'", roomID).Scan(&adminCount)
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM room_members WHERE room_id = $1 AND role = 'admin'", roomID).Scan(&adminCount)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
 	var userRole string
-	err = db.QueryRow("SELECT role FROM room_members WHERE room_id = $1 AND user_id = $2", roomID, userID).Scan(&userRole)
+	err = db.QueryRowContext(ctx, "SELECT role FROM room_members WHERE room_id = $1 AND user_id = $2", roomID, userID).Scan(&userRole)
 	if err != nil {
 		http.Error(w, "You are not a member of this room", http.StatusForbidden)
 		return
 	}
 
 	if userRole == "admin" && adminCount == 1 {
-		http.Error(w, "Cannot leave: You are the only admin. Delete the room or promote another member first", http.StatusBadRequest)
+		http.Error(w, "Cannot leave: You are the only admin. Delete the room, promote another member or transfer ownership first", http.StatusBadRequest)
 		return
 	}
 
-	_, err = db.Exec("DELETE FROM room_members WHERE room_id = $1 AND user_id = $2", roomID, userID)
+	_, err = db.ExecContext(ctx, "DELETE FROM room_members WHERE room_id = $1 AND user_id = $2", roomID, userID)
 	if err != nil {
-		log.Printf("Failed to leave room: %v", err)
+		slog.ErrorContext(r.Context(), "Failed to leave room", "error", err)
 		http.Error(w, "Failed to leave room", http.StatusInternalServerError)
 		return
 	}
+	memberships.invalidate(roomID, userID)
+
+	slog.InfoContext(r.Context(), "User left room")
 
-	log.Printf("User %d left room %d", userID, roomID)
+	username := r.Context().Value("username").(string)
+	announceMemberGone(roomID, "memberLeft", &MemberEvent{UserID: userID, Username: username},
+		newSystemEvent(EventMemberLeft, userID, 0, "actor", username, "at", eventTime(time.Now())))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
 }
 
+// exploreSortOrders maps the ?sort= values of /rooms/explore to ORDER BY clauses
+var exploreSortOrders = map[string]string{
+    "newest":  "r.created_at DESC",
+    "members": "members_count DESC, r.created_at DESC",
+    "active":  "recent_messages DESC, r.created_at DESC",
+}
+
 // Fetches all public/open rooms that the current user has NOT joined.
+// Supports ?q= (name/description search), ?sort=newest|members|active, ?limit= and ?offset=.
 func handleGetAllRooms(w http.ResponseWriter, r *http.Request) {
     userIDFloat := r.Context().Value("user_id").(float64)
     userID := int(userIDFloat)
 
+    params := r.URL.Query()
+    search := strings.TrimSpace(params.Get("q"))
+
+    orderBy, ok := exploreSortOrders[params.Get("sort")]
+    if !ok {
+        orderBy = exploreSortOrders["newest"]
+    }
+
+    limit, err := strconv.Atoi(params.Get("limit"))
+    if err != nil || limit <= 0 || limit > 100 {
+        limit = 50
+    }
+    offset, err := strconv.Atoi(params.Get("offset"))
+    if err != nil || offset < 0 {
+        offset = 0
+    }
+
     query := `
         SELECT 
-            r.id, r.name, r.description,
-            (SELECT COUNT(*) FROM room_members rm_count WHERE rm_count.room_id = r.id) as members_count
+            r.id, r.name, r.description, COALESCE(r.avatar_key, ''),
+            (SELECT COUNT(*) FROM room_members rm_count WHERE rm_count.room_id = r.id) as members_count,
+            (SELECT COUNT(*) FROM messages m WHERE m.room_id = r.id AND m.created_at > NOW() - INTERVAL '7 days') as recent_messages
         FROM rooms r
         LEFT JOIN room_members rm ON r.id = rm.room_id AND rm.user_id = $1
-        WHERE rm.user_id IS NULL 
-        ORDER BY r.created_at DESC
+        WHERE rm.user_id IS NULL AND NOT r.is_private
+            AND NOT EXISTS (SELECT 1 FROM room_bans b WHERE b.room_id = r.id AND b.user_id = $1)
+            AND ($2 = '' OR r.name ILIKE '%' || $2 || '%' OR r.description ILIKE '%' || $2 || '%')
+        ORDER BY ` + orderBy + `
+        LIMIT $3 OFFSET $4
     `
-    rows, err := db.Query(query, userID)
+    ctx, cancel := dbContext(r.Context())
+    defer cancel()
+
+    rows, err := readDB().QueryContext(ctx, query, userID, search, limit, offset)
     if err != nil {
-        log.Printf("DB error fetching explorable rooms for user %d: %v", userID, err)
+        slog.ErrorContext(r.Context(), "DB error fetching explorable rooms", "error", err)
         http.Error(w, "Failed to query rooms", http.StatusInternalServerError)
         return
     }
@@ -1137,14 +1927,17 @@ func handleGetAllRooms(w http.ResponseWriter, r *http.Request) {
     for rows.Next() {
         var r Room
         var membersCount int
+        var avatarKey string
+        var recentMessages int
 
-        if err := rows.Scan(&r.ID, &r.Name, &r.Description, &membersCount); err != nil {
-            log.Println("Error scanning explorable room:", err)
+        if err := rows.Scan(&r.ID, &r.Name, &r.Description, &avatarKey, &membersCount, &recentMessages); err != nil {
+            slog.Error("Error scanning explorable room", "error", err)
             continue
         }
         
         r.Members = membersCount
-        r.Avatar = string(r.Name[0])
+        r.Avatar = avatarInitial(r.Name)
+        r.AvatarURL = roomAvatarURL(r.ID, avatarKey)
 
         r.CreatedBy = 0 
         r.IsPrivate = false 
@@ -1163,13 +1956,18 @@ func handleGetAllRooms(w http.ResponseWriter, r *http.Request) {
     }
 
     if err := json.NewEncoder(w).Encode(explorableRooms); err != nil {
-        log.Printf("Error encoding response: %v", err)
+        slog.ErrorContext(r.Context(), "Error encoding response", "error", err)
         http.Error(w, "Error encoding response", http.StatusInternalServerError)
     }
 }
 
 // WebSocket handler
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if roomManager.isShuttingDown() {
+		http.Error(w, "Server is restarting", http.StatusServiceUnavailable)
+		return
+	}
+
 	tokenString := r.URL.Query().Get("token")
 	if tokenString == "" {
 		http.Error(w, "Missing auth token", http.StatusUnauthorized)
@@ -1182,25 +1980,54 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("WebSocket upgrade error:", err)
+	if !isUserActive(int(claims["user_id"].(float64))) {
+		http.Error(w, "Account has been deactivated", http.StatusForbidden)
+		return
+	}
+	if !isSessionActive(claims, clientIP(r)) {
+		http.Error(w, "Signed out on this device", http.StatusUnauthorized)
 		return
 	}
 
 	userID := int(claims["user_id"].(float64))
 	username := claims["username"].(string)
 
+	releaseSlot, reason := acquireWSConnection(userID, clientIP(r))
+	if releaseSlot == nil {
+		slog.WarnContext(r.Context(), "WebSocket connection refused", "reason", reason)
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, reason, http.StatusTooManyRequests)
+		return
+	}
+
+	// Compression is negotiated during the upgrade but only switched on for clients that opt in via "hello"
+	upgrader := websocket.Upgrader{
+		CheckOrigin:       func(r *http.Request) bool { return true },
+		EnableCompression: true,
+		Subprotocols:      wsSubprotocols,
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		releaseSlot()
+		slog.ErrorContext(r.Context(), "WebSocket upgrade error", "error", err)
+		return
+	}
+
 	client := &Client{
 		ID:       userID,
 		Username: username,
-		Avatar:   string(username[0]),
+		Avatar:   avatarInitial(username),
 		Conn:     conn,
 		Send:     make(chan *WSMessage, 256),
 		Manager:  roomManager,
+		Encoding: encodingForSubprotocol(conn.Subprotocol()),
+		Locale:   requestLocale(r),
+		SessionID: tokenSessionID(claims),
+		shutdown: make(chan struct{}),
+		releaseSlot: releaseSlot,
 	}
 
+	roomManager.writers.Add(1)
 	roomManager.Register <- client
 	go client.readPump()
 	go client.writePump()
@@ -1209,8 +2036,9 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE,OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization,X-Api-Key,X-Request-ID")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID,X-Synced-At")
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -1222,37 +2050,232 @@ func enableCORS(next http.Handler) http.Handler {
 // --- Main ---
 
 func main() {
-	initDB()
+	initLogging()
+
+	shutdownTracing, err := initTracing()
+	if err != nil {
+		fatal("Failed to initialize tracing", err)
+	}
+	defer shutdownTracing()
+
+	if err := initStore(); err != nil {
+		fatal("Failed to initialize database", err)
+	}
 	defer db.Close()
+	defer closeReplicas()
+
+	if err := initStorage(); err != nil {
+		fatal("Failed to initialize file storage", err)
+	}
+
+	if err := initBroker(); err != nil {
+		fatal("Failed to initialize message broker", err)
+	}
+	defer broker.Close()
+
+	if err := initNotifiers(); err != nil {
+		fatal("Failed to initialize notifications", err)
+	}
+	if err := initGIFs(); err != nil {
+		fatal("Failed to initialize GIF search", err)
+	}
+	if err := initCaptcha(); err != nil {
+		fatal("Failed to initialize CAPTCHA", err)
+	}
+	if err := initUsernamePolicy(); err != nil {
+		fatal("Invalid username policy", err)
+	}
+	if err := initRoomCleanup(); err != nil {
+		fatal("Invalid room cleanup policy", err)
+	}
+
+	persister = newMessagePersister(store)
+
+	loadCtx, cancelLoad := dbContext(context.Background())
+	if err := loadRateLimits(loadCtx); err != nil {
+		slog.Error("Failed to load rate limits, using the environment's", "error", err)
+	}
+	cancelLoad()
 
 	go roomManager.Run()
+	go roomManager.reapIdleHubs()
+	go recordWebhookEvents()
+	go runNotifications()
+	go watchRateLimits()
+	// The other stores have no webhooks, idempotency keys or sessions to look after
+	if _, ok := store.(*postgresStore); ok {
+		go runWebhookDeliveries()
+		go pruneIdempotencyKeys()
+		go pruneSessions()
+		if err := watchSessionSignOuts(); err != nil {
+			slog.Error("Failed to subscribe to session sign-outs, they only close local connections", "error", err)
+		}
+	}
+	if emailNotifier != nil {
+		go emailNotifier.run()
+	}
+	if roomCleanup.Action != RoomCleanupOff {
+		go runRoomCleanup()
+	}
 
 	r := mux.NewRouter()
+	r.Use(nameSpanByRoute, withRoomLogField, limitByIP)
+	core := &coreHandlers{store: store}
+
+	// Health probes for load balancers and Kubernetes (no middleware)
+	r.HandleFunc("/healthz", handleHealthz).Methods("GET")
+	r.HandleFunc("/readyz", handleReadyz).Methods("GET")
 
 	// Auth routes (no middleware)
-	r.HandleFunc("/api/register", handleRegister).Methods("POST", "OPTIONS")
-	r.HandleFunc("/api/login", handleLogin).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/register", core.handleRegister).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/login", core.handleLogin).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/captcha", handleGetCaptchaConfig).Methods("GET", "OPTIONS")
+
+	// Generated avatars (public, for <img> tags)
+	r.HandleFunc("/api/avatars/{seed}.png", handleGetGeneratedAvatar).Methods("GET")
+
+	// Incoming webhooks (the token in the path is the credential)
+	r.HandleFunc("/api/hooks/{token}", handleIncomingWebhook).Methods("POST")
+
+	// API reference (public)
+	r.HandleFunc("/api/openapi.json", openAPIHandler(r)).Methods("GET")
+	r.HandleFunc("/api/docs", handleAPIDocs).Methods("GET")
 
 	// API subrouter with auth middleware
 	api := r.PathPrefix("/api").Subrouter()
-	api.Use(authMiddleware)
-	api.HandleFunc("/rooms", handleCreateRoom).Methods("POST", "OPTIONS")
-	api.HandleFunc("/rooms", handleGetRooms).Methods("GET", "OPTIONS")
-	api.HandleFunc("/rooms/{id}/messages", handleGetRoomMessages).Methods("GET", "OPTIONS")
-	api.HandleFunc("/rooms/{id}/members", handleGetRoomMembers).Methods("GET", "OPTIONS")
+	api.Use(authMiddleware, limitByUser)
+	api.HandleFunc("/rooms", core.handleCreateRoom).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms", core.handleGetRooms).Methods("GET", "OPTIONS")
+	api.HandleFunc("/rooms/join-by-code", handleJoinByCode).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/code", handleGetRoomCode).Methods("GET", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/analytics", handleGetRoomAnalytics).Methods("GET", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/code/regenerate", handleRegenerateRoomCode).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/messages", core.handleGetRoomMessages).Methods("GET", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/messages", handlePostRoomMessage).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/messages/{msgId}", handleDeleteMessage).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/messages/{msgId}", handleEditMessage).Methods("PATCH", "OPTIONS")
+	api.HandleFunc("/messages/{id}/history", handleGetMessageHistory).Methods("GET", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/messages/{msgId}/reactions", handleAddReaction).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/messages/{msgId}/reactions", handleRemoveReaction).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/messages/{msgId}/reads", core.handleGetMessageReads).Methods("GET", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/messages/{msgId}/context", core.handleGetMessageContext).Methods("GET", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/members", core.handleGetRoomMembers).Methods("GET", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/members/export", handleExportRoomMembers).Methods("GET", "OPTIONS")
 	api.HandleFunc("/rooms/{id}/members/{memberId}", handleRemoveMember).Methods("DELETE", "OPTIONS")
-	api.HandleFunc("/rooms/{id}/read", handleMarkRoomAsRead).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/members/{memberId}/role", handleUpdateMemberRole).Methods("PATCH", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/members/{memberId}/mute", handleMuteMember).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/members/{memberId}/mute", handleUnmuteMember).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/bans", handleGetRoomBans).Methods("GET", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/bans", handleBanUser).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/bans/{userId}", handleUnbanUser).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/read", core.handleMarkRoomAsRead).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/notifications", handleGetNotificationSettings).Methods("GET", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/notifications", handleUpdateNotificationSettings).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/notifications/mute", handleMuteRoom).Methods("PUT", "OPTIONS")
 	api.HandleFunc("/rooms/{id}", handleDeleteRoom).Methods("DELETE", "OPTIONS")
 	api.HandleFunc("/rooms/{id}/leave", handleLeaveRoom).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/unarchive", handleUnarchiveRoom).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/transfer-ownership/{memberId}", handleTransferOwnership).Methods("POST", "OPTIONS")
 	api.HandleFunc("/rooms/explore", handleGetAllRooms).Methods("GET", "OPTIONS")
 	api.HandleFunc("/rooms/{id}/join", handleJoinRoom).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/join-requests", handleGetJoinRequests).Methods("GET", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/join-requests/{requestId}/approve", handleApproveJoinRequest).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/join-requests/{requestId}/deny", handleDenyJoinRequest).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/invite", handleCreateInvite).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/members/bulk", handleBulkAddMembers).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/invites", handleCreateInvite).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/avatar", handleUploadRoomAvatar).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/avatar", handleDeleteRoomAvatar).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/slow-mode", handleUpdateSlowMode).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/permissions", handleGetRoomPermissions).Methods("GET", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/permissions", handleUpdateRoomPermissions).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/webhooks", handleGetRoomWebhooks).Methods("GET", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/webhooks", handleCreateRoomWebhook).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/webhooks/{hookId}", handleDeleteRoomWebhook).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/webhooks/{hookId}/deliveries", handleGetWebhookDeliveries).Methods("GET", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/incoming-webhooks", handleGetIncomingWebhooks).Methods("GET", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/incoming-webhooks", handleCreateIncomingWebhook).Methods("POST", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/incoming-webhooks/{hookId}", handleUpdateIncomingWebhook).Methods("PATCH", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/incoming-webhooks/{hookId}", handleDeleteIncomingWebhook).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/invites", handleGetMyInvites).Methods("GET", "OPTIONS")
+	api.HandleFunc("/invites/{id}/accept", handleAcceptInvite).Methods("POST", "OPTIONS")
+	api.HandleFunc("/invites/{id}/decline", handleDeclineInvite).Methods("POST", "OPTIONS")
+	api.HandleFunc("/invites/email/redeem", handleRedeemEmailInvite).Methods("POST", "OPTIONS")
+	api.HandleFunc("/push/vapid-key", handleGetVAPIDKey).Methods("GET", "OPTIONS")
+	api.HandleFunc("/push/subscriptions", handleCreatePushSubscription).Methods("POST", "OPTIONS")
+	api.HandleFunc("/push/subscriptions/{id}", handleDeletePushSubscription).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/push/devices", handleRegisterDevice).Methods("POST", "OPTIONS")
+	api.HandleFunc("/push/devices/{id}", handleDeleteDevice).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/contacts", handleGetContacts).Methods("GET", "OPTIONS")
+	api.HandleFunc("/contacts/requests", handleGetContactRequests).Methods("GET", "OPTIONS")
+	api.HandleFunc("/contacts/requests", handleSendContactRequest).Methods("POST", "OPTIONS")
+	api.HandleFunc("/contacts/requests/{id}/accept", handleAcceptContactRequest).Methods("POST", "OPTIONS")
+	api.HandleFunc("/contacts/requests/{id}/decline", handleDeclineContactRequest).Methods("POST", "OPTIONS")
+	api.HandleFunc("/contacts/{userId}", handleRemoveContact).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/contacts/{userId}/dm", handleOpenDirectRoom).Methods("POST", "OPTIONS")
+	api.HandleFunc("/me/status", handleUpdateStatus).Methods("PATCH", "OPTIONS")
+	api.HandleFunc("/me/notification-settings", handleGetNotificationPreferences).Methods("GET", "OPTIONS")
+	api.HandleFunc("/me/notification-settings", handleUpdateNotificationPreferences).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/me/notifications", handleGetNotifications).Methods("GET", "OPTIONS")
+	api.HandleFunc("/me/notifications/read-all", handleMarkAllNotificationsRead).Methods("POST", "OPTIONS")
+	api.HandleFunc("/me/notifications/{id}/read", handleMarkNotificationRead).Methods("POST", "OPTIONS")
+	api.HandleFunc("/me/sessions", handleGetSessions).Methods("GET", "OPTIONS")
+	api.HandleFunc("/me/sessions/{id}", handleDeleteSession).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/bots", handleCreateBot).Methods("POST", "OPTIONS")
+	api.HandleFunc("/uploads", handleUpload).Methods("POST", "OPTIONS")
+	api.HandleFunc("/gifs/search", handleSearchGIFs).Methods("GET", "OPTIONS")
+	api.HandleFunc("/rooms/{id}/polls", handleCreatePoll).Methods("POST", "OPTIONS")
+	api.HandleFunc("/polls/{id}/vote", handleVotePoll).Methods("POST", "OPTIONS")
+
+	// Site-wide admin routes
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(adminMiddleware)
+	admin.HandleFunc("/users", handleAdminListUsers).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/users/{id}/deactivate", handleAdminDeactivateUser).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/users/{id}/reactivate", handleAdminReactivateUser).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/users/{id}/shadowban", handleAdminShadowbanUser).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/users/{id}/shadowban", handleAdminUnshadowbanUser).Methods("DELETE", "OPTIONS")
+	admin.HandleFunc("/rooms/{id}", handleAdminDeleteRoom).Methods("DELETE", "OPTIONS")
+	admin.HandleFunc("/stats", handleAdminStats).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/moderation/words", handleAdminListModerationWords).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/moderation/words", handleAdminAddModerationWord).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/moderation/words/{wordId}", handleAdminDeleteModerationWord).Methods("DELETE", "OPTIONS")
+	admin.HandleFunc("/moderation/flagged", handleAdminListFlaggedMessages).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/debug", handleAdminDebug).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/rate-limits", handleAdminGetRateLimits).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/rate-limits", handleAdminUpdateRateLimits).Methods("PUT", "OPTIONS")
+	admin.HandleFunc("/rate-limits", handleAdminResetRateLimits).Methods("DELETE", "OPTIONS")
+	admin.HandleFunc("/email-domains", handleAdminListEmailDomains).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/email-domains", handleAdminAddEmailDomains).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/email-domains/{domain}", handleAdminDeleteEmailDomain).Methods("DELETE", "OPTIONS")
+	registerPprof(admin)
 
 	// WebSocket route (token passed as query param, so no middleware)
 	r.HandleFunc("/ws", handleWebSocket)
 
-	http.Handle("/", enableCORS(r))
+	// GraphQL: queries over HTTP with the usual auth, subscriptions over a WebSocket like /ws
+	r.Handle("/graphql", graphQLHandler())
 
-	port := getEnv("PORT", "8080")
-	log.Printf("Server running on :%s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	// Uploaded files on local disk; object keys are random so the route is public
+	if ls, ok := fileStorage.(*localStorage); ok {
+		r.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", ls.handler()))
+	}
+
+	checkAPIDocs(r)
+
+	// The embedded web client, if any, gets every path no other route matched
+	if frontend := frontendHandler(); frontend != nil {
+		r.PathPrefix("/").Handler(frontend)
+		slog.Info("Serving the embedded web client")
+	}
+
+	server := &http.Server{
+		Addr:              ":" + getEnv("PORT", "8080"),
+		Handler:           tracingHandler(withRequestID(recoverPanics(enableCORS(r)))),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err := startGRPC(); err != nil {
+		fatal("Failed to start gRPC server", err)
+	}
+	serve(server)
 }
\ No newline at end of file
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Markdown subset supported in messages: **bold**, *italic* / _italic_, `code` and [text](url).
+// The raw text is HTML-escaped before any formatting is applied, so the only tags that can
+// appear in the output are the ones produced here.
+var (
+	mdCodeSpan    = regexp.MustCompile("`([^`\n]+)`")
+	mdLink        = regexp.MustCompile(`\[([^\]\n]+)\]\(([^)\s]+)\)`)
+	mdBold        = regexp.MustCompile(`\*\*([^*\n]+)\*\*`)
+	mdItalic      = regexp.MustCompile(`(^|[^\w*])\*([^*\n]+)\*|(^|[^\w])_([^_\n]+)_`)
+	mdPlaceholder = regexp.MustCompile("\x00([0-9]+)\x00")
+)
+
+var allowedLinkSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+
+func markdownEnabled() bool {
+	return getEnv("MESSAGE_MARKDOWN", "true") == "true"
+}
+
+// renderMarkdown converts a raw message into safe HTML
+func renderMarkdown(raw string) string {
+	text := html.EscapeString(strings.ReplaceAll(raw, "\x00", ""))
+
+	// Code spans and links are swapped for placeholders so later passes can't format inside them
+	var protected []string
+	protect := func(fragment string) string {
+		protected = append(protected, fragment)
+		return fmt.Sprintf("\x00%d\x00", len(protected)-1)
+	}
+
+	text = mdCodeSpan.ReplaceAllStringFunc(text, func(m string) string {
+		return protect("<code>" + mdCodeSpan.FindStringSubmatch(m)[1] + "</code>")
+	})
+
+	text = mdLink.ReplaceAllStringFunc(text, func(m string) string {
+		parts := mdLink.FindStringSubmatch(m)
+		label, href := parts[1], html.UnescapeString(parts[2])
+		u, err := url.Parse(href)
+		if err != nil || !allowedLinkSchemes[strings.ToLower(u.Scheme)] {
+			return label
+		}
+		return protect(fmt.Sprintf(`<a href="%s" target="_blank" rel="noopener noreferrer nofollow">%s</a>`, html.EscapeString(u.String()), label))
+	})
+
+	text = mdBold.ReplaceAllString(text, "<strong>$1</strong>")
+	text = mdItalic.ReplaceAllStringFunc(text, func(m string) string {
+		parts := mdItalic.FindStringSubmatch(m)
+		if parts[2] != "" {
+			return parts[1] + "<em>" + parts[2] + "</em>"
+		}
+		return parts[3] + "<em>" + parts[4] + "</em>"
+	})
+
+	text = mdPlaceholder.ReplaceAllStringFunc(text, func(m string) string {
+		i, _ := strconv.Atoi(strings.Trim(m, "\x00"))
+		return protected[i]
+	})
+
+	return sanitizeMessageHTML(strings.ReplaceAll(text, "\n", "<br>"))
+}
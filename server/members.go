@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// postSystemMessage saves a message from the System user and broadcasts it to the room
+func postSystemMessage(roomID int, event *SystemEvent) (*Message, error) {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	var savedMsg Message
+	err := db.QueryRowContext(ctx,
+		"INSERT INTO messages (room_id, sender_id, kind, content, system_event) VALUES ($1, $2, 'system', $3, $4) RETURNING id, room_id, sender_id, kind, content, created_at",
+		roomID, 1, event.Render(defaultLocale), encodeSystemEvent(event),
+	).Scan(&savedMsg.ID, &savedMsg.RoomID, &savedMsg.SenderID, &savedMsg.Kind, &savedMsg.Text, &savedMsg.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	savedMsg.Sender = "System"
+	savedMsg.Avatar = "S"
+	savedMsg.SystemEvent = event
+
+	roomManager.BroadcastToRoom(roomID, &WSMessage{
+		Type:    "roomMessage",
+		RoomID:  roomID,
+		Message: &savedMsg,
+	})
+	return &savedMsg, nil
+}
+
+const maxMuteMinutes = 60 * 24 * 365
+
+// MemberEvent is the payload of "memberJoined", "memberLeft" and "memberRemoved"
+type MemberEvent struct {
+	UserID    int        `json:"user_id"`
+	Username  string     `json:"username"`
+	Avatar    string     `json:"avatar,omitempty"`    // For "memberJoined"
+	Role      string     `json:"role,omitempty"`      // For "memberJoined"
+	JoinedAt  *time.Time `json:"joined_at,omitempty"` // For "memberJoined"
+	RemovedBy int        `json:"removed_by,omitempty"`
+}
+
+// announceMemberGone posts a system message about a departed member and emits eventType so member
+// lists update live. The departed user's connections get the event directly, then stop receiving the room.
+func announceMemberGone(roomID int, eventType string, member *MemberEvent, announcement *SystemEvent) {
+	event := &WSMessage{Type: eventType, RoomID: roomID, Member: member}
+	roomManager.SendToUser(member.UserID, event)
+	roomManager.unsubscribeUser(roomID, member.UserID)
+
+	if _, err := postSystemMessage(roomID, announcement); err != nil {
+		slog.Error("Failed to add system message", "event", eventType, "room_id", roomID, "error", err)
+	}
+
+	roomManager.BroadcastToRoom(roomID, event)
+}
+
+// subscribeUser registers every open connection of a new member with the room's hub, so the tab
+// that didn't join still gets the room's events
+func (m *RoomManager) subscribeUser(roomID, userID int) {
+	if !m.IsOnline(userID) {
+		return
+	}
+	for {
+		hub := m.GetOrCreateRoomHub(roomID)
+		// Added directly rather than through hub.Register, holding the manager's lock so none of
+		// the connections can be unregistered in between
+		m.mu.RLock()
+		hub.mu.Lock()
+		for client := range m.Users[userID] {
+			hub.Clients[client] = true
+		}
+		hub.mu.Unlock()
+		m.mu.RUnlock()
+
+		select {
+		case <-hub.done: // Stopped meanwhile; its replacement needs them instead
+		default:
+			return
+		}
+	}
+}
+
+// unsubscribeUser stops a removed user's open connections from receiving the room's broadcasts
+func (m *RoomManager) unsubscribeUser(roomID, userID int) {
+	m.mu.Lock()
+	hub, ok := m.Rooms[roomID]
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	hub.mu.Lock()
+	for client := range hub.Clients {
+		if client.ID == userID {
+			delete(hub.Clients, client)
+		}
+	}
+	hub.mu.Unlock()
+}
+
+// checkNotMuted returns a "muted" validation error while the user is muted in the room
+func checkNotMuted(roomID, userID int) error {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	muted, until, err := store.MuteStatus(ctx, roomID, userID)
+	if err != nil || !muted {
+		return err
+	}
+	if until != nil {
+		return &ValidationError{Code: CodeMuted, Message: "You are muted in this room until " + until.Format(time.RFC3339)}
+	}
+	return &ValidationError{Code: CodeMuted, Message: "You are muted in this room"}
+}
+
+// loadMemberForModeration checks the caller may moderate memberID and returns the member's username
+func loadMemberForModeration(w http.ResponseWriter, roomID, userID, memberID int, perm, message string) (string, bool) {
+	role, ok := requireRoomPermission(w, roomID, userID, perm, message)
+	if !ok {
+		return "", false
+	}
+
+	if memberID == userID {
+		http.Error(w, "Cannot do this to yourself", http.StatusBadRequest)
+		return "", false
+	}
+
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	var memberRole, memberName string
+	err := db.QueryRowContext(ctx, `
+		SELECT rm.role, u.username
+		FROM room_members rm
+		JOIN users u ON rm.user_id = u.id
+		WHERE rm.room_id = $1 AND rm.user_id = $2
+	`, roomID, memberID).Scan(&memberRole, &memberName)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Member not found in room", http.StatusNotFound)
+		return "", false
+	} else if err != nil {
+		slog.Error("DB error fetching member", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return "", false
+	}
+
+	if !outranks(role, memberRole) {
+		http.Error(w, "You can only act on members with a lower role", http.StatusForbidden)
+		return "", false
+	}
+	return memberName, true
+}
+
+// Mute a member for duration_minutes, or until unmuted when it is omitted
+func handleMuteMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	memberID, err := strconv.Atoi(vars["memberId"])
+	if err != nil {
+		http.Error(w, "Invalid member ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		DurationMinutes int `json:"duration_minutes"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.DurationMinutes < 0 || req.DurationMinutes > maxMuteMinutes {
+		http.Error(w, fmt.Sprintf("duration_minutes must be between 0 (indefinite) and %d", maxMuteMinutes), http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	memberName, ok := loadMemberForModeration(w, roomID, userID, memberID, PermMuteMembers, "You don't have permission to mute members")
+	if !ok {
+		return
+	}
+
+	var until *time.Time
+	if req.DurationMinutes > 0 {
+		t := time.Now().Add(time.Duration(req.DurationMinutes) * time.Minute)
+		until = &t
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	_, err = db.ExecContext(ctx,
+		"UPDATE room_members SET muted_at = CURRENT_TIMESTAMP, muted_until = $1 WHERE room_id = $2 AND user_id = $3",
+		until, roomID, memberID,
+	)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to mute member", "error", err)
+		http.Error(w, "Failed to mute member", http.StatusInternalServerError)
+		return
+	}
+
+	announcement := newSystemEvent(EventMemberMuted, userID, memberID, "actor", username, "target", memberName)
+	if until != nil {
+		announcement.Params["minutes"] = strconv.Itoa(req.DurationMinutes)
+	}
+	if _, err := postSystemMessage(roomID, announcement); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to add mute system message", "error", err)
+	}
+
+	slog.InfoContext(r.Context(), "Member muted", "member_id", memberID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"user_id": memberID, "muted": true, "muted_until": until})
+}
+
+// Lift a member's mute
+func handleUnmuteMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	memberID, err := strconv.Atoi(vars["memberId"])
+	if err != nil {
+		http.Error(w, "Invalid member ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	memberName, ok := loadMemberForModeration(w, roomID, userID, memberID, PermMuteMembers, "You don't have permission to unmute members")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	_, err = db.ExecContext(ctx, "UPDATE room_members SET muted_at = NULL, muted_until = NULL WHERE room_id = $1 AND user_id = $2", roomID, memberID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to unmute member", "error", err)
+		http.Error(w, "Failed to unmute member", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := postSystemMessage(roomID, newSystemEvent(EventMemberUnmuted, userID, memberID, "actor", username, "target", memberName)); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to add unmute system message", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Change a member's role between admin, moderator and member (admin only)
+func handleUpdateMemberRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	memberID, err := strconv.Atoi(vars["memberId"])
+	if err != nil {
+		http.Error(w, "Invalid member ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !isValidRole(req.Role) {
+		http.Error(w, "Role must be admin, moderator or member", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermManageRoles, "Only admins can change member roles"); !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the room's admin rows so two concurrent demotions can't both pass the last-admin check
+	var adminCount int
+	err = tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM (
+			SELECT 1 FROM room_members WHERE room_id = $1 AND role = 'admin' FOR UPDATE
+		) admins
+	`, roomID).Scan(&adminCount)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to count room admins", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	var currentRole, memberName string
+	err = tx.QueryRowContext(ctx, `
+		SELECT rm.role, u.username
+		FROM room_members rm
+		JOIN users u ON rm.user_id = u.id
+		WHERE rm.room_id = $1 AND rm.user_id = $2
+	`, roomID, memberID).Scan(&currentRole, &memberName)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Member not found in room", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "DB error fetching member", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if currentRole == req.Role {
+		http.Error(w, fmt.Sprintf("%s is already %s", memberName, req.Role), http.StatusConflict)
+		return
+	}
+
+	if currentRole == RoleAdmin && adminCount == 1 {
+		http.Error(w, "Cannot demote the only admin. Promote another member first", http.StatusBadRequest)
+		return
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE room_members SET role = $1 WHERE room_id = $2 AND user_id = $3", req.Role, roomID, memberID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update member role", "error", err)
+		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Server error during commit", http.StatusInternalServerError)
+		return
+	}
+
+	announcement := newSystemEvent(EventRoleGranted, userID, memberID, "actor", username, "target", memberName, "role", req.Role)
+	if req.Role == RoleMember {
+		announcement = newSystemEvent(EventRoleRevoked, userID, memberID, "actor", username, "target", memberName, "role", currentRole)
+	}
+	if _, err := postSystemMessage(roomID, announcement); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to add role change system message", "error", err)
+	}
+
+	slog.InfoContext(r.Context(), "Member role changed", "member_id", memberID, "role", req.Role)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"user_id": memberID, "role": req.Role})
+}
+
+// Hand the room over to another member, who becomes its creator and an admin (room creator only)
+func handleTransferOwnership(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	memberID, err := strconv.Atoi(vars["memberId"])
+	if err != nil {
+		http.Error(w, "Invalid member ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	if memberID == userID {
+		http.Error(w, "You already own this room", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var ownerID int
+	err = tx.QueryRowContext(ctx, "SELECT created_by FROM rooms WHERE id = $1 FOR UPDATE", roomID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "DB error fetching room owner", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if ownerID != userID {
+		http.Error(w, "Only the room owner can transfer ownership", http.StatusForbidden)
+		return
+	}
+
+	var memberName string
+	err = tx.QueryRowContext(ctx, `
+		UPDATE room_members rm SET role = $1
+		FROM users u
+		WHERE rm.room_id = $2 AND rm.user_id = $3 AND u.id = rm.user_id AND NOT u.is_bot
+		RETURNING u.username
+	`, RoleAdmin, roomID, memberID).Scan(&memberName)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Member not found in room", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to promote new owner", "error", err)
+		http.Error(w, "Failed to transfer ownership", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE rooms SET created_by = $1 WHERE id = $2", memberID, roomID); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to transfer ownership", "error", err)
+		http.Error(w, "Failed to transfer ownership", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Server error during commit", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := postSystemMessage(roomID, newSystemEvent(EventOwnershipTransferred, userID, memberID, "actor", username, "target", memberName)); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to add ownership system message", "error", err)
+	}
+
+	slog.InfoContext(r.Context(), "Room ownership transferred", "new_owner_id", memberID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"created_by": memberID})
+}
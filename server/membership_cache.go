@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// membershipCacheTTL bounds how long a cached membership answer is trusted
+// (MEMBERSHIP_CACHE_TTL_SECONDS). Changes made on this instance invalidate the cache right away;
+// the TTL covers joins and removals handled by other instances.
+func membershipCacheTTL() time.Duration {
+	return time.Duration(envInt("MEMBERSHIP_CACHE_TTL_SECONDS", 30)) * time.Second
+}
+
+type membershipEntry struct {
+	member  bool
+	expires time.Time
+}
+
+// membershipCache remembers isUserInRoom answers, keyed by room then user, so the WebSocket
+// path doesn't query room_members for every joinRoom and sendMessage
+type membershipCache struct {
+	mu    sync.Mutex
+	rooms map[int]map[int]membershipEntry
+	gen   uint64 // Bumped by every invalidation, so a lookup racing one doesn't store a stale answer
+}
+
+var memberships = &membershipCache{rooms: make(map[int]map[int]membershipEntry)}
+
+// get returns the cached answer, if any, and the generation to pass to set after a lookup
+func (c *membershipCache) get(roomID, userID int) (member, ok bool, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.rooms[roomID][userID]
+	if ok && time.Now().After(entry.expires) {
+		delete(c.rooms[roomID], userID)
+		ok = false
+	}
+	return entry.member, ok, c.gen
+}
+
+// set caches a lookup result unless the cache was invalidated since gen was read
+func (c *membershipCache) set(roomID, userID int, member bool, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	if c.rooms[roomID] == nil {
+		c.rooms[roomID] = make(map[int]membershipEntry)
+	}
+	c.rooms[roomID][userID] = membershipEntry{member: member, expires: time.Now().Add(membershipCacheTTL())}
+}
+
+// invalidate drops the user's cached membership, after they join, leave, are removed or banned
+func (c *membershipCache) invalidate(roomID, userID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	delete(c.rooms[roomID], userID)
+	if len(c.rooms[roomID]) == 0 {
+		delete(c.rooms, roomID)
+	}
+}
+
+// invalidateRoom drops every cached membership of a deleted room
+func (c *membershipCache) invalidateRoom(roomID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	delete(c.rooms, roomID)
+}
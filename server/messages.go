@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Length of the quoted text embedded in replies
+const replySnippetLength = 140
+
+var errEmptyMessage = &ValidationError{Code: CodeEmptyMessage, Message: "Message must have content, attachments or a GIF"}
+var errInvalidReply = &ValidationError{Code: CodeInvalidReply, Message: "The message being replied to does not exist in this room"}
+
+var errNotRoomMember = errors.New("not a member of this room")
+
+// OutgoingMessage is a user message on its way into the send pipeline
+type OutgoingMessage struct {
+	RoomID         int
+	SenderID       int
+	Sender         string
+	Content        string
+	AttachmentIDs  []int
+	ReplyToID      int
+	GIFID          string // From GET /api/gifs/search; makes the message kind "gif"
+	IdempotencyKey string // Optional; a retry with the same key gets the first message back
+}
+
+// QuotedMessage is the snippet of the replied-to message embedded in a reply
+type QuotedMessage struct {
+	ID       int    `json:"id"`
+	SenderID int    `json:"sender_id"`
+	Sender   string `json:"sender"`
+	Text     string `json:"text"`
+	Deleted  bool   `json:"deleted,omitempty"`
+}
+
+func quoteSnippet(text string) string {
+	runes := []rune(text)
+	if len(runes) <= replySnippetLength {
+		return text
+	}
+	return string(runes[:replySnippetLength]) + "…"
+}
+
+// newQuotedMessage builds the embedded quote from the replied-to row
+func newQuotedMessage(id, senderID int, sender, text string, deleted bool) *QuotedMessage {
+	q := &QuotedMessage{ID: id, SenderID: senderID, Sender: sender, Text: quoteSnippet(text), Deleted: deleted}
+	if deleted {
+		q.Text = DeletedMessagePlaceholder
+	}
+	return q
+}
+
+// loadQuotedMessage fetches the message being replied to, which must be in the same room
+func loadQuotedMessage(roomID, msgID int) (*QuotedMessage, error) {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	var senderID int
+	var sender, text string
+	var deleted bool
+	err := db.QueryRowContext(ctx, `
+		SELECT m.sender_id, u.username, m.content, m.deleted_at IS NOT NULL
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE m.id = $1 AND m.room_id = $2
+	`, msgID, roomID).Scan(&senderID, &sender, &text, &deleted)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidReply
+	} else if err != nil {
+		return nil, err
+	}
+	return newQuotedMessage(msgID, senderID, sender, text, deleted), nil
+}
+
+// messageSelect loads messages with their sender and quoted reply; callers append WHERE/ORDER clauses
+const messageSelect = `SELECT m.id, m.room_id, m.sender_id, u.username, m.kind, m.content, COALESCE(m.content_html, ''),
+			m.created_at, m.deleted_at IS NOT NULL, m.edited_at, m.system_event,
+			COALESCE(m.reply_to_id, 0), COALESCE(q.sender_id, 0), COALESCE(qu.username, ''), COALESCE(q.content, ''), q.deleted_at IS NOT NULL
+         FROM messages m
+         JOIN users u ON m.sender_id = u.id
+         LEFT JOIN messages q ON q.id = m.reply_to_id
+         LEFT JOIN users qu ON qu.id = q.sender_id`
+
+// scanMessages reads rows selected with messageSelect and loads reactions, attachments and polls
+func scanMessages(rows *sql.Rows) []Message {
+	messages := scanMessageRows(rows)
+	attachReactions(messages)
+	attachAttachments(messages)
+	attachPolls(messages)
+	attachGIFs(messages)
+	return messages
+}
+
+// scanMessageRows reads rows selected with messageSelect, without loading what hangs off them
+func scanMessageRows(rows *sql.Rows) []Message {
+	var messages []Message
+	for rows.Next() {
+		var m Message
+		var replyID, replySenderID int
+		var replySender, replyText string
+		var replyDeleted bool
+		var editedAt sql.NullTime
+		var systemEvent []byte
+		if err := rows.Scan(
+			&m.ID, &m.RoomID, &m.SenderID, &m.Sender, &m.Kind, &m.Text, &m.HTML,
+			&m.Timestamp, &m.Deleted, &editedAt, &systemEvent,
+			&replyID, &replySenderID, &replySender, &replyText, &replyDeleted,
+		); err != nil {
+			slog.Error("Error scanning message", "error", err)
+			continue
+		}
+		if m.Deleted {
+			m.Text = DeletedMessagePlaceholder
+			m.HTML = ""
+		} else {
+			if replyID != 0 {
+				m.ReplyTo = newQuotedMessage(replyID, replySenderID, replySender, replyText, replyDeleted)
+			}
+			if editedAt.Valid {
+				m.EditedAt = &editedAt.Time
+			}
+			m.SystemEvent = decodeSystemEvent(systemEvent)
+		}
+		m.Avatar = avatarInitial(m.Sender)
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+// pendingMessage is a validated message waiting for the persister to write it
+type pendingMessage struct {
+	out         *OutgoingMessage
+	content     string // After moderation
+	contentHTML string
+	flagged     bool
+	replyTo     *QuotedMessage
+	gif         *GIF
+	done        func(*Message, error) // Called by the persister once the message is durable or failed
+}
+
+// prepareUserMessage runs the checks that don't need the message saved first: permissions,
+// mutes, slow mode, the replied-to message and moderation. Callers are responsible for the
+// membership check.
+func prepareUserMessage(out *OutgoingMessage) (*pendingMessage, error) {
+	out.Content = sanitizeText(out.Content)
+	if err := validateMessageContent(out.Content, out.AttachmentIDs, out.GIFID); err != nil {
+		return nil, err
+	}
+	if !hasRoomPermission(out.RoomID, roomRole(out.RoomID, out.SenderID), PermSendMessages) {
+		return nil, errRoomReadonly
+	}
+	if err := checkNotArchived(out.RoomID); err != nil {
+		return nil, err
+	}
+	if err := checkNotMuted(out.RoomID, out.SenderID); err != nil {
+		return nil, err
+	}
+	if err := checkSlowMode(out.RoomID, out.SenderID); err != nil {
+		return nil, err
+	}
+
+	var replyTo *QuotedMessage
+	if out.ReplyToID != 0 {
+		var err error
+		if replyTo, err = loadQuotedMessage(out.RoomID, out.ReplyToID); err != nil {
+			return nil, err
+		}
+	}
+
+	var gif *GIF
+	if out.GIFID != "" {
+		var err error
+		if gif, err = resolveGIF(out.GIFID); err != nil {
+			return nil, err
+		}
+	}
+
+	content, flagged, err := moderateContent(out.RoomID, out.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	var contentHTML string
+	if markdownEnabled() && content != "" {
+		contentHTML = renderMarkdown(content)
+	}
+
+	// Recorded on acceptance rather than on commit, so a burst can't slip past slow mode while
+	// its first message is still queued
+	slowMode.record(out.RoomID, out.SenderID, time.Now())
+
+	return &pendingMessage{out: out, content: content, contentHTML: contentHTML, flagged: flagged, replyTo: replyTo, gif: gif}, nil
+}
+
+// queueUserMessage validates a message from a room member and hands it to the persister.
+// Validation errors are returned straight away; done gets the saved message or the write error.
+// A retry of a message already sent with the same idempotency key skips both, and done gets the
+// first message, marked replayed. Callers are responsible for the membership check and the
+// broadcast.
+func queueUserMessage(out *OutgoingMessage, done func(*Message, error)) error {
+	if !idempotencyKeysKept() {
+		out.IdempotencyKey = ""
+	}
+	if out.IdempotencyKey != "" {
+		if saved, err := idempotentMessage(out.SenderID, out.IdempotencyKey); err != nil {
+			return err
+		} else if saved != nil {
+			done(saved, nil)
+			return nil
+		}
+	}
+
+	p, err := prepareUserMessage(out)
+	if err != nil {
+		return err
+	}
+	p.done = done
+	if out.IdempotencyKey != "" {
+		// A retry sent while the first was still queued loses the race for the key when written
+		p.done = func(saved *Message, err error) {
+			if errors.Is(err, errIdempotencyKeyUsed) {
+				if first, loadErr := idempotentMessage(out.SenderID, out.IdempotencyKey); loadErr != nil || first != nil {
+					saved, err = first, loadErr
+				}
+			}
+			done(saved, err)
+		}
+	}
+	return persister.enqueue(p)
+}
+
+// saveUserMessage is queueUserMessage for callers that need the saved message before replying.
+// It waits for the write even if the caller goes away, since the message will be saved anyway.
+func saveUserMessage(out *OutgoingMessage) (*Message, error) {
+	type result struct {
+		msg *Message
+		err error
+	}
+	saved := make(chan result, 1)
+	err := queueUserMessage(out, func(msg *Message, err error) {
+		saved <- result{msg, err}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := <-saved
+	return res.msg, res.err
+}
+
+// postUserMessage saves a message sent from outside the WebSocket (REST, gRPC) and broadcasts it
+func postUserMessage(out *OutgoingMessage) (*Message, error) {
+	if !isUserInRoom(out.SenderID, out.RoomID) {
+		return nil, errNotRoomMember
+	}
+	saved, err := saveUserMessage(out)
+	if err != nil || saved.replayed {
+		return saved, err
+	}
+	roomManager.BroadcastToRoom(out.RoomID, &WSMessage{
+		Type:    "roomMessage",
+		RoomID:  saved.RoomID,
+		Message: saved,
+	})
+	return saved, nil
+}
+
+// Messages loaded on each side of a message by GET .../context, by default and at most
+const (
+	defaultContextMessages = 20
+	maxContextMessages     = 100
+)
+
+// MessageContext is a message with the conversation around it, for jumping to a search result or
+// pinned message without paging from the end
+type MessageContext struct {
+	Messages   []Message `json:"messages"` // Oldest first, the message itself included
+	MoreBefore bool      `json:"more_before"`
+	MoreAfter  bool      `json:"more_after"`
+}
+
+// contextCount reads ?before= or ?after= for GET .../context
+func contextCount(r *http.Request, param string) (int, bool) {
+	v := r.URL.Query().Get(param)
+	if v == "" {
+		return defaultContextMessages, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return min(n, maxContextMessages), true
+}
+
+// Get a message with up to ?before= (20) messages before it and ?after= (20) after it (members only)
+func (h *coreHandlers) handleGetMessageContext(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	msgID, err := strconv.Atoi(vars["msgId"])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	before, ok := contextCount(r, "before")
+	if !ok {
+		http.Error(w, "before must be a non-negative number", http.StatusBadRequest)
+		return
+	}
+	after, ok := contextCount(r, "after")
+	if !ok {
+		http.Error(w, "after must be a non-negative number", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if !isMemberIn(h.store, userID, roomID) {
+		http.Error(w, "Not authorized", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	// Paging back from just past the message ends the page with the message itself, if the
+	// viewer can see it in this room
+	older, moreBefore, err := h.store.MessagePage(ctx, roomID, userID, msgID+1, false, before+1)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to fetch message context", "error", err)
+		http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
+		return
+	}
+	if len(older) == 0 || older[len(older)-1].ID != msgID {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	newer, moreAfter, err := h.store.MessagePage(ctx, roomID, userID, msgID, true, after)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to fetch message context", "error", err)
+		http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
+		return
+	}
+
+	messages := append(older, newer...)
+	localizeMessages(messages, requestLocale(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MessageContext{
+		Messages:   messages,
+		MoreBefore: moreBefore,
+		MoreAfter:  moreAfter,
+	})
+}
+
+// Soft-delete a message (sender, or a member whose role may delete messages)
+func handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	msgID, err := strconv.Atoi(vars["msgId"])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var senderID int
+	var alreadyDeleted bool
+	err = db.QueryRowContext(ctx,
+		"SELECT sender_id, deleted_at IS NOT NULL FROM messages WHERE id = $1 AND room_id = $2",
+		msgID, roomID,
+	).Scan(&senderID, &alreadyDeleted)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "DB error fetching message", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if senderID != userID {
+		if _, ok := requireRoomPermission(w, roomID, userID, PermDeleteMessages, "Only the sender or a room moderator can delete this message"); !ok {
+			return
+		}
+	}
+
+	if alreadyDeleted {
+		http.Error(w, "Message already deleted", http.StatusConflict)
+		return
+	}
+
+	_, err = db.ExecContext(ctx,
+		"UPDATE messages SET deleted_at = CURRENT_TIMESTAMP, deleted_by = $1 WHERE id = $2 AND deleted_at IS NULL",
+		userID, msgID,
+	)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete message", "error", err)
+		http.Error(w, "Failed to delete message", http.StatusInternalServerError)
+		return
+	}
+
+	roomManager.BroadcastToRoom(roomID, &WSMessage{
+		Type:   "messageDeleted",
+		RoomID: roomID,
+		Message: &Message{
+			ID:       msgID,
+			RoomID:   roomID,
+			SenderID: senderID,
+			Text:     DeletedMessagePlaceholder,
+			Deleted:  true,
+		},
+	})
+	slog.InfoContext(r.Context(), "Message deleted", "message_id", msgID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// withRequestID tags each request with an ID, reusing a sane X-Request-ID from a proxy, and
+// echoes it in the response so a user's bug report can be matched to the server logs
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "request_id", id)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// recoverPanics turns a handler panic into a 500 and a logged stack trace instead of letting it
+// take the whole process down
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				// http.ErrAbortHandler is how handlers deliberately abort a response
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				slog.ErrorContext(r.Context(), "Handler panicked", "panic", err, "method", r.Method, "path", r.URL.Path, "stack", string(debug.Stack()))
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recoverClientPanic keeps a panic while handling one WebSocket frame from crashing the server;
+// the connection is closed by readPump's deferred cleanup
+func (c *Client) recoverClientPanic() {
+	if err := recover(); err != nil {
+		c.logger().Error("WebSocket handler panicked, closing connection", "panic", err, "stack", string(debug.Stack()))
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Device platforms, stored in device_tokens.platform
+const (
+	PlatformFCM  = "fcm"  // Android (and iOS apps using Firebase), token from FirebaseMessaging.getToken()
+	PlatformAPNs = "apns" // iOS, the hex device token from registerForRemoteNotifications
+)
+
+// maxDevicesPerUser bounds the device tokens a user can register; the oldest are replaced
+const maxDevicesPerUser = 20
+
+// DeviceToken is a mobile app installation registered for push notifications
+type DeviceToken struct {
+	ID        int       `json:"id"`
+	Platform  string    `json:"platform"`
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// errInvalidDeviceToken reports that the push service no longer knows the token, which is then removed
+var errInvalidDeviceToken = errors.New("device token is no longer valid")
+
+// mobileSender delivers a notification to one device token of its platform
+type mobileSender interface {
+	Send(ctx context.Context, token string, n *Notification) error
+}
+
+// mobilePushNotifier fans notifications out to the user's registered devices
+type mobilePushNotifier struct {
+	senders map[string]mobileSender
+}
+
+// newMobilePushNotifier sets up FCM when FCM_CREDENTIALS_FILE is set and APNs when APNS_KEY_FILE is
+// set; mobile push is off when neither is
+func newMobilePushNotifier() (*mobilePushNotifier, error) {
+	p := &mobilePushNotifier{senders: make(map[string]mobileSender)}
+	if path := getEnv("FCM_CREDENTIALS_FILE", ""); path != "" {
+		fcm, err := newFCMSender(path)
+		if err != nil {
+			return nil, fmt.Errorf("FCM: %w", err)
+		}
+		p.senders[PlatformFCM] = fcm
+	}
+	if path := getEnv("APNS_KEY_FILE", ""); path != "" {
+		apns, err := newAPNsSender(path)
+		if err != nil {
+			return nil, fmt.Errorf("APNs: %w", err)
+		}
+		p.senders[PlatformAPNs] = apns
+	}
+	if len(p.senders) == 0 {
+		return nil, nil
+	}
+	mobilePush = p
+	return p, nil
+}
+
+// mobilePush is set when FCM or APNs is configured
+var mobilePush *mobilePushNotifier
+
+func (p *mobilePushNotifier) Notify(ctx context.Context, n *Notification) {
+	if !n.Push || n.Quiet {
+		return
+	}
+	dbCtx, cancel := dbContext(ctx)
+	rows, err := db.QueryContext(dbCtx, "SELECT id, platform, token FROM device_tokens WHERE user_id = $1", n.UserID)
+	if err != nil {
+		cancel()
+		slog.Error("Failed to load device tokens", "user_id", n.UserID, "error", err)
+		return
+	}
+	var devices []DeviceToken
+	for rows.Next() {
+		var d DeviceToken
+		if err := rows.Scan(&d.ID, &d.Platform, &d.Token); err != nil {
+			slog.Error("Error scanning device token", "error", err)
+			continue
+		}
+		devices = append(devices, d)
+	}
+	rows.Close()
+	cancel()
+
+	for _, d := range devices {
+		sender, ok := p.senders[d.Platform]
+		if !ok {
+			continue
+		}
+		err := sender.Send(ctx, d.Token, n)
+		if errors.Is(err, errInvalidDeviceToken) {
+			// The app was uninstalled or the token was rotated
+			dbCtx, cancel := dbContext(ctx)
+			if _, err := db.ExecContext(dbCtx, "DELETE FROM device_tokens WHERE id = $1", d.ID); err != nil {
+				slog.Error("Failed to delete invalid device token", "device_id", d.ID, "error", err)
+			}
+			cancel()
+		} else if err != nil {
+			slog.Warn("Failed to send mobile push notification", "user_id", n.UserID, "device_id", d.ID, "platform", d.Platform, "error", err)
+		}
+	}
+}
+
+// notificationData is the custom data both platforms carry, so the app can open the message
+func notificationData(n *Notification) map[string]string {
+	return map[string]string{
+		"reason":     n.Reason,
+		"room_id":    strconv.Itoa(n.RoomID),
+		"message_id": strconv.Itoa(n.Message.ID),
+	}
+}
+
+// --- FCM ---
+
+// fcmSender uses the FCM HTTP v1 API, authenticated as the service account in the credentials file
+type fcmSender struct {
+	projectID string
+	client    *http.Client
+}
+
+func newFCMSender(path string) (*fcmSender, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := google.CredentialsFromJSON(context.Background(), data, "https://www.googleapis.com/auth/firebase.messaging")
+	if err != nil {
+		return nil, err
+	}
+	projectID := getEnv("FCM_PROJECT_ID", creds.ProjectID)
+	if projectID == "" {
+		return nil, errors.New("FCM_PROJECT_ID is required when the credentials have no project")
+	}
+	client := oauth2.NewClient(context.Background(), creds.TokenSource)
+	client.Timeout = 10 * time.Second
+	return &fcmSender{projectID: projectID, client: client}, nil
+}
+
+func (s *fcmSender) Send(ctx context.Context, token string, n *Notification) error {
+	body, err := json.Marshal(map[string]any{
+		"message": map[string]any{
+			"token":        token,
+			"notification": map[string]string{"title": n.Title(), "body": n.Body()},
+			"data":         notificationData(n),
+			"android":      map[string]any{"priority": "high", "collapse_key": "room-" + strconv.Itoa(n.RoomID)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	url := "https://fcm.googleapis.com/v1/projects/" + s.projectID + "/messages:send"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var result struct {
+		Error struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result)
+	// UNREGISTERED comes back as 404; a malformed token as INVALID_ARGUMENT
+	if resp.StatusCode == http.StatusNotFound || result.Error.Status == "UNREGISTERED" {
+		return errInvalidDeviceToken
+	}
+	return fmt.Errorf("FCM responded %d: %s", resp.StatusCode, result.Error.Message)
+}
+
+// --- APNs ---
+
+// apnsSender uses APNs token-based authentication with a .p8 signing key, configured by
+// APNS_KEY_ID, APNS_TEAM_ID, APNS_TOPIC (the app's bundle ID) and APNS_SANDBOX
+type apnsSender struct {
+	key    *ecdsa.PrivateKey
+	keyID  string
+	teamID string
+	topic  string
+	host   string
+	client *http.Client
+
+	mu        sync.Mutex
+	token     string
+	tokenTime time.Time
+}
+
+// APNs rejects provider tokens older than an hour and throttles ones refreshed more often than
+// every 20 minutes
+const apnsTokenLifetime = 40 * time.Minute
+
+func newAPNsSender(path string) (*apnsSender, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	s := &apnsSender{
+		key:    key,
+		keyID:  getEnv("APNS_KEY_ID", ""),
+		teamID: getEnv("APNS_TEAM_ID", ""),
+		topic:  getEnv("APNS_TOPIC", ""),
+		host:   "https://api.push.apple.com",
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if s.keyID == "" || s.teamID == "" || s.topic == "" {
+		return nil, errors.New("APNS_KEY_ID, APNS_TEAM_ID and APNS_TOPIC are required")
+	}
+	if getEnv("APNS_SANDBOX", "false") == "true" {
+		s.host = "https://api.sandbox.push.apple.com"
+	}
+	return s, nil
+}
+
+// providerToken returns the signed JWT APNs authenticates requests with, reusing it while it is fresh
+func (s *apnsSender) providerToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Since(s.tokenTime) < apnsTokenLifetime {
+		return s.token, nil
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"iss": s.teamID, "iat": now.Unix()})
+	token.Header["kid"] = s.keyID
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		return "", err
+	}
+	s.token, s.tokenTime = signed, now
+	return signed, nil
+}
+
+func (s *apnsSender) Send(ctx context.Context, token string, n *Notification) error {
+	payload := map[string]any{
+		"aps": map[string]any{
+			"alert":     map[string]string{"title": n.Title(), "body": n.Body()},
+			"sound":     "default",
+			"thread-id": "room-" + strconv.Itoa(n.RoomID),
+		},
+	}
+	for k, v := range notificationData(n) {
+		payload[k] = v
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	auth, err := s.providerToken()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.host+"/3/device/"+token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("authorization", "bearer "+auth)
+	req.Header.Set("apns-topic", s.topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var result struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result)
+	if resp.StatusCode == http.StatusGone || result.Reason == "BadDeviceToken" || result.Reason == "DeviceTokenNotForTopic" {
+		return errInvalidDeviceToken
+	}
+	return fmt.Errorf("APNs responded %d: %s", resp.StatusCode, result.Reason)
+}
+
+// --- Handlers ---
+
+// Register this app installation's push token. Registering a token again moves it to the current user.
+func handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Platform string `json:"platform"`
+		Token    string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Platform != PlatformFCM && req.Platform != PlatformAPNs {
+		http.Error(w, "Platform must be fcm or apns", http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" || len(req.Token) > 4096 {
+		http.Error(w, "Token is required", http.StatusBadRequest)
+		return
+	}
+	if mobilePush == nil || mobilePush.senders[req.Platform] == nil {
+		http.Error(w, "Push notifications are not configured for this platform", http.StatusNotFound)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	device := DeviceToken{Platform: req.Platform, Token: req.Token}
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO device_tokens (user_id, platform, token)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (token) DO UPDATE
+		SET user_id = EXCLUDED.user_id, platform = EXCLUDED.platform, created_at = CURRENT_TIMESTAMP
+		RETURNING id, created_at
+	`, userID, req.Platform, req.Token).Scan(&device.ID, &device.CreatedAt)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save device token", "error", err)
+		http.Error(w, "Failed to register device", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.ExecContext(ctx, `
+		DELETE FROM device_tokens WHERE user_id = $1 AND id NOT IN (
+			SELECT id FROM device_tokens WHERE user_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2
+		)
+	`, userID, maxDevicesPerUser)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to prune device tokens", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(device)
+}
+
+// Unregister a device, e.g. on sign-out in the app
+func handleDeleteDevice(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	deviceID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, "DELETE FROM device_tokens WHERE id = $1 AND user_id = $2", deviceID, userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete device token", "error", err)
+		http.Error(w, "Failed to delete device", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Actions a word list entry can take when it matches a message
+const (
+	ModerationReject = "reject" // Refuse the message
+	ModerationMask   = "mask"   // Replace the word with asterisks
+	ModerationFlag   = "flag"   // Deliver the message but flag it for admin review
+)
+
+var errContentRejected = &ValidationError{Code: CodeContentRejected, Message: "Message contains blocked words"}
+
+type moderationRule struct {
+	ID     int    `json:"id"`
+	RoomID *int   `json:"room_id"` // nil for the global list
+	Word   string `json:"word"`
+	Action string `json:"action"`
+	re     *regexp.Regexp
+}
+
+// wordFilter caches compiled word lists; key 0 is the global list
+type wordFilter struct {
+	mu    sync.RWMutex
+	lists map[int][]moderationRule
+}
+
+var moderation = &wordFilter{lists: make(map[int][]moderationRule)}
+
+func compileModerationWord(word string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)(^|\W)(` + regexp.QuoteMeta(word) + `)(\W|$)`)
+}
+
+func (f *wordFilter) rules(roomID int) ([]moderationRule, error) {
+	f.mu.RLock()
+	list, ok := f.lists[roomID]
+	f.mu.RUnlock()
+	if ok {
+		return list, nil
+	}
+
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	var rows *sql.Rows
+	var err error
+	if roomID == 0 {
+		rows, err = db.QueryContext(ctx, "SELECT id, room_id, word, action FROM moderation_words WHERE room_id IS NULL")
+	} else {
+		rows, err = db.QueryContext(ctx, "SELECT id, room_id, word, action FROM moderation_words WHERE room_id = $1", roomID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list = []moderationRule{}
+	for rows.Next() {
+		var rule moderationRule
+		var rid sql.NullInt64
+		if err := rows.Scan(&rule.ID, &rid, &rule.Word, &rule.Action); err != nil {
+			return nil, err
+		}
+		if rid.Valid {
+			id := int(rid.Int64)
+			rule.RoomID = &id
+		}
+		rule.re = compileModerationWord(rule.Word)
+		list = append(list, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	f.lists[roomID] = list
+	f.mu.Unlock()
+	return list, nil
+}
+
+// invalidate drops a cached list so it is reloaded on the next message
+func (f *wordFilter) invalidate(roomID int) {
+	f.mu.Lock()
+	delete(f.lists, roomID)
+	f.mu.Unlock()
+}
+
+// moderateContent applies the global and room word lists to a message.
+// It returns the (possibly masked) content and whether the message should be flagged.
+func moderateContent(roomID int, content string) (string, bool, error) {
+	if content == "" {
+		return content, false, nil
+	}
+
+	global, err := moderation.rules(0)
+	if err != nil {
+		return "", false, err
+	}
+	room, err := moderation.rules(roomID)
+	if err != nil {
+		return "", false, err
+	}
+
+	flagged := false
+	for _, rule := range append(append([]moderationRule{}, global...), room...) {
+		if !rule.re.MatchString(content) {
+			continue
+		}
+		switch rule.Action {
+		case ModerationReject:
+			return "", false, errContentRejected
+		case ModerationMask:
+			// Matches consume their boundary characters, so repeat until adjacent occurrences are gone
+			for rule.re.MatchString(content) {
+				content = rule.re.ReplaceAllStringFunc(content, func(m string) string {
+					parts := rule.re.FindStringSubmatch(m)
+					return parts[1] + strings.Repeat("*", utf8.RuneCountInString(parts[2])) + parts[3]
+				})
+			}
+		case ModerationFlag:
+			flagged = true
+		}
+	}
+	return content, flagged, nil
+}
+
+// --- Admin API ---
+
+// List global words, or a room's words with ?room_id=
+func handleAdminListModerationWords(w http.ResponseWriter, r *http.Request) {
+	roomID := 0
+	if v := r.URL.Query().Get("room_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid room ID", http.StatusBadRequest)
+			return
+		}
+		roomID = id
+	}
+
+	list, err := moderation.rules(roomID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load moderation words", "error", err)
+		http.Error(w, "Failed to load moderation words", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Add a word to the global list, or to a room's list when room_id is set
+func handleAdminAddModerationWord(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Word   string `json:"word"`
+		Action string `json:"action"`
+		RoomID *int   `json:"room_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	req.Word = strings.ToLower(sanitizeLine(req.Word))
+	if req.Word == "" || len(req.Word) > 100 {
+		http.Error(w, "Word must be between 1 and 100 characters", http.StatusBadRequest)
+		return
+	}
+	// Masking replaces letters with asterisks, so a word with no letters or digits could never be masked away
+	if !strings.ContainsFunc(req.Word, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) {
+		http.Error(w, "Word must contain at least one letter or digit", http.StatusBadRequest)
+		return
+	}
+	if req.Action == "" {
+		req.Action = ModerationMask
+	}
+	if req.Action != ModerationReject && req.Action != ModerationMask && req.Action != ModerationFlag {
+		http.Error(w, "Action must be reject, mask, or flag", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	rule := moderationRule{Word: req.Word, Action: req.Action, RoomID: req.RoomID}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	err := db.QueryRowContext(ctx,
+		"INSERT INTO moderation_words (room_id, word, action, created_by) VALUES ($1, $2, $3, $4) RETURNING id",
+		req.RoomID, req.Word, req.Action, userID,
+	).Scan(&rule.ID)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			http.Error(w, "Word already in list", http.StatusConflict)
+			return
+		} else if ok && pqErr.Code == "23503" {
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to add moderation word", "error", err)
+		http.Error(w, "Failed to add word", http.StatusInternalServerError)
+		return
+	}
+
+	if req.RoomID != nil {
+		moderation.invalidate(*req.RoomID)
+	} else {
+		moderation.invalidate(0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// Remove a word from whichever list it belongs to
+func handleAdminDeleteModerationWord(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	wordID, err := strconv.Atoi(vars["wordId"])
+	if err != nil {
+		http.Error(w, "Invalid word ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var roomID sql.NullInt64
+	err = db.QueryRowContext(ctx, "DELETE FROM moderation_words WHERE id = $1 RETURNING room_id", wordID).Scan(&roomID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Word not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete moderation word", "error", err)
+		http.Error(w, "Failed to delete word", http.StatusInternalServerError)
+		return
+	}
+
+	moderation.invalidate(int(roomID.Int64))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// FlaggedMessage is a message the moderation filter flagged for review
+type FlaggedMessage struct {
+	Message
+	FlaggedAt time.Time `json:"flagged_at"`
+}
+
+// List flagged messages awaiting review
+func handleAdminListFlaggedMessages(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT m.id, m.room_id, m.sender_id, u.username, m.content, m.created_at, m.flagged_at
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE m.flagged_at IS NOT NULL AND m.deleted_at IS NULL
+		ORDER BY m.flagged_at DESC
+		LIMIT 200
+	`)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list flagged messages", "error", err)
+		http.Error(w, "Failed to list flagged messages", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	flagged := []FlaggedMessage{}
+	for rows.Next() {
+		var m FlaggedMessage
+		if err := rows.Scan(&m.ID, &m.RoomID, &m.SenderID, &m.Sender, &m.Text, &m.Timestamp, &m.FlaggedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning flagged message", "error", err)
+			continue
+		}
+		m.Avatar = avatarInitial(m.Sender)
+		flagged = append(flagged, m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flagged)
+}
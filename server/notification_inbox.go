@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Notifications listed by GET /api/me/notifications, by default and at most
+const (
+	defaultInboxPage = 50
+	maxInboxPage     = 100
+)
+
+// inboxNotifier keeps mentions and direct messages that reached a user while they were offline,
+// whether or not they set up push or email, for GET /api/me/notifications. An entry counts as
+// read once it is marked read or the user reads the room past its message.
+type inboxNotifier struct{}
+
+func (inboxNotifier) Notify(ctx context.Context, n *Notification) {
+	if n.Reason == ReasonMessage {
+		return
+	}
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO notifications (user_id, room_id, message_id, reason) VALUES ($1, $2, $3, $4)
+	`, n.UserID, n.RoomID, n.Message.ID, n.Reason)
+	if err != nil {
+		slog.Error("Failed to record notification", "user_id", n.UserID, "error", err)
+	}
+}
+
+// InboxNotification is a stored mention or direct message
+type InboxNotification struct {
+	ID        int64     `json:"id"`
+	Reason    string    `json:"reason"` // "mention" or "direct"
+	RoomID    int       `json:"room_id"`
+	RoomName  string    `json:"room_name"`
+	MessageID int       `json:"message_id"`
+	SenderID  int       `json:"sender_id"`
+	Sender    string    `json:"sender"`
+	Snippet   string    `json:"snippet"` // The start of the message, as in push notifications
+	Read      bool      `json:"read"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NotificationInbox is a page of the user's notifications, newest first
+type NotificationInbox struct {
+	Notifications []InboxNotification `json:"notifications"`
+	Unread        int                 `json:"unread"` // Across all pages
+	More          bool                `json:"more"`   // Older ones remain; pass the last ID as ?before=
+}
+
+// inboxRead is true for a notification n whose message m the user has read, given their
+// membership rm of the room
+const inboxRead = `(n.read_at IS NOT NULL OR m.id <= rm.last_read_message_id)`
+
+// inboxJoins limits notifications n to messages that still exist, in rooms the user is still in
+const inboxJoins = `
+	JOIN room_members rm ON rm.room_id = n.room_id AND rm.user_id = n.user_id
+	JOIN messages m ON m.id = n.message_id AND m.deleted_at IS NULL`
+
+// The user's notifications, newest first. ?unread=true leaves out read ones; ?before= pages back
+// from a notification ID; ?limit= is 50 by default and at most 100.
+func handleGetNotifications(w http.ResponseWriter, r *http.Request) {
+	userID := int(r.Context().Value("user_id").(float64))
+
+	query := r.URL.Query()
+	unreadOnly := query.Get("unread") == "true"
+	var before int64
+	if v := query.Get("before"); v != "" {
+		var err error
+		if before, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultInboxPage
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxInboxPage {
+			http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT n.id, n.reason, n.room_id, r.name, m.id, m.sender_id, su.username, m.kind, m.content,
+			`+inboxRead+`, n.created_at
+		FROM notifications n`+inboxJoins+`
+		JOIN rooms r ON r.id = n.room_id
+		JOIN users su ON su.id = m.sender_id
+		WHERE n.user_id = $1 AND ($2 = 0 OR n.id < $2) AND (NOT $3 OR NOT `+inboxRead+`)
+		ORDER BY n.id DESC
+		LIMIT $4
+	`, userID, before, unreadOnly, limit+1)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get notifications", "error", err)
+		http.Error(w, "Failed to get notifications", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	inbox := NotificationInbox{Notifications: []InboxNotification{}}
+	for rows.Next() {
+		var item InboxNotification
+		var msg Message
+		if err := rows.Scan(&item.ID, &item.Reason, &item.RoomID, &item.RoomName, &item.MessageID, &item.SenderID, &item.Sender,
+			&msg.Kind, &msg.Text, &item.Read, &item.CreatedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning notification", "error", err)
+			continue
+		}
+		item.Snippet = (&Notification{Message: &msg}).Body()
+		inbox.Notifications = append(inbox.Notifications, item)
+	}
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get notifications", "error", err)
+		http.Error(w, "Failed to get notifications", http.StatusInternalServerError)
+		return
+	}
+	if inbox.More = len(inbox.Notifications) > limit; inbox.More {
+		inbox.Notifications = inbox.Notifications[:limit]
+	}
+
+	err = db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM notifications n`+inboxJoins+`
+		WHERE n.user_id = $1 AND NOT `+inboxRead,
+		userID,
+	).Scan(&inbox.Unread)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to count unread notifications", "error", err)
+		http.Error(w, "Failed to get notifications", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inbox)
+}
+
+// Mark one of the user's notifications read
+func handleMarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	notificationID, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid notification ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx,
+		"UPDATE notifications SET read_at = COALESCE(read_at, CURRENT_TIMESTAMP) WHERE id = $1 AND user_id = $2",
+		notificationID, userID,
+	)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to mark notification read", "error", err)
+		http.Error(w, "Failed to mark notification read", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Notification not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Mark all of the user's notifications read
+func handleMarkAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx,
+		"UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND read_at IS NULL",
+		userID,
+	); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to mark notifications read", "error", err)
+		http.Error(w, "Failed to mark notifications read", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Per-room notification levels, stored in room_members.notify_level
+const (
+	NotifyAll      = "all"      // Every message notifies and counts as unread
+	NotifyMentions = "mentions" // Only messages that @mention the user
+	NotifyNone     = "none"     // Room is muted: nothing notifies or counts as unread
+)
+
+func isValidNotifyLevel(level string) bool {
+	return level == NotifyAll || level == NotifyMentions || level == NotifyNone
+}
+
+// roomMutedSQL is true while the member rm has muted the room for a while. Until then the room
+// behaves as if its level were none; afterwards the level applies again.
+const roomMutedSQL = `COALESCE(rm.notifications_muted_until > CURRENT_TIMESTAMP, FALSE)`
+
+// RoomNotificationSettings is the user's notification settings for a room
+type RoomNotificationSettings struct {
+	Level      string     `json:"level"`
+	MutedUntil *time.Time `json:"muted_until"` // Set while the room is muted for a while
+}
+
+// roomNotificationColumns selects RoomNotificationSettings from room_members rm, leaving out a mute that has run out
+const roomNotificationColumns = `rm.notify_level, CASE WHEN ` + roomMutedSQL + ` THEN rm.notifications_muted_until END`
+
+// mentionPattern matches "@username" as a whole word. The syntax is shared by Go's regexp
+// package and Postgres' ~* operator, so the same pattern drives unread counts and notifications.
+func mentionPattern(username string) string {
+	return `(^|[^[:alnum:]_])@` + regexp.QuoteMeta(username) + `($|[^[:alnum:]_])`
+}
+
+func mentionsUser(content, username string) bool {
+	matched, _ := regexp.MatchString("(?i)"+mentionPattern(username), content)
+	return matched
+}
+
+// shouldNotify reports whether a message in a room should notify a member with the given level
+func shouldNotify(level, content, username string) bool {
+	switch level {
+	case NotifyNone:
+		return false
+	case NotifyMentions:
+		return mentionsUser(content, username)
+	default:
+		return true
+	}
+}
+
+// Get the current user's notification level for a room, and until when it is muted
+func handleGetNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var settings RoomNotificationSettings
+	err = db.QueryRowContext(ctx,
+		"SELECT "+roomNotificationColumns+" FROM room_members rm WHERE rm.room_id = $1 AND rm.user_id = $2",
+		roomID, userID,
+	).Scan(&settings.Level, &settings.MutedUntil)
+	if err != nil {
+		http.Error(w, "You are not a member of this room", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// Set the current user's notification level for a room: all, mentions or none
+func handleUpdateNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Level string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !isValidNotifyLevel(req.Level) {
+		http.Error(w, "Level must be all, mentions or none", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var settings RoomNotificationSettings
+	err = db.QueryRowContext(ctx,
+		"UPDATE room_members rm SET notify_level = $1 WHERE rm.room_id = $2 AND rm.user_id = $3 RETURNING "+roomNotificationColumns,
+		req.Level, roomID, userID,
+	).Scan(&settings.Level, &settings.MutedUntil)
+	if err == sql.ErrNoRows {
+		http.Error(w, "You are not a member of this room", http.StatusForbidden)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update notification settings", "error", err)
+		http.Error(w, "Failed to update notification settings", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// Mute a room for duration_minutes ("mute for 8 hours") or until muted_until without changing its
+// level, or unmute it when both are omitted. The mute runs out by itself.
+func handleMuteRoom(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		DurationMinutes int        `json:"duration_minutes"`
+		MutedUntil      *time.Time `json:"muted_until"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.DurationMinutes != 0 && req.MutedUntil != nil {
+		http.Error(w, "Set duration_minutes or muted_until, not both", http.StatusBadRequest)
+		return
+	}
+	if req.DurationMinutes < 0 || req.DurationMinutes > maxMuteMinutes {
+		http.Error(w, fmt.Sprintf("duration_minutes must be between 1 and %d", maxMuteMinutes), http.StatusBadRequest)
+		return
+	}
+	if req.DurationMinutes > 0 {
+		t := time.Now().Add(time.Duration(req.DurationMinutes) * time.Minute)
+		req.MutedUntil = &t
+	} else if req.MutedUntil != nil {
+		if until := time.Until(*req.MutedUntil); until <= 0 || until > maxMuteMinutes*time.Minute {
+			http.Error(w, "muted_until must be in the future and within a year", http.StatusBadRequest)
+			return
+		}
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var settings RoomNotificationSettings
+	err = db.QueryRowContext(ctx,
+		"UPDATE room_members rm SET notifications_muted_until = $1 WHERE rm.room_id = $2 AND rm.user_id = $3 RETURNING "+roomNotificationColumns,
+		req.MutedUntil, roomID, userID,
+	).Scan(&settings.Level, &settings.MutedUntil)
+	if err == sql.ErrNoRows {
+		http.Error(w, "You are not a member of this room", http.StatusForbidden)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to mute room", "error", err)
+		http.Error(w, "Failed to mute room", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
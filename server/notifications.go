@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Why a member is notified of a message
+const (
+	ReasonMessage = "message" // Any message, in a room with notification level "all"
+	ReasonMention = "mention"
+	ReasonDirect  = "direct" // A message in a contact's direct message room
+)
+
+// Notification is one offline member's notification of a new message
+type Notification struct {
+	UserID   int
+	Username string
+	Reason   string
+	RoomID   int
+	RoomName string
+	Message  *Message
+	Push     bool // The user wants push notifications (Web Push and mobile)
+	Email    bool // The user wants email digests
+	Quiet    bool // Inside the user's Do Not Disturb window
+}
+
+// Title names the sender, and the room unless it is a direct message
+func (n *Notification) Title() string {
+	if n.Reason == ReasonDirect {
+		return n.Message.Sender
+	}
+	return n.Message.Sender + " in " + n.RoomName
+}
+
+// Body is the start of the message text
+func (n *Notification) Body() string {
+	if n.Message.Text == "" && n.Message.Kind == "gif" {
+		return "Sent a GIF"
+	} else if n.Message.Text == "" {
+		return "Sent an attachment"
+	}
+	return quoteSnippet(n.Message.Text)
+}
+
+// Notifier delivers notifications over one channel (Web Push, ...). Notify is called from the
+// notification goroutine, so it should bound its own requests with timeouts.
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification)
+}
+
+// notifiers holds the configured channels, set up by initNotifiers
+var notifiers []Notifier
+
+func initNotifiers() error {
+	if _, ok := store.(*postgresStore); ok {
+		notifiers = append(notifiers, inboxNotifier{})
+	}
+	push, err := newWebPushNotifier()
+	if err != nil {
+		return err
+	}
+	if push != nil {
+		notifiers = append(notifiers, push)
+	}
+	mobile, err := newMobilePushNotifier()
+	if err != nil {
+		return err
+	}
+	if mobile != nil {
+		notifiers = append(notifiers, mobile)
+	}
+	if email := newEmailDigestNotifier(); email != nil {
+		notifiers = append(notifiers, email)
+	}
+	return nil
+}
+
+// notificationQueue hands new messages to the goroutine that works out who to notify
+var notificationQueue = make(chan *Message, 1024)
+
+// queueNotifications forwards new messages for offline notification. Called from BroadcastToRoom,
+// on the instance where the message was posted, so each message is considered once.
+func queueNotifications(msg *WSMessage) {
+	if len(notifiers) == 0 || msg.Type != "roomMessage" || msg.Message == nil || msg.Message.SenderID == 0 {
+		return
+	}
+	select {
+	case notificationQueue <- msg.Message:
+	default:
+		slog.Warn("Notification queue full, dropping message", "room_id", msg.Message.RoomID, "message_id", msg.Message.ID)
+	}
+}
+
+// notificationWorkers is how many recipients of a message are notified at once
+const notificationWorkers = 8
+
+func runNotifications() {
+	for msg := range notificationQueue {
+		ctx, cancel := dbContext(context.Background())
+		recipients, err := notificationRecipients(ctx, msg)
+		cancel()
+		if err != nil {
+			slog.Error("Failed to load notification recipients", "room_id", msg.RoomID, "error", err)
+			continue
+		}
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, notificationWorkers)
+		for _, n := range recipients {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				for _, notifier := range notifiers {
+					notifier.Notify(context.Background(), n)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// notificationRecipients returns the members to notify of a message, by their notification level
+// for the room and the event types they enabled, unless they are connected. Only this instance's connections are known, so with
+// several instances a connected user may still be notified.
+func notificationRecipients(ctx context.Context, msg *Message) ([]*Notification, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT u.id, u.username, rm.notify_level, r.name,
+		       r.is_direct, COALESCE(`+dndActiveSQL+`, FALSE),
+		       COALESCE(np.push_enabled, TRUE), COALESCE(np.email_enabled, TRUE),
+		       COALESCE(np.mentions_enabled, TRUE), COALESCE(np.direct_enabled, TRUE), COALESCE(np.all_messages_enabled, TRUE)
+		FROM room_members rm
+		JOIN users u ON u.id = rm.user_id
+		JOIN rooms r ON r.id = rm.room_id
+		LEFT JOIN notification_preferences np ON np.user_id = u.id
+		WHERE rm.room_id = $1 AND rm.user_id != $2 AND rm.notify_level != $3 AND NOT `+roomMutedSQL+` AND u.is_active AND NOT u.is_bot
+	`, msg.RoomID, msg.SenderID, NotifyNone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipients []*Notification
+	for rows.Next() {
+		n := &Notification{RoomID: msg.RoomID, Message: msg}
+		var level string
+		var direct, mentions, directMessages, allMessages bool
+		if err := rows.Scan(&n.UserID, &n.Username, &level, &n.RoomName, &direct, &n.Quiet,
+			&n.Push, &n.Email, &mentions, &directMessages, &allMessages); err != nil {
+			return nil, err
+		}
+		switch {
+		case direct:
+			if !directMessages {
+				continue
+			}
+			n.Reason = ReasonDirect
+		case !shouldNotify(level, msg.Text, n.Username):
+			continue
+		case mentions && mentionsUser(msg.Text, n.Username):
+			n.Reason = ReasonMention
+		case allMessages && level == NotifyAll:
+			n.Reason = ReasonMessage
+		default:
+			continue
+		}
+		// Mentions and direct messages go to the notification inbox even without push or email
+		if n.Reason == ReasonMessage && !n.Push && !n.Email || roomManager.IsOnline(n.UserID) {
+			continue
+		}
+		recipients = append(recipients, n)
+	}
+	return recipients, rows.Err()
+}
+
+// --- Do Not Disturb ---
+
+// DNDSchedule is a daily window, in the user's timezone, during which push notifications are
+// held back and email digests wait until it ends. Messages still count as unread. A window whose
+// end is before its start runs past midnight.
+type DNDSchedule struct {
+	Start    string `json:"start"`    // "22:00"
+	End      string `json:"end"`      // "07:30"
+	Timezone string `json:"timezone"` // IANA name, e.g. "Europe/Berlin"
+}
+
+func (d *DNDSchedule) validate() error {
+	start, err := time.Parse("15:04", d.Start)
+	if err != nil {
+		return errors.New("DND start must be HH:MM")
+	}
+	end, err := time.Parse("15:04", d.End)
+	if err != nil {
+		return errors.New("DND end must be HH:MM")
+	}
+	if start.Equal(end) {
+		return errors.New("DND start and end must differ")
+	}
+	if d.Timezone == "" || d.Timezone == "Local" {
+		return errors.New("DND timezone is required")
+	}
+	if _, err := time.LoadLocation(d.Timezone); err != nil {
+		return errors.New("Unknown DND timezone")
+	}
+	return nil
+}
+
+// dndActiveSQL is true while the schedule in notification_preferences np covers the current time
+const dndActiveSQL = `(np.dnd_start IS NOT NULL AND CASE
+	WHEN np.dnd_start < np.dnd_end THEN (NOW() AT TIME ZONE np.dnd_timezone)::time >= np.dnd_start AND (NOW() AT TIME ZONE np.dnd_timezone)::time < np.dnd_end
+	ELSE (NOW() AT TIME ZONE np.dnd_timezone)::time >= np.dnd_start OR (NOW() AT TIME ZONE np.dnd_timezone)::time < np.dnd_end
+END)`
+
+// --- Preferences ---
+
+// NotificationPreferences are a user's settings across all rooms. The per-room notification
+// level still decides which rooms notify of every message; these pick the channels and event
+// types, and apply to every notifier alike.
+type NotificationPreferences struct {
+	Push           bool         `json:"push"`            // Web Push and mobile notifications
+	Email          bool         `json:"email"`           // Email digests of unread mentions and direct messages
+	Mentions       bool         `json:"mentions"`        // Being @mentioned
+	DirectMessages bool         `json:"direct_messages"` // Messages in direct message rooms
+	AllMessages    bool         `json:"all_messages"`    // Every message in rooms with notification level "all"
+	DND            *DNDSchedule `json:"dnd"`             // Daily quiet hours; null turns them off
+}
+
+// loadNotificationPreferences returns the user's preferences, everything on (and no DND) if they
+// never changed them
+func loadNotificationPreferences(ctx context.Context, userID int) (NotificationPreferences, error) {
+	prefs := NotificationPreferences{Push: true, Email: true, Mentions: true, DirectMessages: true, AllMessages: true}
+	var dnd DNDSchedule
+	var dndTimezone sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT push_enabled, email_enabled, mentions_enabled, direct_enabled, all_messages_enabled,
+		       COALESCE(to_char(dnd_start, 'HH24:MI'), ''), COALESCE(to_char(dnd_end, 'HH24:MI'), ''), dnd_timezone
+		FROM notification_preferences WHERE user_id = $1
+	`, userID).Scan(&prefs.Push, &prefs.Email, &prefs.Mentions, &prefs.DirectMessages, &prefs.AllMessages,
+		&dnd.Start, &dnd.End, &dndTimezone)
+	if err == sql.ErrNoRows {
+		return prefs, nil
+	}
+	if err != nil {
+		return prefs, err
+	}
+	if dndTimezone.Valid {
+		dnd.Timezone = dndTimezone.String
+		prefs.DND = &dnd
+	}
+	return prefs, nil
+}
+
+// Get the current user's notification preferences
+func handleGetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	prefs, err := loadNotificationPreferences(ctx, userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get notification preferences", "error", err)
+		http.Error(w, "Failed to get notification preferences", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+// Update the current user's notification preferences. Fields left out of the body keep their
+// current value.
+func handleUpdateNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	prefs, err := loadNotificationPreferences(ctx, userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get notification preferences", "error", err)
+		http.Error(w, "Failed to update notification preferences", http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	var dndStart, dndEnd, dndTimezone sql.NullString
+	if prefs.DND != nil {
+		if err := prefs.DND.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dndStart = sql.NullString{String: prefs.DND.Start, Valid: true}
+		dndEnd = sql.NullString{String: prefs.DND.End, Valid: true}
+		dndTimezone = sql.NullString{String: prefs.DND.Timezone, Valid: true}
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO notification_preferences (user_id, push_enabled, email_enabled, mentions_enabled, direct_enabled,
+			all_messages_enabled, dnd_start, dnd_end, dnd_timezone)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (user_id) DO UPDATE SET push_enabled = EXCLUDED.push_enabled, email_enabled = EXCLUDED.email_enabled,
+			mentions_enabled = EXCLUDED.mentions_enabled, direct_enabled = EXCLUDED.direct_enabled,
+			all_messages_enabled = EXCLUDED.all_messages_enabled, dnd_start = EXCLUDED.dnd_start,
+			dnd_end = EXCLUDED.dnd_end, dnd_timezone = EXCLUDED.dnd_timezone, updated_at = CURRENT_TIMESTAMP
+	`, userID, prefs.Push, prefs.Email, prefs.Mentions, prefs.DirectMessages, prefs.AllMessages, dndStart, dndEnd, dndTimezone)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update notification preferences", "error", err)
+		http.Error(w, "Failed to update notification preferences", http.StatusInternalServerError)
+		return
+	}
+
+	// Drop pending digest entries for what the user no longer wants emailed
+	_, err = db.ExecContext(ctx, `
+		DELETE FROM email_notifications
+		WHERE user_id = $1 AND (NOT $2 OR (reason = $3 AND NOT $4) OR (reason = $5 AND NOT $6))
+	`, userID, prefs.Email, ReasonMention, prefs.Mentions, ReasonDirect, prefs.DirectMessages)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to clear email notifications", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
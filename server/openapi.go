@@ -0,0 +1,556 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiOperation documents one route for the OpenAPI spec. Request and Response are zero values of
+// the JSON body types; their schemas are derived from the json tags, so they can't drift from the
+// structs the handlers encode.
+type apiOperation struct {
+	Summary   string
+	Query     []apiParam
+	Request   any
+	Multipart bool // multipart/form-data with the upload in a "file" field
+	Response  any
+	CSV       bool // The success body is text/csv rather than a JSON Response
+	Status    int  // Success status, 200 if unset
+	Public    bool // No token needed
+}
+
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+type statusResponse struct {
+	Status string `json:"status"`
+}
+
+type authResponse struct {
+	Token    string `json:"token"`
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+}
+
+var paginationParams = []apiParam{
+	{"limit", "integer", "Page size, at most 100"},
+	{"offset", "integer", "Rows to skip"},
+}
+
+// apiDocs is keyed by "METHOD /path/template" as registered on the router. The spec is built
+// from the router itself, so a route missing here is logged at startup rather than silently absent.
+var apiDocs = map[string]apiOperation{
+	"GET /healthz": {Summary: "Liveness probe", Public: true, Response: statusResponse{}},
+	"GET /readyz":  {Summary: "Readiness probe: database, broker and shutdown state (503 when not ready)", Public: true, Response: map[string]any{}},
+
+	"GET /api/openapi.json": {Summary: "This document", Public: true, Response: map[string]any{}},
+	"GET /api/docs":         {Summary: "Swagger UI for this document", Public: true},
+
+	"POST /api/register": {Summary: "Create an account. captcha_token is required when a CAPTCHA provider is configured.", Public: true, Response: authResponse{}, Request: struct {
+		Username     string `json:"username"`
+		Email        string `json:"email"`
+		Password     string `json:"password"`
+		CaptchaToken string `json:"captcha_token,omitempty"`
+	}{}},
+	"GET /api/captcha": {Summary: "The CAPTCHA provider and site key for the registration form (404 when CAPTCHA is not configured)", Public: true, Response: map[string]string{}},
+	"GET /api/avatars/{seed}.png": {
+		Summary: "A deterministic PNG avatar for the seed: an identicon, or the initial of text on the seed's colour",
+		Public:  true,
+		Query: []apiParam{
+			{"size", "integer", "Width and height in pixels, 16 to 512 (128)"},
+			{"text", "string", "Name whose initial to draw; falls back to the identicon if the font lacks it"},
+		},
+	},
+	"POST /api/login": {Summary: "Log in and get a token", Public: true, Response: authResponse{}, Request: struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}{}},
+
+	"GET /api/rooms": {
+		Summary:  "Rooms the user belongs to, most recently active first. The X-Synced-At response header is the value to pass as updated_since next time.",
+		Response: []Room{},
+		Query: append([]apiParam{
+			{"updated_since", "string", "RFC 3339 time; only rooms with messages sent, edited or deleted, reads or joins since then (or shortly before)"},
+		}, paginationParams...),
+	},
+	"POST /api/rooms": {Summary: "Create a room; an Idempotency-Key header makes retries return the same room", Status: http.StatusCreated, Response: Room{}, Request: struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		IsPrivate   bool   `json:"is_private"`
+	}{}},
+	"GET /api/rooms/explore": {
+		Summary:  "Public rooms the user hasn't joined",
+		Response: []Room{},
+		Query: append([]apiParam{
+			{"q", "string", "Search names and descriptions"},
+			{"sort", "string", "newest (default), members or active"},
+		}, paginationParams...),
+	},
+	"DELETE /api/rooms/{id}":                             {Summary: "Delete a room (admins)", Response: statusResponse{}},
+	"POST /api/rooms/{id}/join":                          {Summary: "Join a public room; for a private room a join request is filed instead (202 with the request)", Response: Room{}},
+	"POST /api/rooms/{id}/leave":                         {Summary: "Leave a room", Response: statusResponse{}},
+	"POST /api/rooms/{id}/unarchive":                     {Summary: "Unarchive a room archived for inactivity so members can post again (admins)", Response: statusResponse{}},
+	"POST /api/rooms/{id}/read":                          {Summary: "Mark everything in the room as read", Response: statusResponse{}},
+	"POST /api/rooms/{id}/transfer-ownership/{memberId}": {Summary: "Hand the room over to another member (owner only)", Response: map[string]int{}},
+
+	"GET /api/rooms/{id}/messages": {Summary: "Latest messages of the room", Response: []Message{}, Query: []apiParam{
+		{"locale", "string", "Language for system messages (en, es, fr, de); defaults to Accept-Language"},
+	}},
+	"POST /api/rooms/{id}/messages": {Summary: "Post a message over REST; an Idempotency-Key header makes retries return the same message", Status: http.StatusCreated, Response: Message{}, Request: struct {
+		Content       string `json:"content"`
+		AttachmentIDs []int  `json:"attachment_ids"`
+		ReplyToID     int    `json:"reply_to_id"`
+		GIFID         string `json:"gif_id"`
+	}{}},
+	"DELETE /api/rooms/{id}/messages/{msgId}": {Summary: "Delete a message (sender, or roles that may delete messages)", Response: statusResponse{}},
+	"PATCH /api/rooms/{id}/messages/{msgId}": {Summary: "Edit the text of your message; the room receives messageEdited", Response: Message{}, Request: struct {
+		Content string `json:"content"`
+	}{}},
+	"GET /api/messages/{id}/history": {Summary: "Earlier versions of an edited message, oldest first (room members)", Response: []MessageRevision{}},
+	"POST /api/rooms/{id}/messages/{msgId}/reactions": {Summary: "React to a message", Response: statusResponse{}, Request: struct {
+		Emoji string `json:"emoji"`
+	}{}},
+	"DELETE /api/rooms/{id}/messages/{msgId}/reactions": {
+		Summary:  "Remove a reaction",
+		Response: statusResponse{},
+		Query:    []apiParam{{"emoji", "string", "The reaction to remove; may also be sent as a JSON body"}},
+	},
+	"GET /api/rooms/{id}/messages/{msgId}/reads": {Summary: "Members who have read the message", Response: []MessageRead{}},
+	"GET /api/rooms/{id}/messages/{msgId}/context": {
+		Summary:  "The message with the conversation around it, oldest first, for jumping to a search result or pinned message",
+		Response: MessageContext{},
+		Query: []apiParam{
+			{"before", "integer", "Messages before it (default 20, at most 100)"},
+			{"after", "integer", "Messages after it (default 20, at most 100)"},
+			{"locale", "string", "Language for system messages (en, es, fr, de); defaults to Accept-Language"},
+		},
+	},
+
+	"GET /api/rooms/{id}/members":               {Summary: "Members of the room", Response: []RoomMember{}},
+	"DELETE /api/rooms/{id}/members/{memberId}": {Summary: "Remove a member", Response: statusResponse{}},
+	"GET /api/rooms/{id}/members/export": {Summary: "Download the members as CSV (admins): username, role, joined_at and last_active_at, plus email for site admins", CSV: true, Query: []apiParam{
+		{"format", "string", "csv, the only format and the default"},
+	}},
+	"POST /api/rooms/{id}/members/bulk": {Summary: "Add users by username or email in bulk, inviting unknown emails (admins)", Response: []BulkMemberResult{}, Request: struct {
+		Members []string `json:"members"`
+	}{}},
+	"PATCH /api/rooms/{id}/members/{memberId}/role": {Summary: "Change a member's role", Response: map[string]any{}, Request: struct {
+		Role string `json:"role"`
+	}{}},
+	"POST /api/rooms/{id}/members/{memberId}/mute": {Summary: "Mute a member; 0 minutes mutes until unmuted", Response: map[string]any{}, Request: struct {
+		DurationMinutes int `json:"duration_minutes"`
+	}{}},
+	"DELETE /api/rooms/{id}/members/{memberId}/mute": {Summary: "Unmute a member", Response: statusResponse{}},
+
+	"GET /api/rooms/{id}/bans": {Summary: "Users banned from the room", Response: []RoomBan{}},
+	"POST /api/rooms/{id}/bans": {Summary: "Ban a user, removing them if they are a member", Status: http.StatusCreated, Response: RoomBan{}, Request: struct {
+		UserID int    `json:"user_id"`
+		Reason string `json:"reason"`
+	}{}},
+	"DELETE /api/rooms/{id}/bans/{userId}": {Summary: "Lift a ban", Response: statusResponse{}},
+
+	"GET /api/rooms/{id}/notifications": {Summary: "The user's notification level for the room, and until when it is muted", Response: RoomNotificationSettings{}},
+	"PUT /api/rooms/{id}/notifications": {Summary: "Set the notification level: all, mentions or none", Response: RoomNotificationSettings{}, Request: struct {
+		Level string `json:"level"`
+	}{}},
+	"PUT /api/rooms/{id}/notifications/mute": {Summary: "Mute the room for duration_minutes or until muted_until, as if its level were none, without leaving it; omit both to unmute", Response: RoomNotificationSettings{}, Request: struct {
+		DurationMinutes int        `json:"duration_minutes,omitempty"`
+		MutedUntil      *time.Time `json:"muted_until,omitempty"`
+	}{}},
+
+	"GET /api/rooms/{id}/join-requests":                      {Summary: "Pending join requests (admins)", Response: []JoinRequest{}},
+	"POST /api/rooms/{id}/join-requests/{requestId}/approve": {Summary: "Approve a join request (admins)", Response: JoinRequest{}},
+	"POST /api/rooms/{id}/join-requests/{requestId}/deny":    {Summary: "Deny a join request (admins)", Response: JoinRequest{}},
+	"GET /api/rooms/{id}/analytics": {
+		Summary:  "Messages per day, most active members, peak hours and membership growth (admins)",
+		Response: RoomAnalytics{},
+		Query:    []apiParam{{"days", "integer", "Days to cover, 30 by default and at most 365"}},
+	},
+	"GET /api/rooms/{id}/code":             {Summary: "The room's join code, e.g. BLUE-FOX-OWL-4217 (roles that may invite)", Response: map[string]string{}},
+	"POST /api/rooms/{id}/code/regenerate": {Summary: "Replace the room's join code (admins)", Response: map[string]string{}},
+	"POST /api/rooms/join-by-code": {Summary: "Join the room a code belongs to; 20 wrong codes per hour", Response: Room{}, Request: struct {
+		Code string `json:"code"`
+	}{}},
+	"POST /api/rooms/{id}/invite": {Summary: "Invite a user to the room by user_id or username; they receive a roomInvited event", Status: http.StatusCreated, Response: RoomInvite{}, Request: struct {
+		UserID   int    `json:"user_id,omitempty"`
+		Username string `json:"username,omitempty"`
+	}{}},
+	"POST /api/rooms/{id}/invites": {Summary: "Same as POST /api/rooms/{id}/invite", Status: http.StatusCreated, Response: RoomInvite{}, Request: struct {
+		UserID   int    `json:"user_id,omitempty"`
+		Username string `json:"username,omitempty"`
+	}{}},
+	"GET /api/invites":               {Summary: "The user's pending invites", Response: []RoomInvite{}},
+	"POST /api/invites/{id}/accept":  {Summary: "Accept an invite and join the room", Response: Room{}},
+	"POST /api/invites/{id}/decline": {Summary: "Decline an invite", Response: statusResponse{}},
+	"POST /api/invites/email/redeem": {Summary: "Redeem an emailed invite token and join its room; each token works once", Response: Room{}, Request: struct {
+		Token string `json:"token"`
+	}{}},
+
+	"POST /api/rooms/{id}/avatar":   {Summary: "Upload the room's avatar image (admins)", Multipart: true, Response: map[string]string{}},
+	"DELETE /api/rooms/{id}/avatar": {Summary: "Remove the room's avatar (admins)", Response: statusResponse{}},
+	"PUT /api/rooms/{id}/slow-mode": {Summary: "Set the minimum seconds between a member's messages; 0 turns slow mode off", Response: map[string]int{}, Request: struct {
+		Seconds int `json:"seconds"`
+	}{}},
+	"GET /api/rooms/{id}/permissions": {Summary: "The room's permission matrix, role -> permission -> allowed", Response: map[string]map[string]bool{}},
+	"PUT /api/rooms/{id}/permissions": {Summary: "Override permissions for moderators and members", Response: map[string]map[string]bool{}, Request: map[string]map[string]bool{}},
+
+	"GET /api/rooms/{id}/webhooks": {Summary: "The room's outbound webhooks (roles that may manage the room)", Response: []RoomWebhook{}},
+	"POST /api/rooms/{id}/webhooks": {Summary: "Register a webhook; events default to all of them. The signing secret is only shown once.", Status: http.StatusCreated, Response: RoomWebhook{}, Request: struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}{}},
+	"DELETE /api/rooms/{id}/webhooks/{hookId}":         {Summary: "Remove a webhook", Response: statusResponse{}},
+	"GET /api/rooms/{id}/webhooks/{hookId}/deliveries": {Summary: "The webhook's 50 latest deliveries", Response: []WebhookDelivery{}},
+
+	"GET /api/rooms/{id}/incoming-webhooks": {Summary: "The room's incoming webhooks (roles that may manage the room)", Response: []IncomingWebhook{}},
+	"POST /api/rooms/{id}/incoming-webhooks": {Summary: "Create an incoming webhook posting as a new bot account of the given name. The token is only shown once.", Status: http.StatusCreated, Response: IncomingWebhook{}, Request: struct {
+		Name string `json:"name"`
+	}{}},
+	"PATCH /api/rooms/{id}/incoming-webhooks/{hookId}": {Summary: "Rename the webhook's bot account", Response: statusResponse{}, Request: struct {
+		Name string `json:"name"`
+	}{}},
+	"DELETE /api/rooms/{id}/incoming-webhooks/{hookId}": {Summary: "Remove an incoming webhook; its bot account is deactivated", Response: statusResponse{}},
+	"POST /api/hooks/{token}":                           {Summary: "Post a Slack-style {\"text\": ...} payload (JSON, or a form with a payload field) into the webhook's room. Responds with plain-text ok.", Public: true, Request: slackPayload{}, Response: ""},
+
+	"GET /api/push/vapid-key":             {Summary: "The VAPID public key to pass to PushManager.subscribe() (404 when Web Push is not configured)", Response: map[string]string{}},
+	"POST /api/push/subscriptions":        {Summary: "Register the browser's push subscription for mention and direct message notifications while offline", Status: http.StatusCreated, Response: PushSubscription{}, Request: PushSubscription{}},
+	"DELETE /api/push/subscriptions/{id}": {Summary: "Remove a push subscription", Response: statusResponse{}},
+	"POST /api/push/devices": {Summary: "Register a mobile app's FCM or APNs token for notifications while offline, following the room notification levels", Status: http.StatusCreated, Response: DeviceToken{}, Request: struct {
+		Platform string `json:"platform"`
+		Token    string `json:"token"`
+	}{}},
+	"DELETE /api/push/devices/{id}":            {Summary: "Unregister a device", Response: statusResponse{}},
+	"GET /api/contacts":                        {Summary: "The user's contacts with online status and their direct message room, if any", Response: []Contact{}},
+	"GET /api/contacts/requests":               {Summary: "Pending friend requests, received and sent", Response: map[string][]ContactRequest{}},
+	"POST /api/contacts/requests/{id}/accept":  {Summary: "Accept a friend request", Response: Contact{}},
+	"POST /api/contacts/requests/{id}/decline": {Summary: "Decline a friend request", Response: statusResponse{}},
+	"DELETE /api/contacts/{userId}":            {Summary: "Remove a contact or withdraw a request", Response: statusResponse{}},
+	"POST /api/contacts/{userId}/dm":           {Summary: "Open the direct message room with a contact; 201 when it was just created", Response: Room{}},
+	"POST /api/contacts/requests": {Summary: "Send a friend request by user_id or username; accepts theirs if they asked first", Status: http.StatusCreated, Response: ContactRequest{}, Request: struct {
+		UserID   int    `json:"user_id"`
+		Username string `json:"username"`
+	}{}},
+
+	"PATCH /api/me/status": {Summary: "Set the user's presence state (available, busy, away) and status emoji and text; omitted fields are kept", Response: UserStatus{}, Request: UserStatus{}},
+	"GET /api/me/notifications": {
+		Summary:  "Mentions and direct messages that arrived while the user was offline, newest first",
+		Response: NotificationInbox{},
+		Query: []apiParam{
+			{"unread", "boolean", "Only unread notifications"},
+			{"before", "integer", "Notifications older than this ID"},
+			{"limit", "integer", "Page size (default 50, at most 100)"},
+		},
+	},
+	"POST /api/me/notifications/{id}/read": {Summary: "Mark a notification read", Response: statusResponse{}},
+	"POST /api/me/notifications/read-all":  {Summary: "Mark all the user's notifications read", Response: statusResponse{}},
+	"GET /api/me/sessions":                 {Summary: "The devices signed in to the user's account, most recently active first", Response: []Session{}},
+	"DELETE /api/me/sessions/{id}":         {Summary: "Sign a device out; its token stops working and its WebSocket, GraphQL and gRPC streams are closed on every instance", Response: statusResponse{}},
+	"GET /api/me/notification-settings":    {Summary: "The user's notification channels, event types and Do Not Disturb hours across rooms", Response: NotificationPreferences{}},
+	"PUT /api/me/notification-settings":    {Summary: "Update the user's notification channels (push, email), event types (mentions, direct messages, all messages) and Do Not Disturb hours; omitted fields are kept", Response: NotificationPreferences{}, Request: NotificationPreferences{}},
+
+	"POST /api/bots": {Summary: "Create a bot account; the API key is only shown once", Status: http.StatusCreated, Response: map[string]any{}, Request: struct {
+		Name string `json:"name"`
+	}{}},
+	"GET /api/gifs/search": {Summary: "Search GIFs through the configured provider; send one by its id as gif_id", Response: map[string]any{}, Query: []apiParam{
+		{"q", "string", "Search terms"},
+		{"limit", "integer", "Results per page, at most 50"},
+		{"next", "string", "The next cursor of the previous page"},
+	}},
+	"POST /api/uploads": {Summary: "Upload an image, audio or video attachment to reference from a message", Multipart: true, Status: http.StatusCreated, Response: Attachment{}},
+	"POST /api/rooms/{id}/polls": {Summary: "Post a poll", Status: http.StatusCreated, Response: Message{}, Request: struct {
+		Question string   `json:"question"`
+		Options  []string `json:"options"`
+	}{}},
+	"POST /api/polls/{id}/vote": {Summary: "Vote in a poll", Response: Poll{}, Request: struct {
+		OptionID int `json:"option_id"`
+	}{}},
+
+	"GET /api/admin/users": {
+		Summary:  "List users (site admins)",
+		Response: []AdminUser{},
+		Query:    append([]apiParam{{"q", "string", "Search usernames and emails"}}, paginationParams...),
+	},
+	"POST /api/admin/users/{id}/deactivate":  {Summary: "Deactivate an account (site admins)", Response: statusResponse{}},
+	"POST /api/admin/users/{id}/reactivate":  {Summary: "Reactivate an account (site admins)", Response: statusResponse{}},
+	"POST /api/admin/users/{id}/shadowban":   {Summary: "Shadowban a user: their messages are only shown to themselves (site admins)", Response: statusResponse{}},
+	"DELETE /api/admin/users/{id}/shadowban": {Summary: "Lift a shadowban; messages sent meanwhile stay hidden (site admins)", Response: statusResponse{}},
+	"DELETE /api/admin/rooms/{id}":           {Summary: "Delete any room (site admins)", Response: statusResponse{}},
+	"GET /api/admin/stats":                   {Summary: "Server statistics (site admins): users, daily and monthly active users, messages per day, busiest rooms and connections", Response: AdminStats{}},
+	"GET /api/admin/moderation/words": {
+		Summary:  "Blocked words (site admins)",
+		Response: []moderationRule{},
+		Query:    []apiParam{{"room_id", "integer", "A room's list instead of the global one"}},
+	},
+	"POST /api/admin/moderation/words": {Summary: "Add a blocked word (site admins)", Status: http.StatusCreated, Response: moderationRule{}, Request: struct {
+		Word   string `json:"word"`
+		Action string `json:"action"`
+		RoomID *int   `json:"room_id"`
+	}{}},
+	"DELETE /api/admin/moderation/words/{wordId}": {Summary: "Remove a blocked word (site admins)", Response: statusResponse{}},
+	"GET /api/admin/moderation/flagged":           {Summary: "Messages flagged by the word filter (site admins)", Response: []FlaggedMessage{}},
+	"GET /api/admin/debug":                        {Summary: "Runtime and hub diagnostics (site admins)", Response: map[string]any{}},
+	"GET /api/admin/rate-limits":                  {Summary: "The HTTP and WebSocket rate limits in force (site admins)", Response: RateLimits{}},
+	"PUT /api/admin/rate-limits":                  {Summary: "Change rate limits on every instance without a restart; omitted fields are kept (site admins)", Response: RateLimits{}, Request: RateLimits{}},
+	"DELETE /api/admin/rate-limits":               {Summary: "Go back to the rate limits from the environment (site admins)", Response: RateLimits{}},
+	"GET /api/admin/email-domains":                {Summary: "Email domains that can't be used to register, subdomains included (site admins)", Response: []BlockedEmailDomain{}},
+	"POST /api/admin/email-domains": {Summary: "Block email domains; ones already blocked are skipped (site admins)", Status: http.StatusCreated, Response: map[string]int{}, Request: struct {
+		Domains []string `json:"domains"`
+	}{}},
+	"DELETE /api/admin/email-domains/{domain}": {Summary: "Unblock an email domain (site admins)", Response: statusResponse{}},
+}
+
+var pathParamPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+// openAPIHandler serves the spec for every documented route on router. It is built on the first
+// request, once all routes are registered.
+func openAPIHandler(router *mux.Router) http.HandlerFunc {
+	var once sync.Once
+	var spec []byte
+	return func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			var err error
+			if spec, err = json.Marshal(buildOpenAPISpec(router)); err != nil {
+				slog.Error("Failed to encode the OpenAPI spec", "error", err)
+			}
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	}
+}
+
+// checkAPIDocs logs API routes that have no apiDocs entry
+func checkAPIDocs(router *mux.Router) {
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tmpl, "/api/") {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			if _, ok := apiDocs[method+" "+tmpl]; !ok && method != http.MethodOptions {
+				slog.Warn("Route is missing from the OpenAPI docs", "route", method+" "+tmpl)
+			}
+		}
+		return nil
+	})
+}
+
+func buildOpenAPISpec(router *mux.Router) map[string]any {
+	schemas := &schemaBuilder{components: make(map[string]any)}
+	paths := make(map[string]map[string]any)
+
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil // Prefix routes like /uploads/ and pprof
+		}
+		for _, method := range methods {
+			doc, ok := apiDocs[method+" "+tmpl]
+			if !ok {
+				continue
+			}
+			if paths[tmpl] == nil {
+				paths[tmpl] = make(map[string]any)
+			}
+			paths[tmpl][strings.ToLower(method)] = schemas.operation(tmpl, doc)
+		}
+		return nil
+	})
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "ChatHub API",
+			"version":     "1.0",
+			"description": "REST API of the ChatHub server. Real-time events are sent over the WebSocket at /ws. Errors are returned as plain text.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas.components,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKey":     map[string]any{"type": "apiKey", "in": "header", "name": "X-Api-Key"},
+			},
+		},
+	}
+}
+
+// schemaBuilder converts Go types to JSON Schema, collecting named structs as components
+type schemaBuilder struct {
+	components map[string]any
+}
+
+func (b *schemaBuilder) operation(tmpl string, doc apiOperation) map[string]any {
+	tag := "health"
+	if rest, ok := strings.CutPrefix(tmpl, "/api/"); ok {
+		tag, _, _ = strings.Cut(rest, "/")
+		tag = strings.TrimSuffix(tag, ".json")
+	}
+	op := map[string]any{"summary": doc.Summary, "tags": []string{tag}}
+
+	params := []map[string]any{}
+	for _, m := range pathParamPattern.FindAllStringSubmatch(tmpl, -1) {
+		typ := "integer" // all path parameters are IDs, except webhook tokens
+		if m[1] == "token" {
+			typ = "string"
+		}
+		params = append(params, map[string]any{"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": typ}})
+	}
+	for _, q := range doc.Query {
+		params = append(params, map[string]any{"name": q.Name, "in": "query", "description": q.Description, "schema": map[string]any{"type": q.Type}})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if doc.Request != nil {
+		op["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{"application/json": map[string]any{"schema": b.schema(reflect.TypeOf(doc.Request))}},
+		}
+	} else if doc.Multipart {
+		op["requestBody"] = map[string]any{
+			"required": true,
+			"content": map[string]any{"multipart/form-data": map[string]any{"schema": map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"file": map[string]any{"type": "string", "format": "binary"}},
+				"required":   []string{"file"},
+			}}},
+		}
+	}
+
+	status := doc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]any{"description": http.StatusText(status)}
+	if doc.Response != nil {
+		success["content"] = map[string]any{"application/json": map[string]any{"schema": b.schema(reflect.TypeOf(doc.Response))}}
+	} else if doc.CSV {
+		success["content"] = map[string]any{"text/csv": map[string]any{"schema": map[string]any{"type": "string"}}}
+	}
+	op["responses"] = map[string]any{
+		strconv.Itoa(status): success,
+		"default":            map[string]any{"description": "Error; the body is a plain-text reason"},
+	}
+
+	switch {
+	case doc.Public:
+		op["security"] = []any{}
+	default:
+		// Bot accounts send their API key instead of a token
+		op["security"] = []any{map[string][]string{"bearerAuth": {}}, map[string][]string{"apiKey": {}}}
+	}
+	return op
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		return b.schema(t.Elem())
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := b.components[name]; !ok {
+			b.components[name] = map[string]any{} // Placeholder, in case the type refers to itself
+			b.components[name] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	case t.Kind() == reflect.Struct:
+		return b.object(t)
+	}
+
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	default:
+		return map[string]any{}
+	}
+}
+
+// object lists a struct's JSON fields the way encoding/json would, flattening untagged embedded structs
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	props := make(map[string]any)
+	b.addFields(t, props)
+	return map[string]any{"type": "object", "properties": props}
+}
+
+func (b *schemaBuilder) addFields(t reflect.Type, props map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				b.addFields(ft, props)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if _, taken := props[name]; !taken {
+			props[name] = b.schema(f.Type)
+		}
+	}
+}
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>ChatHub API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>SwaggerUIBundle({ url: "/api/openapi.json", dom_id: "#swagger-ui" });</script>
+</body>
+</html>`
+
+// Swagger UI for /api/openapi.json
+func handleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerUIPage))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+)
+
+var errPersisterClosed = errors.New("message persister is shut down")
+
+// messageWriters is how many rooms' messages are written concurrently (MESSAGE_WRITERS)
+func messageWriters() int {
+	return envInt("MESSAGE_WRITERS", 4)
+}
+
+// messageBatchSize caps how many queued messages share one transaction (MESSAGE_BATCH_SIZE)
+func messageBatchSize() int {
+	return envInt("MESSAGE_BATCH_SIZE", 100)
+}
+
+// messagePersister writes user messages behind the WebSocket path. Each room is pinned to one
+// writer, which saves messages in the order they were queued, so a room's IDs and broadcasts
+// stay in send order. A writer commits whatever has queued up while its last batch was being
+// written in a single transaction, so batches grow with load instead of adding latency.
+type messagePersister struct {
+	store     Store
+	mu        sync.RWMutex
+	closed    bool
+	queues    []chan *pendingMessage
+	batchSize int
+	wg        sync.WaitGroup
+}
+
+var persister *messagePersister
+
+func newMessagePersister(s Store) *messagePersister {
+	p := &messagePersister{store: s, queues: make([]chan *pendingMessage, messageWriters()), batchSize: messageBatchSize()}
+	for i := range p.queues {
+		p.queues[i] = make(chan *pendingMessage, p.batchSize*4)
+		p.wg.Add(1)
+		go p.run(p.queues[i])
+	}
+	return p
+}
+
+// enqueue blocks while the room's writer is full, which pushes back on the sending connection
+func (p *messagePersister) enqueue(msg *pendingMessage) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return errPersisterClosed
+	}
+	p.queues[msg.out.RoomID%len(p.queues)] <- msg
+	return nil
+}
+
+// Close writes everything already queued, then stops the writers
+func (p *messagePersister) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, queue := range p.queues {
+			close(queue)
+		}
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+func (p *messagePersister) run(queue chan *pendingMessage) {
+	defer p.wg.Done()
+
+	batch := make([]*pendingMessage, 0, p.batchSize)
+	for msg := range queue {
+		batch = append(batch[:0], msg)
+	collect:
+		for len(batch) < p.batchSize {
+			select {
+			case msg, ok := <-queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, msg)
+			default:
+				break collect
+			}
+		}
+		p.flush(batch)
+	}
+}
+
+// flush saves a batch and reports each message's outcome. If the batch fails, its messages are
+// retried one by one so a single bad message (e.g. invalid attachments) doesn't fail the rest.
+func (p *messagePersister) flush(batch []*pendingMessage) {
+	saved, err := p.save(batch)
+	if err == nil {
+		for i, msg := range batch {
+			msg.done(saved[i], nil)
+		}
+		return
+	}
+	if len(batch) == 1 {
+		batch[0].done(nil, err)
+		return
+	}
+
+	slog.Warn("Batched message insert failed, retrying messages one by one", "count", len(batch), "error", err)
+	for _, msg := range batch {
+		saved, err := p.save([]*pendingMessage{msg})
+		if err != nil {
+			msg.done(nil, err)
+			continue
+		}
+		msg.done(saved[0], nil)
+	}
+}
+
+func (p *messagePersister) save(batch []*pendingMessage) ([]*Message, error) {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+	return p.store.SaveMessages(ctx, batch)
+}
+
+// sendIfConnected queues a message for the client from outside its readPump, e.g. a persistence
+// ack, dropping it if the client has disconnected in the meantime
+func (c *Client) sendIfConnected(msg *WSMessage) {
+	c.Manager.mu.RLock()
+	defer c.Manager.mu.RUnlock()
+	if c.Manager.Clients[c] {
+		c.enqueue(msg)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	minPollOptions      = 2
+	maxPollOptions      = 10
+	maxPollOptionLength = 200
+)
+
+type PollOption struct {
+	ID    int    `json:"id"`
+	Text  string `json:"text"`
+	Votes int    `json:"votes"`
+}
+
+// Poll is attached to messages of kind "poll" and sent in "pollUpdated" events
+type Poll struct {
+	ID         int          `json:"id"`
+	Question   string       `json:"question"`
+	Options    []PollOption `json:"options"`
+	TotalVotes int          `json:"total_votes"`
+}
+
+var errInvalidPoll = &ValidationError{Code: CodeInvalidPoll, Message: "A poll needs a question and 2 to 10 distinct, non-empty options of up to 200 characters"}
+
+func validatePollOptions(options []string) ([]string, error) {
+	if len(options) < minPollOptions || len(options) > maxPollOptions {
+		return nil, errInvalidPoll
+	}
+	seen := make(map[string]bool, len(options))
+	cleaned := make([]string, 0, len(options))
+	for _, opt := range options {
+		opt = sanitizeLine(opt)
+		key := strings.ToLower(opt)
+		if opt == "" || len(opt) > maxPollOptionLength || seen[key] {
+			return nil, errInvalidPoll
+		}
+		seen[key] = true
+		cleaned = append(cleaned, opt)
+	}
+	return cleaned, nil
+}
+
+// createPollMessage saves a poll as a message of kind "poll" whose text is the question
+func createPollMessage(roomID, senderID int, sender, question string, options []string) (*Message, error) {
+	question = sanitizeLine(question)
+	if question == "" {
+		return nil, errInvalidPoll
+	}
+	if err := validateMessageContent(question, nil, ""); err != nil {
+		return nil, err
+	}
+	options, err := validatePollOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if !hasRoomPermission(roomID, roomRole(roomID, senderID), PermSendMessages) {
+		return nil, errRoomReadonly
+	}
+	if err := checkNotArchived(roomID); err != nil {
+		return nil, err
+	}
+	if err := checkNotMuted(roomID, senderID); err != nil {
+		return nil, err
+	}
+	if err := checkSlowMode(roomID, senderID); err != nil {
+		return nil, err
+	}
+	question, _, err = moderateContent(roomID, question)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var savedMsg Message
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO messages (room_id, sender_id, content, kind, shadowbanned)
+		VALUES ($1, $2, $3, 'poll', (SELECT is_shadowbanned FROM users WHERE id = $2))
+		RETURNING id, room_id, sender_id, content, kind, created_at, shadowbanned`,
+		roomID, senderID, question,
+	).Scan(&savedMsg.ID, &savedMsg.RoomID, &savedMsg.SenderID, &savedMsg.Text, &savedMsg.Kind, &savedMsg.Timestamp, &savedMsg.shadowbanned)
+	if err != nil {
+		return nil, err
+	}
+
+	poll := &Poll{Question: question, Options: []PollOption{}}
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO polls (message_id, room_id, question, created_by) VALUES ($1, $2, $3, $4) RETURNING id",
+		savedMsg.ID, roomID, question, senderID,
+	).Scan(&poll.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, text := range options {
+		opt := PollOption{Text: text}
+		err = tx.QueryRowContext(ctx,
+			"INSERT INTO poll_options (poll_id, position, text) VALUES ($1, $2, $3) RETURNING id",
+			poll.ID, i, text,
+		).Scan(&opt.ID)
+		if err != nil {
+			return nil, err
+		}
+		poll.Options = append(poll.Options, opt)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	slowMode.record(roomID, senderID, time.Now())
+
+	savedMsg.Sender = sender
+	savedMsg.Avatar = avatarInitial(sender)
+	savedMsg.Poll = poll
+	return &savedMsg, nil
+}
+
+// loadPolls fetches polls with tallies, keyed by message ID
+func loadPolls(messageIDs []int64) (map[int]*Poll, error) {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.message_id, p.id, p.question, o.id, o.text,
+			(SELECT COUNT(*) FROM poll_votes v WHERE v.option_id = o.id)
+		FROM polls p
+		JOIN poll_options o ON o.poll_id = p.id
+		WHERE p.message_id = ANY($1)
+		ORDER BY p.id, o.position
+	`, pq.Array(messageIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	polls := make(map[int]*Poll)
+	for rows.Next() {
+		var msgID int
+		var p Poll
+		var opt PollOption
+		if err := rows.Scan(&msgID, &p.ID, &p.Question, &opt.ID, &opt.Text, &opt.Votes); err != nil {
+			return nil, err
+		}
+		existing, ok := polls[msgID]
+		if !ok {
+			p.Options = []PollOption{}
+			existing = &p
+			polls[msgID] = existing
+		}
+		existing.Options = append(existing.Options, opt)
+		existing.TotalVotes += opt.Votes
+	}
+	return polls, rows.Err()
+}
+
+// attachPolls fills in the poll for every poll message in a page of history
+func attachPolls(messages []Message) {
+	var ids []int64
+	for _, m := range messages {
+		if m.Kind == "poll" && !m.Deleted {
+			ids = append(ids, int64(m.ID))
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	polls, err := loadPolls(ids)
+	if err != nil {
+		slog.Error("Failed to load polls", "error", err)
+		return
+	}
+	for i := range messages {
+		if p, ok := polls[messages[i].ID]; ok && !messages[i].Deleted {
+			messages[i].Poll = p
+		}
+	}
+}
+
+// Create a poll in a room over REST
+func handleCreatePoll(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Question string   `json:"question"`
+		Options  []string `json:"options"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	if !isUserInRoom(userID, roomID) {
+		http.Error(w, "Not authorized", http.StatusForbidden)
+		return
+	}
+
+	savedMsg, err := createPollMessage(roomID, userID, username, req.Question, req.Options)
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		http.Error(w, verr.Message, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create poll", "error", err)
+		http.Error(w, "Failed to create poll", http.StatusInternalServerError)
+		return
+	}
+
+	roomManager.BroadcastToRoom(roomID, &WSMessage{
+		Type:    "roomMessage",
+		RoomID:  roomID,
+		Message: savedMsg,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(savedMsg)
+}
+
+// Vote on a poll; voting again moves the user's single vote to the new option
+func handleVotePoll(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pollID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid poll ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		OptionID int `json:"option_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var roomID, messageID int
+	var deleted bool
+	err = db.QueryRowContext(ctx, `
+		SELECT p.room_id, p.message_id, m.deleted_at IS NOT NULL
+		FROM polls p
+		JOIN messages m ON m.id = p.message_id
+		WHERE p.id = $1
+	`, pollID).Scan(&roomID, &messageID, &deleted)
+	if err == sql.ErrNoRows || deleted {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "DB error fetching poll", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !isUserInRoom(userID, roomID) {
+		http.Error(w, "Not authorized", http.StatusForbidden)
+		return
+	}
+
+	var validOption bool
+	err = db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM poll_options WHERE id = $1 AND poll_id = $2)", req.OptionID, pollID).Scan(&validOption)
+	if err != nil || !validOption {
+		http.Error(w, "Invalid option", http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO poll_votes (poll_id, option_id, user_id) VALUES ($1, $2, $3)
+		ON CONFLICT (poll_id, user_id) DO UPDATE SET option_id = EXCLUDED.option_id, voted_at = CURRENT_TIMESTAMP
+	`, pollID, req.OptionID, userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to record vote", "error", err)
+		http.Error(w, "Failed to record vote", http.StatusInternalServerError)
+		return
+	}
+
+	polls, err := loadPolls([]int64{int64(messageID)})
+	if err != nil || polls[messageID] == nil {
+		slog.ErrorContext(r.Context(), "Failed to load poll tallies", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	poll := polls[messageID]
+
+	roomManager.BroadcastToRoom(roomID, &WSMessage{
+		Type:   "pollUpdated",
+		RoomID: roomID,
+		Message: &Message{
+			ID:     messageID,
+			RoomID: roomID,
+			Kind:   "poll",
+			Poll:   poll,
+		},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(poll)
+}
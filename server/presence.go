@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"unicode/utf8"
+)
+
+// PresenceEvent is the payload of "userOnline", "userOffline" and "userStatusChanged"
+type PresenceEvent struct {
+	UserID   int         `json:"user_id"`
+	Username string      `json:"username"`
+	Online   bool        `json:"online"`
+	Status   *UserStatus `json:"status,omitempty"` // For "userStatusChanged"
+}
+
+// Presence states a user can choose; connection state is reported separately as online
+const (
+	StatusAvailable = "available"
+	StatusBusy      = "busy"
+	StatusAway      = "away"
+)
+
+const (
+	maxStatusEmojiLength = 16
+	maxStatusTextLength  = 100
+)
+
+// UserStatus is the presence state and custom status message a user sets for themselves
+type UserStatus struct {
+	State string `json:"state"`
+	Emoji string `json:"emoji,omitempty"`
+	Text  string `json:"text,omitempty"`
+}
+
+func isValidStatusState(state string) bool {
+	return state == StatusAvailable || state == StatusBusy || state == StatusAway
+}
+
+// IsOnline reports whether the user has at least one open WebSocket connection
+func (m *RoomManager) IsOnline(userID int) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.Users[userID]) > 0
+}
+
+// OnlineUsers returns the users with at least one open WebSocket connection to this instance
+func (m *RoomManager) OnlineUsers() []int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	users := make([]int, 0, len(m.Users))
+	for userID := range m.Users {
+		users = append(users, userID)
+	}
+	return users
+}
+
+// recordLastSeen stores when the user's last connection closed, for notifications that wait
+// until a user has been away for a while
+func recordLastSeen(userID int) {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "UPDATE users SET last_seen_at = CURRENT_TIMESTAMP WHERE id = $1", userID); err != nil {
+		slog.Error("Failed to record last seen", "user_id", userID, "error", err)
+	}
+}
+
+// SendToUser delivers an event to every open connection of a user, whichever rooms they joined
+func (m *RoomManager) SendToUser(userID int, msg *WSMessage) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for client := range m.Users[userID] {
+		client.enqueue(msg)
+	}
+}
+
+// broadcastPresence notifies every active room the user belongs to that they came online or went offline
+func (m *RoomManager) broadcastPresence(client *Client, online bool) {
+	eventType := "userOffline"
+	if online {
+		eventType = "userOnline"
+	}
+	m.broadcastPresenceEvent(eventType, &PresenceEvent{
+		UserID:   client.ID,
+		Username: client.Username,
+		Online:   online,
+	})
+}
+
+// broadcastPresenceEvent sends a presence event to every active room the user belongs to
+func (m *RoomManager) broadcastPresenceEvent(eventType string, presence *PresenceEvent) {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT room_id FROM room_members WHERE user_id = $1", presence.UserID)
+	if err != nil {
+		slog.Error("Failed to load rooms for presence", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var roomID int
+		if err := rows.Scan(&roomID); err != nil {
+			slog.Error("Error scanning room for presence", "error", err)
+			continue
+		}
+
+		// Rooms without a running hub have nobody listening
+		m.mu.RLock()
+		hub, ok := m.Rooms[roomID]
+		m.mu.RUnlock()
+		if !ok {
+			continue
+		}
+
+		event := &WSMessage{
+			Type:     eventType,
+			RoomID:   roomID,
+			Presence: presence,
+		}
+		select {
+		case hub.Broadcast <- event:
+		case <-hub.done:
+		}
+	}
+}
+
+// Update the current user's status. Fields left out keep their value; an empty emoji or text
+// clears it. The change is broadcast to every room the user is in.
+func handleUpdateStatus(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		State *string `json:"state"`
+		Emoji *string `json:"emoji"`
+		Text  *string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.State != nil && !isValidStatusState(*req.State) {
+		http.Error(w, "State must be available, busy or away", http.StatusBadRequest)
+		return
+	}
+	if req.Emoji != nil {
+		*req.Emoji = sanitizeLine(*req.Emoji)
+		if utf8.RuneCountInString(*req.Emoji) > maxStatusEmojiLength {
+			http.Error(w, "Emoji is too long", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Text != nil {
+		*req.Text = sanitizeLine(*req.Text)
+		if !utf8.ValidString(*req.Text) || utf8.RuneCountInString(*req.Text) > maxStatusTextLength {
+			http.Error(w, fmt.Sprintf("Status text must be at most %d characters", maxStatusTextLength), http.StatusBadRequest)
+			return
+		}
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var status UserStatus
+	err := db.QueryRowContext(ctx, `
+		UPDATE users SET
+			status = COALESCE($2, status),
+			status_emoji = COALESCE($3, status_emoji),
+			status_text = COALESCE($4, status_text)
+		WHERE id = $1
+		RETURNING status, status_emoji, status_text
+	`, userID, req.State, req.Emoji, req.Text).Scan(&status.State, &status.Emoji, &status.Text)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update status", "error", err)
+		http.Error(w, "Failed to update status", http.StatusInternalServerError)
+		return
+	}
+
+	go roomManager.broadcastPresenceEvent("userStatusChanged", &PresenceEvent{
+		UserID:   userID,
+		Username: username,
+		Online:   roomManager.IsOnline(userID),
+		Status:   &status,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
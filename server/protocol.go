@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+)
+
+// ProtocolVersion is the WebSocket envelope version this server speaks. Clients that never send
+// "hello" are treated as version 1 with every feature the server had at that time.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
+
+// Optional protocol features a client can opt into with "hello"
+const (
+	FeatureReactions   = "reactions"
+	FeaturePresence    = "presence"
+	FeatureReceipts    = "receipts"
+	FeaturePolls       = "polls"
+	FeatureResume      = "resume"
+	FeatureCompression = "compression" // permessage-deflate, if the upgrade negotiated it
+)
+
+var serverFeatures = []string{FeatureReactions, FeaturePresence, FeatureReceipts, FeaturePolls, FeatureResume, FeatureCompression}
+
+// supports reports whether the connection negotiated a feature. Legacy clients that skipped the
+// handshake keep getting everything except opt-in transport features.
+func (c *Client) supports(feature string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.Features == nil {
+		return feature != FeatureCompression
+	}
+	return c.Features[feature]
+}
+
+// hello negotiates the protocol version and the features both sides support, then replies
+// with the result
+func (c *Client) hello(req *WSMessage) {
+	if req.Version < MinProtocolVersion {
+		c.sendError(req, CodeUnsupportedVersion, fmt.Sprintf("Protocol version must be at least %d", MinProtocolVersion))
+		return
+	}
+
+	version := req.Version
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+
+	requested := make(map[string]bool, len(req.Features))
+	for _, f := range req.Features {
+		requested[f] = true
+	}
+
+	features := make(map[string]bool)
+	agreed := []string{}
+	for _, f := range serverFeatures {
+		if requested[f] {
+			features[f] = true
+			agreed = append(agreed, f)
+		}
+	}
+
+	// writePump reads the features before every write to decide on compression
+	c.mu.Lock()
+	c.Protocol = version
+	c.Features = features
+	c.mu.Unlock()
+
+	c.logger().Debug("Negotiated protocol", "version", version, "features", agreed)
+	c.Send <- &WSMessage{Type: "hello", ClientMsgID: req.ClientMsgID, Version: version, Features: agreed}
+}
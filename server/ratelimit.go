@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimits are the limits in force. They start from the environment, and site admins can
+// change them at PUT /api/admin/rate-limits without a restart; every instance picks up the
+// change within rateLimitReloadInterval.
+type RateLimits struct {
+	WSMessageRate     int `json:"ws_message_rate"`           // Messages per second a connection may send on average
+	WSMessageBurst    int `json:"ws_message_burst"`          // Messages a connection may send back to back
+	WSFloodDisconnect int `json:"ws_flood_disconnect_after"` // Rate-limited messages in a row that close the connection
+	HTTPPerUser       int `json:"http_per_user"`             // API requests per minute per user; 0 is unlimited
+	HTTPPerIP         int `json:"http_per_ip"`               // Requests per minute per client IP; 0 is unlimited
+	WSConnsPerUser    int `json:"ws_connections_per_user"`   // Open WebSocket connections per user on an instance; 0 is unlimited
+	WSConnsPerIP      int `json:"ws_connections_per_ip"`     // Open WebSocket connections per client IP on an instance; 0 is unlimited
+}
+
+const rateLimitReloadInterval = 30 * time.Second
+
+// defaultRateLimits reads WS_MESSAGE_RATE, WS_MESSAGE_BURST, WS_FLOOD_DISCONNECT_AFTER,
+// HTTP_RATE_PER_USER, HTTP_RATE_PER_IP, WS_MAX_CONNECTIONS_PER_USER and WS_MAX_CONNECTIONS_PER_IP
+func defaultRateLimits() RateLimits {
+	return RateLimits{
+		WSMessageRate:     envInt("WS_MESSAGE_RATE", 5),
+		WSMessageBurst:    envInt("WS_MESSAGE_BURST", 10),
+		WSFloodDisconnect: envInt("WS_FLOOD_DISCONNECT_AFTER", 20),
+		HTTPPerUser:       envInt("HTTP_RATE_PER_USER", 0),
+		HTTPPerIP:         envInt("HTTP_RATE_PER_IP", 0),
+		WSConnsPerUser:    envInt("WS_MAX_CONNECTIONS_PER_USER", 20),
+		WSConnsPerIP:      envInt("WS_MAX_CONNECTIONS_PER_IP", 100),
+	}
+}
+
+func (l RateLimits) validate() error {
+	if l.WSMessageRate < 1 || l.WSMessageBurst < 1 || l.WSFloodDisconnect < 1 {
+		return fmt.Errorf("ws_message_rate, ws_message_burst and ws_flood_disconnect_after must be at least 1")
+	}
+	if l.HTTPPerUser < 0 || l.HTTPPerIP < 0 || l.WSConnsPerUser < 0 || l.WSConnsPerIP < 0 {
+		return fmt.Errorf("http_per_user, http_per_ip, ws_connections_per_user and ws_connections_per_ip must not be negative")
+	}
+	return nil
+}
+
+var rateLimits atomic.Pointer[RateLimits]
+
+func currentRateLimits() RateLimits {
+	if l := rateLimits.Load(); l != nil {
+		return *l
+	}
+	return defaultRateLimits()
+}
+
+// loadRateLimits applies the admins' saved limits, or the environment's if none are saved
+func loadRateLimits(ctx context.Context) error {
+	limits := defaultRateLimits()
+	var saved []byte
+	err := db.QueryRowContext(ctx, "SELECT value FROM server_settings WHERE key = 'rate_limits'").Scan(&saved)
+	if err == nil {
+		// Saved limits override the environment field by field
+		err = json.Unmarshal(saved, &limits)
+	} else if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	rateLimits.Store(&limits)
+	return nil
+}
+
+// watchRateLimits reloads the limits periodically so changes made through another instance apply
+// here too, and drops the HTTP buckets of clients that have gone quiet
+func watchRateLimits() {
+	ticker := time.NewTicker(rateLimitReloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := dbContext(context.Background())
+		if err := loadRateLimits(ctx); err != nil {
+			slog.Error("Failed to reload rate limits", "error", err)
+		}
+		cancel()
+		userLimiter.prune()
+		ipLimiter.prune()
+	}
+}
+
+// wsMessageRate is how many messages per second a connection may send on average
+func wsMessageRate() int {
+	return currentRateLimits().WSMessageRate
+}
+
+// wsMessageBurst is how many messages a connection may send back to back before being limited
+func wsMessageBurst() int {
+	return currentRateLimits().WSMessageBurst
+}
+
+// wsFloodLimit is how many rate-limited messages in a row close the connection
+func wsFloodLimit() int {
+	return currentRateLimits().WSFloodDisconnect
+}
+
+// tokenBucket limits one connection's sends. It is only used from the connection's readPump,
+// so it needs no locking.
+type tokenBucket struct {
+	rate     float64 // Tokens added per second
+	burst    float64
+	tokens   float64
+	last     time.Time
+	rejected int // Consecutive rejections, reset by an allowed message
+}
+
+func newTokenBucket(rate, burst int) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// setRate applies changed limits to an existing bucket, keeping the tokens it has
+func (b *tokenBucket) setRate(rate, burst float64) {
+	b.rate, b.burst = rate, burst
+	b.tokens = math.Min(b.tokens, burst)
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		b.rejected++
+		return false
+	}
+	b.tokens--
+	b.rejected = 0
+	return true
+}
+
+// rateLimitError reports when the next token will be available
+func (b *tokenBucket) rateLimitError() *ValidationError {
+	wait := int(math.Ceil((1 - b.tokens) / b.rate))
+	return &ValidationError{
+		Code:       CodeRateLimited,
+		Message:    fmt.Sprintf("You are sending messages too fast. Try again in %d seconds", wait),
+		Limit:      int(b.rate),
+		RetryAfter: wait,
+	}
+}
+
+// --- WebSocket connections ---
+
+// wsConnections counts this instance's open WebSocket connections, so one client can't exhaust
+// its file descriptors
+var wsConnections = struct {
+	mu     sync.Mutex
+	byUser map[int]int
+	byIP   map[string]int
+}{byUser: make(map[int]int), byIP: make(map[string]int)}
+
+// acquireWSConnection takes a connection slot for the user and IP. It returns the function that
+// frees it once the connection closes, or the reason there is no slot left.
+func acquireWSConnection(userID int, ip string) (release func(), reason string) {
+	limits := currentRateLimits()
+
+	wsConnections.mu.Lock()
+	defer wsConnections.mu.Unlock()
+	if limits.WSConnsPerUser > 0 && wsConnections.byUser[userID] >= limits.WSConnsPerUser {
+		return nil, "Too many connections for this account"
+	}
+	if limits.WSConnsPerIP > 0 && wsConnections.byIP[ip] >= limits.WSConnsPerIP {
+		return nil, "Too many connections from this address"
+	}
+	wsConnections.byUser[userID]++
+	wsConnections.byIP[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			wsConnections.mu.Lock()
+			defer wsConnections.mu.Unlock()
+			if wsConnections.byUser[userID]--; wsConnections.byUser[userID] <= 0 {
+				delete(wsConnections.byUser, userID)
+			}
+			if wsConnections.byIP[ip]--; wsConnections.byIP[ip] <= 0 {
+				delete(wsConnections.byIP, ip)
+			}
+		})
+	}, ""
+}
+
+// --- HTTP ---
+
+// httpLimiter keeps a token bucket per client. A limit of N requests per minute lets a client make
+// N requests at once, then refills at N per minute.
+type httpLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+var (
+	userLimiter = &httpLimiter{buckets: make(map[string]*tokenBucket)}
+	ipLimiter   = &httpLimiter{buckets: make(map[string]*tokenBucket)}
+)
+
+// allow takes a request from the key's bucket, returning how many seconds to wait if there is none
+func (l *httpLimiter) allow(key string, perMinute int) (bool, int) {
+	now := time.Now()
+	rate, burst := float64(perMinute)/60, float64(perMinute)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.setRate(rate, burst)
+	if b.allow(now) {
+		return true, 0
+	}
+	return false, int(math.Ceil((1 - b.tokens) / b.rate))
+}
+
+// prune drops buckets that have refilled, since they behave like new ones
+func (l *httpLimiter) prune() {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitExempt reports requests that are never limited: health probes, and the admin API so
+// admins can't lock themselves out while tightening limits
+func rateLimitExempt(r *http.Request) bool {
+	return r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || strings.HasPrefix(r.URL.Path, "/api/admin/")
+}
+
+func writeRateLimited(w http.ResponseWriter, retryAfter int) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// clientIP is the request's remote address or, when TRUST_PROXY_HEADERS=true because the server
+// sits behind proxies that append to X-Forwarded-For, the address the outermost of them saw.
+// TRUSTED_PROXY_HOPS (1) is how many proxies there are: the client is that many entries from the
+// right, as anything further left came from the client and can be forged.
+func clientIP(r *http.Request) string {
+	if getEnv("TRUST_PROXY_HEADERS", "false") == "true" {
+		var hops []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for hop := range strings.SplitSeq(header, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+		if len(hops) > 0 {
+			return hops[max(len(hops)-envInt("TRUSTED_PROXY_HOPS", 1), 0)]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitByIP applies HTTP_RATE_PER_IP to every request
+func limitByIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if perMinute := currentRateLimits().HTTPPerIP; perMinute > 0 && !rateLimitExempt(r) {
+			if ok, retryAfter := ipLimiter.allow(clientIP(r), perMinute); !ok {
+				writeRateLimited(w, retryAfter)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitByUser applies HTTP_RATE_PER_USER to authenticated requests; it runs after authMiddleware
+func limitByUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if perMinute := currentRateLimits().HTTPPerUser; perMinute > 0 && !rateLimitExempt(r) {
+			userID := int(r.Context().Value("user_id").(float64))
+			if ok, retryAfter := userLimiter.allow(strconv.Itoa(userID), perMinute); !ok {
+				writeRateLimited(w, retryAfter)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Get the rate limits in force (site admins)
+func handleAdminGetRateLimits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentRateLimits())
+}
+
+// Change the rate limits (site admins); omitted fields are kept. They apply to open WebSocket
+// connections too, from their next message.
+func handleAdminUpdateRateLimits(w http.ResponseWriter, r *http.Request) {
+	limits := currentRateLimits()
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := limits.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	value, _ := json.Marshal(limits)
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO server_settings (key, value) VALUES ('rate_limits', $1)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_at = CURRENT_TIMESTAMP
+	`, value)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save rate limits", "error", err)
+		http.Error(w, "Failed to save rate limits", http.StatusInternalServerError)
+		return
+	}
+	rateLimits.Store(&limits)
+	slog.InfoContext(r.Context(), "Rate limits changed", "limits", string(value))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limits)
+}
+
+// Go back to the limits from the environment (site admins)
+func handleAdminResetRateLimits(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, "DELETE FROM server_settings WHERE key = 'rate_limits'"); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to reset rate limits", "error", err)
+		http.Error(w, "Failed to reset rate limits", http.StatusInternalServerError)
+		return
+	}
+	limits := defaultRateLimits()
+	rateLimits.Store(&limits)
+	slog.InfoContext(r.Context(), "Rate limits reset")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limits)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const maxReactionLength = 32
+
+// ReactionSummary is the aggregated count for one emoji on a message
+type ReactionSummary struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	UserIDs []int  `json:"user_ids"`
+}
+
+// ReactionEvent is the payload of "reactionAdded" and "reactionRemoved"
+type ReactionEvent struct {
+	MessageID int    `json:"message_id"`
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	Emoji     string `json:"emoji"`
+	Count     int    `json:"count"` // Count for this emoji after the change
+}
+
+// attachReactions loads aggregated reactions for a page of messages in one query
+func attachReactions(messages []Message) {
+	if len(messages) == 0 {
+		return
+	}
+
+	ids := make([]int64, len(messages))
+	index := make(map[int]int, len(messages))
+	for i, m := range messages {
+		ids[i] = int64(m.ID)
+		index[m.ID] = i
+	}
+
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT message_id, emoji, COUNT(*), array_agg(user_id ORDER BY created_at)
+		FROM message_reactions
+		WHERE message_id = ANY($1)
+		GROUP BY message_id, emoji
+		ORDER BY message_id, MIN(created_at)
+	`, pq.Array(ids))
+	if err != nil {
+		slog.Error("Failed to load reactions", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msgID int
+		var rs ReactionSummary
+		var userIDs []int64
+		if err := rows.Scan(&msgID, &rs.Emoji, &rs.Count, pq.Array(&userIDs)); err != nil {
+			slog.Error("Error scanning reaction", "error", err)
+			continue
+		}
+		for _, id := range userIDs {
+			rs.UserIDs = append(rs.UserIDs, int(id))
+		}
+		if i, ok := index[msgID]; ok && !messages[i].Deleted {
+			messages[i].Reactions = append(messages[i].Reactions, rs)
+		}
+	}
+}
+
+// parseReactionRequest validates the room/message path and the emoji for both reaction handlers
+func parseReactionRequest(w http.ResponseWriter, r *http.Request) (roomID, msgID int, emoji string, ok bool) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	msgID, err = strconv.Atoi(vars["msgId"])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	// DELETE clients may pass the emoji as a query parameter instead of a body
+	emoji = r.URL.Query().Get("emoji")
+	if emoji == "" {
+		var req struct {
+			Emoji string `json:"emoji"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		emoji = req.Emoji
+	}
+
+	emoji = sanitizeLine(emoji)
+	if emoji == "" || len(emoji) > maxReactionLength || !utf8.ValidString(emoji) {
+		http.Error(w, "Invalid emoji", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	if !isUserInRoom(userID, roomID) {
+		http.Error(w, "Not authorized", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var deleted bool
+	err = db.QueryRowContext(ctx, "SELECT deleted_at IS NOT NULL FROM messages WHERE id = $1 AND room_id = $2", msgID, roomID).Scan(&deleted)
+	if err == sql.ErrNoRows || deleted {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "DB error fetching message", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	return roomID, msgID, emoji, true
+}
+
+func broadcastReaction(eventType string, roomID, msgID, userID int, username, emoji string) {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	var count int
+	if err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM message_reactions WHERE message_id = $1 AND emoji = $2",
+		msgID, emoji,
+	).Scan(&count); err != nil {
+		slog.Error("Failed to count reactions", "error", err)
+		return
+	}
+
+	roomManager.BroadcastToRoom(roomID, &WSMessage{
+		Type:   eventType,
+		RoomID: roomID,
+		Reaction: &ReactionEvent{
+			MessageID: msgID,
+			UserID:    userID,
+			Username:  username,
+			Emoji:     emoji,
+			Count:     count,
+		},
+	})
+}
+
+// Add an emoji reaction to a message
+func handleAddReaction(w http.ResponseWriter, r *http.Request) {
+	roomID, msgID, emoji, ok := parseReactionRequest(w, r)
+	if !ok {
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	result, err := db.ExecContext(ctx,
+		"INSERT INTO message_reactions (message_id, user_id, emoji) VALUES ($1, $2, $3) ON CONFLICT (message_id, user_id, emoji) DO NOTHING",
+		msgID, userID, emoji,
+	)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to add reaction", "error", err)
+		http.Error(w, "Failed to add reaction", http.StatusInternalServerError)
+		return
+	}
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+		broadcastReaction("reactionAdded", roomID, msgID, userID, username, emoji)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// Remove the current user's emoji reaction from a message
+func handleRemoveReaction(w http.ResponseWriter, r *http.Request) {
+	roomID, msgID, emoji, ok := parseReactionRequest(w, r)
+	if !ok {
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	result, err := db.ExecContext(ctx,
+		"DELETE FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3",
+		msgID, userID, emoji,
+	)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to remove reaction", "error", err)
+		http.Error(w, "Failed to remove reaction", http.StatusInternalServerError)
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		http.Error(w, "Reaction not found", http.StatusNotFound)
+		return
+	}
+
+	broadcastReaction("reactionRemoved", roomID, msgID, userID, username, emoji)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
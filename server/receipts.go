@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ReadReceipt is the payload of "messagesRead": the reader has seen everything up to LastReadMessageID
+type ReadReceipt struct {
+	UserID            int    `json:"user_id"`
+	Username          string `json:"username"`
+	LastReadMessageID int    `json:"last_read_message_id"`
+}
+
+// MessageRead is a member who has read a message, for GET .../reads
+type MessageRead struct {
+	UserID   int       `json:"user_id"`
+	Username string    `json:"username"`
+	ReadAt   time.Time `json:"read_at"`
+}
+
+// Get the members who have read a specific message
+func (h *coreHandlers) handleGetMessageReads(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	msgID, err := strconv.Atoi(vars["msgId"])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if !isMemberIn(h.store, userID, roomID) {
+		http.Error(w, "Not authorized", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	reads, err := h.store.MessageReads(ctx, roomID, msgID, userID)
+	if err == errNotFound {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get message reads", "error", err)
+		http.Error(w, "Failed to get message reads", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reads)
+}
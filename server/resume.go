@@ -0,0 +1,54 @@
+package main
+
+import "context"
+
+// Most messages one resume replays across all its rooms, kept well below the client's 256-frame
+// send buffer; clients reload history for rooms where has_more is set
+const maxResumeMessages = 100
+
+// resume subscribes the client to each room in req.LastSeen and replays messages newer than the
+// last one it saw. The client is registered with the hub before the history query, so nothing is
+// lost between the two; a message may arrive both live and in the replay, and clients dedupe by ID.
+// Frames are queued like broadcasts so a large replay is subject to the slow-client policy rather
+// than blocking readPump.
+func (c *Client) resume(req *WSMessage) {
+	budget := maxResumeMessages
+	for roomID, lastSeenID := range req.LastSeen {
+		if !isUserInRoom(c.ID, roomID) {
+			c.sendError(&WSMessage{RoomID: roomID, ClientMsgID: req.ClientMsgID}, CodeNotAuthorized, "Not authorized for this room")
+			continue
+		}
+
+		c.Manager.SubscribeToRoom(roomID, c)
+
+		ctx, cancel := dbContext(context.Background())
+		rows, err := db.QueryContext(ctx,
+			messageSelect+`
+			WHERE m.room_id = $1 AND m.id > $2 AND (NOT m.shadowbanned OR m.sender_id = $4)
+			ORDER BY m.id ASC
+			LIMIT $3`,
+			roomID, lastSeenID, budget+1, c.ID,
+		)
+		if err != nil {
+			cancel()
+			c.logger().Error("Failed to load missed messages", "room_id", roomID, "error", err)
+			c.sendError(&WSMessage{RoomID: roomID, ClientMsgID: req.ClientMsgID}, CodeInternal, "Failed to replay missed messages")
+			continue
+		}
+		missed := scanMessages(rows)
+		rows.Close()
+		cancel()
+
+		hasMore := len(missed) > budget
+		if hasMore {
+			missed = missed[:budget]
+		}
+		budget -= len(missed)
+		for i := range missed {
+			c.enqueue(&WSMessage{Type: "roomMessage", RoomID: roomID, Message: &missed[i]})
+		}
+		c.enqueue(&WSMessage{Type: "resumed", RoomID: roomID, ClientMsgID: req.ClientMsgID, HasMore: hasMore})
+
+		c.logger().Debug("Client resumed room", "room_id", roomID, "replayed", len(missed))
+	}
+}
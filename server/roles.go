@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Room member roles, from most to least privileged
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+// Actions on a room that are limited to some roles
+const (
+	PermSendMessages   = "send_messages"
+	PermDeleteMessages = "delete_messages" // Delete other members' messages
+	PermInvite         = "invite"
+	PermKick           = "kick"
+	PermManageRoom     = "manage_room" // Avatar and other room settings
+	PermMuteMembers    = "mute_members"
+	PermSlowMode       = "slow_mode"
+	PermBanMembers     = "ban_members"
+	PermApproveJoins   = "approve_joins"
+	PermManageRoles    = "manage_roles"
+	PermDeleteRoom     = "delete_room"
+)
+
+// defaultRolePermissions is the matrix used unless a room overrides it
+var defaultRolePermissions = map[string]map[string]bool{
+	RoleAdmin: {
+		PermSendMessages:   true,
+		PermDeleteMessages: true,
+		PermInvite:         true,
+		PermKick:           true,
+		PermManageRoom:     true,
+		PermMuteMembers:    true,
+		PermSlowMode:       true,
+		PermBanMembers:     true,
+		PermApproveJoins:   true,
+		PermManageRoles:    true,
+		PermDeleteRoom:     true,
+	},
+	RoleModerator: {
+		PermSendMessages:   true,
+		PermDeleteMessages: true,
+		PermInvite:         true,
+		PermKick:           true,
+		PermMuteMembers:    true,
+		PermSlowMode:       true,
+	},
+	RoleMember: {
+		PermSendMessages: true,
+		PermInvite:       true,
+	},
+}
+
+// configurablePermissions can be overridden per room for moderators and members.
+// Admin permissions are fixed so a room can't lock its admins out.
+var configurablePermissions = []string{
+	PermSendMessages, PermDeleteMessages, PermInvite, PermKick, PermManageRoom, PermMuteMembers, PermSlowMode,
+}
+
+var roleRanks = map[string]int{RoleAdmin: 3, RoleModerator: 2, RoleMember: 1}
+
+func isValidRole(role string) bool {
+	return roleRanks[role] > 0
+}
+
+func isConfigurablePermission(perm string) bool {
+	for _, p := range configurablePermissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// permissionOverrides caches each room's overrides of the default matrix, keyed by role then permission
+type permissionOverrides struct {
+	mu    sync.RWMutex
+	rooms map[int]map[string]map[string]bool
+}
+
+var roomPermissions = &permissionOverrides{rooms: make(map[int]map[string]map[string]bool)}
+
+func (p *permissionOverrides) load(roomID int) (map[string]map[string]bool, error) {
+	p.mu.RLock()
+	overrides, ok := p.rooms[roomID]
+	p.mu.RUnlock()
+	if ok {
+		return overrides, nil
+	}
+
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT role, permission, allowed FROM room_role_permissions WHERE room_id = $1", roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overrides = make(map[string]map[string]bool)
+	for rows.Next() {
+		var role, perm string
+		var allowed bool
+		if err := rows.Scan(&role, &perm, &allowed); err != nil {
+			return nil, err
+		}
+		if overrides[role] == nil {
+			overrides[role] = make(map[string]bool)
+		}
+		overrides[role][perm] = allowed
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.rooms[roomID] = overrides
+	p.mu.Unlock()
+	return overrides, nil
+}
+
+func (p *permissionOverrides) invalidate(roomID int) {
+	p.mu.Lock()
+	delete(p.rooms, roomID)
+	p.mu.Unlock()
+}
+
+// hasRoomPermission evaluates perm for a role in a room, applying the room's overrides
+func hasRoomPermission(roomID int, role, perm string) bool {
+	if role != RoleAdmin && isConfigurablePermission(perm) {
+		overrides, err := roomPermissions.load(roomID)
+		if err != nil {
+			slog.Error("Failed to load room permissions", "room_id", roomID, "error", err)
+		} else if allowed, ok := overrides[role][perm]; ok {
+			return allowed
+		}
+	}
+	return defaultRolePermissions[role][perm]
+}
+
+// outranks reports whether a member with role can act on a member with target's role.
+// Admins can act on anyone; moderators only on plain members.
+func outranks(role, target string) bool {
+	return role == RoleAdmin || roleRanks[role] > roleRanks[target]
+}
+
+// roomRole returns the user's role in the room, or "" if they are not a member
+func roomRole(roomID, userID int) string {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	role, err := store.MemberRole(ctx, roomID, userID)
+	if err != nil {
+		slog.Error("Error checking room role", "room_id", roomID, "error", err)
+	}
+	return role
+}
+
+// requireRoomPermission writes a 403 with message and returns false unless the user's role grants perm
+func requireRoomPermission(w http.ResponseWriter, roomID, userID int, perm, message string) (string, bool) {
+	role := roomRole(roomID, userID)
+	if !hasRoomPermission(roomID, role, perm) {
+		http.Error(w, message, http.StatusForbidden)
+		return role, false
+	}
+	return role, true
+}
+
+// effectivePermissions is the matrix a room currently uses, for every role
+func effectivePermissions(roomID int) map[string]map[string]bool {
+	matrix := make(map[string]map[string]bool)
+	for _, role := range []string{RoleAdmin, RoleModerator, RoleMember} {
+		matrix[role] = make(map[string]bool)
+		for perm := range defaultRolePermissions[RoleAdmin] {
+			matrix[role][perm] = hasRoomPermission(roomID, role, perm)
+		}
+	}
+	return matrix
+}
+
+// Get the room's permission matrix (members only)
+func handleGetRoomPermissions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if !isUserInRoom(userID, roomID) {
+		http.Error(w, "Not authorized", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(effectivePermissions(roomID))
+}
+
+// Override permissions for moderators and members, e.g. {"member": {"invite": false}} (admin only)
+func handleUpdateRoomPermissions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	var req map[string]map[string]bool
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	for role, perms := range req {
+		if role != RoleModerator && role != RoleMember {
+			http.Error(w, "Only moderator and member permissions can be changed", http.StatusBadRequest)
+			return
+		}
+		for perm := range perms {
+			if !isConfigurablePermission(perm) {
+				http.Error(w, "Unknown or fixed permission: "+perm, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermManageRoles, "Only admins can change room permissions"); !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for role, perms := range req {
+		for perm, allowed := range perms {
+			// Setting a permission back to its default removes the override
+			if allowed == defaultRolePermissions[role][perm] {
+				_, err = tx.ExecContext(ctx, "DELETE FROM room_role_permissions WHERE room_id = $1 AND role = $2 AND permission = $3", roomID, role, perm)
+			} else {
+				_, err = tx.ExecContext(ctx, `
+					INSERT INTO room_role_permissions (room_id, role, permission, allowed) VALUES ($1, $2, $3, $4)
+					ON CONFLICT (room_id, role, permission) DO UPDATE SET allowed = EXCLUDED.allowed
+				`, roomID, role, perm, allowed)
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Failed to update room permissions", "error", err)
+				http.Error(w, "Failed to update permissions", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Server error during commit", http.StatusInternalServerError)
+		return
+	}
+	roomPermissions.invalidate(roomID)
+
+	slog.InfoContext(r.Context(), "Room permissions updated")
+	notifyWebhooks(roomID, WebhookRoomUpdated, map[string]any{"permissions": effectivePermissions(roomID)})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(effectivePermissions(roomID))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// RoomAnalytics is a room's activity over its last Days days, bucketed by the database's clock.
+// Messages from System and from shadowbanned senders are not counted.
+type RoomAnalytics struct {
+	RoomID         int              `json:"room_id"`
+	Days           int              `json:"days"`
+	MessagesPerDay []DailyCount     `json:"messages_per_day"` // Oldest first, including quiet days
+	TopMembers     []MemberActivity `json:"top_members"`
+	PeakHours      []HourCount      `json:"peak_hours"` // Messages by hour of day, 0 to 23
+	Membership     []MembershipDay  `json:"membership"` // Oldest first
+}
+
+type MemberActivity struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Messages int    `json:"messages"`
+}
+
+type HourCount struct {
+	Hour  int `json:"hour"`
+	Count int `json:"count"`
+}
+
+// MembershipDay counts the members who joined on a day and the room's size at the end of it.
+// Only current members are counted, since departures aren't recorded.
+type MembershipDay struct {
+	Date    string `json:"date"` // YYYY-MM-DD
+	Joined  int    `json:"joined"`
+	Members int    `json:"members"`
+}
+
+const (
+	defaultAnalyticsDays = 30
+	maxAnalyticsDays     = 365
+	analyticsTopMembers  = 10
+)
+
+// analyticsMessages restricts messages m to those of the room ($1) in the last $2 days that analytics count
+const analyticsMessages = `m.room_id = $1 AND m.sender_id != 1 AND NOT m.shadowbanned
+	AND m.created_at >= CURRENT_DATE - ($2::int - 1)`
+
+// Get a room's activity analytics (room admins). ?days= sets the window, 30 by default.
+func handleGetRoomAnalytics(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	days := defaultAnalyticsDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 1 || days > maxAnalyticsDays {
+			http.Error(w, "days must be between 1 and 365", http.StatusBadRequest)
+			return
+		}
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if roomRole(roomID, userID) != RoleAdmin {
+		http.Error(w, "Only admins can view room analytics", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	analytics := RoomAnalytics{RoomID: roomID, Days: days}
+	if analytics.MessagesPerDay, err = roomMessagesPerDay(ctx, roomID, days); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get room messages per day", "error", err)
+		http.Error(w, "Failed to get room analytics", http.StatusInternalServerError)
+		return
+	}
+	if analytics.TopMembers, err = roomTopMembers(ctx, roomID, days); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get most active members", "error", err)
+		http.Error(w, "Failed to get room analytics", http.StatusInternalServerError)
+		return
+	}
+	if analytics.PeakHours, err = roomPeakHours(ctx, roomID, days); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get peak hours", "error", err)
+		http.Error(w, "Failed to get room analytics", http.StatusInternalServerError)
+		return
+	}
+	if analytics.Membership, err = roomMembership(ctx, roomID, days); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get membership growth", "error", err)
+		http.Error(w, "Failed to get room analytics", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(analytics)
+}
+
+func roomMessagesPerDay(ctx context.Context, roomID, days int) ([]DailyCount, error) {
+	rows, err := readDB().QueryContext(ctx, `
+		SELECT to_char(d, 'YYYY-MM-DD'), COUNT(m.id)
+		FROM generate_series(CURRENT_DATE - ($2::int - 1), CURRENT_DATE, INTERVAL '1 day') d
+		LEFT JOIN messages m ON `+analyticsMessages+` AND m.created_at >= d AND m.created_at < d + INTERVAL '1 day'
+		GROUP BY d
+		ORDER BY d
+	`, roomID, days)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]DailyCount, 0, days)
+	for rows.Next() {
+		var day DailyCount
+		if err := rows.Scan(&day.Date, &day.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, day)
+	}
+	return counts, rows.Err()
+}
+
+func roomTopMembers(ctx context.Context, roomID, days int) ([]MemberActivity, error) {
+	rows, err := readDB().QueryContext(ctx, `
+		SELECT u.id, u.username, COUNT(*)
+		FROM messages m
+		JOIN users u ON u.id = m.sender_id
+		WHERE `+analyticsMessages+`
+		GROUP BY u.id, u.username
+		ORDER BY COUNT(*) DESC, u.id
+		LIMIT $3
+	`, roomID, days, analyticsTopMembers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []MemberActivity{}
+	for rows.Next() {
+		var m MemberActivity
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Messages); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func roomPeakHours(ctx context.Context, roomID, days int) ([]HourCount, error) {
+	rows, err := readDB().QueryContext(ctx, `
+		SELECT h, COUNT(m.id)
+		FROM generate_series(0, 23) h
+		LEFT JOIN messages m ON `+analyticsMessages+` AND EXTRACT(HOUR FROM m.created_at) = h
+		GROUP BY h
+		ORDER BY h
+	`, roomID, days)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hours := make([]HourCount, 0, 24)
+	for rows.Next() {
+		var h HourCount
+		if err := rows.Scan(&h.Hour, &h.Count); err != nil {
+			return nil, err
+		}
+		hours = append(hours, h)
+	}
+	return hours, rows.Err()
+}
+
+func roomMembership(ctx context.Context, roomID, days int) ([]MembershipDay, error) {
+	rows, err := readDB().QueryContext(ctx, `
+		SELECT to_char(d, 'YYYY-MM-DD'), COUNT(rm.id),
+			(SELECT COUNT(*) FROM room_members WHERE room_id = $1 AND joined_at < d + INTERVAL '1 day')
+		FROM generate_series(CURRENT_DATE - ($2::int - 1), CURRENT_DATE, INTERVAL '1 day') d
+		LEFT JOIN room_members rm ON rm.room_id = $1 AND rm.joined_at >= d AND rm.joined_at < d + INTERVAL '1 day'
+		GROUP BY d
+		ORDER BY d
+	`, roomID, days)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	membership := make([]MembershipDay, 0, days)
+	for rows.Next() {
+		var day MembershipDay
+		if err := rows.Scan(&day.Date, &day.Joined, &day.Members); err != nil {
+			return nil, err
+		}
+		membership = append(membership, day)
+	}
+	return membership, rows.Err()
+}
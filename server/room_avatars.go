@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxRoomAvatarBytes = 5 << 20
+	roomAvatarSize     = 256
+)
+
+// roomAvatarURL is the room's uploaded image, or its generated avatar when it has none
+func roomAvatarURL(roomID int, key string) string {
+	if key == "" {
+		return generatedAvatarURL(fmt.Sprintf("room-%d", roomID))
+	}
+	return fileStorage.URL(key)
+}
+
+// setRoomAvatarKey stores the new key and removes the previous image from storage
+func setRoomAvatarKey(roomID int, key string) error {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	var oldKey sql.NullString
+	err := db.QueryRowContext(ctx, `
+		UPDATE rooms r SET avatar_key = NULLIF($1, '')
+		FROM (SELECT avatar_key FROM rooms WHERE id = $2) old
+		WHERE r.id = $2
+		RETURNING old.avatar_key
+	`, key, roomID).Scan(&oldKey)
+	if err != nil {
+		return err
+	}
+	if oldKey.Valid && oldKey.String != "" {
+		if err := fileStorage.Delete(context.Background(), oldKey.String); err != nil {
+			slog.Error("Failed to delete old avatar", "room_id", roomID, "key", oldKey.String, "error", err)
+		}
+	}
+	return nil
+}
+
+func broadcastRoomAvatar(roomID int, url string) {
+	roomManager.BroadcastToRoom(roomID, &WSMessage{
+		Type:    "roomUpdated",
+		RoomID:  roomID,
+		Content: url,
+	})
+}
+
+// Upload a room avatar image (admin only); it is scaled down to a small square-bounded image
+func handleUploadRoomAvatar(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermManageRoom, "You don't have permission to change the room avatar"); !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxRoomAvatarBytes+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Missing or invalid file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxRoomAvatarBytes {
+		http.Error(w, "File is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	data, contentType, err := generateThumbnail(file, roomAvatarSize, roomAvatarSize)
+	if err != nil {
+		http.Error(w, "Avatar must be a JPEG, PNG, GIF or WebP image", http.StatusBadRequest)
+		return
+	}
+
+	ext := ".jpg"
+	if contentType == "image/png" {
+		ext = ".png"
+	}
+	key, err := newStorageKey("avatar" + ext)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to generate storage key", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	key = "avatars/" + key
+
+	if err := fileStorage.Save(r.Context(), key, bytes.NewReader(data), int64(len(data)), contentType); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to store room avatar", "error", err)
+		http.Error(w, "Failed to store avatar", http.StatusInternalServerError)
+		return
+	}
+
+	if err := setRoomAvatarKey(roomID, key); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update room avatar", "error", err)
+		fileStorage.Delete(context.Background(), key)
+		http.Error(w, "Failed to update avatar", http.StatusInternalServerError)
+		return
+	}
+
+	url := fileStorage.URL(key)
+	broadcastRoomAvatar(roomID, url)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"avatarUrl": url})
+}
+
+// Remove the room avatar image, falling back to the generated one (admin only)
+func handleDeleteRoomAvatar(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermManageRoom, "You don't have permission to change the room avatar"); !ok {
+		return
+	}
+
+	if err := setRoomAvatarKey(roomID, ""); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to clear room avatar", "error", err)
+		http.Error(w, "Failed to remove avatar", http.StatusInternalServerError)
+		return
+	}
+
+	broadcastRoomAvatar(roomID, roomAvatarURL(roomID, ""))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
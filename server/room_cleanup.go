@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// What happens to a room that stays inactive through the grace period (ROOM_CLEANUP)
+const (
+	RoomCleanupOff     = "off"
+	RoomCleanupArchive = "archive" // It becomes read-only until an admin unarchives it
+	RoomCleanupDelete  = "delete"
+)
+
+const roomCleanupInterval = time.Hour
+
+// roomCleanupPolicy is the server's inactive room cleanup. A room without messages for
+// InactiveDays is flagged: a System message says what will happen and when, and its admins get
+// "roomInactive". If it is still quiet GraceDays later it is archived or deleted. Direct message
+// rooms are left alone.
+type roomCleanupPolicy struct {
+	Action       string
+	InactiveDays int
+	GraceDays    int
+}
+
+var roomCleanup = roomCleanupPolicy{Action: RoomCleanupOff}
+
+// initRoomCleanup reads ROOM_CLEANUP ("off", "archive" or "delete"), ROOM_INACTIVE_DAYS (90) and
+// ROOM_CLEANUP_GRACE_DAYS (14)
+func initRoomCleanup() error {
+	p := roomCleanupPolicy{
+		Action:       getEnv("ROOM_CLEANUP", RoomCleanupOff),
+		InactiveDays: envInt("ROOM_INACTIVE_DAYS", 90),
+		GraceDays:    envInt("ROOM_CLEANUP_GRACE_DAYS", 14),
+	}
+	switch p.Action {
+	case RoomCleanupOff:
+	case RoomCleanupArchive, RoomCleanupDelete:
+		if _, ok := store.(*postgresStore); !ok {
+			return fmt.Errorf("ROOM_CLEANUP=%s needs the Postgres store", p.Action)
+		}
+	default:
+		return fmt.Errorf("unknown ROOM_CLEANUP %q", p.Action)
+	}
+	roomCleanup = p
+	return nil
+}
+
+// cleanupAt is when a room flagged at inactiveSince is archived or deleted, or nil if it isn't flagged
+func (p roomCleanupPolicy) cleanupAt(inactiveSince sql.NullTime) *time.Time {
+	if p.Action == RoomCleanupOff || !inactiveSince.Valid {
+		return nil
+	}
+	at := inactiveSince.Time.AddDate(0, 0, p.GraceDays)
+	return &at
+}
+
+// roomActivitySQL restricts messages m to those that keep a room active: anything but the notice
+// that flagged it
+const roomActivitySQL = `(m.system_event IS NULL OR m.system_event->>'type' != '` + EventRoomInactive + `')`
+
+// runRoomCleanup applies the policy every roomCleanupInterval. Each step claims its rooms with a
+// single UPDATE or DELETE, so instances running it side by side don't act on a room twice.
+func runRoomCleanup() {
+	ticker := time.NewTicker(roomCleanupInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := unflagActiveRooms(); err != nil {
+			slog.Error("Failed to unflag active rooms", "error", err)
+		}
+		if err := cleanUpInactiveRooms(); err != nil {
+			slog.Error("Failed to clean up inactive rooms", "action", roomCleanup.Action, "error", err)
+		}
+		if err := flagInactiveRooms(); err != nil {
+			slog.Error("Failed to flag inactive rooms", "error", err)
+		}
+	}
+}
+
+// unflagActiveRooms clears the flag of rooms that had messages since they were flagged
+func unflagActiveRooms() error {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `
+		UPDATE rooms r SET inactive_since = NULL
+		WHERE r.inactive_since IS NOT NULL AND r.archived_at IS NULL AND EXISTS (
+			SELECT 1 FROM messages m WHERE m.room_id = r.id AND m.created_at > r.inactive_since AND `+roomActivitySQL+`
+		)
+	`)
+	return err
+}
+
+// flagInactiveRooms flags the rooms that have been quiet for InactiveDays and gives notice
+func flagInactiveRooms() error {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		UPDATE rooms r SET inactive_since = CURRENT_TIMESTAMP
+		WHERE r.inactive_since IS NULL AND r.archived_at IS NULL AND NOT r.is_direct
+			AND r.created_at <= NOW() - $1 * INTERVAL '1 day'
+			AND NOT EXISTS (
+				SELECT 1 FROM messages m
+				WHERE m.room_id = r.id AND m.created_at > NOW() - $1 * INTERVAL '1 day' AND `+roomActivitySQL+`
+			)
+		RETURNING r.id, r.inactive_since
+	`, roomCleanup.InactiveDays)
+	if err != nil {
+		return err
+	}
+	flagged := make(map[int]time.Time)
+	for rows.Next() {
+		var roomID int
+		var inactiveSince time.Time
+		if err := rows.Scan(&roomID, &inactiveSince); err != nil {
+			rows.Close()
+			return err
+		}
+		flagged[roomID] = inactiveSince
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for roomID, inactiveSince := range flagged {
+		at := inactiveSince.AddDate(0, 0, roomCleanup.GraceDays)
+		notice, err := postSystemMessage(roomID, newSystemEvent(EventRoomInactive, 1, 0,
+			"days", strconv.Itoa(roomCleanup.InactiveDays), "action", roomCleanup.Action, "at", eventTime(at)))
+		if err != nil {
+			slog.Error("Failed to post inactive room notice", "room_id", roomID, "error", err)
+			continue
+		}
+		notifyRoomAdmins(roomID, &WSMessage{Type: "roomInactive", RoomID: roomID, Message: notice})
+		slog.Info("Room flagged inactive", "room_id", roomID, "action", roomCleanup.Action, "at", at)
+	}
+	return nil
+}
+
+// cleanUpInactiveRooms archives or deletes the rooms whose grace period is over
+func cleanUpInactiveRooms() error {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	query := `UPDATE rooms SET archived_at = CURRENT_TIMESTAMP
+		WHERE inactive_since <= NOW() - $1 * INTERVAL '1 day' AND archived_at IS NULL
+		RETURNING id`
+	if roomCleanup.Action == RoomCleanupDelete {
+		query = `DELETE FROM rooms
+		WHERE inactive_since <= NOW() - $1 * INTERVAL '1 day' AND archived_at IS NULL
+		RETURNING id`
+	}
+	rows, err := db.QueryContext(ctx, query, roomCleanup.GraceDays)
+	if err != nil {
+		return err
+	}
+	var roomIDs []int
+	for rows.Next() {
+		var roomID int
+		if err := rows.Scan(&roomID); err != nil {
+			rows.Close()
+			return err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, roomID := range roomIDs {
+		if roomCleanup.Action == RoomCleanupDelete {
+			roomManager.CloseRoomHub(roomID)
+			memberships.invalidateRoom(roomID)
+			slog.Info("Inactive room deleted", "room_id", roomID)
+			continue
+		}
+		if _, err := postSystemMessage(roomID, newSystemEvent(EventRoomArchived, 1, 0, "at", eventTime(time.Now()))); err != nil {
+			slog.Error("Failed to post room archived notice", "room_id", roomID, "error", err)
+		}
+		slog.Info("Inactive room archived", "room_id", roomID)
+	}
+	return nil
+}
+
+// checkNotArchived returns a "room_archived" validation error for an archived room
+func checkNotArchived(roomID int) error {
+	// Only Postgres archives rooms
+	if _, ok := store.(*postgresStore); !ok {
+		return nil
+	}
+
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	var archived bool
+	err := db.QueryRowContext(ctx, "SELECT archived_at IS NOT NULL FROM rooms WHERE id = $1", roomID).Scan(&archived)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if archived {
+		return errRoomArchived
+	}
+	return nil
+}
+
+// Unarchive a room (admins) so members can post again; it counts as activity
+func handleUnarchiveRoom(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	if roomRole(roomID, userID) != RoleAdmin {
+		http.Error(w, "Only admins can unarchive rooms", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	result, err := db.ExecContext(ctx,
+		"UPDATE rooms SET archived_at = NULL, inactive_since = NULL WHERE id = $1 AND archived_at IS NOT NULL",
+		roomID,
+	)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to unarchive room", "error", err)
+		http.Error(w, "Failed to unarchive room", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Room is not archived", http.StatusConflict)
+		return
+	}
+
+	if _, err := postSystemMessage(roomID, newSystemEvent(EventRoomUnarchived, userID, 0, "actor", username)); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to post room unarchived notice", "error", err)
+	}
+	slog.InfoContext(r.Context(), "Room unarchived")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Room codes like "BLUE-FOX-OWL-4217" let people join from another device, or after hearing the code,
+// without a link. Anyone with a room's code can join it, private or not, so admins can rotate it.
+var (
+	roomCodeAdjectives = []string{
+		"AMBER", "BLUE", "BOLD", "BRAVE", "BRIGHT", "BRISK", "CALM", "CLEAR",
+		"CLEVER", "COOL", "COSMIC", "CRISP", "DARING", "DARK", "DUSTY", "EAGER",
+		"FAST", "FIERY", "FROSTY", "GENTLE", "GIANT", "GOLDEN", "GRAND", "GREEN",
+		"HAPPY", "HIDDEN", "HONEST", "ICY", "JOLLY", "KIND", "LAZY", "LIVELY",
+		"LOUD", "LUCKY", "MAGIC", "MELLOW", "MIGHTY", "MISTY", "NOBLE", "ORANGE",
+		"PLUCKY", "PROUD", "PURPLE", "QUICK", "QUIET", "RAPID", "RED", "ROYAL",
+		"RUSTY", "SHINY", "SILENT", "SILVER", "SLY", "SMART", "SNOWY", "SOLAR",
+		"SUNNY", "SWIFT", "TIDY", "VIVID", "WARM", "WILD", "WISE", "ZESTY",
+	}
+	roomCodeNouns = []string{
+		"BADGER", "BEAR", "BEAVER", "BISON", "CAMEL", "CAT", "COBRA", "CRANE",
+		"CROW", "DEER", "DOLPHIN", "DOVE", "DRAGON", "EAGLE", "FALCON", "FERRET",
+		"FINCH", "FOX", "FROG", "GECKO", "GOAT", "GOOSE", "HARE", "HAWK",
+		"HERON", "HIPPO", "IBIS", "JAGUAR", "KOALA", "LEMUR", "LION", "LLAMA",
+		"LYNX", "MOOSE", "MOTH", "OTTER", "OWL", "PANDA", "PANTHER", "PARROT",
+		"PELICAN", "PENGUIN", "PUFFIN", "PUMA", "RABBIT", "RAVEN", "RHINO", "ROBIN",
+		"SEAL", "SHARK", "SLOTH", "SPARROW", "SQUID", "SWAN", "TIGER", "TOAD",
+		"TURTLE", "VIPER", "WALRUS", "WHALE", "WOLF", "WOMBAT", "YAK", "ZEBRA",
+	}
+)
+
+// How many wrong codes a user, and a client IP, may try per hour, so codes can't be guessed by
+// spreading the guesses over accounts. An IP gets more, as people behind one NAT share it.
+const (
+	maxRoomCodeAttempts      = 20
+	maxRoomCodeAttemptsPerIP = 100
+)
+
+// roomCodeFailures counts the wrong codes of each user ("user:ID") and IP ("ip:ADDR") in the
+// current hour
+var roomCodeFailures = struct {
+	mu      sync.Mutex
+	windows map[string]*roomCodeWindow
+}{windows: make(map[string]*roomCodeWindow)}
+
+type roomCodeWindow struct {
+	start    time.Time
+	failures int
+}
+
+// roomCodeGuesser is who a guess is counted against: the user and their client IP
+func roomCodeGuesser(userID int, r *http.Request) map[string]int {
+	return map[string]int{
+		"user:" + strconv.Itoa(userID): maxRoomCodeAttempts,
+		"ip:" + clientIP(r):            maxRoomCodeAttemptsPerIP,
+	}
+}
+
+// allowRoomCodeAttempt reports whether the guesser has wrong guesses left this hour
+func allowRoomCodeAttempt(guesser map[string]int) bool {
+	roomCodeFailures.mu.Lock()
+	defer roomCodeFailures.mu.Unlock()
+
+	for key, limit := range guesser {
+		window, ok := roomCodeFailures.windows[key]
+		if ok && time.Since(window.start) <= time.Hour && window.failures >= limit {
+			return false
+		}
+	}
+	return true
+}
+
+func recordRoomCodeFailure(guesser map[string]int) {
+	roomCodeFailures.mu.Lock()
+	defer roomCodeFailures.mu.Unlock()
+
+	// Drop expired windows as we go so the map only holds recent guessers
+	for key, window := range roomCodeFailures.windows {
+		if time.Since(window.start) > time.Hour {
+			delete(roomCodeFailures.windows, key)
+		}
+	}
+	for key := range guesser {
+		window, ok := roomCodeFailures.windows[key]
+		if !ok {
+			window = &roomCodeWindow{start: time.Now()}
+			roomCodeFailures.windows[key] = window
+		}
+		window.failures++
+	}
+}
+
+// newRoomCode returns a random ADJECTIVE-NOUN-NOUN-NNNN code, about 31 bits' worth
+func newRoomCode() (string, error) {
+	pick := func(n int) (int, error) {
+		i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+		if err != nil {
+			return 0, err
+		}
+		return int(i.Int64()), nil
+	}
+	adjective, err := pick(len(roomCodeAdjectives))
+	if err != nil {
+		return "", err
+	}
+	first, err := pick(len(roomCodeNouns))
+	if err != nil {
+		return "", err
+	}
+	second, err := pick(len(roomCodeNouns))
+	if err != nil {
+		return "", err
+	}
+	number, err := pick(9000)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s-%s-%d", roomCodeAdjectives[adjective], roomCodeNouns[first], roomCodeNouns[second], number+1000), nil
+}
+
+// normalizeRoomCode accepts codes as people type them: any case, with spaces instead of dashes
+func normalizeRoomCode(code string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(strings.ReplaceAll(code, "-", " ")), "-"))
+}
+
+// assignRoomCode gives the room a new code, or only fills in a missing one unless rotate is set
+func assignRoomCode(ctx context.Context, roomID int, rotate bool) (string, error) {
+	query := "UPDATE rooms SET join_code = COALESCE(join_code, $1) WHERE id = $2 RETURNING join_code"
+	if rotate {
+		query = "UPDATE rooms SET join_code = $1 WHERE id = $2 RETURNING join_code"
+	}
+
+	for attempt := 0; ; attempt++ {
+		code, err := newRoomCode()
+		if err != nil {
+			return "", err
+		}
+		err = db.QueryRowContext(ctx, query, code, roomID).Scan(&code)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" && attempt < 5 {
+			continue
+		}
+		return code, err
+	}
+}
+
+// roomCodeRoom checks the user may share the room's code and that it is not a direct message room
+func roomCodeRoom(w http.ResponseWriter, r *http.Request, perm, message string) (int, bool) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return 0, false
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if _, ok := requireRoomPermission(w, roomID, userID, perm, message); !ok {
+		return 0, false
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var isDirect bool
+	if err := db.QueryRowContext(ctx, "SELECT is_direct FROM rooms WHERE id = $1", roomID).Scan(&isDirect); err != nil {
+		slog.ErrorContext(r.Context(), "DB error fetching room", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return 0, false
+	}
+	if isDirect {
+		http.Error(w, "Direct message rooms have no code", http.StatusBadRequest)
+		return 0, false
+	}
+	return roomID, true
+}
+
+// Get the room's join code, creating it on first use (members who can invite)
+func handleGetRoomCode(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := roomCodeRoom(w, r, PermInvite, "You don't have permission to invite to this room")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var code sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT join_code FROM rooms WHERE id = $1", roomID).Scan(&code)
+	if err == nil && !code.Valid {
+		code.String, err = assignRoomCode(ctx, roomID, false)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get room code", "error", err)
+		http.Error(w, "Failed to get room code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"code": code.String})
+}
+
+// Replace the room's join code, so the old one stops working
+func handleRegenerateRoomCode(w http.ResponseWriter, r *http.Request) {
+	roomID, ok := roomCodeRoom(w, r, PermManageRoom, "You don't have permission to change the room code")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	code, err := assignRoomCode(ctx, roomID, true)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to regenerate room code", "error", err)
+		http.Error(w, "Failed to regenerate room code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"code": code})
+}
+
+// Join the room a code belongs to
+func handleJoinByCode(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	code := normalizeRoomCode(req.Code)
+	if code == "" {
+		http.Error(w, "code is required", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	guesser := roomCodeGuesser(userID, r)
+	if !allowRoomCodeAttempt(guesser) {
+		w.Header().Set("Retry-After", "3600")
+		http.Error(w, "Too many wrong codes. Try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var roomID int
+	err := db.QueryRowContext(ctx, "SELECT id FROM rooms WHERE join_code = $1 AND NOT is_direct", code).Scan(&roomID)
+	if err == sql.ErrNoRows {
+		recordRoomCodeFailure(guesser)
+		http.Error(w, "Invalid room code", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "DB error looking up room code", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Knowing the code counts as an invitation, so private rooms are joined directly
+	joinRoom(w, roomID, userID, username, true)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/microcosm-cc/bluemonday"
+	"golang.org/x/text/unicode/norm"
+)
+
+// isBidiControl reports the embedding, override and isolate characters that can make a name or
+// title display as something other than what it is
+func isBidiControl(r rune) bool {
+	return (r >= '\u202a' && r <= '\u202e') || (r >= '\u2066' && r <= '\u2069')
+}
+
+// sanitizeText cleans multi-line text such as message content: line endings become "\n", control
+// characters other than newlines and tabs are dropped, the text is normalized to NFC, and blank
+// lines and trailing whitespace around it are trimmed. Leading spaces are kept for indented
+// code. Invalid UTF-8 is left for validation to report.
+func sanitizeText(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.Map(func(r rune) rune {
+		if r != '\n' && r != '\t' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+	if utf8.ValidString(s) {
+		s = norm.NFC.String(s)
+	}
+	return strings.TrimRightFunc(strings.TrimLeft(s, "\n"), unicode.IsSpace)
+}
+
+// sanitizeLine cleans single-line text such as names and titles: whitespace controls become
+// spaces, other control and bidi control characters are dropped, the text is normalized to NFC
+// and trimmed
+func sanitizeLine(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\r' || r == '\t':
+			return ' '
+		case unicode.IsControl(r) || isBidiControl(r):
+			return -1
+		}
+		return r
+	}, s)
+	if utf8.ValidString(s) {
+		s = norm.NFC.String(s)
+	}
+	return strings.TrimSpace(s)
+}
+
+// avatarInitial is the letter shown in place of an avatar: the first character of the name,
+// uppercased, with any combining marks that belong to it
+func avatarInitial(name string) string {
+	name = norm.NFC.String(strings.TrimSpace(name))
+	first, size := utf8.DecodeRuneInString(name)
+	if first == utf8.RuneError {
+		return "?"
+	}
+	end := size
+	for end < len(name) {
+		r, n := utf8.DecodeRuneInString(name[end:])
+		if !unicode.Is(unicode.M, r) {
+			break
+		}
+		end += n
+	}
+	return string(unicode.ToUpper(first)) + name[size:end]
+}
+
+// messageHTMLPolicy is the allowlist rendered message HTML is held to: the formatting, link and
+// image markup that user content may use, with URLs limited to safe schemes. Anything it doesn't
+// know, such as script, style, svg and event handler attributes, is removed.
+var messageHTMLPolicy = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	// Keep renderMarkdown's links opening in a new tab without a referrer
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	p.RequireNoReferrerOnLinks(true)
+	return p
+}()
+
+// sanitizeMessageHTML strips markup that could run in another client from a message's rendered
+// HTML. The raw text is stored and sent as typed; clients escape it themselves, so only the HTML
+// form is rebuilt from what messageHTMLPolicy allows.
+func sanitizeMessageHTML(rendered string) string {
+	return messageHTMLPolicy.Sanitize(rendered)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeMessageHTML(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"formatting", "<b>bold</b> and <em>em</em>", "<b>bold</b> and <em>em</em>"},
+		{"script", "hi<script>alert(1)</script>", "hi"},
+		{"event handler", `<img src="/a.png" onerror="alert(1)">`, `<img src="/a.png">`},
+		{"javascript link", `<a href="javascript:alert(1)">x</a>`, "x"},
+		{"svg title", "<svg><title><img src=x onerror=alert(1)></title></svg>", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeMessageHTML(tt.content); got != tt.want {
+				t.Errorf("sanitizeMessageHTML(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeMessageHTMLDropsHandlers(t *testing.T) {
+	for _, content := range []string{
+		"<svg><title><img src=x onerror=alert(1)></title></svg>",
+		"<math><mtext><table><mglyph><style><img src=x onerror=alert(1)>",
+		"<noscript><p title=\"</noscript><img src=x onerror=alert(1)>\">",
+	} {
+		if got := strings.ToLower(sanitizeMessageHTML(content)); strings.Contains(got, "onerror") || strings.Contains(got, "<svg") {
+			t.Errorf("sanitizeMessageHTML(%q) = %q", content, got)
+		}
+	}
+}
+
+func TestRenderMarkdownEscapesOnce(t *testing.T) {
+	content := "<b>x</b> if a < b & c"
+	if got, want := renderMarkdown(content), "&lt;b&gt;x&lt;/b&gt; if a &lt; b &amp; c"; got != want {
+		t.Errorf("renderMarkdown(%q) = %q, want %q", content, got, want)
+	}
+}
+
+// TestSendKeepsTextAsTyped sends messages through prepareUserMessage against a SQLite store: the
+// text to save comes back as typed and only the HTML form is escaped
+func TestSendKeepsTextAsTyped(t *testing.T) {
+	s, err := newSQLiteStore(filepath.Join(t.TempDir(), "chathub.db"))
+	if err != nil {
+		t.Fatalf("newSQLiteStore: %v", err)
+	}
+	prevStore, prevDB := store, db
+	store, db = s, s.db
+	t.Cleanup(func() { store, db = prevStore, prevDB })
+
+	ctx := context.Background()
+	alice, err := s.CreateUser(ctx, "alice", "alice@example.com", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	room := Room{Name: "general", CreatedBy: alice}
+	if _, err := s.CreateRoom(ctx, &room, newSystemEvent(EventRoomCreated, alice, 0, "actor", "alice")); err != nil {
+		t.Fatalf("CreateRoom: %v", err)
+	}
+
+	tests := []struct {
+		content string
+		html    string
+	}{
+		{"a < b & c", "a &lt; b &amp; c"},
+		{"if x<y && y>z", "if x&lt;y &amp;&amp; y&gt;z"},
+		{"<b>hi</b> & bye", "&lt;b&gt;hi&lt;/b&gt; &amp; bye"},
+		{"<script>alert(1)</script>", "&lt;script&gt;alert(1)&lt;/script&gt;"},
+	}
+	for _, tt := range tests {
+		p, err := prepareUserMessage(&OutgoingMessage{RoomID: room.ID, SenderID: alice, Sender: "alice", Content: tt.content})
+		if err != nil {
+			t.Fatalf("prepareUserMessage(%q): %v", tt.content, err)
+		}
+		if p.content != tt.content || p.out.Content != tt.content {
+			t.Errorf("prepareUserMessage(%q) saves %q, want it as typed", tt.content, p.content)
+		}
+		if p.contentHTML != tt.html {
+			t.Errorf("prepareUserMessage(%q) renders %q, want %q", tt.content, p.contentHTML, tt.html)
+		}
+	}
+}
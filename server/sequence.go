@@ -0,0 +1,68 @@
+package main
+
+// roomHistorySize is how many recent broadcasts each hub keeps for "fetchSince" backfill
+func roomHistorySize() int {
+	return envInt("WS_ROOM_HISTORY_SIZE", 500)
+}
+
+// stamp assigns the next sequence number to a broadcast and remembers it for backfill. The
+// message is copied because the same event may be broadcast to several hubs. Runs on the hub's
+// goroutine, so sequence numbers are strictly increasing in the order clients receive them.
+func (h *RoomHub) stamp(message *WSMessage) *WSMessage {
+	stamped := *message
+
+	h.mu.Lock()
+	h.Seq++
+	stamped.Seq = h.Seq
+	h.history = append(h.history, &stamped)
+	if size := roomHistorySize(); len(h.history) > size {
+		h.history = h.history[len(h.history)-size:]
+	}
+	h.mu.Unlock()
+
+	return &stamped
+}
+
+// since returns the buffered broadcasts after seq. complete is false when some of them have
+// already been dropped from the buffer, or seq is from before the hub was (re)started.
+func (h *RoomHub) since(seq int64) (missed []*WSMessage, complete bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if seq > h.Seq {
+		return nil, false
+	}
+	if len(h.history) == 0 {
+		return nil, seq == h.Seq
+	}
+	oldest := h.history[0].Seq
+	for _, m := range h.history {
+		if m.Seq > seq {
+			missed = append(missed, m)
+		}
+	}
+	return missed, seq >= oldest-1
+}
+
+// fetchSince replays the room's broadcasts after req.Seq, then sends "fetchedSince" with the
+// room's current sequence. has_more means the gap couldn't be filled from the buffer and the
+// client should reload the room's history over HTTP instead.
+func (c *Client) fetchSince(req *WSMessage) {
+	if !isUserInRoom(c.ID, req.RoomID) {
+		c.sendError(req, CodeNotAuthorized, "Not authorized for this room")
+		return
+	}
+
+	hub := c.Manager.GetOrCreateRoomHub(req.RoomID)
+	missed, complete := hub.since(req.Seq)
+	for _, m := range missed {
+		c.Send <- m
+	}
+
+	hub.mu.RLock()
+	current := hub.Seq
+	hub.mu.RUnlock()
+	c.Send <- &WSMessage{Type: "fetchedSince", RoomID: req.RoomID, ClientMsgID: req.ClientMsgID, Seq: current, HasMore: !complete}
+
+	c.logger().Debug("Client fetched room events", "room_id", req.RoomID, "since_seq", req.Seq, "replayed", len(missed))
+}
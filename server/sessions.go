@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// A session is a device the user signed in on. Logging in or registering starts one, named by the
+// token's session_id claim, and requests and connections made with the token keep its last
+// activity up to date. Signing a session out rejects its token and, on every instance, closes its
+// WebSocket connections, GraphQL subscriptions and gRPC streams right away. Only Postgres keeps
+// sessions; tokens issued without one can't be signed out and simply expire.
+
+// maxUserAgentLength bounds the User-Agent stored for a session
+const maxUserAgentLength = 255
+
+// sessionBrokerChannel is the broker "room" sign-outs are published on so every instance hears of
+// them. Room IDs start at 1, so no hub ever subscribes to it.
+const sessionBrokerChannel = 0
+
+// errSessionSignedOut is the cause of a stream's context ending because its session was signed out
+var errSessionSignedOut = errors.New("signed out on this device")
+
+// SessionSignOut tells the instances which session was signed out
+type SessionSignOut struct {
+	UserID    int    `json:"user_id"`
+	SessionID string `json:"session_id"`
+}
+
+// Session is a device signed in to the user's account
+type Session struct {
+	ID          string    `json:"id"`
+	UserAgent   string    `json:"user_agent"`
+	IP          string    `json:"ip"`         // Of its latest request or connection
+	CreatedAt   time.Time `json:"created_at"` // When it signed in
+	LastSeenAt  time.Time `json:"last_seen_at"`
+	Connections int       `json:"connections"` // WebSocket connections it has open to this server
+	Current     bool      `json:"current"`     // The session making the request
+}
+
+// startSession records a sign-in from the request's device, returning "" when sessions aren't kept
+func startSession(ctx context.Context, userID int, r *http.Request) (string, error) {
+	if _, ok := store.(*postgresStore); !ok {
+		return "", nil
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	sessionID := hex.EncodeToString(buf)
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO sessions (id, user_id, user_agent, ip) VALUES ($1, $2, $3, $4)",
+		sessionID, userID, userAgent, clientIP(r),
+	)
+	if err != nil {
+		return "", err
+	}
+	return sessionID, nil
+}
+
+// tokenSessionID is the session a token was issued for, or "" if it has none
+func tokenSessionID(claims jwt.MapClaims) string {
+	sessionID, _ := claims["session_id"].(string)
+	return sessionID
+}
+
+// isSessionActive records activity on the token's session, reporting false once it is signed out
+func isSessionActive(claims jwt.MapClaims, ip string) bool {
+	sessionID := tokenSessionID(claims)
+	if sessionID == "" {
+		return true
+	}
+
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx,
+		"UPDATE sessions SET last_seen_at = CURRENT_TIMESTAMP, ip = $3 WHERE id = $1 AND user_id = $2",
+		sessionID, int(claims["user_id"].(float64)), ip,
+	)
+	if err != nil {
+		slog.Error("Error checking session", "error", err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+// sessionConnections counts the user's WebSocket connections by session
+func (m *RoomManager) sessionConnections(userID int) map[string]int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for client := range m.Users[userID] {
+		counts[client.SessionID]++
+	}
+	return counts
+}
+
+// sessionStreams are the GraphQL subscription sockets and gRPC streams open on this instance, by
+// session, so signing out can end them
+var sessionStreams = struct {
+	mu      sync.Mutex
+	nextID  int
+	cancels map[string]map[int]context.CancelCauseFunc
+}{cancels: make(map[string]map[int]context.CancelCauseFunc)}
+
+// trackSessionStream returns a context for a stream opened with the session's token, which ends
+// with errSessionSignedOut when the session is signed out. untrack must be called when it closes.
+func trackSessionStream(ctx context.Context, sessionID string) (_ context.Context, untrack func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	if sessionID == "" {
+		return ctx, func() { cancel(nil) }
+	}
+
+	sessionStreams.mu.Lock()
+	defer sessionStreams.mu.Unlock()
+	sessionStreams.nextID++
+	id := sessionStreams.nextID
+	if sessionStreams.cancels[sessionID] == nil {
+		sessionStreams.cancels[sessionID] = make(map[int]context.CancelCauseFunc)
+	}
+	sessionStreams.cancels[sessionID][id] = cancel
+
+	return ctx, func() {
+		sessionStreams.mu.Lock()
+		delete(sessionStreams.cancels[sessionID], id)
+		if len(sessionStreams.cancels[sessionID]) == 0 {
+			delete(sessionStreams.cancels, sessionID)
+		}
+		sessionStreams.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// endSessionStreams ends the session's GraphQL subscription sockets and gRPC streams
+func endSessionStreams(sessionID string) {
+	sessionStreams.mu.Lock()
+	defer sessionStreams.mu.Unlock()
+	for _, cancel := range sessionStreams.cancels[sessionID] {
+		cancel(errSessionSignedOut)
+	}
+}
+
+// watchingSignOuts is set once this instance hears sign-outs over the broker, its own included
+var watchingSignOuts atomic.Bool
+
+// watchSessionSignOuts closes this instance's connections of sessions signed out anywhere
+func watchSessionSignOuts() error {
+	_, err := broker.Subscribe(sessionBrokerChannel, func(msg *WSMessage) {
+		if msg.Type == "sessionSignedOut" && msg.SignOut != nil {
+			signOutLocally(msg.SignOut)
+		}
+	})
+	if err == nil {
+		watchingSignOuts.Store(true)
+	}
+	return err
+}
+
+// signOutSession closes the session's connections and streams on every instance, or only on this
+// one if the broker can't be reached
+func signOutSession(out *SessionSignOut) {
+	err := broker.Publish(sessionBrokerChannel, &WSMessage{Type: "sessionSignedOut", SignOut: out})
+	if err != nil {
+		slog.Error("Failed to publish session sign-out, closing local connections only", "error", err)
+	}
+	if err != nil || !watchingSignOuts.Load() {
+		signOutLocally(out)
+	}
+}
+
+func signOutLocally(out *SessionSignOut) {
+	roomManager.signOutSession(out.UserID, out.SessionID)
+	endSessionStreams(out.SessionID)
+}
+
+// signOutSession tells the session's WebSocket connections they were signed out and closes them
+func (m *RoomManager) signOutSession(userID int, sessionID string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for client := range m.Users[userID] {
+		if client.SessionID != sessionID {
+			continue
+		}
+		// Queued ahead of the close frame that unregistering sends
+		client.enqueue(&WSMessage{Type: "signedOut"})
+		client.logger().Info("Closing connection of signed out session")
+		go func() { m.Unregister <- client }()
+	}
+}
+
+// The devices signed in to the user's account, most recently active first
+func handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	userID := int(r.Context().Value("user_id").(float64))
+	currentID, _ := r.Context().Value("session_id").(string)
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, user_agent, ip, created_at, last_seen_at FROM sessions
+		WHERE user_id = $1 AND created_at > NOW() - $2 * INTERVAL '1 hour'
+		ORDER BY last_seen_at DESC
+	`, userID, int(tokenLifetime.Hours()))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get sessions", "error", err)
+		http.Error(w, "Failed to get sessions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	connections := roomManager.sessionConnections(userID)
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning session", "error", err)
+			continue
+		}
+		s.Connections = connections[s.ID]
+		s.Current = s.ID == currentID
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get sessions", "error", err)
+		http.Error(w, "Failed to get sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// Sign a device out: its token stops working and its connections and streams are closed
+func handleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE id = $1 AND user_id = $2", sessionID, userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to sign out session", "error", err)
+		http.Error(w, "Failed to sign out session", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	signOutSession(&SessionSignOut{UserID: userID, SessionID: sessionID})
+	slog.InfoContext(r.Context(), "Session signed out", "session_id", sessionID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// pruneSessions deletes sessions whose token has expired every hour
+func pruneSessions() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := dbContext(context.Background())
+		_, err := db.ExecContext(ctx,
+			"DELETE FROM sessions WHERE created_at <= NOW() - $1 * INTERVAL '1 hour'",
+			int(tokenLifetime.Hours()),
+		)
+		cancel()
+		if err != nil {
+			slog.Error("Failed to prune sessions", "error", err)
+		}
+	}
+}
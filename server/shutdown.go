@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// How long shutdown waits for clients' queued messages to be written before moving on
+	shutdownFlushTimeout = 10 * time.Second
+	// How long in-flight HTTP requests get to finish
+	shutdownDrainTimeout = 15 * time.Second
+)
+
+func (m *RoomManager) isShuttingDown() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.shuttingDown
+}
+
+// Shutdown stops new connections and asks every client's writePump to flush its queue and send a
+// "server restarting" close frame, then waits up to timeout for them to finish.
+func (m *RoomManager) Shutdown(timeout time.Duration) {
+	m.mu.Lock()
+	m.shuttingDown = true
+	clients := make([]*Client, 0, len(m.Clients))
+	for client := range m.Clients {
+		clients = append(clients, client)
+	}
+	m.mu.Unlock()
+
+	slog.Info("Closing WebSocket connections", "count", len(clients))
+	for _, client := range clients {
+		close(client.shutdown)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.writers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("All WebSocket connections closed")
+	case <-time.After(timeout):
+		slog.Warn("Timed out waiting for WebSocket connections to close", "timeout", timeout)
+	}
+}
+
+// closeForShutdown writes whatever is already queued for the client, then the close frame.
+// Called from writePump, the connection's only writer.
+func (c *Client) closeForShutdown() {
+	for {
+		c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+		select {
+		case msg, ok := <-c.Send:
+			if !ok {
+				return
+			}
+			if err := c.writeMessage(msg); err != nil {
+				return
+			}
+		default:
+			c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting"))
+			return
+		}
+	}
+}
+
+// serve runs the server until SIGINT/SIGTERM, then shuts down in order: WebSocket clients get a
+// close frame, in-flight HTTP and gRPC requests drain, queued messages are written, and hub goroutines stop. main's deferred cleanups
+// (broker, database pool, trace export) run once it returns.
+func serve(server *http.Server) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		slog.Info("Server running", "addr", server.Addr)
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		fatal("Server stopped", err)
+	case <-ctx.Done():
+	}
+	stop()
+	slog.Info("Shutting down")
+
+	// Hijacked WebSocket connections aren't tracked by server.Shutdown, so close them first
+	roomManager.Shutdown(shutdownFlushTimeout)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), shutdownDrainTimeout)
+	defer cancel()
+	if err := server.Shutdown(drainCtx); err != nil {
+		slog.Warn("HTTP requests still running at shutdown", "error", err)
+	}
+	stopGRPC(shutdownDrainTimeout)
+
+	// Write out queued messages while the hubs can still publish them to other instances
+	persister.Close()
+
+	roomManager.CloseAllHubs()
+	slog.Info("Server stopped")
+}
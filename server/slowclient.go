@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// What the server does when a client's send queue is full, set with WS_SLOW_CLIENT_POLICY
+const (
+	SlowClientDisconnect      = "disconnect"             // Unregister the client straight away
+	SlowClientDropOldest      = "drop_oldest"            // Discard the oldest queued message to make room
+	SlowClientDisconnectAfter = "disconnect_after_drops" // Drop the new message; disconnect after WS_SLOW_CLIENT_MAX_DROPS
+	SlowClientBlock           = "block"                  // Wait up to WS_SLOW_CLIENT_BLOCK_MS, then disconnect
+)
+
+func slowClientPolicy() string {
+	switch policy := getEnv("WS_SLOW_CLIENT_POLICY", SlowClientDisconnect); policy {
+	case SlowClientDisconnect, SlowClientDropOldest, SlowClientDisconnectAfter, SlowClientBlock:
+		return policy
+	default:
+		slog.Warn("Unknown WS_SLOW_CLIENT_POLICY, using the default", "policy", policy, "default", SlowClientDisconnect)
+		return SlowClientDisconnect
+	}
+}
+
+func slowClientMaxDrops() int64 {
+	return int64(envInt("WS_SLOW_CLIENT_MAX_DROPS", 50))
+}
+
+func slowClientBlockTimeout() time.Duration {
+	return time.Duration(envInt("WS_SLOW_CLIENT_BLOCK_MS", 100)) * time.Millisecond
+}
+
+// slowClientStats counts what the policy did, for the admin dashboard
+var slowClientStats struct {
+	Dropped      atomic.Int64
+	Disconnected atomic.Int64
+}
+
+// enqueue queues a message for the client's writePump, applying the slow-client policy when the
+// queue is full. Callers must hold a lock that keeps the manager from closing c.Send meanwhile
+// (the hub's or the manager's). With the block policy this can stall the caller for the timeout.
+func (c *Client) enqueue(msg *WSMessage) {
+	select {
+	case c.Send <- msg:
+		return
+	default:
+	}
+
+	switch slowClientPolicy() {
+	case SlowClientDropOldest:
+		select {
+		case <-c.Send:
+			slowClientStats.Dropped.Add(1)
+		default:
+		}
+		select {
+		case c.Send <- msg:
+		default:
+			slowClientStats.Dropped.Add(1)
+		}
+
+	case SlowClientDisconnectAfter:
+		slowClientStats.Dropped.Add(1)
+		if c.drops.Add(1) >= slowClientMaxDrops() {
+			c.logger().Warn("Slow client dropped too many messages, disconnecting", "drops", c.drops.Load())
+			c.disconnectSlow()
+		}
+
+	case SlowClientBlock:
+		timer := time.NewTimer(slowClientBlockTimeout())
+		defer timer.Stop()
+		select {
+		case c.Send <- msg:
+		case <-timer.C:
+			c.logger().Warn("Slow client queue still full, disconnecting", "waited", slowClientBlockTimeout())
+			c.disconnectSlow()
+		}
+
+	default:
+		c.disconnectSlow()
+	}
+}
+
+func (c *Client) disconnectSlow() {
+	slowClientStats.Disconnected.Add(1)
+	go func() { c.Manager.Unregister <- c }()
+}
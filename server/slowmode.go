@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const maxSlowModeSeconds = 6 * 60 * 60
+
+type slowModeKey struct {
+	roomID, userID int
+}
+
+// slowModeTracker remembers when each user last posted in each room. After a restart the
+// map is empty, so the last message time is read from the database instead.
+type slowModeTracker struct {
+	mu       sync.Mutex
+	lastPost map[slowModeKey]time.Time
+}
+
+var slowMode = &slowModeTracker{lastPost: make(map[slowModeKey]time.Time)}
+
+func (t *slowModeTracker) last(roomID, userID int) (time.Time, error) {
+	key := slowModeKey{roomID, userID}
+	t.mu.Lock()
+	last, ok := t.lastPost[key]
+	t.mu.Unlock()
+	if ok {
+		return last, nil
+	}
+
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	// Compare against NOW() in the database so clock and time zone differences don't matter
+	var elapsed sql.NullFloat64
+	err := db.QueryRowContext(ctx,
+		"SELECT EXTRACT(EPOCH FROM NOW() - MAX(created_at)) FROM messages WHERE room_id = $1 AND sender_id = $2",
+		roomID, userID,
+	).Scan(&elapsed)
+	if err != nil || !elapsed.Valid {
+		return time.Time{}, err
+	}
+	last = time.Now().Add(-time.Duration(elapsed.Float64 * float64(time.Second)))
+	t.record(roomID, userID, last)
+	return last, nil
+}
+
+func (t *slowModeTracker) record(roomID, userID int, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Entries older than the longest interval can't block anyone, drop them once the map gets large
+	if len(t.lastPost) > 10000 {
+		cutoff := time.Now().Add(-maxSlowModeSeconds * time.Second)
+		for k, v := range t.lastPost {
+			if v.Before(cutoff) {
+				delete(t.lastPost, k)
+			}
+		}
+	}
+	if at.After(t.lastPost[slowModeKey{roomID, userID}]) {
+		t.lastPost[slowModeKey{roomID, userID}] = at
+	}
+}
+
+// checkSlowMode returns a "slow_mode" validation error carrying the remaining cooldown when the
+// user posted too recently. Members who may change slow mode are exempt.
+func checkSlowMode(roomID, userID int) error {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	var interval int
+	var role string
+	err := db.QueryRowContext(ctx, `
+		SELECT r.slow_mode_seconds, COALESCE(rm.role, '')
+		FROM rooms r
+		LEFT JOIN room_members rm ON rm.room_id = r.id AND rm.user_id = $2
+		WHERE r.id = $1
+	`, roomID, userID).Scan(&interval, &role)
+	if err != nil || interval <= 0 || hasRoomPermission(roomID, role, PermSlowMode) {
+		return nil
+	}
+
+	last, err := slowMode.last(roomID, userID)
+	if err != nil {
+		return err
+	}
+
+	remaining := time.Until(last.Add(time.Duration(interval) * time.Second))
+	if remaining <= 0 {
+		return nil
+	}
+	wait := int((remaining + time.Second - 1) / time.Second)
+	return &ValidationError{
+		Code:       CodeSlowMode,
+		Message:    fmt.Sprintf("Slow mode is on. You can send another message in %d seconds", wait),
+		Limit:      interval,
+		RetryAfter: wait,
+	}
+}
+
+// Set a room's slow mode interval; 0 turns it off
+func handleUpdateSlowMode(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Seconds int `json:"seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Seconds < 0 || req.Seconds > maxSlowModeSeconds {
+		http.Error(w, fmt.Sprintf("Seconds must be between 0 and %d", maxSlowModeSeconds), http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+	username := r.Context().Value("username").(string)
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermSlowMode, "You don't have permission to change slow mode"); !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, "UPDATE rooms SET slow_mode_seconds = $1 WHERE id = $2", req.Seconds, roomID); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update slow mode", "error", err)
+		http.Error(w, "Failed to update slow mode", http.StatusInternalServerError)
+		return
+	}
+
+	announcement := newSystemEvent(EventSlowModeChanged, userID, 0, "actor", username)
+	if req.Seconds > 0 {
+		announcement.Params["seconds"] = strconv.Itoa(req.Seconds)
+	}
+	if _, err := postSystemMessage(roomID, announcement); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to add slow mode system message", "error", err)
+	}
+	notifyWebhooks(roomID, WebhookRoomUpdated, map[string]int{"slow_mode_seconds": req.Seconds})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"slow_mode_seconds": req.Seconds})
+}
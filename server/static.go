@@ -0,0 +1,52 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// webFiles is the web client's production build, copied into web/ before `go build`
+// (see the README). Without it the binary serves only the API.
+//
+//go:embed all:web
+var webFiles embed.FS
+
+// frontendHandler serves the embedded web client, or returns nil when none was embedded or
+// SERVE_FRONTEND=false. Paths that aren't files get index.html so client-side routes like
+// /chat/12 survive a reload.
+func frontendHandler() http.Handler {
+	if getEnv("SERVE_FRONTEND", "true") == "false" {
+		return nil
+	}
+	site, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		return nil
+	}
+	if _, err := fs.Stat(site, "index.html"); err != nil {
+		return nil
+	}
+
+	files := http.FileServer(http.FS(site))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Unknown API paths should still 404 rather than get the app's HTML
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		if info, err := fs.Stat(site, name); err != nil || info.IsDir() {
+			w.Header().Set("Cache-Control", "no-cache")
+			http.ServeFileFS(w, r, site, "index.html")
+			return
+		}
+		// The build fingerprints everything under static/, so those files never change
+		if strings.HasPrefix(name, "static/") {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		}
+		files.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Storage is the backend that holds uploaded file contents
+type Storage interface {
+	Save(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	Delete(ctx context.Context, key string) error
+	URL(key string) string
+}
+
+var fileStorage Storage
+
+// initStorage selects the backend from STORAGE_DRIVER ("local" or "s3")
+func initStorage() error {
+	switch driver := getEnv("STORAGE_DRIVER", "local"); driver {
+	case "local":
+		s, err := newLocalStorage(
+			getEnv("UPLOAD_DIR", "./uploads"),
+			getEnv("UPLOAD_BASE_URL", "http://localhost:"+getEnv("PORT", "8080")+"/uploads"),
+		)
+		if err != nil {
+			return err
+		}
+		fileStorage = s
+	case "s3":
+		s, err := newS3Storage()
+		if err != nil {
+			return err
+		}
+		fileStorage = s
+	default:
+		return fmt.Errorf("unknown STORAGE_DRIVER %q", driver)
+	}
+	return nil
+}
+
+// --- Local Disk ---
+
+type localStorage struct {
+	dir     string
+	baseURL string
+}
+
+func newLocalStorage(dir, baseURL string) (*localStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create upload dir: %w", err)
+	}
+	return &localStorage{dir: dir, baseURL: strings.TrimRight(baseURL, "/")}, nil
+}
+
+func (s *localStorage) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s *localStorage) Save(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(p)
+		return err
+	}
+	return f.Close()
+}
+
+func (s *localStorage) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *localStorage) URL(key string) string {
+	return s.baseURL + "/" + key
+}
+
+// handler serves the stored files. They are user content, so a browser is told to download rather
+// than render them when visited directly, not to guess another type, and not to run anything in
+// them; <img>, <audio> and <video> still embed them.
+func (s *localStorage) handler() http.Handler {
+	files := http.FileServer(http.Dir(s.dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setUploadHeaders(w.Header())
+		files.ServeHTTP(w, r)
+	})
+}
+
+// uploadContentDisposition is the disposition uploaded files are served with
+const uploadContentDisposition = "attachment"
+
+func setUploadHeaders(h http.Header) {
+	h.Set("Content-Disposition", uploadContentDisposition)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+}
+
+// --- S3 ---
+
+type s3Storage struct {
+	client    *s3.Client
+	bucket    string
+	publicURL string
+}
+
+// newS3Storage reads S3_BUCKET, S3_REGION, optional S3_ENDPOINT (for MinIO etc.)
+// and S3_PUBLIC_URL; credentials come from the standard AWS environment/config chain.
+func newS3Storage() (*s3Storage, error) {
+	bucket := getEnv("S3_BUCKET", "")
+	if bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET is required for the s3 storage driver")
+	}
+	region := getEnv("S3_REGION", "us-east-1")
+
+	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("load AWS config: %w", err)
+	}
+
+	endpoint := getEnv("S3_ENDPOINT", "")
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	publicURL := getEnv("S3_PUBLIC_URL", "")
+	if publicURL == "" {
+		if endpoint != "" {
+			publicURL = strings.TrimRight(endpoint, "/") + "/" + bucket
+		} else {
+			publicURL = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, region)
+		}
+	}
+
+	return &s3Storage{client: client, bucket: bucket, publicURL: strings.TrimRight(publicURL, "/")}, nil
+}
+
+func (s *s3Storage) Save(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+		ContentType:   aws.String(contentType),
+		// Served straight from the bucket, so the object carries the disposition local files get
+		ContentDisposition: aws.String(uploadContentDisposition),
+	})
+	return err
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *s3Storage) URL(key string) string {
+	return s.publicURL + "/" + key
+}
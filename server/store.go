@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Store is the persistence behind the core of the API: accounts, rooms and their members, sending
+// messages, message history and read state. The core handlers are given one (see coreHandlers)
+// instead of issuing SQL against db, so the backend can be swapped for another database or a
+// fake; other code reaches the one the server runs on through the store global.
+type Store interface {
+	UserStore
+	RoomStore
+	MessageStore
+}
+
+type UserStore interface {
+	// CreateUser returns errUsernameTaken or errEmailTaken if either is in use
+	CreateUser(ctx context.Context, username, email, passwordHash string) (int, error)
+	// UserCredentials returns errNotFound if there is no such user
+	UserCredentials(ctx context.Context, username string) (*UserCredentials, error)
+	IsUserActive(ctx context.Context, userID int) (bool, error)
+}
+
+type RoomStore interface {
+	// CreateRoom saves the room with its creator as admin, and posts the system message announcing
+	// it, all at once. It fills in the room's ID and CreatedAt.
+	CreateRoom(ctx context.Context, room *Room, event *SystemEvent) (*Message, error)
+	IsRoomMember(ctx context.Context, roomID, userID int) (bool, error)
+	// MemberRole returns the user's role in the room, or "" if they are not a member
+	MemberRole(ctx context.Context, roomID, userID int) (string, error)
+	// MuteStatus reports whether the member is muted in the room and, for a timed mute, until when
+	MuteStatus(ctx context.Context, roomID, userID int) (muted bool, until *time.Time, err error)
+	// RoomMembers lists the room's members, admins first, then moderators, each by join date
+	RoomMembers(ctx context.Context, roomID int) ([]RoomMember, error)
+	// ListRooms loads the user's rooms, most recently active first, with their latest message and
+	// unread counts, along with the time the list is current as of, to be passed back as
+	// UpdatedSince
+	ListRooms(ctx context.Context, userID int, username string, opts roomListOptions) ([]Room, time.Time, error)
+}
+
+type MessageStore interface {
+	// MessagePage loads up to limit of the room's messages, as viewerID sees them, oldest first:
+	// forward, those after the message with ID cursor (0 for the start of the history); otherwise
+	// those before it (0 for the latest). more reports whether further messages lie beyond the
+	// page in that direction.
+	MessagePage(ctx context.Context, roomID, viewerID, cursor int, forward bool, limit int) (messages []Message, more bool, err error)
+	// SaveMessages writes a batch of prepared messages in one transaction, in order, with their
+	// attachments, GIFs and idempotency keys. If any of them fails, none is saved.
+	SaveMessages(ctx context.Context, batch []*pendingMessage) ([]*Message, error)
+	// MarkRoomRead moves the member's read pointer up to the room's latest message. advanced is
+	// false if there was nothing new to read.
+	MarkRoomRead(ctx context.Context, roomID, userID int) (lastReadID int, advanced bool, err error)
+	// MessageReads lists the members other than its sender who have read the message, earliest
+	// first. It returns errNotFound if viewerID can't see the message.
+	MessageReads(ctx context.Context, roomID, msgID, viewerID int) ([]MessageRead, error)
+}
+
+// roomListOptions narrows ListRooms; the zero value lists all of the user's rooms
+type roomListOptions struct {
+	RoomID       int // Only this room
+	Limit        int // At most 100; 0 is no limit
+	Offset       int
+	UpdatedSince *time.Time
+}
+
+// roomSyncWindow is how far before UpdatedSince the stores look for changes. A message's
+// created_at is when its transaction began, which can be before the previous list was taken even
+// though the message only became visible after it. Writes can't run past DB_QUERY_TIMEOUT_MS, so
+// looking back twice that catches them.
+func roomSyncWindow() time.Duration {
+	return max(time.Minute, 2*dbQueryTimeout())
+}
+
+// updatedSince is UpdatedSince moved back by roomSyncWindow, or nil for the full list
+func (o roomListOptions) updatedSince() *time.Time {
+	if o.UpdatedSince == nil {
+		return nil
+	}
+	since := o.UpdatedSince.Add(-roomSyncWindow())
+	return &since
+}
+
+// UserCredentials is what logging in checks a password against
+type UserCredentials struct {
+	ID           int
+	PasswordHash string
+	Active       bool
+}
+
+var (
+	errNotFound      = errors.New("not found")
+	errUsernameTaken = errors.New("username already taken")
+	errEmailTaken    = errors.New("email already registered")
+
+	errNeedsPostgres = &ValidationError{Code: CodeInvalidMessage, Message: "Attachments and GIFs need the Postgres store"}
+)
+
+// setLastMessage fills in the room's preview from its latest message, if it has one
+func (room *Room) setLastMessage(content sql.NullString, at sql.NullTime, senderID sql.NullInt64) {
+	room.LastMessage = "No messages yet."
+	if content.Valid {
+		room.LastMessage = content.String
+	}
+	room.LastMessageAt = &room.CreatedAt
+	if at.Valid {
+		room.LastMessageAt = &at.Time
+	}
+	room.LastMessageTime = room.LastMessageAt.Format(LastMessageTimeFormat)
+	room.LastSenderID = int(senderID.Int64) // 0 without messages
+}
+
+var store Store
+
+// coreHandlers serve the API the Store covers, against the Store they are built with
+type coreHandlers struct {
+	store Store
+}
+
+// initStore selects the backend from DB_DRIVER ("postgres" or "sqlite"). With SQLite, code that
+// still queries db directly runs against the same file and fails where it needs Postgres, so it
+// suits working on accounts, rooms, messaging and history locally rather than the whole API.
+func initStore() error {
+	loadEnv()
+	switch driver := getEnv("DB_DRIVER", "postgres"); driver {
+	case "postgres":
+		initDB()
+		store = newPostgresStore(db)
+	case "sqlite":
+		s, err := newSQLiteStore(getEnv("SQLITE_PATH", "chathub.db"))
+		if err != nil {
+			return err
+		}
+		db = s.db
+		store = s
+	default:
+		return fmt.Errorf("unknown DB_DRIVER %q", driver)
+	}
+	return nil
+}
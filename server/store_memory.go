@@ -0,0 +1,337 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore is a Store held in process memory, for exercising handlers and hubs without a
+// database. Nothing survives a restart.
+type memoryStore struct {
+	mu       sync.RWMutex
+	users    []*memoryUser // Indexed by ID - 1
+	rooms    []*Room       // Indexed by ID - 1
+	members  map[int][]*memoryMember
+	messages map[int][]Message // By room, in ID order
+	nextMsg  int
+}
+
+type memoryUser struct {
+	id           int
+	username     string
+	email        string
+	passwordHash string
+	active       bool
+	status       UserStatus
+}
+
+type memoryMember struct {
+	userID     int
+	role       string
+	joinedAt   time.Time
+	lastReadID int
+	lastReadAt time.Time
+}
+
+// newMemoryStore starts out with the System user (ID 1) that posts system messages
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users: []*memoryUser{{
+			id: 1, username: "System", email: "system@chathub.io", passwordHash: "SYSTEM_ACCOUNT_HASH",
+			active: true, status: UserStatus{State: StatusAvailable},
+		}},
+		members:  make(map[int][]*memoryMember),
+		messages: make(map[int][]Message),
+	}
+}
+
+func (s *memoryStore) user(id int) *memoryUser {
+	if id < 1 || id > len(s.users) {
+		return nil
+	}
+	return s.users[id-1]
+}
+
+func (s *memoryStore) room(id int) *Room {
+	if id < 1 || id > len(s.rooms) {
+		return nil
+	}
+	return s.rooms[id-1]
+}
+
+func (s *memoryStore) CreateUser(ctx context.Context, username, email, passwordHash string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if strings.EqualFold(u.username, username) {
+			return 0, errUsernameTaken
+		}
+		if u.email == email {
+			return 0, errEmailTaken
+		}
+	}
+	u := &memoryUser{
+		id: len(s.users) + 1, username: username, email: email, passwordHash: passwordHash,
+		active: true, status: UserStatus{State: StatusAvailable},
+	}
+	s.users = append(s.users, u)
+	return u.id, nil
+}
+
+func (s *memoryStore) UserCredentials(ctx context.Context, username string) (*UserCredentials, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, u := range s.users {
+		if u.username == username {
+			return &UserCredentials{ID: u.id, PasswordHash: u.passwordHash, Active: u.active}, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (s *memoryStore) IsUserActive(ctx context.Context, userID int) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u := s.user(userID)
+	return u != nil && u.active, nil
+}
+
+func (s *memoryStore) CreateRoom(ctx context.Context, room *Room, event *SystemEvent) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.user(room.CreatedBy) == nil {
+		return nil, errNotFound
+	}
+	now := time.Now().UTC()
+	room.ID = len(s.rooms) + 1
+	room.CreatedAt = now
+	stored := *room
+	s.rooms = append(s.rooms, &stored)
+	s.members[room.ID] = []*memoryMember{{userID: room.CreatedBy, role: "admin", joinedAt: now, lastReadAt: now}}
+
+	s.nextMsg++
+	msg := Message{
+		ID: s.nextMsg, RoomID: room.ID, SenderID: 1, Sender: "System", Avatar: "S",
+		Kind: "system", Text: event.Render(defaultLocale), Timestamp: now, SystemEvent: event,
+	}
+	s.messages[room.ID] = append(s.messages[room.ID], msg)
+	return &msg, nil
+}
+
+func (s *memoryStore) IsRoomMember(ctx context.Context, roomID, userID int) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.member(roomID, userID) != nil, nil
+}
+
+func (s *memoryStore) member(roomID, userID int) *memoryMember {
+	for _, m := range s.members[roomID] {
+		if m.userID == userID {
+			return m
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) MemberRole(ctx context.Context, roomID, userID int) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if m := s.member(roomID, userID); m != nil {
+		return m.role, nil
+	}
+	return "", nil
+}
+
+// MuteStatus always reports unmuted: nothing mutes members of a memoryStore
+func (s *memoryStore) MuteStatus(ctx context.Context, roomID, userID int) (bool, *time.Time, error) {
+	return false, nil, nil
+}
+
+func (s *memoryStore) RoomMembers(ctx context.Context, roomID int) ([]RoomMember, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var members []RoomMember
+	for _, m := range s.members[roomID] {
+		u := s.user(m.userID)
+		members = append(members, RoomMember{
+			ID:       u.id,
+			Username: u.username,
+			Email:    u.email,
+			Avatar:   avatarInitial(u.username),
+			Role:     m.role,
+			JoinedAt: m.joinedAt,
+			Online:   roomManager.IsOnline(u.id),
+			Status:   u.status,
+		})
+	}
+	rank := map[string]int{"admin": 1, "moderator": 2}
+	slices.SortStableFunc(members, func(a, b RoomMember) int {
+		ra, rb := cmp.Or(rank[a.Role], 3), cmp.Or(rank[b.Role], 3)
+		return cmp.Or(cmp.Compare(ra, rb), a.JoinedAt.Compare(b.JoinedAt))
+	})
+	return members, nil
+}
+
+func (s *memoryStore) MessagePage(ctx context.Context, roomID, viewerID, cursor int, forward bool, limit int) (messages []Message, more bool, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	history := s.visible(roomID, viewerID)
+	// index is where the first message with the ID or a later one is
+	index := func(id int) int {
+		i, _ := slices.BinarySearchFunc(history, id, func(m Message, id int) int { return cmp.Compare(m.ID, id) })
+		return i
+	}
+	var page []Message
+	if forward {
+		page = history[index(cursor+1):]
+		if more = len(page) > limit; more {
+			page = page[:limit]
+		}
+	} else {
+		page = history
+		if cursor != 0 {
+			page = history[:index(cursor)]
+		}
+		if more = len(page) > limit; more {
+			page = page[len(page)-limit:]
+		}
+	}
+	return page, more, nil
+}
+
+// SaveMessages stores text messages only, like the SQLite store
+func (s *memoryStore) SaveMessages(ctx context.Context, batch []*pendingMessage) ([]*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range batch {
+		if len(p.out.AttachmentIDs) > 0 || p.gif != nil {
+			return nil, errNeedsPostgres
+		}
+		if s.room(p.out.RoomID) == nil || s.user(p.out.SenderID) == nil {
+			return nil, errNotFound
+		}
+	}
+	saved := make([]*Message, len(batch))
+	for i, p := range batch {
+		s.nextMsg++
+		msg := Message{
+			ID: s.nextMsg, RoomID: p.out.RoomID, SenderID: p.out.SenderID, Sender: p.out.Sender,
+			Avatar: avatarInitial(p.out.Sender), Kind: "text", Text: p.content, HTML: p.contentHTML,
+			Timestamp: time.Now().UTC(), ReplyTo: p.replyTo,
+		}
+		s.messages[msg.RoomID] = append(s.messages[msg.RoomID], msg)
+		saved[i] = &msg
+	}
+	return saved, nil
+}
+
+// visible is the room's history as viewerID sees it
+func (s *memoryStore) visible(roomID, viewerID int) []Message {
+	return slices.DeleteFunc(slices.Clone(s.messages[roomID]), func(m Message) bool {
+		return m.shadowbanned && m.SenderID != viewerID
+	})
+}
+
+// ListRooms leaves out notification levels and mention counts, like the SQLite store
+func (s *memoryStore) ListRooms(ctx context.Context, userID int, username string, opts roomListOptions) ([]Room, time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	syncedAt := time.Now()
+	rooms := []Room{}
+	for _, stored := range s.rooms {
+		m := s.member(stored.ID, userID)
+		if m == nil || (opts.RoomID != 0 && stored.ID != opts.RoomID) {
+			continue
+		}
+		room := *stored
+		room.Members = len(s.members[room.ID])
+		history := s.visible(room.ID, userID)
+
+		var content sql.NullString
+		var at sql.NullTime
+		var senderID sql.NullInt64
+		if len(history) > 0 {
+			last := history[len(history)-1]
+			content = sql.NullString{String: last.Text, Valid: true}
+			if last.Deleted {
+				content.String = DeletedMessagePlaceholder
+			}
+			at = sql.NullTime{Time: last.Timestamp, Valid: true}
+			senderID = sql.NullInt64{Int64: int64(last.SenderID), Valid: true}
+		}
+		if since := opts.updatedSince(); since != nil &&
+			!(at.Valid && at.Time.After(*since)) && !m.joinedAt.After(*since) && !m.lastReadAt.After(*since) {
+			continue
+		}
+		room.setLastMessage(content, at, senderID)
+
+		room.Unread = 0
+		for _, msg := range history {
+			if msg.ID > m.lastReadID && msg.SenderID != userID && !msg.Deleted && !msg.shadowbanned {
+				room.Unread++
+			}
+		}
+		room.Avatar = avatarInitial(room.Name)
+		room.AvatarURL = roomAvatarURL(room.ID, "")
+		rooms = append(rooms, room)
+	}
+
+	slices.SortStableFunc(rooms, func(a, b Room) int {
+		return cmp.Or(b.LastMessageAt.Compare(*a.LastMessageAt), cmp.Compare(b.ID, a.ID))
+	})
+	rooms = rooms[min(opts.Offset, len(rooms)):]
+	if opts.Limit > 0 {
+		rooms = rooms[:min(opts.Limit, 100, len(rooms))]
+	}
+	return rooms, syncedAt, nil
+}
+
+func (s *memoryStore) MarkRoomRead(ctx context.Context, roomID, userID int) (int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.member(roomID, userID)
+	history := s.messages[roomID]
+	if m == nil || len(history) == 0 || m.lastReadID >= history[len(history)-1].ID {
+		return 0, false, nil
+	}
+	m.lastReadID = history[len(history)-1].ID
+	m.lastReadAt = time.Now().UTC()
+	return m.lastReadID, true, nil
+}
+
+func (s *memoryStore) MessageReads(ctx context.Context, roomID, msgID, viewerID int) ([]MessageRead, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	history := s.visible(roomID, viewerID)
+	i := slices.IndexFunc(history, func(m Message) bool { return m.ID == msgID && !m.Deleted })
+	if i < 0 {
+		return nil, errNotFound
+	}
+	senderID := history[i].SenderID
+
+	reads := []MessageRead{}
+	for _, m := range s.members[roomID] {
+		if m.lastReadID >= msgID && m.userID != senderID {
+			reads = append(reads, MessageRead{UserID: m.userID, Username: s.user(m.userID).username, ReadAt: m.lastReadAt})
+		}
+	}
+	slices.SortStableFunc(reads, func(a, b MessageRead) int { return a.ReadAt.Compare(b.ReadAt) })
+	return reads, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	roomManager = NewRoomManager()
+	go roomManager.Run()
+	os.Exit(m.Run())
+}
+
+// newTestRoom creates a user and a room of theirs in s, returning both IDs
+func newTestRoom(t *testing.T, s *memoryStore, username string) (userID, roomID int) {
+	t.Helper()
+	ctx := context.Background()
+	userID, err := s.CreateUser(ctx, username, username+"@example.com", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	room := Room{Name: username + "'s room", CreatedBy: userID}
+	if _, err := s.CreateRoom(ctx, &room, newSystemEvent(EventRoomCreated, userID, 0, "actor", username)); err != nil {
+		t.Fatalf("CreateRoom: %v", err)
+	}
+	return userID, room.ID
+}
+
+// sendTestMessage saves a text message through s as the persister would
+func sendTestMessage(t *testing.T, s *memoryStore, roomID, senderID int, sender, content string) *Message {
+	t.Helper()
+	saved, err := s.SaveMessages(context.Background(), []*pendingMessage{{
+		out:     &OutgoingMessage{RoomID: roomID, SenderID: senderID, Sender: sender, Content: content},
+		content: content,
+	}})
+	if err != nil {
+		t.Fatalf("SaveMessages: %v", err)
+	}
+	return saved[0]
+}
+
+func TestMemoryStoreUsers(t *testing.T) {
+	s := newMemoryStore()
+	ctx := context.Background()
+
+	id, err := s.CreateUser(ctx, "alice", "alice@example.com", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if _, err := s.CreateUser(ctx, "Alice", "other@example.com", "hash"); err != errUsernameTaken {
+		t.Errorf("CreateUser with a taken username in another case = %v, want errUsernameTaken", err)
+	}
+	if _, err := s.CreateUser(ctx, "bob", "alice@example.com", "hash"); err != errEmailTaken {
+		t.Errorf("CreateUser with a taken email = %v, want errEmailTaken", err)
+	}
+
+	creds, err := s.UserCredentials(ctx, "alice")
+	if err != nil || creds.ID != id || creds.PasswordHash != "hash" || !creds.Active {
+		t.Errorf("UserCredentials = %+v, %v", creds, err)
+	}
+	if _, err := s.UserCredentials(ctx, "nobody"); err != errNotFound {
+		t.Errorf("UserCredentials for an unknown user = %v, want errNotFound", err)
+	}
+}
+
+func TestMemoryStoreRooms(t *testing.T) {
+	s := newMemoryStore()
+	ctx := context.Background()
+	alice, roomID := newTestRoom(t, s, "alice")
+	bob, _ := s.CreateUser(ctx, "bob", "bob@example.com", "hash")
+
+	if role, _ := s.MemberRole(ctx, roomID, alice); role != RoleAdmin {
+		t.Errorf("creator's role = %q, want %q", role, RoleAdmin)
+	}
+	if member, _ := s.IsRoomMember(ctx, roomID, bob); member {
+		t.Error("IsRoomMember reports a user who never joined")
+	}
+	if role, _ := s.MemberRole(ctx, roomID, bob); role != "" {
+		t.Errorf("non-member's role = %q, want none", role)
+	}
+
+	s.members[roomID] = append(s.members[roomID], &memoryMember{userID: bob, role: RoleModerator, joinedAt: time.Now()})
+	members, err := s.RoomMembers(ctx, roomID)
+	if err != nil || len(members) != 2 {
+		t.Fatalf("RoomMembers = %v, %v", members, err)
+	}
+	if members[0].ID != alice || members[1].ID != bob {
+		t.Errorf("RoomMembers order = %d, %d; want admin %d first", members[0].ID, members[1].ID, alice)
+	}
+
+	// The room starts with the system message announcing it
+	messages, more, err := s.MessagePage(ctx, roomID, alice, 0, false, 10)
+	if err != nil || more || len(messages) != 1 || messages[0].Kind != "system" {
+		t.Fatalf("MessagePage after CreateRoom = %v, %v, %v", messages, more, err)
+	}
+}
+
+func TestMemoryStoreMessagePages(t *testing.T) {
+	s := newMemoryStore()
+	ctx := context.Background()
+	alice, roomID := newTestRoom(t, s, "alice")
+	var ids []int
+	for _, text := range []string{"one", "two", "three", "four"} {
+		ids = append(ids, sendTestMessage(t, s, roomID, alice, "alice", text).ID)
+	}
+
+	latest, more, _ := s.MessagePage(ctx, roomID, alice, 0, false, 2)
+	if !more || len(latest) != 2 || latest[0].ID != ids[2] || latest[1].ID != ids[3] {
+		t.Errorf("latest page = %v, more %v; want messages %v oldest first", latest, more, ids[2:])
+	}
+	older, more, _ := s.MessagePage(ctx, roomID, alice, ids[2], false, 10)
+	if more || len(older) != 3 || older[2].ID != ids[1] {
+		t.Errorf("page before %d = %v, more %v", ids[2], older, more)
+	}
+	newer, more, _ := s.MessagePage(ctx, roomID, alice, ids[1], true, 10)
+	if more || len(newer) != 2 || newer[0].ID != ids[2] {
+		t.Errorf("page after %d = %v, more %v", ids[1], newer, more)
+	}
+
+	if _, err := s.SaveMessages(ctx, []*pendingMessage{{out: &OutgoingMessage{RoomID: roomID, SenderID: alice, AttachmentIDs: []int{1}}}}); err != errNeedsPostgres {
+		t.Errorf("SaveMessages with attachments = %v, want errNeedsPostgres", err)
+	}
+}
+
+func TestMemoryStoreReadTracking(t *testing.T) {
+	s := newMemoryStore()
+	ctx := context.Background()
+	alice, roomID := newTestRoom(t, s, "alice")
+	bob, _ := s.CreateUser(ctx, "bob", "bob@example.com", "hash")
+	s.members[roomID] = append(s.members[roomID], &memoryMember{userID: bob, role: RoleMember, joinedAt: time.Now()})
+
+	sendTestMessage(t, s, roomID, alice, "alice", "hello")
+	last := sendTestMessage(t, s, roomID, alice, "alice", "anyone there?")
+
+	rooms, _, err := s.ListRooms(ctx, bob, "bob", roomListOptions{})
+	if err != nil || len(rooms) != 1 {
+		t.Fatalf("ListRooms = %v, %v", rooms, err)
+	}
+	// The system message counts too; it isn't bob's
+	if rooms[0].Unread != 3 || rooms[0].LastMessage != "anyone there?" || rooms[0].LastSenderID != alice {
+		t.Errorf("bob's room = unread %d, last %q by %d", rooms[0].Unread, rooms[0].LastMessage, rooms[0].LastSenderID)
+	}
+
+	if reads, _ := s.MessageReads(ctx, roomID, last.ID, bob); len(reads) != 0 {
+		t.Errorf("MessageReads before anyone read = %v", reads)
+	}
+	lastReadID, advanced, err := s.MarkRoomRead(ctx, roomID, bob)
+	if err != nil || !advanced || lastReadID != last.ID {
+		t.Fatalf("MarkRoomRead = %d, %v, %v; want %d", lastReadID, advanced, err, last.ID)
+	}
+	if _, advanced, _ := s.MarkRoomRead(ctx, roomID, bob); advanced {
+		t.Error("MarkRoomRead advanced with nothing new to read")
+	}
+
+	rooms, _, _ = s.ListRooms(ctx, bob, "bob", roomListOptions{})
+	if rooms[0].Unread != 0 {
+		t.Errorf("unread after MarkRoomRead = %d", rooms[0].Unread)
+	}
+	reads, err := s.MessageReads(ctx, roomID, last.ID, alice)
+	if err != nil || len(reads) != 1 || reads[0].UserID != bob {
+		t.Errorf("MessageReads = %v, %v; want bob", reads, err)
+	}
+	if _, err := s.MessageReads(ctx, roomID, last.ID+100, alice); err != errNotFound {
+		t.Errorf("MessageReads of an unknown message = %v, want errNotFound", err)
+	}
+
+	// Only rooms with something new since are listed
+	since := time.Now().Add(time.Hour)
+	if rooms, _, _ := s.ListRooms(ctx, bob, "bob", roomListOptions{UpdatedSince: &since}); len(rooms) != 0 {
+		t.Errorf("ListRooms updated since the future = %v", rooms)
+	}
+}
+
+func TestHubBroadcast(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const roomID = 9001
+	alice := roomManager.WatchRoom(ctx, roomID, 2, "alice")
+	bob := roomManager.WatchRoom(ctx, roomID, 3, "bob")
+	other := roomManager.WatchRoom(ctx, roomID+1, 4, "carol")
+
+	for i := range 3 {
+		roomManager.BroadcastToRoom(roomID, &WSMessage{Type: "roomMessage", RoomID: roomID, Message: &Message{ID: i + 1, RoomID: roomID, Text: "hi"}})
+	}
+
+	for name, events := range map[string]<-chan *WSMessage{"alice": alice, "bob": bob} {
+		var lastSeq int64
+		for i := range 3 {
+			select {
+			case msg := <-events:
+				if msg.Message == nil || msg.Message.ID != i+1 {
+					t.Fatalf("%s got %+v, want message %d", name, msg, i+1)
+				}
+				if msg.Seq <= lastSeq {
+					t.Errorf("%s got seq %d after %d", name, msg.Seq, lastSeq)
+				}
+				lastSeq = msg.Seq
+			case <-time.After(time.Second):
+				t.Fatalf("%s got %d of 3 broadcasts", name, i)
+			}
+		}
+	}
+
+	select {
+	case msg := <-other:
+		t.Errorf("watcher of another room got %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
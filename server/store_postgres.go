@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// postgresStore is the Store over the primary database, with history read from replicas
+type postgresStore struct {
+	db   *sql.DB
+	read func() *sql.DB // The primary or a healthy replica
+}
+
+func newPostgresStore(db *sql.DB) *postgresStore {
+	return &postgresStore{db: db, read: readDB}
+}
+
+func (s *postgresStore) CreateUser(ctx context.Context, username, email, passwordHash string) (int, error) {
+	var userID int
+	err := s.db.QueryRowContext(ctx,
+		`INSERT INTO users (username, email, password_hash)
+		SELECT $1, $2, $3 WHERE NOT EXISTS (SELECT 1 FROM users WHERE LOWER(username) = LOWER($1))
+		RETURNING id`,
+		username, email, passwordHash,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, errUsernameTaken
+	}
+
+	// 23505 is the PostgreSQL error code for unique_violation
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		if pqErr.Constraint == "users_email_key" {
+			return 0, errEmailTaken
+		}
+		return 0, errUsernameTaken
+	}
+	return userID, err
+}
+
+func (s *postgresStore) UserCredentials(ctx context.Context, username string) (*UserCredentials, error) {
+	var c UserCredentials
+	err := s.db.QueryRowContext(ctx,
+		"SELECT id, password_hash, is_active FROM users WHERE username = $1",
+		username,
+	).Scan(&c.ID, &c.PasswordHash, &c.Active)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *postgresStore) IsUserActive(ctx context.Context, userID int) (bool, error) {
+	var active bool
+	err := s.db.QueryRowContext(ctx, "SELECT is_active FROM users WHERE id = $1", userID).Scan(&active)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return active, err
+}
+
+func (s *postgresStore) CreateRoom(ctx context.Context, room *Room, event *SystemEvent) (*Message, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO rooms (name, description, created_by, is_private) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		room.Name, room.Description, room.CreatedBy, room.IsPrivate,
+	).Scan(&room.ID, &room.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO room_members (room_id, user_id, role) VALUES ($1, $2, $3)",
+		room.ID, room.CreatedBy, "admin",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg Message
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO messages (room_id, sender_id, kind, content, system_event) VALUES ($1, $2, 'system', $3, $4) RETURNING id, room_id, sender_id, kind, content, created_at",
+		room.ID, 1, event.Render(defaultLocale), encodeSystemEvent(event),
+	).Scan(&msg.ID, &msg.RoomID, &msg.SenderID, &msg.Kind, &msg.Text, &msg.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	msg.Sender = "System"
+	msg.Avatar = "S"
+	msg.SystemEvent = event
+	return &msg, nil
+}
+
+func (s *postgresStore) IsRoomMember(ctx context.Context, roomID, userID int) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM room_members WHERE user_id = $1 AND room_id = $2)", userID, roomID).Scan(&exists)
+	return exists, err
+}
+
+func (s *postgresStore) ListRooms(ctx context.Context, userID int, username string, opts roomListOptions) ([]Room, time.Time, error) {
+	rooms := []Room{}
+	var limit sql.NullInt64 // NULL is LIMIT ALL
+	if opts.Limit > 0 {
+		limit = sql.NullInt64{Int64: int64(min(opts.Limit, 100)), Valid: true}
+	}
+
+	// The time and the list come from one snapshot, on the same connection, so a replica can't
+	// replay more between them. The time is the transaction's start on the database clock; the
+	// client's next updated_since looks back roomSyncWindow from it for what was still being
+	// committed. On a replica it is the last replayed commit instead, since newer primary commits
+	// may not have arrived yet.
+	tx, err := s.read().BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer tx.Rollback()
+	var syncedAt time.Time
+	if err := tx.QueryRowContext(ctx, "SELECT COALESCE(pg_last_xact_replay_timestamp(), CURRENT_TIMESTAMP)").Scan(&syncedAt); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// The latest message is looked up per room through idx_messages_room_id_id, and unread counts
+	// only scan messages after the read pointer, so the cost follows the user's rooms rather than
+	// the size of the messages table
+	rows, err := tx.QueryContext(ctx, `
+        SELECT
+            r.id, r.name, r.description, r.created_by, r.created_at, r.is_private, r.is_direct, COALESCE(r.avatar_key, ''), `+roomNotificationColumns+`, r.slow_mode_seconds,
+            r.archived_at, r.inactive_since,
+            (SELECT COUNT(*) FROM room_members WHERE room_id = r.id) AS members_count,
+            lm.content,
+            lm.created_at,
+			lm.sender_id,
+            -- Calculate unread count: messages not sent by user after the member's read pointer,
+            -- limited by the member's notification level
+            (
+                SELECT COUNT(*)
+                FROM messages m
+                WHERE m.room_id = r.id
+                    AND m.sender_id != $1  -- Exclude own messages
+                    AND m.deleted_at IS NULL
+                    AND NOT m.shadowbanned
+                    AND rm.notify_level != 'none' AND NOT `+roomMutedSQL+`
+                    AND (rm.notify_level != 'mentions' OR m.content ~* $3)
+                    AND m.id > rm.last_read_message_id
+            ) AS unread_count,
+            -- Unread messages that mention the user, for a badge distinct from unread_count
+            (
+                SELECT COUNT(*)
+                FROM messages m
+                WHERE m.room_id = r.id
+                    AND m.sender_id != $1
+                    AND m.deleted_at IS NULL
+                    AND NOT m.shadowbanned
+                    AND rm.notify_level != 'none' AND NOT `+roomMutedSQL+`
+                    AND m.content ~* $3
+                    AND m.id > rm.last_read_message_id
+            ) AS unread_mentions
+        FROM rooms r
+        JOIN room_members rm ON rm.room_id = r.id
+        LEFT JOIN LATERAL (
+            -- The single latest message (lm = Latest Message)
+			SELECT id,
+				CASE WHEN deleted_at IS NULL THEN content ELSE $2 END AS content,
+				created_at, sender_id
+            FROM messages
+            WHERE room_id = r.id AND (NOT shadowbanned OR sender_id = $1)
+            ORDER BY id DESC
+            LIMIT 1
+        ) lm ON TRUE
+        WHERE rm.user_id = $1
+            AND ($4::timestamptz IS NULL OR rm.joined_at > $4 OR rm.last_read_at > $4 OR EXISTS (
+                SELECT 1 FROM messages m
+                WHERE m.room_id = r.id AND GREATEST(m.created_at, m.edited_at, m.deleted_at) > $4
+            ))
+            AND ($7 = 0 OR r.id = $7)
+        ORDER BY lm.created_at DESC NULLS LAST, r.id DESC -- Order by latest activity
+        LIMIT $5 OFFSET $6
+    `, userID, DeletedMessagePlaceholder, mentionPattern(username), opts.updatedSince(), limit, opts.Offset, opts.RoomID)
+
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var room Room
+		var membersCount int
+		var unreadCount int
+
+		var lastMessage sql.NullString
+		var lastMessageTime sql.NullTime
+		var lastSenderID sql.NullInt64
+		var avatarKey string
+		var inactiveSince sql.NullTime
+
+		if err := rows.Scan(
+			&room.ID, &room.Name, &room.Description, &room.CreatedBy, &room.CreatedAt, &room.IsPrivate, &room.IsDirect, &avatarKey, &room.NotifyLevel, &room.MutedUntil, &room.SlowModeSeconds,
+			&room.ArchivedAt, &inactiveSince,
+			&membersCount,
+			&lastMessage,
+			&lastMessageTime,
+			&lastSenderID,
+			&unreadCount,
+			&room.UnreadMentions,
+		); err != nil {
+			slog.ErrorContext(ctx, "Error scanning room", "error", err)
+			continue
+		}
+
+		room.Members = membersCount
+		room.Unread = unreadCount
+		room.CleanupAt = roomCleanup.cleanupAt(inactiveSince)
+
+		room.setLastMessage(lastMessage, lastMessageTime, lastSenderID)
+		room.Avatar = avatarInitial(room.Name)
+		room.AvatarURL = roomAvatarURL(room.ID, avatarKey)
+
+		rooms = append(rooms, room)
+	}
+	return rooms, syncedAt, rows.Err()
+}
+
+func (s *postgresStore) MemberRole(ctx context.Context, roomID, userID int) (string, error) {
+	var role string
+	err := s.db.QueryRowContext(ctx, "SELECT role FROM room_members WHERE room_id = $1 AND user_id = $2", roomID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+func (s *postgresStore) MuteStatus(ctx context.Context, roomID, userID int) (bool, *time.Time, error) {
+	var muted bool
+	var until sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+		SELECT muted_at IS NOT NULL AND (muted_until IS NULL OR muted_until > NOW()), muted_until
+		FROM room_members WHERE room_id = $1 AND user_id = $2
+	`, roomID, userID).Scan(&muted, &until)
+	if err == sql.ErrNoRows || (err == nil && !muted) {
+		return false, nil, nil
+	} else if err != nil {
+		return false, nil, err
+	}
+	if until.Valid {
+		return true, &until.Time, nil
+	}
+	return true, nil, nil
+}
+
+func (s *postgresStore) RoomMembers(ctx context.Context, roomID int) ([]RoomMember, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT u.id, u.username, u.email, rm.role, rm.joined_at,
+			rm.muted_at IS NOT NULL AND (rm.muted_until IS NULL OR rm.muted_until > NOW()), rm.muted_until,
+			u.status, u.status_emoji, u.status_text
+		FROM room_members rm
+		JOIN users u ON rm.user_id = u.id
+		WHERE rm.room_id = $1
+		ORDER BY
+			CASE rm.role
+				WHEN 'admin' THEN 1
+				WHEN 'moderator' THEN 2
+				ELSE 3
+			END,
+			rm.joined_at ASC
+	`, roomID)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []RoomMember
+	for rows.Next() {
+		var m RoomMember
+		var mutedUntil sql.NullTime
+		if err := rows.Scan(&m.ID, &m.Username, &m.Email, &m.Role, &m.JoinedAt, &m.Muted, &mutedUntil,
+			&m.Status.State, &m.Status.Emoji, &m.Status.Text); err != nil {
+			slog.ErrorContext(ctx, "Error scanning member", "error", err)
+			continue
+		}
+		m.Avatar = avatarInitial(m.Username)
+		m.Online = roomManager.IsOnline(m.ID)
+		if m.Muted && mutedUntil.Valid {
+			m.MutedUntil = &mutedUntil.Time
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *postgresStore) MessagePage(ctx context.Context, roomID, viewerID, cursor int, forward bool, limit int) (messages []Message, more bool, err error) {
+	var rows *sql.Rows
+	if forward {
+		rows, err = s.read().QueryContext(ctx, messageSelect+`
+         WHERE m.room_id = $1 AND m.id > $2 AND (NOT m.shadowbanned OR m.sender_id = $4)
+         ORDER BY m.id ASC
+         LIMIT $3`, roomID, cursor, limit+1, viewerID)
+	} else {
+		rows, err = s.read().QueryContext(ctx, messageSelect+`
+         WHERE m.room_id = $1 AND ($2 = 0 OR m.id < $2) AND (NOT m.shadowbanned OR m.sender_id = $4)
+         ORDER BY m.id DESC
+         LIMIT $3`, roomID, cursor, limit+1, viewerID)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	messages = scanMessages(rows)
+	if more = len(messages) > limit; more {
+		messages = messages[:limit]
+	}
+	if !forward {
+		slices.Reverse(messages)
+	}
+	return messages, more, nil
+}
+
+func (s *postgresStore) MarkRoomRead(ctx context.Context, roomID, userID int) (int, bool, error) {
+	// Only ever moves the pointer forward; no row means there was nothing new to read
+	var lastReadID int
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE room_members rm
+		SET last_read_message_id = latest.id, last_read_at = CURRENT_TIMESTAMP
+		FROM (SELECT COALESCE(MAX(id), 0) AS id FROM messages WHERE room_id = $2) latest
+		WHERE rm.room_id = $2 AND rm.user_id = $1 AND rm.last_read_message_id < latest.id
+		RETURNING rm.last_read_message_id
+	`, userID, roomID).Scan(&lastReadID)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return lastReadID, true, nil
+}
+
+func (s *postgresStore) MessageReads(ctx context.Context, roomID, msgID, viewerID int) ([]MessageRead, error) {
+	// Deleted messages, and shadowbanned ones the viewer can't see, have no receipts to show
+	var senderID int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT sender_id FROM messages
+		WHERE id = $1 AND room_id = $2 AND deleted_at IS NULL AND (NOT shadowbanned OR sender_id = $3)
+	`, msgID, roomID, viewerID).Scan(&senderID)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	// A member has read the message once their read pointer reaches it; read_at is when the
+	// pointer last moved, so it is the time they caught up at least this far
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT u.id, u.username, rm.last_read_at
+		FROM room_members rm
+		JOIN users u ON rm.user_id = u.id
+		WHERE rm.room_id = $1 AND rm.last_read_message_id >= $2 AND rm.user_id != $3
+		ORDER BY rm.last_read_at ASC
+	`, roomID, msgID, senderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reads := []MessageRead{}
+	for rows.Next() {
+		var mr MessageRead
+		if err := rows.Scan(&mr.UserID, &mr.Username, &mr.ReadAt); err != nil {
+			slog.ErrorContext(ctx, "Error scanning message read", "error", err)
+			continue
+		}
+		reads = append(reads, mr)
+	}
+	return reads, rows.Err()
+}
+
+func (s *postgresStore) SaveMessages(ctx context.Context, batch []*pendingMessage) ([]*Message, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	saved := make([]*Message, len(batch))
+	for i, msg := range batch {
+		if saved[i], err = insertUserMessage(ctx, tx, msg); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+// insertUserMessage writes a prepared message and links any uploaded attachments to it
+func insertUserMessage(ctx context.Context, tx *sql.Tx, p *pendingMessage) (*Message, error) {
+	out := p.out
+	kind := "text"
+	if p.gif != nil {
+		kind = "gif"
+	}
+	var savedMsg Message
+	err := tx.QueryRowContext(ctx,
+		`INSERT INTO messages (room_id, sender_id, content, content_html, flagged_at, reply_to_id, kind, shadowbanned)
+		VALUES ($1, $2, $3, NULLIF($4, ''), CASE WHEN $5 THEN CURRENT_TIMESTAMP END, NULLIF($6, 0), $7,
+			(SELECT is_shadowbanned FROM users WHERE id = $2))
+		RETURNING id, room_id, sender_id, kind, content, COALESCE(content_html, ''), created_at, shadowbanned`,
+		out.RoomID, out.SenderID, p.content, p.contentHTML, p.flagged, out.ReplyToID, kind,
+	).Scan(&savedMsg.ID, &savedMsg.RoomID, &savedMsg.SenderID, &savedMsg.Kind, &savedMsg.Text, &savedMsg.HTML, &savedMsg.Timestamp, &savedMsg.shadowbanned)
+	if err != nil {
+		return nil, err
+	}
+	if out.IdempotencyKey != "" {
+		if err := claimIdempotencyKey(ctx, tx, out.SenderID, IdempotencyMessage, out.IdempotencyKey, savedMsg.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(out.AttachmentIDs) > 0 {
+		savedMsg.Attachments, err = linkAttachments(ctx, tx, savedMsg.ID, out.SenderID, out.AttachmentIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.gif != nil {
+		if err := insertMessageGIF(ctx, tx, savedMsg.ID, p.gif); err != nil {
+			return nil, err
+		}
+		savedMsg.GIF = p.gif
+	}
+
+	savedMsg.Sender = out.Sender
+	savedMsg.Avatar = avatarInitial(out.Sender)
+	savedMsg.ReplyTo = p.replyTo
+	savedMsg.Read = false
+	return &savedMsg, nil
+}
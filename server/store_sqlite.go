@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteSchema holds the tables behind the Store. Features that still query db directly have no
+// tables here and need Postgres.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username TEXT UNIQUE NOT NULL,
+    email TEXT UNIQUE NOT NULL,
+    password_hash TEXT NOT NULL,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    status TEXT NOT NULL DEFAULT 'available', -- 'available', 'busy', 'away'
+    status_emoji TEXT NOT NULL DEFAULT '',
+    status_text TEXT NOT NULL DEFAULT '',
+    is_shadowbanned BOOLEAN NOT NULL DEFAULT FALSE,
+    last_seen_at DATETIME, -- When the user's last connection closed
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS rooms (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    is_private BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS room_members (
+    room_id INTEGER NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL DEFAULT 'member', -- 'admin', 'moderator', 'member'
+    joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    muted_at DATETIME,
+    muted_until DATETIME,
+    last_read_message_id INTEGER NOT NULL DEFAULT 0, -- The member has read everything up to here
+    last_read_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (room_id, user_id)
+);
+CREATE TABLE IF NOT EXISTS messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    room_id INTEGER NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+    sender_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL DEFAULT 'text',
+    content TEXT NOT NULL,
+    content_html TEXT,
+    reply_to_id INTEGER REFERENCES messages(id) ON DELETE SET NULL,
+    shadowbanned BOOLEAN NOT NULL DEFAULT FALSE,
+    flagged_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    deleted_at DATETIME,
+    edited_at DATETIME,
+    system_event TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_messages_room_id ON messages(room_id, id);
+-- Read by the rate limits, and the permission and word list checks messages are sent through
+CREATE TABLE IF NOT EXISTS server_settings (
+    key TEXT PRIMARY KEY, -- e.g. 'rate_limits'
+    value TEXT NOT NULL,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS room_role_permissions (
+    room_id INTEGER NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+    role TEXT NOT NULL,
+    permission TEXT NOT NULL,
+    allowed BOOLEAN NOT NULL,
+    PRIMARY KEY (room_id, role, permission)
+);
+CREATE TABLE IF NOT EXISTS moderation_words (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    room_id INTEGER REFERENCES rooms(id) ON DELETE CASCADE, -- NULL for the global list
+    word TEXT NOT NULL,
+    action TEXT NOT NULL DEFAULT 'mask' -- 'reject', 'mask', 'flag'
+);
+
+INSERT OR IGNORE INTO users (id, username, email, password_hash) VALUES (1, 'System', 'system@chathub.io', 'SYSTEM_ACCOUNT_HASH');
+`
+
+// sqliteStore is the Store over a local SQLite file (DB_DRIVER=sqlite, SQLITE_PATH), so the
+// server runs without a database server during development
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	conn, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(sqliteSchema); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	slog.Info("✅ SQLite database opened", "path", path)
+	return &sqliteStore{db: conn}, nil
+}
+
+func (s *sqliteStore) CreateUser(ctx context.Context, username, email, passwordHash string) (int, error) {
+	var userID int
+	err := s.db.QueryRowContext(ctx,
+		`INSERT INTO users (username, email, password_hash)
+		SELECT ?1, ?2, ?3 WHERE NOT EXISTS (SELECT 1 FROM users WHERE username = ?1 COLLATE NOCASE)
+		RETURNING id`,
+		username, email, passwordHash,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, errUsernameTaken
+	}
+
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+		if strings.Contains(sqliteErr.Error(), "users.email") {
+			return 0, errEmailTaken
+		}
+		return 0, errUsernameTaken
+	}
+	return userID, err
+}
+
+func (s *sqliteStore) UserCredentials(ctx context.Context, username string) (*UserCredentials, error) {
+	var c UserCredentials
+	err := s.db.QueryRowContext(ctx,
+		"SELECT id, password_hash, is_active FROM users WHERE username = ?",
+		username,
+	).Scan(&c.ID, &c.PasswordHash, &c.Active)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *sqliteStore) IsUserActive(ctx context.Context, userID int) (bool, error) {
+	var active bool
+	err := s.db.QueryRowContext(ctx, "SELECT is_active FROM users WHERE id = ?", userID).Scan(&active)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return active, err
+}
+
+func (s *sqliteStore) CreateRoom(ctx context.Context, room *Room, event *SystemEvent) (*Message, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO rooms (name, description, created_by, is_private) VALUES (?, ?, ?, ?) RETURNING id, created_at",
+		room.Name, room.Description, room.CreatedBy, room.IsPrivate,
+	).Scan(&room.ID, &room.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO room_members (room_id, user_id, role) VALUES (?, ?, ?)",
+		room.ID, room.CreatedBy, "admin",
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg Message
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO messages (room_id, sender_id, kind, content, system_event) VALUES (?, ?, 'system', ?, ?) RETURNING id, room_id, sender_id, kind, content, created_at",
+		room.ID, 1, event.Render(defaultLocale), encodeSystemEvent(event),
+	).Scan(&msg.ID, &msg.RoomID, &msg.SenderID, &msg.Kind, &msg.Text, &msg.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	msg.Sender = "System"
+	msg.Avatar = "S"
+	msg.SystemEvent = event
+	return &msg, nil
+}
+
+func (s *sqliteStore) IsRoomMember(ctx context.Context, roomID, userID int) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM room_members WHERE user_id = ? AND room_id = ?)", userID, roomID).Scan(&exists)
+	return exists, err
+}
+
+// ListRooms leaves out notification levels, mention counts, uploaded avatars and cleanup, which
+// need Postgres
+func (s *sqliteStore) ListRooms(ctx context.Context, userID int, username string, opts roomListOptions) ([]Room, time.Time, error) {
+	limit := -1 // No limit
+	if opts.Limit > 0 {
+		limit = min(opts.Limit, 100)
+	}
+	var since any
+	if updatedSince := opts.updatedSince(); updatedSince != nil {
+		// DATETIME columns hold UTC text, which compares correctly with a UTC time
+		since = updatedSince.UTC()
+	}
+
+	syncedAt := time.Now()
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT r.id, r.name, r.description, COALESCE(r.created_by, 0), r.created_at, r.is_private,
+			(SELECT COUNT(*) FROM room_members WHERE room_id = r.id),
+			CASE WHEN lm.deleted_at IS NULL THEN lm.content ELSE ?2 END, lm.created_at, lm.sender_id,
+			(
+				SELECT COUNT(*) FROM messages m
+				WHERE m.room_id = r.id AND m.sender_id != ?1 AND m.deleted_at IS NULL AND NOT m.shadowbanned
+					AND m.id > rm.last_read_message_id
+			)
+		FROM rooms r
+		JOIN room_members rm ON rm.room_id = r.id
+		LEFT JOIN messages lm ON lm.id = (
+			SELECT MAX(id) FROM messages WHERE room_id = r.id AND (NOT shadowbanned OR sender_id = ?1)
+		)
+		WHERE rm.user_id = ?1
+			AND (?3 IS NULL OR rm.joined_at > ?3 OR rm.last_read_at > ?3 OR EXISTS (
+				SELECT 1 FROM messages m
+				WHERE m.room_id = r.id
+					AND MAX(m.created_at, COALESCE(m.edited_at, m.created_at), COALESCE(m.deleted_at, m.created_at)) > ?3
+			))
+			AND (?4 = 0 OR r.id = ?4)
+		ORDER BY lm.created_at IS NULL, lm.created_at DESC, r.id DESC
+		LIMIT ?5 OFFSET ?6
+	`, userID, DeletedMessagePlaceholder, since, opts.RoomID, limit, opts.Offset)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer rows.Close()
+
+	rooms := []Room{}
+	for rows.Next() {
+		var room Room
+		var lastMessage sql.NullString
+		var lastMessageTime sql.NullTime
+		var lastSenderID sql.NullInt64
+		if err := rows.Scan(&room.ID, &room.Name, &room.Description, &room.CreatedBy, &room.CreatedAt, &room.IsPrivate,
+			&room.Members, &lastMessage, &lastMessageTime, &lastSenderID, &room.Unread); err != nil {
+			slog.ErrorContext(ctx, "Error scanning room", "error", err)
+			continue
+		}
+		room.setLastMessage(lastMessage, lastMessageTime, lastSenderID)
+		room.Avatar = avatarInitial(room.Name)
+		room.AvatarURL = roomAvatarURL(room.ID, "")
+		rooms = append(rooms, room)
+	}
+	return rooms, syncedAt, rows.Err()
+}
+
+func (s *sqliteStore) MemberRole(ctx context.Context, roomID, userID int) (string, error) {
+	var role string
+	err := s.db.QueryRowContext(ctx, "SELECT role FROM room_members WHERE room_id = ? AND user_id = ?", roomID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+func (s *sqliteStore) MuteStatus(ctx context.Context, roomID, userID int) (bool, *time.Time, error) {
+	var muted bool
+	var until sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+		SELECT muted_at IS NOT NULL AND (muted_until IS NULL OR muted_until > CURRENT_TIMESTAMP), muted_until
+		FROM room_members WHERE room_id = ? AND user_id = ?
+	`, roomID, userID).Scan(&muted, &until)
+	if err == sql.ErrNoRows || (err == nil && !muted) {
+		return false, nil, nil
+	} else if err != nil {
+		return false, nil, err
+	}
+	if until.Valid {
+		return true, &until.Time, nil
+	}
+	return true, nil, nil
+}
+
+func (s *sqliteStore) RoomMembers(ctx context.Context, roomID int) ([]RoomMember, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT u.id, u.username, u.email, rm.role, rm.joined_at,
+			rm.muted_at IS NOT NULL AND (rm.muted_until IS NULL OR rm.muted_until > CURRENT_TIMESTAMP), rm.muted_until,
+			u.status, u.status_emoji, u.status_text
+		FROM room_members rm
+		JOIN users u ON rm.user_id = u.id
+		WHERE rm.room_id = ?
+		ORDER BY
+			CASE rm.role
+				WHEN 'admin' THEN 1
+				WHEN 'moderator' THEN 2
+				ELSE 3
+			END,
+			rm.joined_at ASC
+	`, roomID)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []RoomMember
+	for rows.Next() {
+		var m RoomMember
+		var mutedUntil sql.NullTime
+		if err := rows.Scan(&m.ID, &m.Username, &m.Email, &m.Role, &m.JoinedAt, &m.Muted, &mutedUntil,
+			&m.Status.State, &m.Status.Emoji, &m.Status.Text); err != nil {
+			slog.ErrorContext(ctx, "Error scanning member", "error", err)
+			continue
+		}
+		m.Avatar = avatarInitial(m.Username)
+		m.Online = roomManager.IsOnline(m.ID)
+		if m.Muted && mutedUntil.Valid {
+			m.MutedUntil = &mutedUntil.Time
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// MessagePage returns messages without reactions, attachments, polls or GIFs, which live in
+// tables only Postgres has
+func (s *sqliteStore) MessagePage(ctx context.Context, roomID, viewerID, cursor int, forward bool, limit int) (messages []Message, more bool, err error) {
+	var rows *sql.Rows
+	if forward {
+		rows, err = s.db.QueryContext(ctx, messageSelect+`
+		WHERE m.room_id = ? AND m.id > ? AND (NOT m.shadowbanned OR m.sender_id = ?)
+		ORDER BY m.id ASC
+		LIMIT ?`, roomID, cursor, viewerID, limit+1)
+	} else {
+		rows, err = s.db.QueryContext(ctx, messageSelect+`
+		WHERE m.room_id = ? AND (? = 0 OR m.id < ?) AND (NOT m.shadowbanned OR m.sender_id = ?)
+		ORDER BY m.id DESC
+		LIMIT ?`, roomID, cursor, cursor, viewerID, limit+1)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	messages = scanMessageRows(rows)
+	if more = len(messages) > limit; more {
+		messages = messages[:limit]
+	}
+	if !forward {
+		slices.Reverse(messages)
+	}
+	return messages, more, nil
+}
+
+// SaveMessages stores text messages only: attachments and GIFs live in tables only Postgres has
+func (s *sqliteStore) SaveMessages(ctx context.Context, batch []*pendingMessage) ([]*Message, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	saved := make([]*Message, len(batch))
+	for i, p := range batch {
+		out := p.out
+		if len(out.AttachmentIDs) > 0 || p.gif != nil {
+			return nil, errNeedsPostgres
+		}
+		var msg Message
+		err := tx.QueryRowContext(ctx,
+			`INSERT INTO messages (room_id, sender_id, content, content_html, flagged_at, reply_to_id, shadowbanned)
+			VALUES (?1, ?2, ?3, NULLIF(?4, ''), CASE WHEN ?5 THEN CURRENT_TIMESTAMP END, NULLIF(?6, 0),
+				(SELECT is_shadowbanned FROM users WHERE id = ?2))
+			RETURNING id, room_id, sender_id, kind, content, COALESCE(content_html, ''), created_at, shadowbanned`,
+			out.RoomID, out.SenderID, p.content, p.contentHTML, p.flagged, out.ReplyToID,
+		).Scan(&msg.ID, &msg.RoomID, &msg.SenderID, &msg.Kind, &msg.Text, &msg.HTML, &msg.Timestamp, &msg.shadowbanned)
+		if err != nil {
+			return nil, err
+		}
+		msg.Sender = out.Sender
+		msg.Avatar = avatarInitial(out.Sender)
+		msg.ReplyTo = p.replyTo
+		saved[i] = &msg
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+func (s *sqliteStore) MarkRoomRead(ctx context.Context, roomID, userID int) (int, bool, error) {
+	var lastReadID int
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE room_members
+		SET last_read_message_id = (SELECT COALESCE(MAX(id), 0) FROM messages WHERE room_id = ?2),
+			last_read_at = CURRENT_TIMESTAMP
+		WHERE room_id = ?2 AND user_id = ?1
+			AND last_read_message_id < (SELECT COALESCE(MAX(id), 0) FROM messages WHERE room_id = ?2)
+		RETURNING last_read_message_id
+	`, userID, roomID).Scan(&lastReadID)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return lastReadID, true, nil
+}
+
+func (s *sqliteStore) MessageReads(ctx context.Context, roomID, msgID, viewerID int) ([]MessageRead, error) {
+	var senderID int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT sender_id FROM messages
+		WHERE id = ? AND room_id = ? AND deleted_at IS NULL AND (NOT shadowbanned OR sender_id = ?)
+	`, msgID, roomID, viewerID).Scan(&senderID)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT u.id, u.username, rm.last_read_at
+		FROM room_members rm
+		JOIN users u ON rm.user_id = u.id
+		WHERE rm.room_id = ? AND rm.last_read_message_id >= ? AND rm.user_id != ?
+		ORDER BY rm.last_read_at ASC
+	`, roomID, msgID, senderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reads := []MessageRead{}
+	for rows.Next() {
+		var mr MessageRead
+		if err := rows.Scan(&mr.UserID, &mr.Username, &mr.ReadAt); err != nil {
+			slog.ErrorContext(ctx, "Error scanning message read", "error", err)
+			continue
+		}
+		reads = append(reads, mr)
+	}
+	return reads, rows.Err()
+}
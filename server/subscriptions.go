@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// subscribeAll registers the client with the hub of every room the user is a member of and
+// reports the room IDs in a "roomsSynced" event. It runs on connect and on "syncRooms", so
+// clients get events for inactive rooms without sending a joinRoom per room.
+func (c *Client) subscribeAll() {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT room_id FROM room_members WHERE user_id = $1", c.ID)
+	if err != nil {
+		c.logger().Error("Failed to load rooms for client", "error", err)
+		c.sendError(&WSMessage{}, CodeInternal, "Failed to sync rooms")
+		return
+	}
+
+	roomIDs := []int{}
+	for rows.Next() {
+		var roomID int
+		if err := rows.Scan(&roomID); err != nil {
+			slog.Error("Error scanning room for sync", "error", err)
+			continue
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	rows.Close()
+
+	for _, roomID := range roomIDs {
+		c.Manager.SubscribeToRoom(roomID, c)
+	}
+
+	c.Send <- &WSMessage{Type: "roomsSynced", RoomIDs: roomIDs}
+	c.logger().Debug("Client subscribed to rooms", "count", len(roomIDs))
+}
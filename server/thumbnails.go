@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Images above this many pixels are not decoded for thumbnails, to avoid decompression bombs
+const maxThumbnailSourcePixels = 50_000_000
+
+var errNotThumbnailable = errors.New("image format not supported for thumbnails")
+
+func thumbnailMaxSize() (int, int) {
+	w, err := strconv.Atoi(getEnv("THUMBNAIL_MAX_WIDTH", "320"))
+	if err != nil || w <= 0 {
+		w = 320
+	}
+	h, err := strconv.Atoi(getEnv("THUMBNAIL_MAX_HEIGHT", "320"))
+	if err != nil || h <= 0 {
+		h = 320
+	}
+	return w, h
+}
+
+func isThumbnailable(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// generateThumbnail scales an image down to fit within maxW x maxH, preserving aspect ratio.
+// PNG and GIF sources keep transparency by encoding to PNG; everything else becomes JPEG.
+func generateThumbnail(src io.ReadSeeker, maxW, maxH int) ([]byte, string, error) {
+	cfg, format, err := image.DecodeConfig(src)
+	if err != nil {
+		return nil, "", errNotThumbnailable
+	}
+	if cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		return nil, "", errNotThumbnailable
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return nil, "", err
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > maxW || h > maxH {
+		// Scale by whichever side overflows the most
+		if w*maxH > h*maxW {
+			h = h * maxW / w
+			w = maxW
+		} else {
+			w = w * maxH / h
+			h = maxH
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+
+	var buf bytes.Buffer
+	switch format {
+	case "png", "gif":
+		err = png.Encode(&buf, dst)
+		return buf.Bytes(), "image/png", err
+	default:
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80})
+		return buf.Bytes(), "image/jpeg", err
+	}
+}
+
+// storeThumbnail generates and saves a thumbnail next to the original, returning its key.
+// Failures are logged and reported as an empty key so the upload itself still succeeds.
+func storeThumbnail(ctx context.Context, key string, src io.ReadSeeker) string {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		slog.Error("Failed to rewind upload for thumbnail", "error", err)
+		return ""
+	}
+
+	maxW, maxH := thumbnailMaxSize()
+	data, contentType, err := generateThumbnail(src, maxW, maxH)
+	if err != nil {
+		if !errors.Is(err, errNotThumbnailable) {
+			slog.Error("Failed to generate thumbnail", "key", key, "error", err)
+		}
+		return ""
+	}
+
+	ext := ".jpg"
+	if contentType == "image/png" {
+		ext = ".png"
+	}
+	thumbKey := strings.TrimSuffix(key, path.Ext(key)) + "_thumb" + ext
+
+	if err := fileStorage.Save(ctx, thumbKey, bytes.NewReader(data), int64(len(data)), contentType); err != nil {
+		slog.Error("Failed to store thumbnail", "key", key, "error", err)
+		return ""
+	}
+	return thumbKey
+}
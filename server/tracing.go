@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"log/slog"
+	"net/http"
+
+	"github.com/XSAM/otelsql"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("chatapp")
+
+// tracingEnabled is on when an OTLP endpoint is configured, e.g. a collector or Jaeger's OTLP port
+func tracingEnabled() bool {
+	return getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", getEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")) != ""
+}
+
+// initTracing installs an OTLP/HTTP exporter configured by the standard OTEL_* variables and
+// returns a function that flushes pending spans. Without an endpoint the no-op tracer stays.
+func initTracing() (func(), error) {
+	if !tracingEnabled() {
+		return func() {}, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	slog.Info("✅ Tracing enabled, exporting spans over OTLP")
+	return func() {
+		if err := provider.Shutdown(context.Background()); err != nil {
+			slog.Error("Failed to flush spans", "error", err)
+		}
+	}, nil
+}
+
+// openDB opens Postgres with query spans. Queries only get spans inside a traced operation,
+// so background jobs and not-yet-traced handlers don't each start a trace of their own.
+func openDB(connStr string) (*sql.DB, error) {
+	return otelsql.Open("postgres", connStr,
+		otelsql.WithAttributes(attribute.String("db.system", "postgresql")),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitRows:             true,
+			SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+				return trace.SpanFromContext(ctx).SpanContext().IsValid()
+			},
+		}),
+	)
+}
+
+// tracingHandler starts a span per HTTP request; nameSpanByRoute then renames it after the matched route
+func tracingHandler(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http")
+}
+
+// nameSpanByRoute names request spans like "GET /api/rooms/{id}/messages" instead of the raw path
+func nameSpanByRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				trace.SpanFromContext(r.Context()).SetName(r.Method + " " + tmpl)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startWSSpan traces one incoming WebSocket frame, from the socket read to the broadcast
+func (c *Client) startWSSpan(msg *WSMessage) (context.Context, trace.Span) {
+	return tracer.Start(context.Background(), "ws."+msg.Type,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.Int("chat.user_id", c.ID),
+			attribute.Int("chat.room_id", msg.RoomID),
+		),
+	)
+}
+
+// endSpan records err, if any, and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
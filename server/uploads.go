@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Attachment is an uploaded file, optionally linked to a message
+type Attachment struct {
+	ID          int    `json:"id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+	// Only set for images a thumbnail could be generated for
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+}
+
+var errInvalidAttachments = &ValidationError{Code: CodeInvalidAttachments, Message: "One or more attachments are invalid or already used"}
+
+func maxUploadBytes() int64 {
+	n, err := strconv.ParseInt(getEnv("UPLOAD_MAX_BYTES", ""), 10, 64)
+	if err != nil || n <= 0 {
+		return 10 << 20 // 10 MB
+	}
+	return n
+}
+
+// uploadContentTypes are the file extensions that can be uploaded and the content type each is
+// stored and served with. Only images, audio and video are accepted: HTML, SVG and other types a
+// browser could run script from are not.
+var uploadContentTypes = map[string]string{
+	".jpg": "image/jpeg", ".jpeg": "image/jpeg", ".png": "image/png", ".gif": "image/gif",
+	".webp": "image/webp", ".avif": "image/avif", ".heic": "image/heic",
+	".mp3": "audio/mpeg", ".m4a": "audio/mp4", ".ogg": "audio/ogg", ".oga": "audio/ogg",
+	".opus": "audio/opus", ".wav": "audio/wav", ".flac": "audio/flac",
+	".mp4": "video/mp4", ".m4v": "video/mp4", ".mov": "video/quicktime", ".webm": "video/webm",
+}
+
+// uploadContentType is the content type a file with this name is stored as, or "" if it can't be
+// uploaded
+func uploadContentType(filename string) string {
+	return uploadContentTypes[strings.ToLower(filepath.Ext(filename))]
+}
+
+// newStorageKey returns a random, unguessable object key that keeps the file extension, if it is
+// one uploads allow
+func newStorageKey(filename string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	if uploadContentTypes[ext] == "" {
+		ext = ""
+	}
+	return time.Now().Format("2006/01/") + hex.EncodeToString(buf) + ext, nil
+}
+
+// Upload an image, audio or video file; the returned ID is passed as attachment_ids when sending a message
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	maxBytes := maxUploadBytes()
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+1<<20) // Leave room for multipart overhead
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Missing or invalid file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxBytes {
+		http.Error(w, "File is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	// The content type follows from the extension; what the client claims isn't trusted
+	filename := filepath.Base(header.Filename)
+	contentType := uploadContentType(filename)
+	if contentType == "" {
+		http.Error(w, "Only image, audio and video files can be uploaded", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	key, err := newStorageKey(filename)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to generate storage key", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := fileStorage.Save(r.Context(), key, file, header.Size, contentType); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to store upload", "error", err)
+		http.Error(w, "Failed to store file", http.StatusInternalServerError)
+		return
+	}
+
+	att := Attachment{
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        header.Size,
+		URL:         fileStorage.URL(key),
+	}
+
+	var thumbKey string
+	if isThumbnailable(contentType) {
+		thumbKey = storeThumbnail(r.Context(), key, file)
+		if thumbKey != "" {
+			att.ThumbnailURL = fileStorage.URL(thumbKey)
+		}
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	err = db.QueryRowContext(ctx,
+		"INSERT INTO attachments (uploader_id, storage_key, thumbnail_key, filename, content_type, size_bytes) VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6) RETURNING id",
+		userID, key, thumbKey, filename, contentType, header.Size,
+	).Scan(&att.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save attachment", "error", err)
+		fileStorage.Delete(context.Background(), key)
+		if thumbKey != "" {
+			fileStorage.Delete(context.Background(), thumbKey)
+		}
+		http.Error(w, "Failed to store file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(att)
+}
+
+// linkAttachments claims the uploader's unused attachments for a newly saved message
+func linkAttachments(ctx context.Context, tx *sql.Tx, messageID, uploaderID int, ids []int) ([]Attachment, error) {
+	ids64 := make([]int64, len(ids))
+	for i, id := range ids {
+		ids64[i] = int64(id)
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE attachments SET message_id = $1
+		WHERE id = ANY($2) AND uploader_id = $3 AND message_id IS NULL
+		RETURNING id, storage_key, COALESCE(thumbnail_key, ''), filename, content_type, size_bytes
+	`, messageID, pq.Array(ids64), uploaderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		var a Attachment
+		var key, thumbKey string
+		if err := rows.Scan(&a.ID, &key, &thumbKey, &a.Filename, &a.ContentType, &a.Size); err != nil {
+			return nil, err
+		}
+		a.URL = fileStorage.URL(key)
+		if thumbKey != "" {
+			a.ThumbnailURL = fileStorage.URL(thumbKey)
+		}
+		attachments = append(attachments, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(attachments) != len(ids) {
+		return nil, errInvalidAttachments
+	}
+	return attachments, nil
+}
+
+// attachAttachments loads attachment metadata for a page of messages in one query
+func attachAttachments(messages []Message) {
+	if len(messages) == 0 {
+		return
+	}
+
+	ids := make([]int64, len(messages))
+	index := make(map[int]int, len(messages))
+	for i, m := range messages {
+		ids[i] = int64(m.ID)
+		index[m.ID] = i
+	}
+
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT message_id, id, storage_key, COALESCE(thumbnail_key, ''), filename, content_type, size_bytes
+		FROM attachments
+		WHERE message_id = ANY($1)
+		ORDER BY message_id, id
+	`, pq.Array(ids))
+	if err != nil {
+		slog.Error("Failed to load attachments", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msgID int
+		var a Attachment
+		var key, thumbKey string
+		if err := rows.Scan(&msgID, &a.ID, &key, &thumbKey, &a.Filename, &a.ContentType, &a.Size); err != nil {
+			slog.Error("Error scanning attachment", "error", err)
+			continue
+		}
+		a.URL = fileStorage.URL(key)
+		if thumbKey != "" {
+			a.ThumbnailURL = fileStorage.URL(thumbKey)
+		}
+		if i, ok := index[msgID]; ok && !messages[i].Deleted {
+			messages[i].Attachments = append(messages[i].Attachments, a)
+		}
+	}
+}
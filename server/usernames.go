@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// usernamePolicy is what new usernames must satisfy. Names are compared case-insensitively,
+// both against the reserved list and against existing accounts, since mentions ignore case.
+type usernamePolicy struct {
+	minLength int
+	maxLength int
+	pattern   *regexp.Regexp
+	hint      string          // Explains pattern to whoever fails it
+	reserved  map[string]bool // Lowercased
+}
+
+// defaultReservedUsernames can't be registered by anyone; System is the account of server messages
+var defaultReservedUsernames = []string{
+	"system", "admin", "administrator", "root", "moderator", "mod", "staff", "support",
+	"chathub", "everyone", "here", "channel", "null", "undefined",
+}
+
+var usernames = defaultUsernamePolicy()
+
+func defaultUsernamePolicy() *usernamePolicy {
+	p := &usernamePolicy{
+		minLength: 3,
+		maxLength: 32,
+		pattern:   regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N}_.-]*$`),
+		hint:      "Username may only contain letters, digits, underscores, dots and hyphens, and must start with a letter or digit",
+		reserved:  make(map[string]bool),
+	}
+	for _, name := range defaultReservedUsernames {
+		p.reserved[name] = true
+	}
+	return p
+}
+
+// initUsernamePolicy reads USERNAME_MIN_LENGTH (3) and USERNAME_MAX_LENGTH (32), in characters;
+// USERNAME_PATTERN, a regular expression for the whole name (by default letters and digits,
+// then also "_", "." and "-"); and RESERVED_USERNAMES, a comma-separated list added to the
+// built-in reserved names.
+func initUsernamePolicy() error {
+	p := defaultUsernamePolicy()
+	p.minLength = envInt("USERNAME_MIN_LENGTH", p.minLength)
+	p.maxLength = envInt("USERNAME_MAX_LENGTH", p.maxLength)
+	if p.minLength > p.maxLength {
+		return fmt.Errorf("USERNAME_MIN_LENGTH %d is above USERNAME_MAX_LENGTH %d", p.minLength, p.maxLength)
+	}
+	if pattern := getEnv("USERNAME_PATTERN", ""); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid USERNAME_PATTERN: %w", err)
+		}
+		p.pattern, p.hint = re, "Username contains characters that aren't allowed"
+	}
+	for _, name := range strings.Split(getEnv("RESERVED_USERNAMES", ""), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			p.reserved[strings.ToLower(name)] = true
+		}
+	}
+	usernames = p
+	return nil
+}
+
+// check returns why the username can't be registered, or "" if it can
+func (p *usernamePolicy) check(username string) string {
+	if !utf8.ValidString(username) {
+		return "Username must be valid UTF-8"
+	}
+	if n := utf8.RuneCountInString(username); n < p.minLength || n > p.maxLength {
+		return fmt.Sprintf("Username must be between %d and %d characters", p.minLength, p.maxLength)
+	}
+	if !p.pattern.MatchString(username) {
+		return p.hint
+	}
+	if p.reserved[strings.ToLower(username)] {
+		return "This username is reserved"
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+)
+
+const maxAttachmentsPerMessage = 10
+
+// ValidationError is a client mistake in a message, reported back with a machine-readable code
+type ValidationError struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	Limit      int    `json:"limit,omitempty"`       // The exceeded limit, for *_too_long / too_many_* codes
+	RetryAfter int    `json:"retry_after,omitempty"` // Seconds until the request may be retried, for slow_mode
+}
+
+// Error codes sent in the "error" WSMessage and in validation errors, so clients can react
+// programmatically. Every error also echoes the offending request's client_msg_id.
+const (
+	CodeNotAuthorized      = "not_authorized" // Not a member of the room
+	CodeRoomReadonly       = "room_readonly"  // The member's role can't send messages in the room
+	CodeRoomArchived       = "room_archived"  // The room was archived for inactivity
+	CodeRateLimited        = "rate_limited"   // Too many frames from this connection
+	CodeMessageTooLong     = "message_too_long"
+	CodeTooManyAttachments = "too_many_attachments"
+	CodeEmptyMessage       = "empty_message"
+	CodeInvalidEncoding    = "invalid_encoding"
+	CodeInvalidMessage     = "invalid_message" // Malformed frame, e.g. a missing room_id
+	CodeInvalidReply       = "invalid_reply"
+	CodeInvalidAttachments = "invalid_attachments"
+	CodeInvalidPoll        = "invalid_poll"
+	CodeInvalidGIF         = "invalid_gif"
+	CodeContentRejected    = "content_rejected"
+	CodeMuted              = "muted"
+	CodeSlowMode           = "slow_mode"
+	CodeUnknownType        = "unknown_type"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeInternal           = "internal_error"
+)
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+var errRoomReadonly = &ValidationError{Code: CodeRoomReadonly, Message: "You don't have permission to send messages in this room"}
+
+var errRoomArchived = &ValidationError{Code: CodeRoomArchived, Message: "This room is archived"}
+
+func envInt(key string, def int) int {
+	n, err := strconv.Atoi(getEnv(key, ""))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+// maxMessageLength is the longest message content accepted, in characters
+func maxMessageLength() int {
+	return envInt("MAX_MESSAGE_LENGTH", 4000)
+}
+
+// maxFrameBytes caps a single incoming WebSocket frame; larger frames close the connection
+func maxFrameBytes() int64 {
+	return int64(envInt("WS_MAX_FRAME_BYTES", 64*1024))
+}
+
+// validateMessageContent checks a message before it enters the moderation/persistence pipeline
+func validateMessageContent(content string, attachmentIDs []int, gifID string) error {
+	if content == "" && len(attachmentIDs) == 0 && gifID == "" {
+		return errEmptyMessage
+	}
+	if !utf8.ValidString(content) {
+		return &ValidationError{Code: CodeInvalidEncoding, Message: "Message must be valid UTF-8"}
+	}
+	if limit := maxMessageLength(); utf8.RuneCountInString(content) > limit {
+		return &ValidationError{
+			Code:    CodeMessageTooLong,
+			Message: fmt.Sprintf("Message exceeds the maximum length of %d characters", limit),
+			Limit:   limit,
+		}
+	}
+	if len(attachmentIDs) > maxAttachmentsPerMessage {
+		return &ValidationError{
+			Code:    CodeTooManyAttachments,
+			Message: fmt.Sprintf("A message can have at most %d attachments", maxAttachmentsPerMessage),
+			Limit:   maxAttachmentsPerMessage,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Events a room webhook can subscribe to
+const (
+	WebhookMessageCreated = "message.created"
+	WebhookMessageDeleted = "message.deleted"
+	WebhookMessageEdited  = "message.edited"
+	WebhookMemberJoined   = "member.joined"
+	WebhookMemberLeft     = "member.left" // Left or was removed
+	WebhookRoomUpdated    = "room.updated"
+)
+
+var webhookEvents = []string{WebhookMessageCreated, WebhookMessageDeleted, WebhookMessageEdited, WebhookMemberJoined, WebhookMemberLeft, WebhookRoomUpdated}
+
+// webhookEventForBroadcast maps the room broadcasts that webhooks can receive to their event
+var webhookEventForBroadcast = map[string]string{
+	"roomMessage":    WebhookMessageCreated,
+	"messageDeleted": WebhookMessageDeleted,
+	"messageEdited":  WebhookMessageEdited,
+	"memberJoined":   WebhookMemberJoined,
+	"memberLeft":     WebhookMemberLeft,
+	"memberRemoved":  WebhookMemberLeft,
+	"roomUpdated":    WebhookRoomUpdated,
+}
+
+const (
+	maxWebhooksPerRoom = 10
+	// How many deliveries one poll claims, and how long a claim lasts before another instance may retry it
+	webhookClaimBatch = 20
+	webhookClaimLease = 5 * time.Minute
+)
+
+// webhookMaxAttempts is how many times a delivery is tried before it is marked failed (WEBHOOK_MAX_ATTEMPTS)
+func webhookMaxAttempts() int {
+	return envInt("WEBHOOK_MAX_ATTEMPTS", 6)
+}
+
+// webhookRetryDelay backs off exponentially from 10s, capped at an hour
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := 10 * time.Second << min(attempts-1, 9)
+	return min(delay, time.Hour)
+}
+
+// webhookClient only connects to public addresses, checked on every dial so a name that resolves
+// differently after registration can't reach the internal network, and doesn't follow redirects,
+// which are reported as a failed delivery
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip, err := netip.ParseAddr(host)
+				if err != nil {
+					return err
+				}
+				return checkWebhookAddr(ip)
+			},
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// RoomWebhook is an outbound webhook registered on a room. The secret is only returned when the
+// hook is created.
+type RoomWebhook struct {
+	ID        int       `json:"id"`
+	RoomID    int       `json:"room_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedBy int       `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is an entry of a webhook's delivery log
+type WebhookDelivery struct {
+	ID             int64      `json:"id"`
+	Event          string     `json:"event"`
+	Status         string     `json:"status"` // "pending", "succeeded" or "failed"
+	Attempts       int        `json:"attempts"`
+	ResponseStatus int        `json:"response_status,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// --- Queueing ---
+
+type webhookEvent struct {
+	roomID int
+	event  string
+	data   json.RawMessage
+}
+
+// webhookQueue hands events to the goroutine that records their deliveries, so broadcasting
+// never waits on the database
+var webhookQueue = make(chan webhookEvent, 1024)
+
+// roomsWithWebhooks caches whether a room has any webhooks, so rooms without them (most) cost
+// one lookup per cache period rather than a write per event
+var roomsWithWebhooks = struct {
+	mu      sync.Mutex
+	entries map[int]webhookCacheEntry
+}{entries: make(map[int]webhookCacheEntry)}
+
+type webhookCacheEntry struct {
+	hasHooks bool
+	expires  time.Time
+}
+
+const webhookCacheTTL = 30 * time.Second
+
+func invalidateRoomWebhooks(roomID int) {
+	roomsWithWebhooks.mu.Lock()
+	delete(roomsWithWebhooks.entries, roomID)
+	roomsWithWebhooks.mu.Unlock()
+}
+
+func roomHasWebhooks(ctx context.Context, roomID int) (bool, error) {
+	roomsWithWebhooks.mu.Lock()
+	entry, ok := roomsWithWebhooks.entries[roomID]
+	roomsWithWebhooks.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.hasHooks, nil
+	}
+
+	var hasHooks bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM room_webhooks WHERE room_id = $1)", roomID).Scan(&hasHooks); err != nil {
+		return false, err
+	}
+	roomsWithWebhooks.mu.Lock()
+	roomsWithWebhooks.entries[roomID] = webhookCacheEntry{hasHooks: hasHooks, expires: time.Now().Add(webhookCacheTTL)}
+	roomsWithWebhooks.mu.Unlock()
+	return hasHooks, nil
+}
+
+// notifyWebhooks queues an event for the room's webhooks. Events are dropped, with a warning, if
+// the queue is full.
+func notifyWebhooks(roomID int, event string, data any) {
+	// Only Postgres keeps webhooks
+	if _, ok := store.(*postgresStore); !ok {
+		return
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("Failed to encode webhook event", "room_id", roomID, "event", event, "error", err)
+		return
+	}
+	select {
+	case webhookQueue <- webhookEvent{roomID: roomID, event: event, data: raw}:
+	default:
+		slog.Warn("Webhook queue full, dropping event", "room_id", roomID, "event", event)
+	}
+}
+
+// notifyWebhooksOfBroadcast forwards the room broadcasts webhooks can subscribe to. Called from
+// BroadcastToRoom, on the instance where the event happened, so each event is recorded once.
+func notifyWebhooksOfBroadcast(roomID int, msg *WSMessage) {
+	if event, ok := webhookEventForBroadcast[msg.Type]; ok {
+		notifyWebhooks(roomID, event, msg)
+	}
+}
+
+// recordWebhookEvents turns queued events into a pending delivery per subscribed webhook
+func recordWebhookEvents() {
+	for ev := range webhookQueue {
+		ctx, cancel := dbContext(context.Background())
+		hasHooks, err := roomHasWebhooks(ctx, ev.roomID)
+		if err == nil && hasHooks {
+			_, err = db.ExecContext(ctx, `
+				INSERT INTO webhook_deliveries (webhook_id, event, payload)
+				SELECT id, $2, $3 FROM room_webhooks WHERE room_id = $1 AND $2 = ANY(events)
+			`, ev.roomID, ev.event, []byte(ev.data))
+		}
+		cancel()
+		if err != nil {
+			slog.Error("Failed to record webhook deliveries", "room_id", ev.roomID, "event", ev.event, "error", err)
+		}
+	}
+}
+
+// --- Delivery ---
+
+// runWebhookDeliveries polls for due deliveries every WEBHOOK_POLL_SECONDS. Deliveries are claimed
+// with SKIP LOCKED and a lease, so several instances can share the work and a delivery in flight
+// when an instance dies is retried once the lease runs out.
+func runWebhookDeliveries() {
+	ticker := time.NewTicker(time.Duration(envInt("WEBHOOK_POLL_SECONDS", 2)) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		deliveries, err := claimWebhookDeliveries()
+		if err != nil {
+			slog.Error("Failed to claim webhook deliveries", "error", err)
+			continue
+		}
+		var wg sync.WaitGroup
+		for _, d := range deliveries {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d.deliver()
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+type claimedDelivery struct {
+	id        int64
+	event     string
+	payload   []byte
+	attempts  int
+	createdAt time.Time
+	roomID    int
+	url       string
+	secret    string
+}
+
+func claimWebhookDeliveries() ([]*claimedDelivery, error) {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		UPDATE webhook_deliveries d
+		SET attempts = d.attempts + 1, next_attempt_at = NOW() + $1 * INTERVAL '1 second'
+		FROM room_webhooks h
+		WHERE h.id = d.webhook_id AND d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.event, d.payload, d.attempts, d.created_at, h.room_id, h.url, h.secret
+	`, webhookClaimLease.Seconds(), webhookClaimBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var claimed []*claimedDelivery
+	for rows.Next() {
+		d := &claimedDelivery{}
+		if err := rows.Scan(&d.id, &d.event, &d.payload, &d.attempts, &d.createdAt, &d.roomID, &d.url, &d.secret); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, d)
+	}
+	return claimed, rows.Err()
+}
+
+// signWebhook is the X-ChatHub-Signature of a body: the hex HMAC-SHA256 keyed by the hook's secret
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver POSTs the event and records the outcome. The body is the same on every attempt, so
+// receivers can dedupe on its id.
+func (d *claimedDelivery) deliver() {
+	body, err := json.Marshal(map[string]any{
+		"id":         d.id,
+		"event":      d.event,
+		"room_id":    d.roomID,
+		"created_at": d.createdAt,
+		"data":       json.RawMessage(d.payload),
+	})
+	if err != nil {
+		d.finish(0, err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		d.finish(0, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ChatHub-Webhook")
+	req.Header.Set("X-ChatHub-Event", d.event)
+	req.Header.Set("X-ChatHub-Delivery", strconv.FormatInt(d.id, 10))
+	req.Header.Set("X-ChatHub-Signature", signWebhook(d.secret, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		d.finish(0, err)
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		d.finish(resp.StatusCode, fmt.Errorf("endpoint returned %s", resp.Status))
+		return
+	}
+	d.finish(resp.StatusCode, nil)
+}
+
+func (d *claimedDelivery) finish(statusCode int, deliveryErr error) {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+
+	responseStatus := sql.NullInt64{Int64: int64(statusCode), Valid: statusCode != 0}
+	var err error
+	switch {
+	case deliveryErr == nil:
+		_, err = db.ExecContext(ctx, `
+			UPDATE webhook_deliveries
+			SET status = 'succeeded', response_status = $2, last_error = NULL, delivered_at = NOW()
+			WHERE id = $1
+		`, d.id, responseStatus)
+	case d.attempts >= webhookMaxAttempts():
+		slog.Warn("Webhook delivery failed for good", "room_id", d.roomID, "delivery_id", d.id, "attempts", d.attempts, "error", deliveryErr)
+		_, err = db.ExecContext(ctx, `
+			UPDATE webhook_deliveries SET status = 'failed', response_status = $2, last_error = $3 WHERE id = $1
+		`, d.id, responseStatus, deliveryErr.Error())
+	default:
+		_, err = db.ExecContext(ctx, `
+			UPDATE webhook_deliveries
+			SET response_status = $2, last_error = $3, next_attempt_at = NOW() + $4 * INTERVAL '1 second'
+			WHERE id = $1
+		`, d.id, responseStatus, deliveryErr.Error(), webhookRetryDelay(d.attempts).Seconds())
+	}
+	if err != nil {
+		slog.Error("Failed to record webhook delivery", "delivery_id", d.id, "error", err)
+	}
+}
+
+// --- Handlers ---
+
+func generateWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(buf), nil
+}
+
+// Ranges outside the ones netip classifies that webhooks must not reach either
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"), // Benchmarking
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, which can map to any IPv4 address
+}
+
+// webhookAllowPrivate lets webhooks reach private addresses, for development (WEBHOOK_ALLOW_PRIVATE_NETWORKS)
+func webhookAllowPrivate() bool {
+	return getEnv("WEBHOOK_ALLOW_PRIVATE_NETWORKS", "false") == "true"
+}
+
+// checkWebhookAddr rejects loopback, private, link-local (which includes cloud metadata
+// endpoints), multicast and other non-public addresses
+func checkWebhookAddr(ip netip.Addr) error {
+	if webhookAllowPrivate() {
+		return nil
+	}
+	ip = ip.Unmap()
+	public := ip.IsGlobalUnicast() && !ip.IsPrivate() && !slices.ContainsFunc(nonPublicPrefixes, func(p netip.Prefix) bool {
+		return p.Contains(ip)
+	})
+	if !public {
+		return fmt.Errorf("%s is not a public address", ip)
+	}
+	return nil
+}
+
+// validWebhookURL checks that a webhook URL is absolute http or https and that its host resolves
+// only to public addresses
+func validWebhookURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("url host %s could not be resolved", u.Hostname())
+	}
+	for _, ip := range addrs {
+		if err := checkWebhookAddr(ip); err != nil {
+			return fmt.Errorf("url must point to a public host: %w", err)
+		}
+	}
+	return nil
+}
+
+// List the room's webhooks (members who may manage the room)
+func handleGetRoomWebhooks(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermManageRoom, "You don't have permission to manage webhooks"); !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, room_id, url, events, COALESCE(created_by, 0), created_at
+		FROM room_webhooks WHERE room_id = $1 ORDER BY id
+	`, roomID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get webhooks", "error", err)
+		http.Error(w, "Failed to get webhooks", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	hooks := []RoomWebhook{}
+	for rows.Next() {
+		var hook RoomWebhook
+		if err := rows.Scan(&hook.ID, &hook.RoomID, &hook.URL, pq.Array(&hook.Events), &hook.CreatedBy, &hook.CreatedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning webhook", "error", err)
+			continue
+		}
+		hooks = append(hooks, hook)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+// Register a webhook. With no events given it receives all of them.
+func handleCreateRoomWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := validWebhookURL(r.Context(), req.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Events) == 0 {
+		req.Events = webhookEvents
+	}
+	for _, event := range req.Events {
+		if !slices.Contains(webhookEvents, event) {
+			http.Error(w, "Unknown event "+strconv.Quote(event), http.StatusBadRequest)
+			return
+		}
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermManageRoom, "You don't have permission to manage webhooks"); !ok {
+		return
+	}
+
+	secret, err := generateWebhookSecret()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to generate webhook secret", "error", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM room_webhooks WHERE room_id = $1", roomID).Scan(&count); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to count webhooks", "error", err)
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxWebhooksPerRoom {
+		http.Error(w, fmt.Sprintf("A room can have at most %d webhooks", maxWebhooksPerRoom), http.StatusConflict)
+		return
+	}
+
+	hook := RoomWebhook{RoomID: roomID, URL: req.URL, Events: req.Events, Secret: secret, CreatedBy: userID}
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO room_webhooks (room_id, url, secret, events, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`, roomID, req.URL, secret, pq.Array(req.Events), userID).Scan(&hook.ID, &hook.CreatedAt)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create webhook", "error", err)
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+	invalidateRoomWebhooks(roomID)
+
+	slog.InfoContext(r.Context(), "Webhook created", "webhook_id", hook.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+// Remove a webhook along with its delivery log
+func handleDeleteRoomWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	hookID, err := strconv.Atoi(vars["hookId"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermManageRoom, "You don't have permission to manage webhooks"); !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, "DELETE FROM room_webhooks WHERE id = $1 AND room_id = $2", hookID, roomID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete webhook", "error", err)
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	invalidateRoomWebhooks(roomID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// The webhook's latest deliveries, newest first
+func handleGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	hookID, err := strconv.Atoi(vars["hookId"])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	if _, ok := requireRoomPermission(w, roomID, userID, PermManageRoom, "You don't have permission to manage webhooks"); !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM room_webhooks WHERE id = $1 AND room_id = $2)", hookID, roomID).Scan(&exists); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get webhook deliveries", "error", err)
+		http.Error(w, "Failed to get webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, event, status, attempts, COALESCE(response_status, 0), COALESCE(last_error, ''),
+			created_at, next_attempt_at, delivered_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY id DESC
+		LIMIT 50
+	`, hookID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get webhook deliveries", "error", err)
+		http.Error(w, "Failed to get webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var nextAttempt, deliveredAt sql.NullTime
+		if err := rows.Scan(&d.ID, &d.Event, &d.Status, &d.Attempts, &d.ResponseStatus, &d.LastError,
+			&d.CreatedAt, &nextAttempt, &deliveredAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning webhook delivery", "error", err)
+			continue
+		}
+		if d.Status == "pending" && nextAttempt.Valid {
+			d.NextAttemptAt = &nextAttempt.Time
+		}
+		if deliveredAt.Valid {
+			d.DeliveredAt = &deliveredAt.Time
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
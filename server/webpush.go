@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+	"github.com/gorilla/mux"
+)
+
+// Push services keep undelivered notifications this long, in seconds, before dropping them
+const webPushTTL = 24 * 60 * 60
+
+// maxPushSubscriptionsPerUser bounds the devices a user can register; the oldest are replaced
+const maxPushSubscriptionsPerUser = 20
+
+// PushSubscription is a browser's Web Push subscription, as returned by PushManager.subscribe()
+type PushSubscription struct {
+	ID       int    `json:"id"`
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// webPushPayload is what the service worker receives in its "push" event
+type webPushPayload struct {
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	Reason    string `json:"reason"` // "message", "mention" or "direct"
+	RoomID    int    `json:"room_id"`
+	MessageID int    `json:"message_id"`
+}
+
+// webPushNotifier sends notifications to every browser the user subscribed from
+type webPushNotifier struct {
+	publicKey  string
+	privateKey string
+	subject    string
+	client     *http.Client
+}
+
+// pushNotifier is set when VAPID keys are configured
+var pushNotifier *webPushNotifier
+
+// newWebPushNotifier reads VAPID_PUBLIC_KEY, VAPID_PRIVATE_KEY and VAPID_SUBJECT (a mailto: or
+// https: contact for push services). Web Push is off unless both keys are set.
+func newWebPushNotifier() (*webPushNotifier, error) {
+	publicKey, privateKey := getEnv("VAPID_PUBLIC_KEY", ""), getEnv("VAPID_PRIVATE_KEY", "")
+	if publicKey == "" && privateKey == "" {
+		return nil, nil
+	}
+	if publicKey == "" || privateKey == "" {
+		return nil, errors.New("VAPID_PUBLIC_KEY and VAPID_PRIVATE_KEY must be set together")
+	}
+	pushNotifier = &webPushNotifier{
+		publicKey:  publicKey,
+		privateKey: privateKey,
+		subject:    getEnv("VAPID_SUBJECT", "mailto:admin@chathub.io"),
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+	return pushNotifier, nil
+}
+
+// Notify sends the notification to every browser the user subscribed from
+func (p *webPushNotifier) Notify(ctx context.Context, n *Notification) {
+	if !n.Push || n.Quiet {
+		return
+	}
+	dbCtx, cancel := dbContext(ctx)
+	rows, err := db.QueryContext(dbCtx, "SELECT id, endpoint, p256dh, auth FROM push_subscriptions WHERE user_id = $1", n.UserID)
+	if err != nil {
+		cancel()
+		slog.Error("Failed to load push subscriptions", "user_id", n.UserID, "error", err)
+		return
+	}
+	var subs []PushSubscription
+	for rows.Next() {
+		var sub PushSubscription
+		if err := rows.Scan(&sub.ID, &sub.Endpoint, &sub.Keys.P256dh, &sub.Keys.Auth); err != nil {
+			slog.Error("Error scanning push subscription", "error", err)
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	rows.Close()
+	cancel()
+	if len(subs) == 0 {
+		return
+	}
+
+	payload := webPushPayload{
+		Title:     n.Title(),
+		Body:      n.Body(),
+		Reason:    n.Reason,
+		RoomID:    n.RoomID,
+		MessageID: n.Message.ID,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Failed to encode push notification", "error", err)
+		return
+	}
+
+	for _, sub := range subs {
+		resp, err := webpush.SendNotificationWithContext(ctx, body, &webpush.Subscription{
+			Endpoint: sub.Endpoint,
+			Keys:     webpush.Keys{P256dh: sub.Keys.P256dh, Auth: sub.Keys.Auth},
+		}, &webpush.Options{
+			HTTPClient:      p.client,
+			Subscriber:      p.subject,
+			VAPIDPublicKey:  p.publicKey,
+			VAPIDPrivateKey: p.privateKey,
+			TTL:             webPushTTL,
+			Urgency:         webpush.UrgencyHigh,
+		})
+		if err != nil {
+			slog.Warn("Failed to send push notification", "user_id", n.UserID, "subscription_id", sub.ID, "error", err)
+			continue
+		}
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+			// The browser unsubscribed or the subscription expired
+			dbCtx, cancel := dbContext(ctx)
+			if _, err := db.ExecContext(dbCtx, "DELETE FROM push_subscriptions WHERE id = $1", sub.ID); err != nil {
+				slog.Error("Failed to delete expired push subscription", "subscription_id", sub.ID, "error", err)
+			}
+			cancel()
+		case resp.StatusCode >= 400:
+			slog.Warn("Push service rejected notification", "user_id", n.UserID, "subscription_id", sub.ID, "status", resp.StatusCode)
+		}
+	}
+}
+
+// Get the VAPID public key browsers need to subscribe (the applicationServerKey)
+func handleGetVAPIDKey(w http.ResponseWriter, r *http.Request) {
+	if pushNotifier == nil {
+		http.Error(w, "Web Push is not configured", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"public_key": pushNotifier.publicKey})
+}
+
+// Register this browser's push subscription. Subscribing again with the same endpoint updates it.
+func handleCreatePushSubscription(w http.ResponseWriter, r *http.Request) {
+	if pushNotifier == nil {
+		http.Error(w, "Web Push is not configured", http.StatusNotFound)
+		return
+	}
+
+	var sub PushSubscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(sub.Endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+		http.Error(w, "Endpoint must be an https URL", http.StatusBadRequest)
+		return
+	}
+	if sub.Keys.P256dh == "" || sub.Keys.Auth == "" {
+		http.Error(w, "Subscription keys are required", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO push_subscriptions (user_id, endpoint, p256dh, auth, user_agent)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (endpoint) DO UPDATE
+		SET user_id = EXCLUDED.user_id, p256dh = EXCLUDED.p256dh, auth = EXCLUDED.auth,
+		    user_agent = EXCLUDED.user_agent, created_at = CURRENT_TIMESTAMP
+		RETURNING id, created_at
+	`, userID, sub.Endpoint, sub.Keys.P256dh, sub.Keys.Auth, strings.TrimSpace(r.UserAgent())).Scan(&sub.ID, &sub.CreatedAt)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save push subscription", "error", err)
+		http.Error(w, "Failed to save subscription", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.ExecContext(ctx, `
+		DELETE FROM push_subscriptions WHERE user_id = $1 AND id NOT IN (
+			SELECT id FROM push_subscriptions WHERE user_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2
+		)
+	`, userID, maxPushSubscriptionsPerUser)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to prune push subscriptions", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sub)
+}
+
+// Remove one of the user's push subscriptions, e.g. when notifications are turned off in the browser
+func handleDeletePushSubscription(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	subID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid subscription ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := int(r.Context().Value("user_id").(float64))
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, "DELETE FROM push_subscriptions WHERE id = $1 AND user_id = $2", subID, userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete push subscription", "error", err)
+		http.Error(w, "Failed to delete subscription", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}